@@ -9,6 +9,7 @@ import (
 	"os"
 	"time"
 
+	"crm-communication-api/internal/rbac"
 	"crm-communication-api/models"
 
 	"github.com/google/uuid"
@@ -18,7 +19,7 @@ import (
 	"github.com/markbates/goth/providers/google"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
+	googleoauth "golang.org/x/oauth2/google"
 	"gorm.io/gorm"
 )
 
@@ -64,7 +65,7 @@ func NewGoogleAuthService(db *gorm.DB, logger *logrus.Logger) *GoogleAuthService
 			"https://www.googleapis.com/auth/userinfo.profile",
 			"https://www.googleapis.com/auth/gmail.readonly",
 		},
-		Endpoint: google.Endpoint,
+		Endpoint: googleoauth.Endpoint,
 	}
 
 	// Configure session store
@@ -152,7 +153,7 @@ func (s *GoogleAuthService) HandleGoogleCallback(w http.ResponseWriter, r *http.
 			Email:    gothUser.Email,
 			Name:     gothUser.Name,
 			Avatar:   gothUser.AvatarURL,
-			Role:     "user", // Default role for new users
+			Role:     rbac.DefaultRole,
 			Password: "",     // No password for OAuth users
 		}
 
@@ -197,18 +198,14 @@ func (s *GoogleAuthService) HandleGoogleCallback(w http.ResponseWriter, r *http.
 		}
 	}
 
-	// Generate JWT tokens for our API
-	accessToken, refreshToken, err := GenerateTokens(&user, "google")
+	// Sign the device in and generate JWT tokens for our API
+	tokens, err := StartSession(s.DB, &user, "google", DeviceFromRequest(r))
 	if err != nil {
-		s.Logger.WithError(err).Error("Failed to generate tokens")
+		s.Logger.WithError(err).Error("Failed to start session")
 		http.Error(w, "Failed to generate authentication tokens", http.StatusInternalServerError)
 		return
 	}
-
-	// Store refresh token
-	if err := StoreRefreshToken(s.DB, user.ID.String(), refreshToken); err != nil {
-		s.Logger.WithError(err).Error("Failed to store refresh token")
-	}
+	accessToken, refreshToken := tokens.AccessToken, tokens.RefreshToken
 
 	// In a real application, you would redirect to a frontend with the tokens
 	// Here we're just returning JSON with the tokens
@@ -0,0 +1,286 @@
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// DefaultGoogleJWKSURL is where Google publishes the keys signing its ID tokens
+const DefaultGoogleJWKSURL = "https://www.googleapis.com/oauth2/v3/certs"
+
+// googleIssuers are the issuers of Google ID tokens
+var googleIssuers = []string{"accounts.google.com", "https://accounts.google.com"}
+
+// ErrInvalidIDToken is returned for Google ID tokens that fail verification
+var ErrInvalidIDToken = errors.New("invalid Google ID token")
+
+const (
+	// defaultKeyCacheTime is how long fetched keys are used when the response does not say
+	defaultKeyCacheTime = time.Hour
+
+	// minKeyRefresh is how often a key set is fetched again at most when a token names an
+	// unknown key
+	minKeyRefresh = time.Minute
+)
+
+// KeySet finds the public key a token was signed with by its key ID
+type KeySet interface {
+	PublicKey(ctx context.Context, kid string) (interface{}, error)
+}
+
+// StaticKeySet is a fixed set of public keys by key ID, such as a local key set for tests
+type StaticKeySet map[string]interface{}
+
+// PublicKey implements KeySet
+func (s StaticKeySet) PublicKey(ctx context.Context, kid string) (interface{}, error) {
+	key, ok := s[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
+
+// jwk is a JSON Web Key
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// ParseJWKS reads a JSON Web Key Set. Keys of types other than RSA are skipped.
+func ParseJWKS(data []byte) (StaticKeySet, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid key set: %w", err)
+	}
+
+	keys := make(StaticKeySet, len(set.Keys))
+	for _, key := range set.Keys {
+		if key.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus of key %q: %w", key.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("invalid exponent of key %q", key.Kid)
+		}
+		keys[key.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
+
+// RemoteKeySet fetches a JSON Web Key Set from a URL and caches it as long as the response allows
+type RemoteKeySet struct {
+	url    string
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    StaticKeySet
+	expires time.Time
+	fetched time.Time
+}
+
+// NewRemoteKeySet creates a key set fetched from url. client may be nil to use a client with a
+// 10 second timeout.
+func NewRemoteKeySet(url string, client *http.Client) *RemoteKeySet {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &RemoteKeySet{url: url, client: client}
+}
+
+// PublicKey implements KeySet. The set is fetched again when it expired or, at most once a
+// minute, when it does not have the key, which happens after the keys rotate.
+func (r *RemoteKeySet) PublicKey(ctx context.Context, kid string) (interface{}, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if key, ok := r.keys[kid]; ok && now.Before(r.expires) {
+		return key, nil
+	}
+	if r.keys == nil || now.After(r.expires) || now.Sub(r.fetched) >= minKeyRefresh {
+		if err := r.fetch(ctx, now); err != nil {
+			return nil, err
+		}
+	}
+	return r.keys.PublicKey(ctx, kid)
+}
+
+// fetch downloads the key set
+func (r *RemoteKeySet) fetch(ctx context.Context, now time.Time) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch keys: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch keys: status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("failed to fetch keys: %w", err)
+	}
+	keys, err := ParseJWKS(data)
+	if err != nil {
+		return err
+	}
+
+	r.keys = keys
+	r.fetched = now
+	r.expires = now.Add(cacheTime(resp.Header.Get("Cache-Control")))
+	return nil
+}
+
+// cacheTime reads the max-age of a Cache-Control header
+func cacheTime(header string) time.Duration {
+	for _, directive := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if strings.EqualFold(name, "max-age") {
+			if seconds, err := time.ParseDuration(value + "s"); err == nil && seconds > 0 {
+				return seconds
+			}
+		}
+	}
+	return defaultKeyCacheTime
+}
+
+// googleClaims are the claims of a Google ID token
+type googleClaims struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+	Picture       string `json:"picture"`
+	jwt.RegisteredClaims
+}
+
+// GoogleTokenVerifier verifies the ID tokens Google Sign-In hands to our front ends
+type GoogleTokenVerifier struct {
+	keys      KeySet
+	clientIDs []string
+}
+
+// NewGoogleTokenVerifier creates a verifier accepting tokens signed with keys and issued to one
+// of clientIDs
+func NewGoogleTokenVerifier(keys KeySet, clientIDs ...string) *GoogleTokenVerifier {
+	return &GoogleTokenVerifier{keys: keys, clientIDs: clientIDs}
+}
+
+// Verify checks an ID token's signature, issuer, audience and expiry, and returns the Google
+// account it identifies. Accounts without a verified email are rejected.
+func (v *GoogleTokenVerifier) Verify(ctx context.Context, idToken string) (*GoogleUserInfo, error) {
+	var claims googleClaims
+	token, err := jwt.ParseWithClaims(idToken, &claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, errors.New("unexpected signing method")
+		}
+		kid, _ := token.Header["kid"].(string)
+		return v.keys.PublicKey(ctx, kid)
+	})
+	if err != nil || !token.Valid {
+		return nil, ErrInvalidIDToken
+	}
+
+	issued := false
+	for _, issuer := range googleIssuers {
+		issued = issued || claims.VerifyIssuer(issuer, true)
+	}
+	audience := false
+	for _, clientID := range v.clientIDs {
+		audience = audience || claims.VerifyAudience(clientID, true)
+	}
+	if !issued || !audience || claims.Subject == "" || claims.Email == "" || !claims.EmailVerified {
+		return nil, ErrInvalidIDToken
+	}
+
+	return &GoogleUserInfo{
+		ID:       claims.Subject,
+		Email:    claims.Email,
+		Name:     claims.Name,
+		Picture:  claims.Picture,
+		Verified: claims.EmailVerified,
+	}, nil
+}
+
+var (
+	// The verifier VerifyGoogleIDToken uses; created from the environment on first use unless set
+	// with UseGoogleVerifier
+	googleVerifier   *GoogleTokenVerifier
+	googleVerifierMu sync.Mutex
+)
+
+// UseGoogleVerifier makes VerifyGoogleIDToken use v, for instance one with a local key set in tests
+func UseGoogleVerifier(v *GoogleTokenVerifier) {
+	googleVerifierMu.Lock()
+	defer googleVerifierMu.Unlock()
+	googleVerifier = v
+}
+
+// VerifyGoogleIDToken verifies a Google ID token. Tokens must be issued to GOOGLE_CLIENT_ID, a
+// comma-separated list of OAuth client IDs, and are checked against the key set in the file
+// GOOGLE_JWKS_FILE or at GOOGLE_JWKS_URL, by default the keys Google publishes.
+func VerifyGoogleIDToken(ctx context.Context, idToken string) (*GoogleUserInfo, error) {
+	googleVerifierMu.Lock()
+	if googleVerifier == nil {
+		v, err := googleVerifierFromEnv()
+		if err != nil {
+			googleVerifierMu.Unlock()
+			return nil, err
+		}
+		googleVerifier = v
+	}
+	v := googleVerifier
+	googleVerifierMu.Unlock()
+
+	return v.Verify(ctx, idToken)
+}
+
+// googleVerifierFromEnv creates the verifier configured by the environment
+func googleVerifierFromEnv() (*GoogleTokenVerifier, error) {
+	var clientIDs []string
+	for _, id := range strings.Split(os.Getenv("GOOGLE_CLIENT_ID"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			clientIDs = append(clientIDs, id)
+		}
+	}
+	if len(clientIDs) == 0 {
+		return nil, errors.New("Google sign-in is not configured, set GOOGLE_CLIENT_ID")
+	}
+
+	if path := os.Getenv("GOOGLE_JWKS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read GOOGLE_JWKS_FILE: %w", err)
+		}
+		keys, err := ParseJWKS(data)
+		if err != nil {
+			return nil, err
+		}
+		return NewGoogleTokenVerifier(keys, clientIDs...), nil
+	}
+
+	return NewGoogleTokenVerifier(NewRemoteKeySet(getEnvOrDefault("GOOGLE_JWKS_URL", DefaultGoogleJWKSURL), nil), clientIDs...), nil
+}
@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const testGoogleClientID = "test-client.apps.googleusercontent.com"
+
+// googleTestKey is a key signing test ID tokens, published by a local JWKS endpoint
+type googleTestKey struct {
+	kid     string
+	private *rsa.PrivateKey
+}
+
+func newGoogleTestKey(t *testing.T, kid string) googleTestKey {
+	t.Helper()
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return googleTestKey{kid: kid, private: private}
+}
+
+// jwks serves the keys as Google does
+func jwks(keys ...googleTestKey) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		set := struct {
+			Keys []map[string]string `json:"keys"`
+		}{}
+		for _, key := range keys {
+			set.Keys = append(set.Keys, map[string]string{
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"kid": key.kid,
+				"n":   base64.RawURLEncoding.EncodeToString(key.private.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.private.E)).Bytes()),
+			})
+		}
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		json.NewEncoder(w).Encode(set)
+	})
+}
+
+// googleTestClaims returns the claims of a valid ID token, for tests to change
+func googleTestClaims() googleClaims {
+	now := time.Now()
+	return googleClaims{
+		Email:         "ada@example.com",
+		EmailVerified: true,
+		Name:          "Ada Lovelace",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "https://accounts.google.com",
+			Subject:   "1234567890",
+			Audience:  jwt.ClaimStrings{testGoogleClientID},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+		},
+	}
+}
+
+func (k googleTestKey) sign(t *testing.T, claims googleClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = k.kid
+	signed, err := token.SignedString(k.private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestVerifyGoogleIDToken(t *testing.T) {
+	key := newGoogleTestKey(t, "google-1")
+	other := newGoogleTestKey(t, "other")
+	server := httptest.NewServer(jwks(key))
+	defer server.Close()
+	verifier := NewGoogleTokenVerifier(NewRemoteKeySet(server.URL, server.Client()), testGoogleClientID)
+
+	valid := key.sign(t, googleTestClaims())
+	parts := strings.Split(valid, ".")
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts[1] = base64.RawURLEncoding.EncodeToString([]byte(strings.Replace(string(payload), "ada@example.com", "eve@example.com", 1)))
+	tampered := strings.Join(parts, ".")
+
+	wrongAudience := googleTestClaims()
+	wrongAudience.Audience = jwt.ClaimStrings{"someone-else.apps.googleusercontent.com"}
+	expired := googleTestClaims()
+	expired.IssuedAt = jwt.NewNumericDate(time.Now().Add(-2 * time.Hour))
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+	wrongIssuer := googleTestClaims()
+	wrongIssuer.Issuer = "https://accounts.example.com"
+	unverified := googleTestClaims()
+	unverified.EmailVerified = false
+
+	hmac := jwt.NewWithClaims(jwt.SigningMethodHS256, googleTestClaims())
+	hmac.Header["kid"] = key.kid
+	hmacSigned, err := hmac.SignedString([]byte("a shared secret anyone could use"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"tampered", tampered},
+		{"wrong audience", key.sign(t, wrongAudience)},
+		{"expired", key.sign(t, expired)},
+		{"wrong issuer", key.sign(t, wrongIssuer)},
+		{"unverified email", key.sign(t, unverified)},
+		{"unknown key", other.sign(t, googleTestClaims())},
+		{"HMAC signed", hmacSigned},
+		{"not a token", "not-a-token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := verifier.Verify(context.Background(), tt.token); !errors.Is(err, ErrInvalidIDToken) {
+				t.Errorf("Verify() error = %v, want ErrInvalidIDToken", err)
+			}
+		})
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		info, err := verifier.Verify(context.Background(), valid)
+		if err != nil {
+			t.Fatalf("Verify() error = %v", err)
+		}
+		if info.ID != "1234567890" || info.Email != "ada@example.com" || info.Name != "Ada Lovelace" || !info.Verified {
+			t.Errorf("Verify() = %+v, want the token's account", info)
+		}
+	})
+}
+
+func TestParseJWKS(t *testing.T) {
+	key := newGoogleTestKey(t, "google-1")
+	rec := httptest.NewRecorder()
+	jwks(key).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	keys, err := ParseJWKS(rec.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, ok := keys["google-1"].(*rsa.PublicKey)
+	if !ok || !public.Equal(&key.private.PublicKey) {
+		t.Errorf("ParseJWKS() = %v, want the published key", keys)
+	}
+
+	if _, err := ParseJWKS([]byte(`{"keys": [{"kty": "RSA", "kid": "bad", "n": "AQAB", "e": ""}]}`)); err == nil {
+		t.Error("ParseJWKS() accepted a key without an exponent")
+	}
+}
+
+func TestRemoteKeySetCaches(t *testing.T) {
+	key := newGoogleTestKey(t, "google-1")
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		jwks(key).ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	keys := NewRemoteKeySet(server.URL, server.Client())
+	for i := 0; i < 3; i++ {
+		if _, err := keys.PublicKey(context.Background(), "google-1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// An unknown key right after a fetch is not worth fetching again
+	if _, err := keys.PublicKey(context.Background(), "unknown"); err == nil {
+		t.Error("PublicKey() found an unknown key")
+	}
+	if fetches != 1 {
+		t.Errorf("fetched the key set %d times, want 1", fetches)
+	}
+}
+
+func TestCacheTime(t *testing.T) {
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"public, max-age=19830, must-revalidate, no-transform", 19830 * time.Second},
+		{"MAX-AGE=60", time.Minute},
+		{"no-cache", defaultKeyCacheTime},
+		{"max-age=soon", defaultKeyCacheTime},
+		{"", defaultKeyCacheTime},
+	}
+	for _, tt := range tests {
+		if got := cacheTime(tt.header); got != tt.want {
+			t.Errorf("cacheTime(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
@@ -11,11 +11,26 @@ import (
 	"github.com/google/uuid"
 )
 
-// Secret keys for signing JWT tokens
-var (
-	AccessTokenSecretKey  = getEnvOrDefault("JWT_SECRET_KEY", "default_access_token_secret_key")
-	RefreshTokenSecretKey = getEnvOrDefault("REFRESH_TOKEN_SECRET_KEY", "default_refresh_token_secret_key")
-)
+// refreshTokenSecret is the HMAC key of refresh tokens, set by ConfigureKeys. Access tokens are
+// signed with the key ring instead, so that other services can verify them.
+var refreshTokenSecret []byte
+
+// useRefreshTokenSecret sets the HMAC key of refresh tokens
+func useRefreshTokenSecret(secret []byte) {
+	keyRingMu.Lock()
+	defer keyRingMu.Unlock()
+	refreshTokenSecret = secret
+}
+
+// currentRefreshTokenSecret returns the HMAC key of refresh tokens
+func currentRefreshTokenSecret() ([]byte, error) {
+	keyRingMu.RLock()
+	defer keyRingMu.RUnlock()
+	if len(refreshTokenSecret) == 0 {
+		return nil, errors.New("no refresh token secret configured")
+	}
+	return refreshTokenSecret, nil
+}
 
 // Claims represents the JWT claims structure
 type Claims struct {
@@ -23,13 +38,14 @@ type Claims struct {
 	Name         string `json:"name"`
 	Role         string `json:"role"`
 	AuthProvider string `json:"auth_provider"`
+	SessionID    string `json:"sid,omitempty"` // The session the token was issued to, see StartSession
 	jwt.RegisteredClaims
 }
 
-// GenerateJWT creates a JWT token for a user
-func GenerateJWT(user *models.User, authProvider string, expiryHours int) (string, error) {
+// GenerateJWT creates a JWT token for a user's session
+func GenerateJWT(user *models.User, authProvider string, sessionID string, expiry time.Duration) (string, error) {
 	// Set expiration time
-	expirationTime := time.Now().Add(time.Duration(expiryHours) * time.Hour)
+	expirationTime := time.Now().Add(expiry)
 
 	// Create JWT claims
 	claims := &Claims{
@@ -37,6 +53,7 @@ func GenerateJWT(user *models.User, authProvider string, expiryHours int) (strin
 		Name:         user.Name,
 		Role:         user.Role,
 		AuthProvider: authProvider,
+		SessionID:    sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
@@ -46,15 +63,22 @@ func GenerateJWT(user *models.User, authProvider string, expiryHours int) (strin
 		},
 	}
 
-	// Create token with claims
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-	// Sign the token with secret key
-	return token.SignedString([]byte(AccessTokenSecretKey))
+	// Sign with the key active now, named in the kid header
+	ring, err := currentKeyRing()
+	if err != nil {
+		return "", err
+	}
+	key, err := ring.Signing(time.Now())
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(key.method(), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.private)
 }
 
-// GenerateRefreshToken creates a refresh token for a user
-func GenerateRefreshToken(user *models.User, authProvider string) (string, error) {
+// GenerateRefreshToken creates a refresh token for a user's session
+func GenerateRefreshToken(user *models.User, authProvider string, sessionID string) (string, error) {
 	// Set a longer expiration time for refresh token (e.g., 7 days)
 	refreshExpiryHours, _ := strconv.Atoi(getEnvOrDefault("REFRESH_TOKEN_EXPIRY", "168")) // Default: 7 days
 	
@@ -65,7 +89,9 @@ func GenerateRefreshToken(user *models.User, authProvider string) (string, error
 		Name:         user.Name,
 		Role:         user.Role,
 		AuthProvider: authProvider,
+		SessionID:    sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(), // Tells apart the refresh tokens issued in the same second
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			NotBefore: jwt.NewNumericDate(time.Now()),
@@ -75,19 +101,32 @@ func GenerateRefreshToken(user *models.User, authProvider string) (string, error
 	}
 
 	// Create and sign the refresh token
+	secret, err := currentRefreshTokenSecret()
+	if err != nil {
+		return "", err
+	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(RefreshTokenSecretKey))
+	return token.SignedString(secret)
 }
 
 // ValidateJWT validates a JWT token and returns the claims
 func ValidateJWT(tokenString string) (*Claims, error) {
 	// Parse the token with claims
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		// Validate the alg is what we expect
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		ring, err := currentKeyRing()
+		if err != nil {
+			return nil, err
+		}
+		kid, _ := token.Header["kid"].(string)
+		key, err := ring.Verifying(kid, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		// Validate the alg is the one of the key
+		if token.Method.Alg() != key.Algorithm {
 			return nil, errors.New("unexpected signing method")
 		}
-		return []byte(AccessTokenSecretKey), nil
+		return key.Public(), nil
 	})
 
 	if err != nil {
@@ -110,7 +149,7 @@ func ValidateRefreshToken(tokenString string) (*Claims, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, errors.New("unexpected signing method")
 		}
-		return []byte(RefreshTokenSecretKey), nil
+		return currentRefreshTokenSecret()
 	})
 
 	if err != nil {
@@ -0,0 +1,356 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Algorithms access tokens are signed with
+const (
+	AlgorithmRS256 = "RS256"
+	AlgorithmEdDSA = "EdDSA"
+)
+
+// minRSABits is the smallest RSA key accepted for signing
+const minRSABits = 2048
+
+// jwksCacheTime is how long verifiers may cache the key set served by JWKSHandler. Keys are
+// published as soon as they are configured, so a scheduled key is known to verifiers well before
+// it signs anything as long as it is added more than this ahead of its activation.
+const jwksCacheTime = 5 * time.Minute
+
+// SigningKey is a private key signing access tokens from ActivateAt on
+type SigningKey struct {
+	ID         string    // The kid header of the tokens it signs, the RFC 7638 thumbprint of its public key
+	Algorithm  string    // AlgorithmRS256 or AlgorithmEdDSA
+	ActivateAt time.Time // When it starts signing; zero signs from the start
+	private    crypto.Signer
+}
+
+// NewSigningKey wraps an RSA or Ed25519 private key
+func NewSigningKey(private crypto.Signer, activateAt time.Time) (*SigningKey, error) {
+	key := &SigningKey{ActivateAt: activateAt, private: private}
+	switch k := private.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < minRSABits {
+			return nil, fmt.Errorf("RSA keys must be at least %d bits", minRSABits)
+		}
+		key.Algorithm = AlgorithmRS256
+	case ed25519.PrivateKey:
+		key.Algorithm = AlgorithmEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported key type %T, use RSA or Ed25519", private)
+	}
+
+	thumbprint, err := json.Marshal(key.jwk(false))
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(thumbprint)
+	key.ID = base64.RawURLEncoding.EncodeToString(sum[:])
+	return key, nil
+}
+
+// ParseSigningKey reads a PEM encoded PKCS #8 (or PKCS #1 RSA) private key
+func ParseSigningKey(data []byte, activateAt time.Time) (*SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM encoded key found")
+	}
+
+	var private interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q, use a PKCS #8 private key", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T, use RSA or Ed25519", private)
+	}
+	return NewSigningKey(signer, activateAt)
+}
+
+// GenerateSigningKey creates a random Ed25519 key, for development
+func GenerateSigningKey() (*SigningKey, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return NewSigningKey(private, time.Time{})
+}
+
+// method returns the JWT signing method of the key
+func (k *SigningKey) method() jwt.SigningMethod {
+	if k.Algorithm == AlgorithmEdDSA {
+		return jwt.SigningMethodEdDSA
+	}
+	return jwt.SigningMethodRS256
+}
+
+// Public returns the public key verifying the key's tokens
+func (k *SigningKey) Public() crypto.PublicKey {
+	return k.private.Public()
+}
+
+// jwk returns the public key as a JSON Web Key. Without metadata it only has the members the
+// RFC 7638 thumbprint is computed from, in the order it requires.
+func (k *SigningKey) jwk(metadata bool) map[string]string {
+	var key map[string]string
+	switch public := k.Public().(type) {
+	case *rsa.PublicKey:
+		key = map[string]string{
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+			"kty": "RSA",
+			"n":   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+		}
+	case ed25519.PublicKey:
+		key = map[string]string{
+			"crv": "Ed25519",
+			"kty": "OKP",
+			"x":   base64.RawURLEncoding.EncodeToString(public),
+		}
+	}
+	if metadata {
+		key["kid"] = k.ID
+		key["alg"] = k.Algorithm
+		key["use"] = "sig"
+	}
+	return key
+}
+
+// KeyRing holds the keys signing access tokens. The key signing at a given time is the one
+// activated last. An older key is still accepted, and published, until the key replacing it has
+// been active for longer than tokens live, since every token it signed has expired by then.
+type KeyRing struct {
+	keys     []*SigningKey // By activation
+	lifetime time.Duration // The longest lifetime of the tokens signed
+}
+
+// NewKeyRing creates a key ring for tokens living up to lifetime
+func NewKeyRing(keys []*SigningKey, lifetime time.Duration) (*KeyRing, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no signing key")
+	}
+	sorted := append([]*SigningKey(nil), keys...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].ActivateAt.Before(sorted[j].ActivateAt) })
+
+	seen := make(map[string]bool, len(sorted))
+	for _, key := range sorted {
+		if seen[key.ID] {
+			return nil, fmt.Errorf("key %s is configured twice", key.ID)
+		}
+		seen[key.ID] = true
+	}
+	return &KeyRing{keys: sorted, lifetime: lifetime}, nil
+}
+
+// Signing returns the key signing tokens at now
+func (r *KeyRing) Signing(now time.Time) (*SigningKey, error) {
+	var signing *SigningKey
+	for _, key := range r.keys {
+		if !key.ActivateAt.After(now) {
+			signing = key
+		}
+	}
+	if signing == nil {
+		return nil, errors.New("no signing key is active yet")
+	}
+	return signing, nil
+}
+
+// Published returns the keys tokens may be signed with at now: the signing key, the keys it
+// replaced that signed tokens still alive, and the keys scheduled to sign next
+func (r *KeyRing) Published(now time.Time) []*SigningKey {
+	var published []*SigningKey
+	for i, key := range r.keys {
+		if i+1 < len(r.keys) {
+			next := r.keys[i+1].ActivateAt
+			if !next.After(now) && now.Sub(next) > r.lifetime {
+				continue
+			}
+		}
+		published = append(published, key)
+	}
+	return published
+}
+
+// Verifying returns the published key with an ID
+func (r *KeyRing) Verifying(kid string, now time.Time) (*SigningKey, error) {
+	for _, key := range r.Published(now) {
+		if key.ID == kid {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// JWKS returns the published keys as a JSON Web Key Set
+func (r *KeyRing) JWKS(now time.Time) ([]byte, error) {
+	set := struct {
+		Keys []map[string]string `json:"keys"`
+	}{Keys: []map[string]string{}}
+	for _, key := range r.Published(now) {
+		set.Keys = append(set.Keys, key.jwk(true))
+	}
+	return json.Marshal(set)
+}
+
+var (
+	// The key ring signing and verifying access tokens; nil until UseKeyRing or ConfigureKeys
+	keyRing   *KeyRing
+	keyRingMu sync.RWMutex
+)
+
+// UseKeyRing makes access tokens signed and verified with r
+func UseKeyRing(r *KeyRing) {
+	keyRingMu.Lock()
+	defer keyRingMu.Unlock()
+	keyRing = r
+}
+
+// currentKeyRing returns the key ring set with UseKeyRing
+func currentKeyRing() (*KeyRing, error) {
+	keyRingMu.RLock()
+	defer keyRingMu.RUnlock()
+	if keyRing == nil {
+		return nil, errors.New("no JWT signing keys configured")
+	}
+	return keyRing, nil
+}
+
+// DevelopmentMode reports whether APP_ENV is development, which allows running without configured
+// key material
+func DevelopmentMode() bool {
+	env := strings.ToLower(os.Getenv("APP_ENV"))
+	return env == "development" || env == "dev"
+}
+
+// ConfigureKeys loads the keys signing tokens from the environment and fails when none is
+// configured outside development mode.
+//
+// JWT_SIGNING_KEYS lists PEM files of RSA or Ed25519 private keys, separated by commas. A file
+// may be followed by @ and an RFC 3339 time at which the key starts signing, which schedules
+// rotations: list the next key with its activation time ahead of it, and remove the old key once
+// it is no longer published. REFRESH_TOKEN_SECRET_KEY is the HMAC key of refresh tokens, at least
+// 32 bytes.
+//
+// In development mode a missing signing key or refresh token secret is generated, so that tokens
+// do not survive a restart.
+func ConfigureKeys() error {
+	lifetime := accessTokenExpiry()
+
+	var keys []*SigningKey
+	for _, entry := range strings.Split(os.Getenv("JWT_SIGNING_KEYS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		path, activation, scheduled := strings.Cut(entry, "@")
+		var activateAt time.Time
+		if scheduled {
+			var err error
+			if activateAt, err = time.Parse(time.RFC3339, activation); err != nil {
+				return fmt.Errorf("invalid activation time of %s: %w", path, err)
+			}
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read signing key: %w", err)
+		}
+		key, err := ParseSigningKey(data, activateAt)
+		if err != nil {
+			return fmt.Errorf("invalid signing key %s: %w", path, err)
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		if !DevelopmentMode() {
+			return errors.New("no JWT signing key configured, set JWT_SIGNING_KEYS (or APP_ENV=development to generate one)")
+		}
+		key, err := GenerateSigningKey()
+		if err != nil {
+			return err
+		}
+		log.Printf("WARNING: signing tokens with a generated key %s, tokens will not survive a restart", key.ID)
+		keys = append(keys, key)
+	}
+
+	ring, err := NewKeyRing(keys, lifetime)
+	if err != nil {
+		return err
+	}
+	if _, err := ring.Signing(time.Now()); err != nil {
+		return err
+	}
+
+	secret := os.Getenv("REFRESH_TOKEN_SECRET_KEY")
+	if len(secret) < 32 {
+		if !DevelopmentMode() {
+			return errors.New("REFRESH_TOKEN_SECRET_KEY must be set to at least 32 bytes")
+		}
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		secret = string(b)
+		log.Printf("WARNING: signing refresh tokens with a generated secret, sessions will not survive a restart")
+	}
+
+	UseKeyRing(ring)
+	useRefreshTokenSecret([]byte(secret))
+	for _, key := range ring.Published(time.Now()) {
+		if key.ActivateAt.IsZero() {
+			log.Printf("JWT signing key %s (%s)", key.ID, key.Algorithm)
+		} else {
+			log.Printf("JWT signing key %s (%s) signing from %s", key.ID, key.Algorithm, key.ActivateAt.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// JWKSHandler serves the public keys of the key ring as a JSON Web Key Set, for other services
+// to verify access tokens
+func JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	ring, err := currentKeyRing()
+	if err != nil {
+		http.Error(w, "No keys configured", http.StatusServiceUnavailable)
+		return
+	}
+	body, err := ring.JWKS(time.Now())
+	if err != nil {
+		http.Error(w, "Failed to encode keys", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(jwksCacheTime.Seconds())))
+	w.Write(body)
+}
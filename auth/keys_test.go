@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+// newTestSigningKey creates an Ed25519 key signing from activateAt on
+func newTestSigningKey(t *testing.T, activateAt time.Time) *SigningKey {
+	t.Helper()
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := NewSigningKey(private, activateAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// keyIDs returns the IDs of keys, in order
+func keyIDs(keys []*SigningKey) []string {
+	ids := make([]string, 0, len(keys))
+	for _, key := range keys {
+		ids = append(ids, key.ID)
+	}
+	return ids
+}
+
+func TestKeyRingPublishesScheduledKeysBeforeTheySign(t *testing.T) {
+	now := time.Now()
+	current := newTestSigningKey(t, now.Add(-time.Hour))
+	scheduled := newTestSigningKey(t, now.Add(time.Hour))
+	ring, err := NewKeyRing([]*SigningKey{scheduled, current}, 15*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signing, err := ring.Signing(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signing.ID != current.ID {
+		t.Errorf("signing with %s before the scheduled key activates, want %s", signing.ID, current.ID)
+	}
+	if _, err := ring.Verifying(scheduled.ID, now); err != nil {
+		t.Errorf("scheduled key not published before it activates: %v", err)
+	}
+
+	signing, err = ring.Signing(now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signing.ID != scheduled.ID {
+		t.Errorf("signing with %s once the scheduled key activates, want %s", signing.ID, scheduled.ID)
+	}
+}
+
+func TestKeyRingDropsRetiredKeysOnceTheirTokensExpired(t *testing.T) {
+	now := time.Now()
+	lifetime := 15 * time.Minute
+	retired := newTestSigningKey(t, now.Add(-time.Hour))
+	successor := newTestSigningKey(t, now)
+	ring, err := NewKeyRing([]*SigningKey{retired, successor}, lifetime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tokens the retired key signed just before its successor activated live until lifetime has
+	// passed, so it is still published until then
+	for _, at := range []time.Time{now, now.Add(lifetime)} {
+		if got := keyIDs(ring.Published(at)); len(got) != 2 || got[0] != retired.ID || got[1] != successor.ID {
+			t.Errorf("published %v at %s, want both keys", got, at.Sub(now))
+		}
+	}
+
+	later := now.Add(lifetime + time.Second)
+	if got := keyIDs(ring.Published(later)); len(got) != 1 || got[0] != successor.ID {
+		t.Errorf("published %v once lifetime has passed, want only the successor %s", got, successor.ID)
+	}
+	if _, err := ring.Verifying(retired.ID, later); err == nil {
+		t.Error("retired key still verifies tokens once lifetime has passed")
+	}
+}
+
+func TestKeyRingRejectsDuplicateKeys(t *testing.T) {
+	key := newTestSigningKey(t, time.Time{})
+	again, err := NewSigningKey(key.private, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewKeyRing([]*SigningKey{key, again}, time.Hour); err == nil {
+		t.Error("key ring accepted the same key twice")
+	}
+}
@@ -0,0 +1,279 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"crm-communication-api/database"
+	"crm-communication-api/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrInvalidRefreshToken is returned for refresh tokens that are malformed, expired, revoked or
+// were never issued
+var ErrInvalidRefreshToken = errors.New("invalid refresh token")
+
+// ErrRefreshTokenReused is returned for refresh tokens that were already exchanged. The session
+// they belong to is revoked, since one of its tokens is in the wrong hands.
+var ErrRefreshTokenReused = errors.New("refresh token already used")
+
+// ErrSessionRevoked is returned for access tokens whose session was signed out
+var ErrSessionRevoked = errors.New("session revoked")
+
+// Key of the Device in a request's context
+const deviceCtxKey contextKey = "device"
+
+// Device describes where a request comes from, recorded on the sessions it signs in or refreshes
+type Device struct {
+	UserAgent string
+	IPAddress string
+}
+
+// DeviceFromRequest returns the device a request comes from. The address is the first one of
+// X-Forwarded-For when set, so that it is the client's behind a proxy; it is only shown to the
+// user and never trusted.
+func DeviceFromRequest(r *http.Request) Device {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		ip = strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	return Device{UserAgent: r.UserAgent(), IPAddress: ip}
+}
+
+// WithDevice returns a context carrying the device of a request
+func WithDevice(ctx context.Context, device Device) context.Context {
+	return context.WithValue(ctx, deviceCtxKey, device)
+}
+
+// DeviceFromContext returns the device added by the middleware, or an empty one
+func DeviceFromContext(ctx context.Context) Device {
+	device, _ := ctx.Value(deviceCtxKey).(Device)
+	return device
+}
+
+// Tokens are the tokens issued to a session
+type Tokens struct {
+	AccessToken  string
+	RefreshToken string
+	SessionID    uuid.UUID
+	User         models.User
+}
+
+// defaultAccessTokenExpiry is the lifetime of access tokens when JWT_EXPIRY_TIME is not set
+const defaultAccessTokenExpiry = 15 * time.Minute
+
+// accessTokenExpiry returns the lifetime of access tokens, JWT_EXPIRY_TIME: a number of minutes
+// or a duration such as "1h30m"
+func accessTokenExpiry() time.Duration {
+	value := getEnvOrDefault("JWT_EXPIRY_TIME", "15")
+	if minutes, err := strconv.Atoi(value); err == nil {
+		if minutes <= 0 {
+			return defaultAccessTokenExpiry
+		}
+		return time.Duration(minutes) * time.Minute
+	}
+	expiry, err := time.ParseDuration(value)
+	if err != nil || expiry <= 0 {
+		return defaultAccessTokenExpiry
+	}
+	return expiry
+}
+
+// GenerateTokens creates an access token and a refresh token for a user's session
+func GenerateTokens(user *models.User, authProvider string, sessionID string) (string, string, error) {
+	accessToken, err := GenerateJWT(user, authProvider, sessionID, accessTokenExpiry())
+	if err != nil {
+		return "", "", err
+	}
+	refreshToken, err := GenerateRefreshToken(user, authProvider, sessionID)
+	if err != nil {
+		return "", "", err
+	}
+	return accessToken, refreshToken, nil
+}
+
+// HashToken returns the digest under which a refresh token is stored, so that a leaked table
+// does not hand out working tokens
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// StartSession signs a user in on a device: it opens a session and issues its first tokens
+func StartSession(db *gorm.DB, user *models.User, authProvider string, device Device) (*Tokens, error) {
+	now := time.Now()
+	session := models.Session{
+		ID:           uuid.New(),
+		UserID:       user.ID,
+		AuthProvider: authProvider,
+		UserAgent:    device.UserAgent,
+		IPAddress:    device.IPAddress,
+		LastUsedAt:   now,
+	}
+
+	var tokens *Tokens
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if tokens, err = issueTokens(user, &session); err != nil {
+			return err
+		}
+		if err := tx.Create(&session).Error; err != nil {
+			return err
+		}
+		return storeRefreshToken(tx, &session, tokens.RefreshToken)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// RotateRefreshToken exchanges a refresh token for a new pair of tokens of the same session. The
+// token is marked used rather than deleted, so that a second use is recognized as reuse: the whole
+// session is then revoked and ErrRefreshTokenReused returned.
+func RotateRefreshToken(db *gorm.DB, token string, device Device) (*Tokens, error) {
+	claims, err := ValidateRefreshToken(token)
+	if err != nil {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	now := time.Now()
+	var tokens *Tokens
+	var reused *models.RefreshToken
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// Lock the row so that concurrent exchanges of the same token are told apart
+		var stored models.RefreshToken
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("token = ?", HashToken(token)).First(&stored).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidRefreshToken
+		}
+		if err != nil {
+			return err
+		}
+		if stored.UserID.String() != claims.UserID || !now.Before(stored.ExpiresAt) {
+			return ErrInvalidRefreshToken
+		}
+
+		if stored.UsedAt != nil {
+			reused = &stored
+			_, err := models.RevokeSession(tx, stored.UserID, stored.SessionID, models.RevokedReuse, now)
+			return err
+		}
+
+		var session models.Session
+		err = tx.Where("id = ?", stored.SessionID).First(&session).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidRefreshToken
+		}
+		if err != nil {
+			return err
+		}
+		if !session.Active(now) {
+			return ErrInvalidRefreshToken
+		}
+
+		var user models.User
+		err = tx.Where("id = ?", stored.UserID).First(&user).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidRefreshToken
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Model(&stored).Update("used_at", now).Error; err != nil {
+			return err
+		}
+		if tokens, err = issueTokens(&user, &session); err != nil {
+			return err
+		}
+		session.LastUsedAt = now
+		if device.UserAgent != "" {
+			session.UserAgent = device.UserAgent
+		}
+		if device.IPAddress != "" {
+			session.IPAddress = device.IPAddress
+		}
+		if err := tx.Save(&session).Error; err != nil {
+			return err
+		}
+		return storeRefreshToken(tx, &session, tokens.RefreshToken)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reused != nil {
+		log.Printf("Refresh token of session %s of user %s was reused, session revoked", reused.SessionID, reused.UserID)
+		return nil, ErrRefreshTokenReused
+	}
+	return tokens, nil
+}
+
+// ValidateAccessToken validates an access token and checks that its session was not signed out.
+// Tokens issued without a session are only checked by ValidateJWT.
+func ValidateAccessToken(tokenString string) (*Claims, error) {
+	claims, err := ValidateJWT(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.SessionID == "" {
+		return claims, nil
+	}
+
+	var session models.Session
+	if err := database.DB.Where("id = ?", claims.SessionID).First(&session).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrSessionRevoked
+		}
+		return nil, err
+	}
+	if session.RevokedAt != nil {
+		return nil, ErrSessionRevoked
+	}
+	return claims, nil
+}
+
+// issueTokens generates the tokens of a session and extends the session to the refresh token's
+// expiry
+func issueTokens(user *models.User, session *models.Session) (*Tokens, error) {
+	accessToken, refreshToken, err := GenerateTokens(user, session.AuthProvider, session.ID.String())
+	if err != nil {
+		return nil, err
+	}
+	claims, err := ValidateRefreshToken(refreshToken)
+	if err != nil {
+		return nil, err
+	}
+	session.ExpiresAt = claims.ExpiresAt.Time
+
+	return &Tokens{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		SessionID:    session.ID,
+		User:         *user,
+	}, nil
+}
+
+// storeRefreshToken records a refresh token of a session so that it can be exchanged once
+func storeRefreshToken(tx *gorm.DB, session *models.Session, token string) error {
+	return tx.Create(&models.RefreshToken{
+		UserID:    session.UserID,
+		SessionID: session.ID,
+		Token:     HashToken(token),
+		ExpiresAt: session.ExpiresAt,
+	}).Error
+}
@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+
+	"crm-communication-api/database"
+	"crm-communication-api/internal/testdb"
+	"crm-communication-api/models"
+)
+
+// useTestKeys signs tokens with fresh keys for the duration of a test
+func useTestKeys(t *testing.T) {
+	t.Helper()
+
+	key, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring, err := NewKeyRing([]*SigningKey{key}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previousRing, _ := currentKeyRing()
+	previousSecret := refreshTokenSecret
+	UseKeyRing(ring)
+	useRefreshTokenSecret([]byte("a refresh token secret of 32 bytes"))
+	t.Cleanup(func() {
+		UseKeyRing(previousRing)
+		useRefreshTokenSecret(previousSecret)
+	})
+}
+
+// useTestDB points database.DB at an empty database with the session tables
+func useTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	db := testdb.Open(t, &models.User{}, &models.Session{}, &models.RefreshToken{})
+	previous := database.DB
+	database.DB = db
+	t.Cleanup(func() { database.DB = previous })
+	return db
+}
+
+func TestRefreshTokensAreSingleUse(t *testing.T) {
+	useTestKeys(t)
+	db := useTestDB(t)
+
+	user := models.User{Name: "Ada", Email: "ada@example.com", Role: "agent"}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	device := Device{UserAgent: "test", IPAddress: "192.0.2.1"}
+	first, err := StartSession(db, &user, "password", device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ValidateAccessToken(first.AccessToken); err != nil {
+		t.Fatalf("access token of a new session: %v", err)
+	}
+
+	second, err := RotateRefreshToken(db, first.RefreshToken, device)
+	if err != nil {
+		t.Fatalf("first exchange: %v", err)
+	}
+	if second.SessionID != first.SessionID || second.RefreshToken == first.RefreshToken {
+		t.Fatalf("exchange returned session %s with the same token %v, want new tokens for session %s",
+			second.SessionID, second.RefreshToken == first.RefreshToken, first.SessionID)
+	}
+
+	// Exchanging the first token again gives the session away as stolen
+	if _, err := RotateRefreshToken(db, first.RefreshToken, device); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("second exchange error = %v, want ErrRefreshTokenReused", err)
+	}
+	if _, err := RotateRefreshToken(db, second.RefreshToken, device); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("exchange in a revoked session error = %v, want ErrInvalidRefreshToken", err)
+	}
+	if _, err := ValidateAccessToken(second.AccessToken); !errors.Is(err, ErrSessionRevoked) {
+		t.Errorf("access token of a revoked session error = %v, want ErrSessionRevoked", err)
+	}
+}
+
+func TestRotateRefreshTokenRejectsUnknownTokens(t *testing.T) {
+	useTestKeys(t)
+	db := useTestDB(t)
+
+	user := models.User{Name: "Ada", Email: "ada@example.com", Role: "agent"}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := StartSession(db, &user, "password", Device{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Well signed, but never stored
+	unstored, err := GenerateRefreshToken(&user, "password", tokens.SessionID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, token := range map[string]string{
+		"garbage":      "not-a-token",
+		"access token": tokens.AccessToken,
+		"tampered":     tokens.RefreshToken[:len(tokens.RefreshToken)-2] + "xx",
+		"not stored":   unstored,
+	} {
+		if _, err := RotateRefreshToken(db, token, Device{}); !errors.Is(err, ErrInvalidRefreshToken) {
+			t.Errorf("%s: error = %v, want ErrInvalidRefreshToken", name, err)
+		}
+	}
+}
+
+func TestAccessTokenExpiry(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", defaultAccessTokenExpiry},
+		{"15", 15 * time.Minute},
+		{"90", 90 * time.Minute},
+		{"1h30m", 90 * time.Minute},
+		{"0", defaultAccessTokenExpiry},
+		{"-5m", defaultAccessTokenExpiry},
+		{"soon", defaultAccessTokenExpiry},
+	}
+	for _, tt := range tests {
+		t.Setenv("JWT_EXPIRY_TIME", tt.value)
+		if got := accessTokenExpiry(); got != tt.want {
+			t.Errorf("accessTokenExpiry() with %q = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
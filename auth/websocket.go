@@ -0,0 +1,30 @@
+package auth
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocketTokenProtocol is the Sec-WebSocket-Protocol value browsers use to pass an access token,
+// sent as the pair ["bearer", "<token>"] since they cannot set an Authorization header
+const WebSocketTokenProtocol = "bearer"
+
+// WebSocketToken extracts an access token from a WebSocket upgrade request, looking at the
+// Authorization header first and then the Sec-WebSocket-Protocol header. It returns an
+// empty string when the request carries no token.
+func WebSocketToken(r *http.Request) string {
+	if authHeader := r.Header.Get("Authorization"); strings.HasPrefix(authHeader, "Bearer ") {
+		return strings.TrimPrefix(authHeader, "Bearer ")
+	}
+
+	protocols := websocket.Subprotocols(r)
+	for i := 0; i+1 < len(protocols); i++ {
+		if protocols[i] == WebSocketTokenProtocol {
+			return protocols[i+1]
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
+
+	"crm-communication-api/database"
+	"crm-communication-api/internal/rbac"
+	"crm-communication-api/models"
+)
+
+// errRoomForbidden is returned when a user may not join a room, because its client is not
+// visible to them or there is no such room
+var errRoomForbidden = errors.New("not allowed to join room")
+
+// checkRoomAccess checks that a user may join a room: the client the room belongs to must be
+// visible to them, as for the GraphQL API. Connections whose user ID is not a registered user
+// cannot join any room. Rooms that do not exist are refused the same way, so that the answer
+// tells nothing about the clients a user cannot see.
+func checkRoomAccess(userID, room string) error {
+	target, err := resolveRoom(room)
+	if errors.Is(err, errRoomNotFound) || errors.Is(err, errInvalidRoomID) {
+		return fmt.Errorf("%w %s", errRoomForbidden, room)
+	}
+	if err != nil {
+		return err
+	}
+
+	user, err := registeredUser(userID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("%w %s", errRoomForbidden, room)
+	}
+
+	allowed, err := rbac.CanAccessClient(database.DB, *user, target.ClientID)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return fmt.Errorf("%w %s", errRoomForbidden, room)
+	}
+	return nil
+}
+
+// refuseRoom closes a connection asking for a room its user may not join, or whose access could
+// not be checked
+func refuseRoom(conn *websocket.Conn, err error) {
+	if errors.Is(err, errRoomForbidden) {
+		closeWithCode(conn, closeForbidden, err.Error())
+	} else {
+		closeWithCode(conn, websocket.CloseInternalServerErr, "failed to check room access")
+	}
+}
+
+// hasPermission reports whether the role of a connection's user grants a permission
+func hasPermission(userID string, permission rbac.Permission) (bool, error) {
+	user, err := registeredUser(userID)
+	if err != nil || user == nil {
+		return false, err
+	}
+	return rbac.Has(database.DB, user.Role, permission)
+}
+
+// registeredUser loads the user of a connection, or returns nil when the user ID is not a user
+func registeredUser(userID string) (*models.User, error) {
+	id, err := uuid.Parse(userID)
+	if err != nil {
+		return nil, nil
+	}
+	var user models.User
+	if err := database.DB.Where("id = ?", id).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &user, nil
+}
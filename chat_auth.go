@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"crm-communication-api/auth"
+	"crm-communication-api/models"
+)
+
+// Close codes sent when a chat connection fails authentication. They are in the
+// 4000-4999 range reserved for applications so clients can tell them apart.
+const (
+	// closeUnauthorized means no valid token was presented; the client should log in again
+	closeUnauthorized = 4001
+
+	// closeTokenExpired means the access token expired mid-connection; the client should
+	// refresh it and reconnect, or send an auth frame with a fresh token before expiry
+	closeTokenExpired = 4002
+
+	// closeForbidden means the user may not join the room the connection asked for
+	closeForbidden = 4004
+)
+
+// authTimeout is how long a connection without a token in its handshake has to send an auth frame
+const authTimeout = 10 * time.Second
+
+// authenticateFirstFrame waits for the first frame on a new connection and validates it as an auth frame.
+// Clients that cannot pass a token in the handshake send {"v": 1, "type": "auth", "payload": {"token": "..."}}.
+func authenticateFirstFrame(conn *websocket.Conn) (*auth.Claims, error) {
+	conn.SetReadDeadline(time.Now().Add(authTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	_, msgBytes, err := conn.ReadMessage()
+	if err != nil {
+		return nil, fmt.Errorf("no auth frame received: %w", err)
+	}
+
+	var frame models.WSMessage
+	var payload models.WSAuthPayload
+	if err := json.Unmarshal(msgBytes, &frame); err != nil || frame.Type != models.WSTypeAuth {
+		return nil, errors.New("authentication required")
+	}
+	if err := json.Unmarshal(frame.Payload, &payload); err != nil || payload.Token == "" {
+		return nil, errors.New("authentication required")
+	}
+
+	claims, err := auth.ValidateAccessToken(payload.Token)
+	if err != nil {
+		return nil, errors.New("invalid token")
+	}
+	return claims, nil
+}
+
+// tokenExpiry returns when the token behind a set of claims expires, or the zero time if it never does
+func tokenExpiry(claims *auth.Claims) time.Time {
+	if claims.ExpiresAt == nil {
+		return time.Time{}
+	}
+	return claims.ExpiresAt.Time
+}
+
+// expiryTimer returns a timer for a token expiry and its channel. The channel is nil,
+// and so never fires, when the token does not expire.
+func expiryTimer(expiresAt time.Time) (*time.Timer, <-chan time.Time) {
+	if expiresAt.IsZero() {
+		return nil, nil
+	}
+	timer := time.NewTimer(time.Until(expiresAt))
+	return timer, timer.C
+}
+
+// closeWithCode sends a close frame with an application close code and reason
+func closeWithCode(conn *websocket.Conn, code int, reason string) {
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(10*time.Second))
+	conn.Close()
+}
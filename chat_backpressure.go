@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+
+	"crm-communication-api/internal/backpressure"
+	"crm-communication-api/models"
+)
+
+const (
+	// sendBufferSize is how many frames a connection can have waiting before its policy applies
+	sendBufferSize = 256
+
+	// spillLimit is how many frames the spill policy queues before it disconnects the client
+	spillLimit = 4096
+
+	// resumeTTL is how long the frames of a connection closed for being slow are kept for it
+	resumeTTL = 2 * time.Minute
+
+	// resumeGrace keeps a session that passed the resume check until the new connection registers
+	resumeGrace = 30 * time.Second
+
+	// maxParkedFrames caps the frames kept for a closed connection; past it the session can no
+	// longer be resumed and the client falls back to replaying history
+	maxParkedFrames = 4096
+
+	// closeSlowConsumer means the connection was closed because the client did not read its
+	// frames fast enough; it can reconnect with the resume token from its session frame
+	closeSlowConsumer = 4003
+)
+
+// parkedSession keeps what a connection closed for being slow would have received, so a new
+// connection presenting its resume token catches up without gaps
+type parkedSession struct {
+	userID    string
+	rooms     map[string]bool
+	frames    []models.WSMessage
+	expiresAt time.Time
+}
+
+// resumeCheck asks the hub whether a user can resume a session
+type resumeCheck struct {
+	token  string
+	userID string
+	reply  chan resumable
+}
+
+// resumable answers a resumeCheck with the rooms the session would rejoin
+type resumable struct {
+	ok    bool
+	rooms []string
+}
+
+// newSendQueue creates the outbound queue of a connection
+func newSendQueue(policy backpressure.Policy) *backpressure.Queue[models.WSMessage] {
+	return backpressure.NewQueue(policy, sendBufferSize, spillLimit, frameCoalesceKey)
+}
+
+// slowPolicyFromRequest reads the slow_policy handshake parameter, falling back to the
+// CHAT_SLOW_POLICY environment variable and then to backpressure.DefaultPolicy
+func slowPolicyFromRequest(r *http.Request) (backpressure.Policy, error) {
+	name := r.URL.Query().Get("slow_policy")
+	if name == "" {
+		name = os.Getenv("CHAT_SLOW_POLICY")
+	}
+	return backpressure.ParsePolicy(name)
+}
+
+// frameCoalesceKey identifies the state a frame reports, so a newer frame for the same state can
+// replace a queued one. Chat messages, acks and errors are never coalesced.
+func frameCoalesceKey(frame models.WSMessage) string {
+	var payload struct {
+		ID        string `json:"id"`
+		Room      string `json:"room"`
+		UserID    string `json:"user_id"`
+		MessageID string `json:"message_id"`
+	}
+
+	switch frame.Type {
+	case models.WSTypePresence, models.WSTypeTypingStarted, models.WSTypeTypingStopped, models.WSTypeRead,
+		models.WSTypeMessageUpdated, models.WSTypeMessageDeleted, models.WSTypeReactionAdded, models.WSTypeReactionRemoved:
+		if json.Unmarshal(frame.Payload, &payload) != nil {
+			return ""
+		}
+	default:
+		return ""
+	}
+
+	switch frame.Type {
+	case models.WSTypePresence:
+		return "presence:" + payload.UserID
+	case models.WSTypeTypingStarted, models.WSTypeTypingStopped:
+		return "typing:" + payload.Room + ":" + payload.UserID
+	case models.WSTypeRead:
+		return "read:" + payload.Room + ":" + payload.UserID
+	case models.WSTypeMessageUpdated, models.WSTypeMessageDeleted:
+		return "message:" + payload.ID
+	default:
+		return "reactions:" + payload.MessageID
+	}
+}
+
+// push queues a frame for a client, disconnecting the client if its policy says it is too slow.
+// It reports false when the client was disconnected. It must only be called from the run loop.
+func (h *ChatHub) push(client *ChatClient, frame models.WSMessage) bool {
+	if client.send.Push(frame) {
+		return true
+	}
+	h.kick(client)
+	return false
+}
+
+// kick disconnects a slow client with closeSlowConsumer and parks its queued frames under its
+// resume token. It must only be called from the run loop.
+func (h *ChatHub) kick(client *ChatClient) {
+	backpressure.Count(client.send.Policy(), backpressure.EventDisconnected)
+
+	session := &parkedSession{
+		userID:    client.userID,
+		rooms:     make(map[string]bool),
+		frames:    client.send.Drain(),
+		expiresAt: time.Now().Add(resumeTTL),
+	}
+	for _, room := range client.subscribedRooms() {
+		session.rooms[room] = true
+	}
+	h.parked[client.resumeToken] = session
+
+	client.closeCode = closeSlowConsumer
+	client.closeReason = "too slow, reconnect with resume_token"
+	h.removeClient(client)
+}
+
+// park keeps a frame for the closed connections that belonged to its room.
+// It must only be called from the run loop.
+func (h *ChatHub) park(room string, frame models.WSMessage) {
+	for token, session := range h.parked {
+		if !session.rooms[room] {
+			continue
+		}
+		if len(session.frames) >= maxParkedFrames {
+			delete(h.parked, token)
+			continue
+		}
+		session.frames = append(session.frames, frame)
+	}
+}
+
+// canResume reports whether a session can be resumed by a user and, if so, which rooms it would
+// rejoin, and keeps it for at least resumeGrace. It must only be called from the run loop.
+func (h *ChatHub) canResume(check resumeCheck) resumable {
+	session, exists := h.parked[check.token]
+	if !exists || session.userID != check.userID {
+		return resumable{}
+	}
+	if grace := time.Now().Add(resumeGrace); session.expiresAt.Before(grace) {
+		session.expiresAt = grace
+	}
+	rooms := make([]string, 0, len(session.rooms))
+	for room := range session.rooms {
+		rooms = append(rooms, room)
+	}
+	return resumable{ok: true, rooms: rooms}
+}
+
+// checkResume asks the run loop whether a user can resume a session, and which rooms it would
+// rejoin; it is safe to call from any goroutine
+func (h *ChatHub) checkResume(token, userID string) ([]string, bool) {
+	check := resumeCheck{token: token, userID: userID, reply: make(chan resumable, 1)}
+	h.resumeChecks <- check
+	answer := <-check.reply
+	return answer.rooms, answer.ok
+}
+
+// startSession sends a registering client its session frame. When the client resumes a parked
+// session, the frame is followed by the session's parked frames and the client joins the session's
+// rooms. It must only be called from the run loop.
+func (h *ChatHub) startSession(client *ChatClient) {
+	sessionPayload := models.WSSessionPayload{
+		ResumeToken: client.resumeToken,
+		Policy:      string(client.send.Policy()),
+	}
+
+	session, exists := h.parked[client.resumes]
+	if !exists || session.userID != client.userID {
+		client.send.PushAll([]models.WSMessage{newFrame(models.WSTypeSession, "", sessionPayload)})
+		return
+	}
+
+	delete(h.parked, client.resumes)
+	sessionPayload.Resumed = true
+	sessionPayload.Replayed = len(session.frames)
+	client.send.PushAll(append([]models.WSMessage{newFrame(models.WSTypeSession, "", sessionPayload)}, session.frames...))
+	for room := range session.rooms {
+		h.joinRoom(client, room)
+	}
+	backpressure.Count(client.send.Policy(), backpressure.EventResumed)
+}
+
+// expireParked forgets sessions that were not resumed in time. It must only be called from the run loop.
+func (h *ChatHub) expireParked(now time.Time) {
+	for token, session := range h.parked {
+		if now.After(session.expiresAt) {
+			delete(h.parked, token)
+		}
+	}
+}
+
+// newResumeToken returns the token a connection can be resumed with
+func newResumeToken() string {
+	return uuid.New().String()
+}
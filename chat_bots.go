@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"crm-communication-api/database"
+	"crm-communication-api/internal/bot"
+	"crm-communication-api/models"
+)
+
+const (
+	// defaultBots are the bots enabled when CHAT_BOTS is not set
+	defaultBots = "crmbot,autoresponder"
+
+	// botReplyLimit is how many times a bot may reply in a room per botReplyWindow
+	botReplyLimit  = 5
+	botReplyWindow = time.Minute
+
+	// botTimeout bounds how long a bot may take to answer a message
+	botTimeout = 10 * time.Second
+)
+
+// newBotRegistry creates the bots listed in CHAT_BOTS, a comma-separated list of crmbot and
+// autoresponder, or "none". Every bot posts as a user of its own, created if needed.
+func newBotRegistry() *bot.Registry {
+	enabled := os.Getenv("CHAT_BOTS")
+	if enabled == "" {
+		enabled = defaultBots
+	}
+
+	registry := bot.NewRegistry(botReplyLimit, botReplyWindow)
+	for _, name := range strings.Split(enabled, ",") {
+		var b bot.Bot
+		switch name = strings.TrimSpace(name); name {
+		case "crmbot":
+			b = bot.NewCRMBot(database.DB)
+		case "autoresponder":
+			b = bot.NewAutoResponder()
+		case "", "none":
+			continue
+		default:
+			log.Fatalf("Unknown bot %q in CHAT_BOTS, use crmbot, autoresponder or none", name)
+		}
+
+		if _, err := botUser(database.DB, b.Name()); err != nil {
+			log.Fatalf("Failed to create the user of bot %s: %v", b.Name(), err)
+		}
+		registry.Register(b)
+		log.Printf("Chat bot %s enabled", b.Name())
+	}
+	return registry
+}
+
+// botUser returns the user a bot posts as, creating it with the "bot" role if needed
+func botUser(db *gorm.DB, name string) (models.User, error) {
+	user := models.User{Name: name, Email: name + "@bots.local", Role: "bot"}
+	err := db.Where(models.User{Email: user.Email}).FirstOrCreate(&user).Error
+	return user, err
+}
+
+// runBots hands a message posted in a room to the bots it triggers, which answer on goroutines of
+// their own
+func (h *ChatHub) runBots(message ChatMessage) {
+	if h.bots == nil {
+		return
+	}
+
+	matches := h.bots.Match(bot.Event{
+		Room:      message.Room,
+		MessageID: message.ID,
+		SenderID:  message.SenderID,
+		Sender:    message.Sender,
+		Content:   message.Content,
+		Mentions:  message.Mentions,
+	})
+	for _, match := range matches {
+		go h.answer(match)
+	}
+}
+
+// answer runs one bot and posts its replies as the bot's user
+func (h *ChatHub) answer(match bot.Match) {
+	ctx, cancel := context.WithTimeout(context.Background(), botTimeout)
+	defer cancel()
+
+	name := match.Bot.Name()
+	replies, err := match.Bot.Handle(ctx, match.Event)
+	if err != nil {
+		log.Printf("Bot %s failed to answer message %s: %v", name, match.Event.MessageID, err)
+		return
+	}
+
+	user, err := botUser(database.DB, name)
+	if err != nil {
+		log.Printf("Bot %s has no user to post as: %v", name, err)
+		return
+	}
+	for _, reply := range replies {
+		message := ChatMessage{
+			ID:        uuid.New().String(),
+			Sender:    user.Name,
+			SenderID:  user.ID.String(),
+			Content:   reply.Content,
+			Room:      match.Event.Room,
+			Timestamp: time.Now(),
+		}
+		if _, err := postMessage(h, message); err != nil {
+			log.Printf("Bot %s failed to post its reply: %v", name, err)
+		}
+	}
+}
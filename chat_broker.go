@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/google/uuid"
+
+	"crm-communication-api/database"
+	"crm-communication-api/internal/broker"
+	"crm-communication-api/models"
+)
+
+// chatTopic is the broker topic on which chat hubs share room frames
+const chatTopic = "chat_rooms"
+
+// outboundBufferSize is how many frames can wait to be published before the hub drops them
+const outboundBufferSize = 256
+
+// messageRefKind is the kind of the broker messages standing in for message and message_updated
+// frames too large for the broker, e.g. a long message over Postgres NOTIFY. Hubs receiving one
+// load the message from the database.
+const messageRefKind = "message_ref"
+
+// messageRef identifies the message of a frame sent as a messageRefKind broker message
+type messageRef struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// newBroker picks the broker the hubs share. Set CHAT_BROKER=postgres when running several
+// replicas so they fan events out through Postgres LISTEN/NOTIFY on DATABASE_URL; by default
+// events stay in this process.
+func newBroker() broker.Broker {
+	switch mode := os.Getenv("CHAT_BROKER"); mode {
+	case "postgres":
+		log.Println("Fanning chat events out through Postgres LISTEN/NOTIFY")
+		return broker.NewPostgres(database.DB, os.Getenv("DATABASE_URL"))
+	case "", "memory":
+		return broker.NewInProcess()
+	default:
+		log.Fatalf("Unknown CHAT_BROKER %q, use postgres or memory", mode)
+		return nil
+	}
+}
+
+// connectBroker subscribes the hub to frames published by hubs on other nodes and starts
+// publishing its own. Without a broker the hub only serves its own connections.
+func (h *ChatHub) connectBroker() {
+	if h.broker == nil {
+		return
+	}
+
+	if _, err := h.broker.Subscribe(chatTopic, h.receiveRemote); err != nil {
+		log.Printf("Chat hub could not subscribe to %s, serving local connections only: %v", chatTopic, err)
+		return
+	}
+	h.outbound = make(chan broker.Message, outboundBufferSize)
+	go h.forwardToBroker()
+}
+
+// fanOut sends a frame to the room's members on this node, except one client which may be nil,
+// and shares it with the other nodes. It must only be called from the run loop.
+func (h *ChatHub) fanOut(room string, frame models.WSMessage, except *ChatClient) {
+	h.broadcastFrame(room, frame, except)
+	h.share(room, frame)
+}
+
+// share queues a frame for the room's members on the other nodes. It must only be called from
+// the run loop.
+func (h *ChatHub) share(room string, frame models.WSMessage) {
+	if h.outbound == nil {
+		return
+	}
+
+	data, err := json.Marshal(frame)
+	if err != nil {
+		log.Printf("Chat hub could not encode a %s frame for the broker: %v", frame.Type, err)
+		return
+	}
+	select {
+	case h.outbound <- broker.Message{Origin: h.origin, Key: room, Kind: frame.Type, Data: data}:
+	default:
+		log.Printf("Chat hub broker queue full, %s frame for room %s not sent to other nodes", frame.Type, room)
+	}
+}
+
+// forwardToBroker publishes queued frames. It runs on its own goroutine so a slow broker never
+// holds up the run loop.
+func (h *ChatHub) forwardToBroker() {
+	for msg := range h.outbound {
+		err := h.broker.Publish(chatTopic, msg)
+		if errors.Is(err, broker.ErrPayloadTooLarge) {
+			err = h.publishMessageRef(msg)
+		}
+		if err != nil {
+			log.Printf("Chat hub failed to publish a %s frame for room %s: %v", msg.Kind, msg.Key, err)
+		}
+	}
+}
+
+// publishMessageRef publishes a reference to the message of a frame the broker could not carry,
+// so the other hubs load it themselves. Only chat message frames can be that large.
+func (h *ChatHub) publishMessageRef(msg broker.Message) error {
+	if msg.Kind != models.WSTypeMessage && msg.Kind != models.WSTypeMessageUpdated {
+		return fmt.Errorf("%w: %s frames cannot be sent by reference", broker.ErrPayloadTooLarge, msg.Kind)
+	}
+
+	var frame models.WSMessage
+	var message struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(msg.Data, &frame); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(frame.Payload, &message); err != nil {
+		return err
+	}
+	if message.ID == "" {
+		return fmt.Errorf("%w: the %s frame has no message ID", broker.ErrPayloadTooLarge, msg.Kind)
+	}
+
+	data, err := json.Marshal(messageRef{Type: msg.Kind, ID: message.ID})
+	if err != nil {
+		return err
+	}
+	return h.broker.Publish(chatTopic, broker.Message{Origin: msg.Origin, Key: msg.Key, Kind: messageRefKind, Data: data})
+}
+
+// receiveRemote hands frames published by other hubs to the run loop
+func (h *ChatHub) receiveRemote(msg broker.Message) {
+	if msg.Origin == h.origin {
+		return
+	}
+
+	if msg.Kind == messageRefKind {
+		h.receiveMessageRef(msg)
+		return
+	}
+
+	var frame models.WSMessage
+	if err := json.Unmarshal(msg.Data, &frame); err != nil {
+		log.Printf("Chat hub dropped a malformed frame from the broker: %v", err)
+		return
+	}
+	h.remote <- roomFrame{room: msg.Key, frame: frame, origin: msg.Origin}
+}
+
+// receiveMessageRef loads the message another hub published by reference and hands its frame
+// to the run loop
+func (h *ChatHub) receiveMessageRef(msg broker.Message) {
+	var ref messageRef
+	if err := json.Unmarshal(msg.Data, &ref); err != nil {
+		log.Printf("Chat hub dropped a malformed message reference from the broker: %v", err)
+		return
+	}
+	id, err := uuid.Parse(ref.ID)
+	if err != nil {
+		log.Printf("Chat hub dropped a message reference with an invalid ID %q", ref.ID)
+		return
+	}
+
+	message, err := loadLiveMessage(id, msg.Key)
+	if err != nil {
+		log.Printf("Chat hub could not load message %s published by reference: %v", id, err)
+		return
+	}
+	h.remote <- roomFrame{room: msg.Key, frame: newFrame(ref.Type, "", message), origin: msg.Origin}
+}
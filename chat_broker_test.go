@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"crm-communication-api/internal/backpressure"
+	"crm-communication-api/internal/broker"
+	"crm-communication-api/models"
+)
+
+// connectTestClient registers a client without a socket in a hub, joined to a room
+func connectTestClient(hub *ChatHub, userID, room string) *ChatClient {
+	client := &ChatClient{
+		hub:      hub,
+		send:     newSendQueue(backpressure.DefaultPolicy),
+		userID:   userID,
+		username: userID,
+		room:     room,
+		roomSubs: make(map[string]bool),
+	}
+	hub.register <- client
+	return client
+}
+
+// waitForFrame pops a client's frames until one of a type arrives
+func waitForFrame(t *testing.T, client *ChatClient, frameType string) models.WSMessage {
+	t.Helper()
+
+	timeout := time.After(2 * time.Second)
+	for {
+		for {
+			frame, ok := client.send.Pop()
+			if !ok {
+				break
+			}
+			if frame.Type == frameType {
+				return frame
+			}
+		}
+		select {
+		case <-client.send.Ready():
+		case <-timeout:
+			t.Fatalf("no %s frame for %s", frameType, client.userID)
+		}
+	}
+}
+
+func TestMessagesReachOtherHubs(t *testing.T) {
+	b := broker.NewInProcess()
+	hubA := newChatHub(b, nil, nil)
+	hubB := newChatHub(b, nil, nil)
+	go hubA.run()
+	go hubB.run()
+
+	room := uuid.New().String()
+	alice := connectTestClient(hubA, "alice", room)
+	bob := connectTestClient(hubB, "bob", room)
+	waitForFrame(t, alice, models.WSTypeSession)
+	waitForFrame(t, bob, models.WSTypeSession)
+
+	hubA.broadcast <- ChatMessage{ID: uuid.New().String(), Sender: "alice", SenderID: "alice", Content: "hello from A", Room: room}
+
+	for _, client := range []*ChatClient{alice, bob} {
+		var message ChatMessage
+		if err := json.Unmarshal(waitForFrame(t, client, models.WSTypeMessage).Payload, &message); err != nil {
+			t.Fatal(err)
+		}
+		if message.Content != "hello from A" || message.Room != room {
+			t.Errorf("%s got %+v, want the message sent on hub A", client.userID, message)
+		}
+	}
+}
+
+// limitedBroker is an in-process broker that, like Postgres NOTIFY, refuses large messages
+type limitedBroker struct {
+	*broker.InProcess
+	limit int
+}
+
+func (b limitedBroker) Publish(topic string, msg broker.Message) error {
+	if len(msg.Data) > b.limit {
+		return broker.ErrPayloadTooLarge
+	}
+	return b.InProcess.Publish(topic, msg)
+}
+
+func TestOversizedMessagesArePublishedByReference(t *testing.T) {
+	b := limitedBroker{InProcess: broker.NewInProcess(), limit: 1024}
+	published := make(chan broker.Message, 10)
+	if _, err := b.Subscribe(chatTopic, func(msg broker.Message) { published <- msg }); err != nil {
+		t.Fatal(err)
+	}
+
+	hub := newChatHub(b, nil, nil)
+	go hub.run()
+
+	room := uuid.New().String()
+	id := uuid.New().String()
+	hub.broadcast <- ChatMessage{ID: id, Sender: "alice", Content: strings.Repeat("long ", 1000), Room: room}
+
+	select {
+	case msg := <-published:
+		if msg.Kind != messageRefKind || msg.Key != room || msg.Origin != hub.origin {
+			t.Fatalf("published %s for %s from %s, want a message reference for %s", msg.Kind, msg.Key, msg.Origin, room)
+		}
+		var ref messageRef
+		if err := json.Unmarshal(msg.Data, &ref); err != nil {
+			t.Fatal(err)
+		}
+		if ref != (messageRef{Type: models.WSTypeMessage, ID: id}) {
+			t.Errorf("reference = %+v, want message %s", ref, id)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("nothing published for the oversized message")
+	}
+}
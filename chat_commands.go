@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+
+	"crm-communication-api/database"
+	"crm-communication-api/internal/command"
+	"crm-communication-api/models"
+)
+
+const (
+	// commandTimeout bounds how long a slash command may run
+	commandTimeout = 10 * time.Second
+
+	// reminderInterval is how often due reminders are looked for
+	reminderInterval = 30 * time.Second
+)
+
+// userFrame is a frame for every connection of one user
+type userFrame struct {
+	userID string
+	frame  models.WSMessage
+}
+
+// handleCommand runs a slash command typed in a room and answers with a notice only the
+// connection that sent it receives. It reports false when the hub does not know the command,
+// which is then posted as a message so bots with a command trigger can answer it.
+func (c *ChatClient) handleCommand(frame models.WSMessage, room, content string) bool {
+	name, args, text, ok := command.Parse(content)
+	if !ok {
+		return false
+	}
+	if c.hub.commands == nil || !c.hub.commands.Has(name) {
+		if c.hub.bots != nil && c.hub.bots.HasCommand(name) {
+			return false
+		}
+		c.replyNotice(frame.ID, room, name, "Unknown command /"+name+", type /help for the list")
+		return true
+	}
+
+	inv, err := commandInvocation(c.userID, room, name, args, text)
+	if err != nil {
+		c.replyFailure(frame.ID, err)
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	reply, err := c.hub.commands.Run(ctx, inv)
+	switch {
+	case errors.Is(err, command.ErrForbidden):
+		c.replyError(frame.ID, models.WSErrForbidden, err.Error())
+	case errors.Is(err, command.ErrUsage), errors.Is(err, command.ErrUnknownCommand):
+		c.replyNotice(frame.ID, room, name, err.Error())
+	case err != nil:
+		log.Printf("Command /%s in room %s failed: %v", name, room, err)
+		c.replyFailure(frame.ID, err)
+	default:
+		c.replyNotice(frame.ID, room, name, reply)
+	}
+	return true
+}
+
+// replyNotice answers a frame with a notice, then acknowledges it
+func (c *ChatClient) replyNotice(id, room, name, content string) {
+	c.reply(
+		newFrame(models.WSTypeNotice, "", models.WSNoticePayload{Room: room, Command: name, Content: content}),
+		newFrame(models.WSTypeAck, id, models.WSAckPayload{}),
+	)
+}
+
+// commandInvocation describes a command typed by a user in a room
+func commandInvocation(userID, room, name string, args []string, text string) (command.Invocation, error) {
+	target, err := resolveRoom(room)
+	if err != nil {
+		return command.Invocation{}, err
+	}
+
+	var user models.User
+	if err := database.DB.Where("id = ?", userID).First(&user).Error; err != nil {
+		return command.Invocation{}, err
+	}
+
+	return command.Invocation{
+		User:     user,
+		ClientID: target.ClientID,
+		ThreadID: target.ThreadID,
+		ParentID: target.ParentID,
+		Room:     room,
+		Name:     name,
+		Args:     args,
+		Text:     text,
+	}, nil
+}
+
+// notifyUser sends a frame to every connection of a user on this node. It must only be called
+// from the run loop.
+func (h *ChatHub) notifyUser(notice userFrame) {
+	for client := range h.clients {
+		if client.userID == notice.userID {
+			h.push(client, notice.frame)
+		}
+	}
+}
+
+// receiveUserFrame hands a frame sent to a user through the WebSocket hub's SendToUser, such as a
+// mention, to the run loop, which sends it to every connection of the user on this node
+func (h *ChatHub) receiveUserFrame(userID uuid.UUID, data []byte) {
+	var frame models.WSMessage
+	if err := json.Unmarshal(data, &frame); err != nil {
+		log.Printf("Chat hub dropped a malformed frame for user %s: %v", userID, err)
+		return
+	}
+	h.notices <- userFrame{userID: userID.String(), frame: frame}
+}
+
+// deliverReminders sends due reminders to their users. Only the reminders of users connected to
+// this node are claimed, so with several replicas each reminder is delivered by a node its user is
+// connected to, and reminders of offline users wait until they connect.
+func (h *ChatHub) deliverReminders() {
+	ticker := time.NewTicker(reminderInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		var online []uuid.UUID
+		for _, p := range h.localRoster("") {
+			if p.Status == models.PresenceOffline {
+				continue
+			}
+			if id, err := uuid.Parse(p.UserID); err == nil {
+				online = append(online, id)
+			}
+		}
+
+		due, err := models.ClaimDueReminders(database.DB, online, now)
+		if err != nil {
+			log.Printf("Failed to claim due reminders: %v", err)
+			continue
+		}
+		for _, reminder := range due {
+			h.notices <- userFrame{
+				userID: reminder.UserID.String(),
+				frame: newFrame(models.WSTypeNotice, "", models.WSNoticePayload{
+					Room:    reminder.Room,
+					Command: "remind",
+					Content: "Reminder: " + reminder.Content,
+				}),
+			}
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"crm-communication-api/internal/broker"
+	"crm-communication-api/internal/command"
+	"crm-communication-api/models"
+)
+
+func TestCommandRepliesOnlyReachTheCaller(t *testing.T) {
+	db := openChatTest(t)
+
+	ada := models.User{Name: "Ada", Email: "ada@example.com", Role: "agent"}
+	bob := models.User{Name: "Bob", Email: "bob@example.com", Role: "admin"}
+	for _, user := range []*models.User{&ada, &bob} {
+		if err := db.Create(user).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	client := models.Client{Name: "Acme", Email: "acme@example.com", OwnerID: &ada.ID}
+	if err := db.Create(&client).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	hub := newChatHub(broker.NewInProcess(), nil, command.NewRouter(db, command.NewDraftStore(db)))
+	url := startChatServer(t, hub)
+	room := client.ID.String()
+	adaConn := dialChat(t, url, ada, room)
+	others := map[string]*websocket.Conn{
+		"Ada's other connection": dialChat(t, url, ada, room),
+		"Bob":                    dialChat(t, url, bob, room),
+	}
+	readFrame(t, adaConn, models.WSTypeSession)
+	for _, conn := range others {
+		readFrame(t, conn, models.WSTypeSession)
+	}
+
+	if err := adaConn.WriteJSON(newFrame(models.WSTypeSend, "1", models.WSSendPayload{Content: "/note Called back"})); err != nil {
+		t.Fatal(err)
+	}
+	var notice models.WSNoticePayload
+	if err := json.Unmarshal(readFrame(t, adaConn, models.WSTypeNotice).Payload, &notice); err != nil {
+		t.Fatal(err)
+	}
+	if notice.Command != "note" || notice.Room != room {
+		t.Errorf("Ada got the notice %+v, want the reply to /note in %s", notice, room)
+	}
+
+	// The other connections hear nothing of the command before the next message
+	if err := adaConn.WriteJSON(newFrame(models.WSTypeSend, "2", models.WSSendPayload{Content: "Hello"})); err != nil {
+		t.Fatal(err)
+	}
+	for name, conn := range others {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			var frame models.WSMessage
+			if err := conn.ReadJSON(&frame); err != nil {
+				t.Fatalf("%s got no message: %v", name, err)
+			}
+			if frame.Type == models.WSTypeNotice {
+				t.Errorf("%s got the notice of Ada's command", name)
+			}
+			var message ChatMessage
+			if frame.Type != models.WSTypeMessage || json.Unmarshal(frame.Payload, &message) != nil || message.Sender == "System" {
+				continue
+			}
+			if message.Content != "Hello" {
+				t.Errorf("%s got the message %q, want Hello", name, message.Content)
+			}
+			break
+		}
+	}
+
+	var stored int64
+	if err := db.Model(&models.Message{}).Where("content LIKE ?", "/note%").Count(&stored).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored != 0 {
+		t.Errorf("the command was stored as %d messages", stored)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+
+	"crm-communication-api/models"
+)
+
+// The hub is the resolvers.ChatRooms of the GraphQL resolvers: the changes published by the
+// resolvers, whether made through GraphQL or by the frame handlers, reach the rooms through these
+// methods. They send to the run loop, which fans the frames out to the other nodes too.
+
+// MessageChanged sends a message that was edited to its room, with its reactions and where its
+// mentions are, or the tombstone of a deleted message
+func (h *ChatHub) MessageChanged(message models.Message) {
+	room := message.ConversationID().String()
+	if message.IsDeleted() {
+		deleted := chatMessageFromModel(message, room)
+		deleted.History = false
+		h.publish <- roomFrame{room: room, frame: newFrame(models.WSTypeMessageDeleted, "", deleted)}
+		return
+	}
+
+	updated, err := loadLiveMessage(message.ID, room)
+	if err != nil {
+		log.Printf("Chat hub could not load changed message %s: %v", message.ID, err)
+		return
+	}
+	h.publish <- roomFrame{room: room, frame: newFrame(models.WSTypeMessageUpdated, "", updated)}
+}
+
+// ReactionChanged sends a reaction added to a message or removed from it to the message's room
+func (h *ChatHub) ReactionChanged(message models.Message, user models.User, emoji string, added bool, reactions []models.ReactionCount) {
+	frameType := models.WSTypeReactionAdded
+	if !added {
+		frameType = models.WSTypeReactionRemoved
+	}
+	room := message.ConversationID().String()
+	h.publish <- roomFrame{room: room, frame: newFrame(frameType, "", models.WSReactionEventPayload{
+		Room:      room,
+		MessageID: message.ID,
+		UserID:    user.ID.String(),
+		Name:      user.Name,
+		Emoji:     emoji,
+		Reactions: reactions,
+	})}
+}
+
+// MessageRead sends a read marker that moved forward to its room
+func (h *ChatHub) MessageRead(read models.MessageRead) {
+	room := read.ConversationID.String()
+	h.publish <- roomFrame{room: room, frame: newFrame(models.WSTypeRead, "", models.WSReadEventPayload{
+		Room:      room,
+		UserID:    read.UserID.String(),
+		Name:      read.User.Name,
+		MessageID: read.MessageID,
+		ReadAt:    read.ReadAt,
+	})}
+}
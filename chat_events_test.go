@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"gorm.io/gorm"
+
+	"crm-communication-api/database"
+	"crm-communication-api/internal/broker"
+	"crm-communication-api/internal/graphql/resolvers"
+	"crm-communication-api/internal/testdb"
+	"crm-communication-api/models"
+)
+
+// useEventsTest stores a user and a message in a client's channel in a test database, and makes
+// a running hub the chat rooms of the resolvers
+func useEventsTest(t *testing.T) (*ChatHub, models.User, models.Message) {
+	t.Helper()
+
+	db := testdb.Open(t, &models.User{}, &models.Client{}, &models.Message{}, &models.MessageMention{},
+		&models.MessageRevision{}, &models.MessageRead{}, &models.Reaction{}, &models.TimelineEvent{})
+	previous := database.DB
+	database.DB = db
+	t.Cleanup(func() { database.DB = previous })
+
+	hub := newChatHub(broker.NewInProcess(), nil, nil)
+	go hub.run()
+	resolvers.UseChatRooms(hub)
+	t.Cleanup(func() { resolvers.UseChatRooms(nil) })
+
+	user := models.User{Name: "Ada", Email: "ada@example.com", Role: "agent"}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	client := models.Client{Name: "Acme", Email: "acme@example.com"}
+	if err := db.Create(&client).Error; err != nil {
+		t.Fatal(err)
+	}
+	// The message is stored without its hooks, which number it and record it in the timeline
+	message := models.Message{Content: "Hello", SenderID: user.ID, ClientID: client.ID}
+	if err := db.Session(&gorm.Session{SkipHooks: true}).Create(&message).Error; err != nil {
+		t.Fatal(err)
+	}
+	return hub, user, message
+}
+
+func TestReadMarkersReachTheRoom(t *testing.T) {
+	hub, user, message := useEventsTest(t)
+	room := message.ConversationID().String()
+	bob := connectTestClient(hub, "bob", room)
+	waitForFrame(t, bob, models.WSTypeSession)
+
+	if _, err := resolvers.MarkMessageRead(database.DB, user.ID, &message); err != nil {
+		t.Fatal(err)
+	}
+
+	var read models.WSReadEventPayload
+	if err := json.Unmarshal(waitForFrame(t, bob, models.WSTypeRead).Payload, &read); err != nil {
+		t.Fatal(err)
+	}
+	if read.Room != room || read.UserID != user.ID.String() || read.Name != "Ada" || read.MessageID != message.ID {
+		t.Errorf("bob got %+v, want Ada's marker on the message", read)
+	}
+}
+
+func TestEditsReachTheRoom(t *testing.T) {
+	hub, user, message := useEventsTest(t)
+	room := message.ConversationID().String()
+	bob := connectTestClient(hub, "bob", room)
+	waitForFrame(t, bob, models.WSTypeSession)
+
+	if _, err := resolvers.EditMessageContent(database.DB, &message, user.ID, "Hello again"); err != nil {
+		t.Fatal(err)
+	}
+
+	var edited ChatMessage
+	if err := json.Unmarshal(waitForFrame(t, bob, models.WSTypeMessageUpdated).Payload, &edited); err != nil {
+		t.Fatal(err)
+	}
+	if edited.ID != message.ID.String() || edited.Content != "Hello again" || edited.EditedAt == nil {
+		t.Errorf("bob got %+v, want the edited message", edited)
+	}
+}
+
+func TestDeletesReachTheRoom(t *testing.T) {
+	hub, user, message := useEventsTest(t)
+	room := message.ConversationID().String()
+	bob := connectTestClient(hub, "bob", room)
+	waitForFrame(t, bob, models.WSTypeSession)
+
+	if err := resolvers.DeleteMessageBy(database.DB, &message, user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	var deleted ChatMessage
+	if err := json.Unmarshal(waitForFrame(t, bob, models.WSTypeMessageDeleted).Payload, &deleted); err != nil {
+		t.Fatal(err)
+	}
+	if deleted.ID != message.ID.String() || deleted.DeletedAt == nil || deleted.Content == "Hello" {
+		t.Errorf("bob got %+v, want the tombstone of the message", deleted)
+	}
+}
+
+func TestReactionsReachTheRoom(t *testing.T) {
+	hub, user, message := useEventsTest(t)
+	room := message.ConversationID().String()
+	bob := connectTestClient(hub, "bob", room)
+	waitForFrame(t, bob, models.WSTypeSession)
+
+	if err := resolvers.ChangeMessageReaction(database.DB, &message, user.ID, "👍", true); err != nil {
+		t.Fatal(err)
+	}
+
+	var reaction models.WSReactionEventPayload
+	if err := json.Unmarshal(waitForFrame(t, bob, models.WSTypeReactionAdded).Payload, &reaction); err != nil {
+		t.Fatal(err)
+	}
+	if reaction.MessageID != message.ID || reaction.Name != "Ada" || len(reaction.Reactions) != 1 || reaction.Reactions[0].Count != 1 {
+		t.Errorf("bob got %+v, want Ada's reaction counted on the message", reaction)
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"crm-communication-api/database"
+	"crm-communication-api/internal/mention"
+	"crm-communication-api/models"
+)
+
+const (
+	// defaultHistoryLimit is the number of messages replayed when a client does not ask for a page size
+	defaultHistoryLimit = 50
+
+	// maxHistoryLimit caps a single history page so it always fits in a client's send buffer
+	maxHistoryLimit = 200
+)
+
+// Errors returned when a frame or handshake names a room or message that cannot be used
+var (
+	errInvalidRoomID    = errors.New("invalid room ID")
+	errRoomNotFound     = errors.New("no client or chat thread with ID")
+	errInvalidMessageID = errors.New("invalid message ID")
+	errMessageNotFound  = errors.New("message not found")
+)
+
+// historyQuery describes which slice of a room's history a client wants.
+// With no AfterSeq, SinceID or Since the latest Limit messages are returned; BeforeID pages backwards.
+type historyQuery struct {
+	Limit    int
+	AfterSeq int64 // Messages with a greater sequence number, see loadMissedMessages
+	SinceID  string
+	Since    time.Time
+	BeforeID string
+}
+
+// historyQueryFromRequest reads the history part of the /ws/chat handshake:
+// history_limit, resume_from, since_id and since (RFC 3339)
+func historyQueryFromRequest(r *http.Request) (historyQuery, error) {
+	params := r.URL.Query()
+	query := historyQuery{SinceID: params.Get("since_id")}
+
+	if resumeFrom := params.Get("resume_from"); resumeFrom != "" {
+		seq, err := strconv.ParseInt(resumeFrom, 10, 64)
+		if err != nil || seq < 0 {
+			return query, fmt.Errorf("invalid resume_from %q", resumeFrom)
+		}
+		query.AfterSeq = seq
+	}
+
+	if limit := params.Get("history_limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			return query, fmt.Errorf("invalid history_limit %q", limit)
+		}
+		query.Limit = n
+	}
+
+	if since := params.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return query, fmt.Errorf("invalid since timestamp %q", since)
+		}
+		query.Since = t
+	}
+
+	return query, nil
+}
+
+// chatRoom is what a room ID refers to: the main channel of a CRM client, a ChatThread of that
+// client, or the reply thread of a message
+type chatRoom struct {
+	ClientID uuid.UUID
+	ThreadID *uuid.UUID
+	ParentID *uuid.UUID
+}
+
+// resolveRoom maps a room ID to the conversation it names. The ID is looked up as a ChatThread,
+// then a CRM client, then a top-level message whose replies form the room.
+func resolveRoom(room string) (chatRoom, error) {
+	roomID, err := uuid.Parse(room)
+	if err != nil {
+		return chatRoom{}, fmt.Errorf("%w %q", errInvalidRoomID, room)
+	}
+
+	var thread models.ChatThread
+	err = database.DB.Where("id = ?", roomID).First(&thread).Error
+	if err == nil {
+		return chatRoom{ClientID: thread.ClientID, ThreadID: &thread.ID}, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return chatRoom{}, err
+	}
+
+	var client models.Client
+	err = database.DB.Where("id = ?", roomID).First(&client).Error
+	if err == nil {
+		return chatRoom{ClientID: client.ID}, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return chatRoom{}, err
+	}
+
+	var parent models.Message
+	if err := database.DB.Where("id = ? AND parent_id IS NULL", roomID).First(&parent).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return chatRoom{}, fmt.Errorf("%w %s", errRoomNotFound, room)
+		}
+		return chatRoom{}, err
+	}
+	return chatRoom{ClientID: parent.ClientID, ThreadID: parent.ThreadID, ParentID: &parent.ID}, nil
+}
+
+// roomMessages scopes a query to the messages of a room. Client rooms only contain messages
+// that are not part of a chat thread, and replies only appear in their parent's reply thread.
+func roomMessages(room string) (*gorm.DB, error) {
+	target, err := resolveRoom(room)
+	if err != nil {
+		return nil, err
+	}
+
+	query := database.DB.Model(&models.Message{}).Where("messages.client_id = ?", target.ClientID)
+	if target.ParentID != nil {
+		return query.Where("messages.parent_id = ?", *target.ParentID), nil
+	}
+	query = query.Where("messages.parent_id IS NULL")
+	if target.ThreadID != nil {
+		return query.Where("messages.thread_id = ?", *target.ThreadID), nil
+	}
+	return query.Where("messages.thread_id IS NULL"), nil
+}
+
+// loadRoomHistory loads a page of persisted messages for a room, oldest first
+func loadRoomHistory(room string, query historyQuery) ([]ChatMessage, error) {
+	limit := query.Limit
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+	if limit > maxHistoryLimit {
+		limit = maxHistoryLimit
+	}
+
+	scope, err := roomMessages(room)
+	if err != nil {
+		return nil, err
+	}
+	scope = scope.Preload("Sender").Preload("Mentions.User").Limit(limit)
+
+	var dbMessages []models.Message
+	switch {
+	case query.AfterSeq > 0:
+		err = scope.Where("messages.seq > ?", query.AfterSeq).
+			Order("messages.seq ASC").
+			Find(&dbMessages).Error
+		if err != nil {
+			return nil, err
+		}
+
+	case query.BeforeID != "":
+		anchor, err := findAnchorMessage(query.BeforeID)
+		if err != nil {
+			return nil, err
+		}
+		err = scope.Where("messages.created_at < ? OR (messages.created_at = ? AND messages.id < ?)", anchor.CreatedAt, anchor.CreatedAt, anchor.ID).
+			Order("messages.created_at DESC, messages.id DESC").
+			Find(&dbMessages).Error
+		if err != nil {
+			return nil, err
+		}
+		reverseMessages(dbMessages)
+
+	case query.SinceID != "":
+		anchor, err := findAnchorMessage(query.SinceID)
+		if err != nil {
+			return nil, err
+		}
+		err = scope.Where("messages.created_at > ? OR (messages.created_at = ? AND messages.id > ?)", anchor.CreatedAt, anchor.CreatedAt, anchor.ID).
+			Order("messages.created_at ASC, messages.id ASC").
+			Find(&dbMessages).Error
+		if err != nil {
+			return nil, err
+		}
+
+	case !query.Since.IsZero():
+		err = scope.Where("messages.created_at > ?", query.Since).
+			Order("messages.created_at ASC, messages.id ASC").
+			Find(&dbMessages).Error
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		err = scope.Order("messages.created_at DESC, messages.id DESC").Find(&dbMessages).Error
+		if err != nil {
+			return nil, err
+		}
+		reverseMessages(dbMessages)
+	}
+
+	messageIDs := make([]uuid.UUID, 0, len(dbMessages))
+	for _, m := range dbMessages {
+		messageIDs = append(messageIDs, m.ID)
+	}
+	reactions, err := models.ReactionCounts(database.DB, messageIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Mentions are resolved for the whole page at once
+	contents := make([]string, 0, len(dbMessages))
+	for _, m := range dbMessages {
+		contents = append(contents, m.Content)
+	}
+	mentions, err := mention.ResolveAll(database.DB, contents)
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([]ChatMessage, 0, len(dbMessages))
+	for i, m := range dbMessages {
+		message := chatMessageFromModel(m, room)
+		message.Reactions = reactions[m.ID]
+		message.MentionSpans = mentions[i].Mentions
+		history = append(history, message)
+	}
+	return history, nil
+}
+
+// loadMissedMessages loads every message of a room after a sequence number, oldest first, in pages
+// of maxHistoryLimit. Unlike other history queries it is not capped, so a client resuming from the
+// last sequence number it received gets exactly the messages it missed.
+func loadMissedMessages(room string, afterSeq int64) ([]ChatMessage, error) {
+	var missed []ChatMessage
+	for {
+		page, err := loadRoomHistory(room, historyQuery{AfterSeq: afterSeq, Limit: maxHistoryLimit})
+		if err != nil {
+			return nil, err
+		}
+		missed = append(missed, page...)
+		if len(page) < maxHistoryLimit {
+			return missed, nil
+		}
+		afterSeq = page[len(page)-1].Seq
+	}
+}
+
+// loadHandshakeHistory loads the messages a new connection replays: the ones it missed when it
+// resumes from a sequence number, otherwise the page the handshake asked for
+func loadHandshakeHistory(room string, query historyQuery) ([]ChatMessage, error) {
+	if query.AfterSeq > 0 {
+		return loadMissedMessages(room, query.AfterSeq)
+	}
+	return loadRoomHistory(room, query)
+}
+
+// withReplay puts replayed messages ahead of the frames queued for a connection while they were
+// loading. A message both replayed and delivered live is only kept in the replay.
+func withReplay(replay []ChatMessage, queued []models.WSMessage) []models.WSMessage {
+	replayed := make(map[string]bool, len(replay))
+	frames := make([]models.WSMessage, 0, len(replay)+len(queued))
+	for _, msg := range replay {
+		replayed[msg.ID] = true
+		frames = append(frames, newFrame(models.WSTypeMessage, "", msg))
+	}
+
+	for _, frame := range queued {
+		if frame.Type == models.WSTypeMessage {
+			var live struct {
+				ID string `json:"id"`
+			}
+			if json.Unmarshal(frame.Payload, &live) == nil && replayed[live.ID] {
+				continue
+			}
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// findAnchorMessage looks up the message a history page is relative to
+func findAnchorMessage(id string) (*models.Message, error) {
+	messageID, err := uuid.Parse(id)
+	if err != nil {
+		return nil, fmt.Errorf("%w %q", errInvalidMessageID, id)
+	}
+
+	var anchor models.Message
+	if err := database.DB.Where("id = ?", messageID).First(&anchor).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("%w: %s", errMessageNotFound, id)
+		}
+		return nil, err
+	}
+	return &anchor, nil
+}
+
+// chatMessageFromModel converts a persisted message to the form sent over the socket
+func chatMessageFromModel(m models.Message, room string) ChatMessage {
+	mentions := make([]string, 0, len(m.Mentions))
+	for _, mention := range m.Mentions {
+		mentions = append(mentions, mention.User.Name)
+	}
+
+	message := ChatMessage{
+		ID:          m.ID.String(),
+		Sender:      m.Sender.Name,
+		Content:     m.Content,
+		Mentions:    mentions,
+		Room:        room,
+		Seq:         m.Seq,
+		ReplyCount:  m.ReplyCount,
+		LastReplyAt: m.LastReplyAt,
+		History:     true,
+		Timestamp:   m.CreatedAt,
+		EditedAt:    m.EditedAt,
+		DeletedAt:   m.DeletedAt,
+	}
+	if m.ParentID != nil {
+		message.ParentID = m.ParentID.String()
+	}
+	return message
+}
+
+// reverseMessages reverses a slice of messages in place
+func reverseMessages(messages []models.Message) {
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+}
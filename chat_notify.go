@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+
+	"crm-communication-api/database"
+	"crm-communication-api/internal/notify"
+	"crm-communication-api/models"
+)
+
+const (
+	// defaultDigestInterval is how often digests are sent when DIGEST_INTERVAL is not set
+	defaultDigestInterval = 15 * time.Minute
+
+	// defaultSMTPPort is the port used when SMTP_PORT is not set
+	defaultSMTPPort = "587"
+)
+
+// newNotifier creates the notifier queueing what offline users miss and emailing them digests.
+// Digests are sent every DIGEST_INTERVAL (a duration such as 15m or 1h) through the SMTP server
+// at SMTP_HOST, or written to the log when SMTP_HOST is not set.
+func newNotifier(hub *ChatHub) *notify.Notifier {
+	interval := defaultDigestInterval
+	if value := os.Getenv("DIGEST_INTERVAL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			log.Fatalf("Invalid DIGEST_INTERVAL %q, use a duration such as 15m", value)
+		}
+		interval = parsed
+	}
+
+	var sender notify.Sender = notify.LogSender{}
+	if host := os.Getenv("SMTP_HOST"); host != "" {
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = defaultSMTPPort
+		}
+		from := os.Getenv("SMTP_FROM")
+		if from == "" {
+			log.Fatal("SMTP_FROM must be set along with SMTP_HOST")
+		}
+		sender = notify.NewSMTPSender(net.JoinHostPort(host, port), os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), from)
+		log.Printf("Emailing notification digests through %s every %s", host, interval)
+	}
+
+	return notify.New(database.DB, sender, hub, interval)
+}
+
+// Online reports whether a user has a connection to any node, for the notifier. Users whose node
+// stopped count as online until their presence expires.
+func (h *ChatHub) Online(userID uuid.UUID) bool {
+	id := userID.String()
+	for _, p := range h.roster("") {
+		if p.UserID == id {
+			return p.Status != models.PresenceOffline
+		}
+	}
+	return false
+}
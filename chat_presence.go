@@ -0,0 +1,464 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"crm-communication-api/auth"
+	"crm-communication-api/models"
+)
+
+const (
+	// awayAfter is how long a connected user can stay silent before being reported as away
+	awayAfter = 5 * time.Minute
+
+	// typingTimeout ends a typing indicator the client never stopped, e.g. because it disconnected
+	typingTimeout = 6 * time.Second
+
+	// presenceSweepInterval is how often the hub looks for away users and expired typing indicators
+	presenceSweepInterval = time.Second
+
+	// presenceShareInterval is how often the hub shares the presence of its rooms' members with
+	// the other nodes again, for nodes started since
+	presenceShareInterval = 30 * time.Second
+
+	// remotePresenceTTL is how long presence shared by another node lasts unless shared again, so
+	// that the users of a node that stopped go offline
+	remotePresenceTTL = 3 * presenceShareInterval
+)
+
+// userPresence is the hub's view of one user across all their connections
+type userPresence struct {
+	userID   string
+	name     string
+	status   string
+	lastSeen time.Time
+	clients  map[*ChatClient]bool
+}
+
+// remoteMemberKey identifies a room member connected to another node. A user connected to
+// several nodes is a member once per node.
+type remoteMemberKey struct {
+	origin string
+	userID string
+}
+
+// remoteMember is the presence of a room member connected to another node, as that node shared it
+type remoteMember struct {
+	presence  models.WSPresencePayload
+	expiresAt time.Time
+}
+
+// typingUpdate reports that a client started or stopped typing in a room
+type typingUpdate struct {
+	client *ChatClient
+	room   string
+	typing bool
+}
+
+// rosterRequest asks the hub for the presence of a room's members, or of every known user
+// when room is empty, on every node or only on this one
+type rosterRequest struct {
+	room  string
+	local bool
+	reply chan []models.WSPresencePayload
+}
+
+// payload returns the presence frame payload for a user
+func (p *userPresence) payload() models.WSPresencePayload {
+	return models.WSPresencePayload{
+		UserID:   p.userID,
+		Name:     p.name,
+		Status:   p.status,
+		LastSeen: p.lastSeen,
+	}
+}
+
+// rooms returns the rooms any of the user's connections belong to
+func (p *userPresence) rooms() []string {
+	seen := make(map[string]bool)
+	rooms := []string{}
+	for client := range p.clients {
+		for _, room := range client.subscribedRooms() {
+			if !seen[room] {
+				seen[room] = true
+				rooms = append(rooms, room)
+			}
+		}
+	}
+	return rooms
+}
+
+// broadcastFrame sends a frame to every member of a room except one client, which may be nil,
+// and keeps it for the room's slow connections waiting to be resumed. It must only be called from
+// the run loop.
+func (h *ChatHub) broadcastFrame(room string, frame models.WSMessage, except *ChatClient) {
+	// Park first: a client kicked below already has the frame in its parked queue
+	h.park(room, frame)
+	for client := range h.rooms[room] {
+		if client == except {
+			continue
+		}
+		h.push(client, frame)
+	}
+}
+
+// announcePresence sends a user's presence to the given rooms, on every node. It must only be
+// called from the run loop.
+func (h *ChatHub) announcePresence(p *userPresence, rooms []string) {
+	frame := newFrame(models.WSTypePresence, "", p.payload())
+	for _, room := range rooms {
+		h.fanOut(room, frame, nil)
+	}
+}
+
+// trackRemotePresence records the presence of a room member connected to another node, and
+// reports whether it changed so that presence shared again is not announced again. Members going
+// offline are forgotten. It must only be called from the run loop.
+func (h *ChatHub) trackRemotePresence(rf roomFrame) bool {
+	var presence models.WSPresencePayload
+	if err := json.Unmarshal(rf.frame.Payload, &presence); err != nil {
+		log.Printf("Chat hub dropped a malformed presence frame from the broker: %v", err)
+		return false
+	}
+
+	key := remoteMemberKey{origin: rf.origin, userID: presence.UserID}
+	members := h.remoteMembers[rf.room]
+	previous, known := members[key]
+	if presence.Status == models.PresenceOffline {
+		delete(members, key)
+		if len(members) == 0 {
+			delete(h.remoteMembers, rf.room)
+		}
+		return true
+	}
+
+	if members == nil {
+		members = make(map[remoteMemberKey]remoteMember)
+		h.remoteMembers[rf.room] = members
+	}
+	members[key] = remoteMember{presence: presence, expiresAt: time.Now().Add(remotePresenceTTL)}
+	return !known || previous.presence.Status != presence.Status
+}
+
+// sharePresence shares the presence of the members of this node's rooms with the other nodes
+// again. They only announce what changed, and keep it until remotePresenceTTL has passed. It must
+// only be called from the run loop.
+func (h *ChatHub) sharePresence(now time.Time) {
+	h.presenceSharedAt = now
+	for room := range h.rooms {
+		for _, member := range h.localPresence(room) {
+			h.share(room, newFrame(models.WSTypePresence, "", member))
+		}
+	}
+}
+
+// expireRemoteMembers takes offline the members of other nodes whose presence was not shared
+// again in time. It must only be called from the run loop.
+func (h *ChatHub) expireRemoteMembers(now time.Time) {
+	for room, members := range h.remoteMembers {
+		for key, member := range members {
+			if now.Before(member.expiresAt) {
+				continue
+			}
+			delete(members, key)
+			offline := member.presence
+			offline.Status = models.PresenceOffline
+			h.broadcastFrame(room, newFrame(models.WSTypePresence, "", offline), nil)
+		}
+		if len(members) == 0 {
+			delete(h.remoteMembers, room)
+		}
+	}
+}
+
+// trackConnect marks a newly registered client's user online. The client's room hears of it when
+// the client is introduced; the rooms of the user's other connections only hear of an away user
+// coming back. It must only be called from the run loop.
+func (h *ChatHub) trackConnect(client *ChatClient) {
+	p, exists := h.presence[client.userID]
+	if !exists {
+		p = &userPresence{userID: client.userID, clients: make(map[*ChatClient]bool)}
+		h.presence[client.userID] = p
+	}
+	wasOnline := len(p.clients) > 0 && p.status == models.PresenceOnline
+	p.clients[client] = true
+	p.name = client.username
+	p.status = models.PresenceOnline
+	p.lastSeen = time.Now()
+
+	if wasOnline {
+		return
+	}
+	rooms := []string{}
+	for _, room := range p.rooms() {
+		if room != client.room {
+			rooms = append(rooms, room)
+		}
+	}
+	h.announcePresence(p, rooms)
+}
+
+// trackDisconnect forgets a removed client and marks its user offline once their last
+// connection is gone. rooms are the rooms the client belonged to. It must only be called
+// from the run loop.
+func (h *ChatHub) trackDisconnect(client *ChatClient, rooms []string) {
+	p, exists := h.presence[client.userID]
+	if !exists {
+		return
+	}
+	delete(p.clients, client)
+	if len(p.clients) > 0 {
+		return
+	}
+
+	for _, room := range rooms {
+		h.stopTyping(room, p)
+	}
+	p.status = models.PresenceOffline
+	p.lastSeen = time.Now()
+	h.announcePresence(p, rooms)
+}
+
+// introduce tells a room that a client joined it and sends the client the presence of the
+// room's other members. It must only be called from the run loop.
+func (h *ChatHub) introduce(client *ChatClient, room string) {
+	p, exists := h.presence[client.userID]
+	if !exists {
+		return
+	}
+	h.announcePresence(p, []string{room})
+
+	// Announcing may have dropped the client if its buffer was full
+	if _, ok := h.clients[client]; !ok {
+		return
+	}
+
+	frames := []models.WSMessage{}
+	for _, member := range h.roomRoster(room) {
+		if member.UserID != client.userID {
+			frames = append(frames, newFrame(models.WSTypePresence, "", member))
+		}
+	}
+	for _, frame := range frames {
+		if !h.push(client, frame) {
+			return
+		}
+	}
+}
+
+// touch records activity from a client, bringing an away user back online.
+// It must only be called from the run loop.
+func (h *ChatHub) touch(client *ChatClient) {
+	p, exists := h.presence[client.userID]
+	if !exists {
+		return
+	}
+	p.lastSeen = time.Now()
+	if p.status == models.PresenceAway {
+		p.status = models.PresenceOnline
+		h.announcePresence(p, p.rooms())
+	}
+}
+
+// setTyping starts or stops a typing indicator. Starting an indicator that is already shown
+// only extends it. It must only be called from the run loop.
+func (h *ChatHub) setTyping(update typingUpdate) {
+	p, exists := h.presence[update.client.userID]
+	if !exists || !h.rooms[update.room][update.client] {
+		return
+	}
+	if !update.typing {
+		h.stopTyping(update.room, p)
+		return
+	}
+
+	typists, exists := h.typists[update.room]
+	if !exists {
+		typists = make(map[string]time.Time)
+		h.typists[update.room] = typists
+	}
+	_, alreadyTyping := typists[p.userID]
+	typists[p.userID] = time.Now().Add(typingTimeout)
+	if !alreadyTyping {
+		h.fanOut(update.room, h.typingFrame(models.WSTypeTypingStarted, update.room, p), update.client)
+	}
+}
+
+// stopTyping clears a user's typing indicator in a room, if shown.
+// It must only be called from the run loop.
+func (h *ChatHub) stopTyping(room string, p *userPresence) {
+	typists, exists := h.typists[room]
+	if !exists {
+		return
+	}
+	if _, typing := typists[p.userID]; !typing {
+		return
+	}
+	delete(typists, p.userID)
+	if len(typists) == 0 {
+		delete(h.typists, room)
+	}
+	h.fanOut(room, h.typingFrame(models.WSTypeTypingStopped, room, p), nil)
+}
+
+// typingFrame builds a typing_started or typing_stopped frame
+func (h *ChatHub) typingFrame(frameType, room string, p *userPresence) models.WSMessage {
+	return newFrame(frameType, "", models.WSTypingEventPayload{Room: room, UserID: p.userID, Name: p.name})
+}
+
+// sweepPresence marks silent users away and expires stale typing indicators.
+// It must only be called from the run loop.
+func (h *ChatHub) sweepPresence(now time.Time) {
+	for _, p := range h.presence {
+		if p.status == models.PresenceOnline && now.Sub(p.lastSeen) > awayAfter {
+			p.status = models.PresenceAway
+			h.announcePresence(p, p.rooms())
+		}
+	}
+
+	for room, typists := range h.typists {
+		for userID, expiresAt := range typists {
+			if now.After(expiresAt) {
+				h.stopTyping(room, h.presence[userID])
+			}
+		}
+	}
+
+	h.expireRemoteMembers(now)
+	if now.Sub(h.presenceSharedAt) >= presenceShareInterval {
+		h.sharePresence(now)
+	}
+}
+
+// roomRoster returns the presence of a room's members, or of every known user when room is
+// empty, on every node and sorted by name. Users connected to several nodes get their most present
+// status. It must only be called from the run loop.
+func (h *ChatHub) roomRoster(room string) []models.WSPresencePayload {
+	members := make(map[string]models.WSPresencePayload)
+	add := func(p models.WSPresencePayload) {
+		current, exists := members[p.UserID]
+		if !exists || presenceRank(p.Status) > presenceRank(current.Status) ||
+			(p.Status == current.Status && p.LastSeen.After(current.LastSeen)) {
+			members[p.UserID] = p
+		}
+	}
+	for _, p := range h.localPresence(room) {
+		add(p)
+	}
+	for remoteRoom, remote := range h.remoteMembers {
+		if room != "" && remoteRoom != room {
+			continue
+		}
+		for _, member := range remote {
+			add(member.presence)
+		}
+	}
+
+	roster := make([]models.WSPresencePayload, 0, len(members))
+	for _, p := range members {
+		roster = append(roster, p)
+	}
+	sort.Slice(roster, func(i, j int) bool {
+		return roster[i].Name < roster[j].Name
+	})
+	return roster
+}
+
+// localPresence returns the presence of a room's members connected to this node, or of every
+// user seen on this node when room is empty. It must only be called from the run loop.
+func (h *ChatHub) localPresence(room string) []models.WSPresencePayload {
+	presence := []models.WSPresencePayload{}
+	if room == "" {
+		for _, p := range h.presence {
+			presence = append(presence, p.payload())
+		}
+		return presence
+	}
+
+	seen := make(map[string]bool)
+	for client := range h.rooms[room] {
+		if seen[client.userID] {
+			continue
+		}
+		seen[client.userID] = true
+		if p, exists := h.presence[client.userID]; exists {
+			presence = append(presence, p.payload())
+		}
+	}
+	return presence
+}
+
+// presenceRank orders statuses from the least to the most present
+func presenceRank(status string) int {
+	switch status {
+	case models.PresenceOnline:
+		return 2
+	case models.PresenceAway:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// roster asks the run loop for the presence roster of every node; it is safe to call from any
+// goroutine
+func (h *ChatHub) roster(room string) []models.WSPresencePayload {
+	return h.requestRoster(rosterRequest{room: room})
+}
+
+// localRoster asks the run loop for the presence of the users connected to this node; it is safe
+// to call from any goroutine
+func (h *ChatHub) localRoster(room string) []models.WSPresencePayload {
+	return h.requestRoster(rosterRequest{room: room, local: true})
+}
+
+// requestRoster sends a roster request to the run loop and waits for the reply
+func (h *ChatHub) requestRoster(req rosterRequest) []models.WSPresencePayload {
+	req.reply = make(chan []models.WSPresencePayload, 1)
+	h.rosterRequests <- req
+	return <-req.reply
+}
+
+// servePresence handles GET /api/presence?room=<client or thread ID>, returning who of the
+// room's members is online, away or offline. Only users who may join the room can read it.
+func servePresence(hub *ChatHub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	authHeader := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		http.Error(w, "Unauthorized: Missing token", http.StatusUnauthorized)
+		return
+	}
+	claims, err := auth.ValidateAccessToken(strings.TrimPrefix(authHeader, "Bearer "))
+	if err != nil {
+		http.Error(w, "Unauthorized: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	// The roster of every user would show the members of rooms the caller cannot see
+	room := r.URL.Query().Get("room")
+	if room == "" {
+		http.Error(w, "room is required", http.StatusBadRequest)
+		return
+	}
+	if err := checkRoomAccess(claims.UserID, room); err != nil {
+		if errors.Is(err, errRoomForbidden) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+		} else {
+			http.Error(w, "failed to check room access", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hub.roster(room))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"crm-communication-api/internal/broker"
+	"crm-communication-api/models"
+)
+
+// presenceFrames drains a client's frames and returns the presence frames about a user
+func presenceFrames(t *testing.T, client *ChatClient, userID string) []models.WSPresencePayload {
+	t.Helper()
+
+	var frames []models.WSPresencePayload
+	for _, frame := range client.send.Drain() {
+		if frame.Type != models.WSTypePresence {
+			continue
+		}
+		var presence models.WSPresencePayload
+		if err := json.Unmarshal(frame.Payload, &presence); err != nil {
+			t.Fatal(err)
+		}
+		if presence.UserID == userID {
+			frames = append(frames, presence)
+		}
+	}
+	return frames
+}
+
+func TestConnectingAnnouncesPresenceOnce(t *testing.T) {
+	hub := newChatHub(broker.NewInProcess(), nil, nil)
+	go hub.run()
+
+	room := uuid.New().String()
+	alice := connectTestClient(hub, "alice", room)
+	waitForFrame(t, alice, models.WSTypeSession)
+
+	// Registering another client waits for the run loop to be done with the previous one
+	connectTestClient(hub, "bob", room)
+	connectTestClient(hub, "carol", uuid.New().String())
+	if frames := presenceFrames(t, alice, "bob"); len(frames) != 1 || frames[0].Status != models.PresenceOnline {
+		t.Fatalf("alice got %+v about bob connecting, want one online frame", frames)
+	}
+
+	// A second connection of an online user elsewhere changes nothing for the room
+	connectTestClient(hub, "bob", uuid.New().String())
+	connectTestClient(hub, "carol", uuid.New().String())
+	if frames := presenceFrames(t, alice, "bob"); len(frames) != 0 {
+		t.Errorf("alice got %+v about bob connecting again elsewhere, want none", frames)
+	}
+}
+
+func TestPresenceReachesOtherHubs(t *testing.T) {
+	b := broker.NewInProcess()
+	hubA := newChatHub(b, nil, nil)
+	hubB := newChatHub(b, nil, nil)
+	go hubA.run()
+	go hubB.run()
+
+	room := uuid.New().String()
+	alice := connectTestClient(hubA, "alice", room)
+	waitForFrame(t, alice, models.WSTypeSession)
+	bob := connectTestClient(hubB, "bob", room)
+	waitForFrame(t, bob, models.WSTypeSession)
+
+	// Bob's presence reaches alice through the broker
+	for {
+		var presence models.WSPresencePayload
+		if err := json.Unmarshal(waitForFrame(t, alice, models.WSTypePresence).Payload, &presence); err != nil {
+			t.Fatal(err)
+		}
+		if presence.UserID == "bob" {
+			break
+		}
+	}
+
+	roster := hubA.roster(room)
+	if len(roster) != 2 || roster[0].UserID != "alice" || roster[1].UserID != "bob" || roster[1].Status != models.PresenceOnline {
+		t.Errorf("hub A roster = %+v, want alice and bob online", roster)
+	}
+	if local := hubA.localRoster(room); len(local) != 1 || local[0].UserID != "alice" {
+		t.Errorf("hub A local roster = %+v, want only alice", local)
+	}
+}
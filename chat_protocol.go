@@ -0,0 +1,485 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"crm-communication-api/auth"
+	"crm-communication-api/database"
+	"crm-communication-api/internal/command"
+	"crm-communication-api/internal/graphql/resolvers"
+	"crm-communication-api/internal/mention"
+	"crm-communication-api/internal/rbac"
+	"crm-communication-api/models"
+)
+
+// newFrame wraps a payload in a protocol envelope
+func newFrame(frameType, id string, payload interface{}) models.WSMessage {
+	frame := models.WSMessage{
+		Version: models.WSProtocolVersion,
+		Type:    frameType,
+		ID:      id,
+	}
+	if payload != nil {
+		frame.Payload, _ = json.Marshal(payload)
+	}
+	return frame
+}
+
+// reply queues frames for this client only. Frames go through the hub so they are never
+// written to a send channel the hub has already closed.
+func (c *ChatClient) reply(frames ...models.WSMessage) {
+	c.hub.deliver <- chatDelivery{client: c, frames: frames}
+}
+
+// replyAck confirms the frame with the given ID was processed
+func (c *ChatClient) replyAck(id string, ack models.WSAckPayload) {
+	c.reply(newFrame(models.WSTypeAck, id, ack))
+}
+
+// replyError rejects the frame with the given ID
+func (c *ChatClient) replyError(id, code, message string) {
+	c.reply(newFrame(models.WSTypeError, id, models.WSErrorPayload{Code: code, Message: message}))
+}
+
+// replyFailure rejects a frame because processing it returned err
+func (c *ChatClient) replyFailure(id string, err error) {
+	c.replyError(id, frameErrorCode(err), err.Error())
+}
+
+// frameErrorCode maps an error from the chat helpers to an error frame code
+func frameErrorCode(err error) string {
+	switch {
+	case errors.Is(err, errInvalidRoomID), errors.Is(err, errInvalidMessageID), errors.Is(err, models.ErrInvalidParent),
+		errors.Is(err, models.ErrInvalidReaction):
+		return models.WSErrInvalidPayload
+	case errors.Is(err, errRoomNotFound), errors.Is(err, errMessageNotFound):
+		return models.WSErrNotFound
+	case errors.Is(err, errRoomForbidden):
+		return models.WSErrForbidden
+	default:
+		return models.WSErrInternal
+	}
+}
+
+// handleFrame dispatches an inbound frame. It returns false when the connection must be closed.
+func (c *ChatClient) handleFrame(frame models.WSMessage) bool {
+	if frame.Version != models.WSProtocolVersion {
+		c.replyError(frame.ID, models.WSErrUnsupportedVersion,
+			fmt.Sprintf("protocol version %d is not supported, use %d", frame.Version, models.WSProtocolVersion))
+		return true
+	}
+
+	switch frame.Type {
+	case models.WSTypeAuth:
+		return c.handleAuth(frame)
+	case models.WSTypeSend:
+		c.handleSend(frame)
+	case models.WSTypeSubscribe:
+		c.handleSubscribe(frame)
+	case models.WSTypeUnsubscribe:
+		c.handleUnsubscribe(frame)
+	case models.WSTypeLoadMore:
+		c.handleLoadMore(frame)
+	case models.WSTypeTyping:
+		c.handleTyping(frame)
+	case models.WSTypeRead:
+		c.handleRead(frame)
+	case models.WSTypeEdit:
+		c.handleEdit(frame)
+	case models.WSTypeDelete:
+		c.handleDelete(frame)
+	case models.WSTypeReact:
+		c.handleReaction(frame, true)
+	case models.WSTypeUnreact:
+		c.handleReaction(frame, false)
+	case models.WSTypePing:
+		c.reply(newFrame(models.WSTypePong, frame.ID, nil))
+	default:
+		c.replyError(frame.ID, models.WSErrUnknownType, fmt.Sprintf("unknown frame type %q", frame.Type))
+	}
+	return true
+}
+
+// decodePayload unmarshals a frame's payload, answering with an error frame if it is malformed
+func (c *ChatClient) decodePayload(frame models.WSMessage, payload interface{}) bool {
+	if len(frame.Payload) == 0 || json.Unmarshal(frame.Payload, payload) != nil {
+		c.replyError(frame.ID, models.WSErrInvalidPayload, fmt.Sprintf("invalid %s payload", frame.Type))
+		return false
+	}
+	return true
+}
+
+// targetRoom returns the room a frame applies to, defaulting to the handshake room,
+// and answers with an error frame if the connection has not joined it
+func (c *ChatClient) targetRoom(frame models.WSMessage, room string) (string, bool) {
+	if room == "" {
+		room = c.room
+	}
+	if !c.isSubscribed(room) {
+		c.replyError(frame.ID, models.WSErrNotSubscribed, fmt.Sprintf("subscribe to room %s first", room))
+		return "", false
+	}
+	return room, true
+}
+
+// handleAuth replaces the connection's access token before it expires
+func (c *ChatClient) handleAuth(frame models.WSMessage) bool {
+	var payload models.WSAuthPayload
+	if !c.decodePayload(frame, &payload) {
+		return true
+	}
+
+	claims, err := auth.ValidateAccessToken(payload.Token)
+	if err != nil || claims.UserID != c.userID {
+		closeWithCode(c.conn, closeUnauthorized, "invalid token")
+		return false
+	}
+
+	c.reauth <- tokenExpiry(claims)
+	c.replyAck(frame.ID, models.WSAckPayload{})
+	return true
+}
+
+// handleSend persists and broadcasts a new message, acknowledging it with the stored message ID
+func (c *ChatClient) handleSend(frame models.WSMessage) {
+	var payload models.WSSendPayload
+	if !c.decodePayload(frame, &payload) {
+		return
+	}
+	if strings.TrimSpace(payload.Content) == "" {
+		c.replyError(frame.ID, models.WSErrInvalidPayload, "content must not be empty")
+		return
+	}
+	room, ok := c.targetRoom(frame, payload.Room)
+	if !ok {
+		return
+	}
+	if !c.allowMessage(frame, room) {
+		return
+	}
+
+	// Slash commands are answered to the sender only and never posted
+	if c.handleCommand(frame, room, payload.Content) {
+		return
+	}
+	payload.Content = command.Unescape(payload.Content)
+
+	// Create a new message; its mentions are resolved when it is posted
+	message := ChatMessage{
+		ID:        uuid.New().String(),
+		Sender:    c.username,
+		SenderID:  c.userID,
+		Content:   payload.Content,
+		Room:      room,
+		Timestamp: time.Now(),
+	}
+
+	// Store the message, then send it to the hub for broadcasting
+	message, err := postMessage(c.hub, message)
+	if err != nil {
+		c.replyFailure(frame.ID, err)
+		return
+	}
+	c.replyAck(frame.ID, models.WSAckPayload{MessageID: message.ID})
+
+	c.hub.runBots(message)
+}
+
+// handleSubscribe joins an additional room and replays its recent history
+func (c *ChatClient) handleSubscribe(frame models.WSMessage) {
+	var payload models.WSRoomPayload
+	if !c.decodePayload(frame, &payload) {
+		return
+	}
+	if c.isSubscribed(payload.Room) {
+		c.replyAck(frame.ID, models.WSAckPayload{})
+		return
+	}
+	if err := checkRoomAccess(c.userID, payload.Room); err != nil {
+		c.replyFailure(frame.ID, err)
+		return
+	}
+	if payload.ResumeFrom > 0 {
+		c.resubscribe(frame, payload)
+		return
+	}
+
+	// Join before loading the history so no message falls in between, as in resubscribe
+	c.hub.subscribe <- roomSubscription{client: c, room: payload.Room}
+
+	history, err := loadRoomHistory(payload.Room, historyQuery{})
+	if err != nil {
+		c.hub.unsubscribe <- roomSubscription{client: c, room: payload.Room}
+		c.replyFailure(frame.ID, err)
+		return
+	}
+
+	frames := make([]models.WSMessage, 0, len(history)+1)
+	for _, msg := range history {
+		frames = append(frames, newFrame(models.WSTypeMessage, "", msg))
+	}
+	frames = append(frames, newFrame(models.WSTypeAck, frame.ID, models.WSAckPayload{Count: len(history)}))
+	c.reply(frames...)
+}
+
+// resubscribe joins a room and replays every message after a sequence number. The room is joined
+// before the replay loads so no message falls in between; a message posted meanwhile can arrive
+// both live and in the replay.
+func (c *ChatClient) resubscribe(frame models.WSMessage, payload models.WSRoomPayload) {
+	if _, err := resolveRoom(payload.Room); err != nil {
+		c.replyFailure(frame.ID, err)
+		return
+	}
+	c.hub.subscribe <- roomSubscription{client: c, room: payload.Room}
+
+	missed, err := loadMissedMessages(payload.Room, payload.ResumeFrom)
+	if err != nil {
+		c.hub.unsubscribe <- roomSubscription{client: c, room: payload.Room}
+		c.replyFailure(frame.ID, err)
+		return
+	}
+
+	frames := make([]models.WSMessage, 0, len(missed)+1)
+	for _, msg := range missed {
+		frames = append(frames, newFrame(models.WSTypeMessage, "", msg))
+	}
+	frames = append(frames, newFrame(models.WSTypeAck, frame.ID, models.WSAckPayload{Count: len(missed)}))
+	c.reply(frames...)
+}
+
+// handleUnsubscribe leaves a room
+func (c *ChatClient) handleUnsubscribe(frame models.WSMessage) {
+	var payload models.WSRoomPayload
+	if !c.decodePayload(frame, &payload) {
+		return
+	}
+	room, ok := c.targetRoom(frame, payload.Room)
+	if !ok {
+		return
+	}
+
+	c.hub.unsubscribe <- roomSubscription{client: c, room: room}
+	c.replyAck(frame.ID, models.WSAckPayload{})
+}
+
+// handleLoadMore pages backwards through a room's history
+func (c *ChatClient) handleLoadMore(frame models.WSMessage) {
+	var payload models.WSLoadMorePayload
+	if !c.decodePayload(frame, &payload) {
+		return
+	}
+	if payload.BeforeID == "" {
+		c.replyError(frame.ID, models.WSErrInvalidPayload, "before_id is required")
+		return
+	}
+	room, ok := c.targetRoom(frame, payload.Room)
+	if !ok {
+		return
+	}
+
+	page, err := loadRoomHistory(room, historyQuery{BeforeID: payload.BeforeID, Limit: payload.Limit})
+	if err != nil {
+		c.replyFailure(frame.ID, err)
+		return
+	}
+
+	frames := make([]models.WSMessage, 0, len(page)+1)
+	for _, msg := range page {
+		frames = append(frames, newFrame(models.WSTypeMessage, "", msg))
+	}
+	frames = append(frames, newFrame(models.WSTypeAck, frame.ID, models.WSAckPayload{Count: len(page)}))
+	c.reply(frames...)
+}
+
+// handleTyping starts or stops the connection user's typing indicator in a room. Clients repeat
+// typing frames while the user types; the server stops the indicator after typingTimeout otherwise.
+func (c *ChatClient) handleTyping(frame models.WSMessage) {
+	var payload models.WSTypingPayload
+	if !c.decodePayload(frame, &payload) {
+		return
+	}
+	room, ok := c.targetRoom(frame, payload.Room)
+	if !ok {
+		return
+	}
+
+	c.hub.typing <- typingUpdate{client: c, room: room, typing: payload.Typing}
+	c.replyAck(frame.ID, models.WSAckPayload{})
+}
+
+// handleRead moves the connection user's read marker in a room forward to a message and tells
+// the room's participants. Markers never move backwards, so stale read frames are acknowledged
+// without a broadcast.
+func (c *ChatClient) handleRead(frame models.WSMessage) {
+	var payload models.WSReadPayload
+	if !c.decodePayload(frame, &payload) {
+		return
+	}
+	room, ok := c.targetRoom(frame, payload.Room)
+	if !ok {
+		return
+	}
+
+	message, err := findAnchorMessage(payload.MessageID.String())
+	if err != nil {
+		c.replyFailure(frame.ID, err)
+		return
+	}
+	if message.ConversationID().String() != room {
+		c.replyError(frame.ID, models.WSErrInvalidPayload, fmt.Sprintf("message %s is not in room %s", payload.MessageID, room))
+		return
+	}
+
+	userID, err := uuid.Parse(c.userID)
+	if err != nil {
+		c.replyError(frame.ID, models.WSErrUnauthorized, "read receipts need a registered user")
+		return
+	}
+	// The marker is sent to the room, and to GraphQL subscribers, by the hub as resolvers.ChatRooms
+	if _, err := resolvers.MarkMessageRead(database.DB, userID, message); err != nil {
+		c.replyFailure(frame.ID, err)
+		return
+	}
+	c.replyAck(frame.ID, models.WSAckPayload{MessageID: message.ID.String()})
+}
+
+// handleEdit replaces the content of one of the user's messages and sends the edited message to its room
+func (c *ChatClient) handleEdit(frame models.WSMessage) {
+	var payload models.WSEditPayload
+	if !c.decodePayload(frame, &payload) {
+		return
+	}
+	if strings.TrimSpace(payload.Content) == "" {
+		c.replyError(frame.ID, models.WSErrInvalidPayload, "content must not be empty")
+		return
+	}
+
+	message, err := findAnchorMessage(payload.MessageID.String())
+	if err != nil {
+		c.replyFailure(frame.ID, err)
+		return
+	}
+	if _, ok := c.targetRoom(frame, message.ConversationID().String()); !ok {
+		return
+	}
+	if message.SenderID.String() != c.userID {
+		c.replyError(frame.ID, models.WSErrForbidden, "only the sender can edit a message")
+		return
+	}
+	if message.IsDeleted() {
+		c.replyError(frame.ID, models.WSErrInvalidPayload, "a deleted message cannot be edited")
+		return
+	}
+
+	// The edited message is sent to the room, and to GraphQL subscribers, by the hub as resolvers.ChatRooms
+	if _, err := resolvers.EditMessageContent(database.DB, message, message.SenderID, payload.Content); err != nil {
+		c.replyFailure(frame.ID, fmt.Errorf("failed to edit message: %w", err))
+		return
+	}
+	c.replyAck(frame.ID, models.WSAckPayload{MessageID: message.ID.String()})
+}
+
+// loadLiveMessage loads a message as sent to its room when it is posted or changes, with its
+// reactions and where its mentions are
+func loadLiveMessage(id uuid.UUID, room string) (ChatMessage, error) {
+	var message models.Message
+	if err := database.DB.Preload("Sender").Preload("Mentions.User").Where("id = ?", id).First(&message).Error; err != nil {
+		return ChatMessage{}, err
+	}
+	reactions, err := models.MessageReactionCounts(database.DB, message.ID)
+	if err != nil {
+		return ChatMessage{}, err
+	}
+	mentions, err := mention.Resolve(database.DB, message.Content)
+	if err != nil {
+		return ChatMessage{}, err
+	}
+
+	chatMessage := chatMessageFromModel(message, room)
+	chatMessage.SenderID = message.SenderID.String()
+	chatMessage.History = false
+	chatMessage.Reactions = reactions
+	chatMessage.MentionSpans = mentions.Mentions
+	return chatMessage, nil
+}
+
+// handleDelete turns a message into a tombstone and sends it to the message's room. Users delete
+// their own messages; users with MESSAGES_MODERATE anyone's.
+func (c *ChatClient) handleDelete(frame models.WSMessage) {
+	var payload models.WSDeletePayload
+	if !c.decodePayload(frame, &payload) {
+		return
+	}
+
+	message, err := findAnchorMessage(payload.MessageID.String())
+	if err != nil {
+		c.replyFailure(frame.ID, err)
+		return
+	}
+	if _, ok := c.targetRoom(frame, message.ConversationID().String()); !ok {
+		return
+	}
+	deleter := message.SenderID
+	if message.SenderID.String() != c.userID {
+		moderator, err := hasPermission(c.userID, rbac.MessagesModerate)
+		if err != nil {
+			c.replyFailure(frame.ID, err)
+			return
+		}
+		if !moderator {
+			c.replyError(frame.ID, models.WSErrForbidden, "only the sender or a moderator can delete a message")
+			return
+		}
+		deleter = uuid.MustParse(c.userID)
+	}
+
+	// Deleting twice is harmless. The tombstone is sent to the room, and to GraphQL subscribers, by
+	// the hub as resolvers.ChatRooms.
+	if err := resolvers.DeleteMessageBy(database.DB, message, deleter); err != nil {
+		c.replyFailure(frame.ID, fmt.Errorf("failed to delete message: %w", err))
+		return
+	}
+	c.replyAck(frame.ID, models.WSAckPayload{MessageID: message.ID.String()})
+}
+
+// handleReaction puts an emoji on a message, or takes it off, and sends the message's new reaction
+// counts to its room. Reacting twice with the same emoji, or removing a missing reaction, is
+// acknowledged without a broadcast.
+func (c *ChatClient) handleReaction(frame models.WSMessage, add bool) {
+	var payload models.WSReactPayload
+	if !c.decodePayload(frame, &payload) {
+		return
+	}
+	if err := models.ValidateEmoji(payload.Emoji); err != nil {
+		c.replyFailure(frame.ID, err)
+		return
+	}
+
+	message, err := findAnchorMessage(payload.MessageID.String())
+	if err != nil {
+		c.replyFailure(frame.ID, err)
+		return
+	}
+	if _, ok := c.targetRoom(frame, message.ConversationID().String()); !ok {
+		return
+	}
+
+	userID, err := uuid.Parse(c.userID)
+	if err != nil {
+		c.replyError(frame.ID, models.WSErrUnauthorized, "reactions need a registered user")
+		return
+	}
+
+	// A change is sent to the room, and to GraphQL subscribers, by the hub as resolvers.ChatRooms
+	if err := resolvers.ChangeMessageReaction(database.DB, message, userID, payload.Emoji, add); err != nil {
+		c.replyFailure(frame.ID, err)
+		return
+	}
+	c.replyAck(frame.ID, models.WSAckPayload{MessageID: message.ID.String()})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"crm-communication-api/internal/ratelimit"
+	"crm-communication-api/models"
+)
+
+const (
+	// Default rates of each role, per user and per connection, and of every room
+	defaultUserRate       = "default=10/10s,admin=30/10s"
+	defaultConnectionRate = "default=5/5s,admin=15/5s"
+	defaultRoomRate       = "30/10s"
+
+	// Users rejected muteAfter times within muteWindow are muted for muteFor
+	muteAfter  = 5
+	muteWindow = time.Minute
+	muteFor    = 5 * time.Minute
+)
+
+// newRateLimiter creates the limiter shared by send frames and the createMessage mutation.
+// CHAT_RATE_USER and CHAT_RATE_CONNECTION set the rates of each role as comma-separated
+// role=<messages>/<duration> pairs, where "default" covers the roles not listed, and
+// CHAT_RATE_ROOM sets the rate of every room.
+func newRateLimiter() *ratelimit.Limiter {
+	users := parseRoleRates("CHAT_RATE_USER", defaultUserRate)
+	connections := parseRoleRates("CHAT_RATE_CONNECTION", defaultConnectionRate)
+
+	// Roles listed for one scope only get the default rate of the other
+	roles := make(map[string]ratelimit.Limits)
+	for _, rates := range []map[string]ratelimit.Rate{users, connections} {
+		for role := range rates {
+			limits := ratelimit.Limits{User: users[ratelimit.DefaultRole], Connection: connections[ratelimit.DefaultRole]}
+			if rate, ok := users[role]; ok {
+				limits.User = rate
+			}
+			if rate, ok := connections[role]; ok {
+				limits.Connection = rate
+			}
+			roles[role] = limits
+		}
+	}
+
+	room := os.Getenv("CHAT_RATE_ROOM")
+	if room == "" {
+		room = defaultRoomRate
+	}
+	roomRate, err := ratelimit.ParseRate(room)
+	if err != nil {
+		log.Fatalf("Invalid CHAT_RATE_ROOM: %v", err)
+	}
+
+	log.Printf("Chat rate limits: %s per user, %s per connection and %s per room by default", users[ratelimit.DefaultRole], connections[ratelimit.DefaultRole], roomRate)
+	return ratelimit.New(ratelimit.Config{
+		Roles:      roles,
+		Room:       roomRate,
+		MuteAfter:  muteAfter,
+		MuteWindow: muteWindow,
+		MuteFor:    muteFor,
+	})
+}
+
+// parseRoleRates reads the role=rate pairs of an environment variable, falling back to fallback.
+// A rate without a role is the default rate.
+func parseRoleRates(name, fallback string) map[string]ratelimit.Rate {
+	value := os.Getenv(name)
+	if value == "" {
+		value = fallback
+	}
+
+	rates := make(map[string]ratelimit.Rate)
+	for _, pair := range strings.Split(value, ",") {
+		role, rate, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			role, rate = ratelimit.DefaultRole, role
+		}
+		parsed, err := ratelimit.ParseRate(rate)
+		if err != nil {
+			log.Fatalf("Invalid %s: %v", name, err)
+		}
+		rates[strings.TrimSpace(role)] = parsed
+	}
+	if _, ok := rates[ratelimit.DefaultRole]; !ok {
+		log.Fatalf("Invalid %s: set a default rate, such as default=10/10s", name)
+	}
+	return rates
+}
+
+// allowMessage spends a message from the sender's, the connection's and the room's quotas,
+// answering with a rate_limited or muted error frame when they are spent
+func (c *ChatClient) allowMessage(frame models.WSMessage, room string) bool {
+	err := ratelimit.Allow(ratelimit.Message{
+		UserID:     c.userID,
+		Role:       c.role,
+		Connection: c.resumeToken,
+		Room:       room,
+	})
+	if err == nil {
+		return true
+	}
+
+	var limited *ratelimit.Error
+	if !errors.As(err, &limited) {
+		c.replyFailure(frame.ID, err)
+		return false
+	}
+	code := models.WSErrRateLimited
+	if limited.Scope == ratelimit.ScopeMuted {
+		code = models.WSErrMuted
+	}
+	c.reply(newFrame(models.WSTypeError, frame.ID, models.WSErrorPayload{
+		Code:       code,
+		Message:    limited.Error(),
+		RetryAfter: int(math.Ceil(limited.RetryAfter.Seconds())),
+	}))
+	return false
+}
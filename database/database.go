@@ -73,4 +73,9 @@ func InitDB() {
         }
         
         log.Println("Database connected successfully")
-}
\ No newline at end of file
+}
+
+// GetDB returns the connection opened by InitDB
+func GetDB() *gorm.DB {
+        return DB
+}
@@ -0,0 +1,226 @@
+// Package backpressure decides what happens to frames for a WebSocket consumer that reads more
+// slowly than the server writes, and counts what each policy dropped.
+package backpressure
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+)
+
+// Policy is what a connection's queue does when it is full
+type Policy string
+
+const (
+	// DropOldest discards the oldest queued frame to make room; the connection stays open
+	DropOldest Policy = "drop_oldest"
+
+	// Coalesce replaces a queued frame superseded by the new one, such as an older presence or
+	// typing state for the same user, and otherwise discards the oldest queued frame
+	Coalesce Policy = "coalesce"
+
+	// Disconnect closes the connection so the client can resume it
+	Disconnect Policy = "disconnect"
+
+	// Spill keeps queueing past the buffer size, up to a spill limit, and only closes the
+	// connection once that is reached
+	Spill Policy = "spill"
+)
+
+// DefaultPolicy is used when a connection does not choose one
+const DefaultPolicy = Disconnect
+
+// ParsePolicy reads a policy name; an empty name selects DefaultPolicy
+func ParsePolicy(name string) (Policy, error) {
+	switch policy := Policy(name); policy {
+	case "":
+		return DefaultPolicy, nil
+	case DropOldest, Coalesce, Disconnect, Spill:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown backpressure policy %q, use drop_oldest, coalesce, disconnect or spill", name)
+	}
+}
+
+// Metrics counts backpressure events, keyed "<policy>.<event>", and is published on /debug/vars
+var Metrics = expvar.NewMap("backpressure")
+
+// Events counted in Metrics
+const (
+	EventDropped      = "dropped"      // A frame was discarded
+	EventCoalesced    = "coalesced"    // A queued frame was replaced by a newer one
+	EventSpilled      = "spilled"      // A frame was queued past the buffer size
+	EventDisconnected = "disconnected" // A connection was closed for being slow
+	EventResumed      = "resumed"      // A closed connection was resumed with its queued frames
+)
+
+// Count records a backpressure event for a policy
+func Count(policy Policy, event string) {
+	Metrics.Add(string(policy)+"."+event, 1)
+}
+
+// Queue holds the frames waiting to be written to one connection and applies its policy when
+// they pile up. It is safe for concurrent use by one consumer and any number of producers.
+type Queue[T any] struct {
+	policy     Policy
+	capacity   int
+	spillLimit int
+	key        func(T) string
+
+	mu     sync.Mutex
+	items  []T
+	closed bool
+	ready  chan struct{}
+}
+
+// NewQueue creates a queue holding up to capacity frames, or spillLimit frames with the Spill
+// policy. key returns the identity of a frame for the Coalesce policy: frames with the same
+// non-empty key supersede each other. It may be nil for other policies.
+func NewQueue[T any](policy Policy, capacity, spillLimit int, key func(T) string) *Queue[T] {
+	return &Queue[T]{
+		policy:     policy,
+		capacity:   capacity,
+		spillLimit: spillLimit,
+		key:        key,
+		items:      make([]T, 0, capacity),
+		ready:      make(chan struct{}, 1),
+	}
+}
+
+// Policy returns the queue's policy
+func (q *Queue[T]) Policy() Policy {
+	return q.policy
+}
+
+// Push queues a frame. It returns false when the consumer is too slow to keep and must be
+// disconnected; the frame is queued anyway so it can be handed to a resumed connection.
+// Frames pushed to a closed queue are discarded.
+func (q *Queue[T]) Push(item T) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return true
+	}
+	defer q.signal()
+
+	if len(q.items) < q.capacity {
+		q.items = append(q.items, item)
+		return true
+	}
+
+	switch q.policy {
+	case DropOldest:
+		q.items = append(q.items[1:], item)
+		Count(q.policy, EventDropped)
+	case Coalesce:
+		if q.coalesce(item) {
+			Count(q.policy, EventCoalesced)
+		} else {
+			q.items = append(q.items[1:], item)
+			Count(q.policy, EventDropped)
+		}
+	case Spill:
+		q.items = append(q.items, item)
+		if len(q.items) > q.spillLimit {
+			return false
+		}
+		Count(q.policy, EventSpilled)
+	default:
+		q.items = append(q.items, item)
+		return false
+	}
+	return true
+}
+
+// PushAll queues frames regardless of the policy, such as the frames a resumed connection
+// missed. Frames pushed to a closed queue are discarded.
+func (q *Queue[T]) PushAll(items []T) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.items = append(q.items, items...)
+	q.signal()
+}
+
+// Rewrite replaces the queued frames with what fn returns, with no frame pushed in between. It
+// lets a connection put frames loaded while it was already receiving ahead of the queued ones.
+func (q *Queue[T]) Rewrite(fn func(queued []T) []T) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.items = fn(q.items)
+	q.signal()
+}
+
+// coalesce removes the queued frame the item supersedes and queues the item last. It reports
+// false when no queued frame has the item's key.
+func (q *Queue[T]) coalesce(item T) bool {
+	k := q.key(item)
+	if k == "" {
+		return false
+	}
+	for i := len(q.items) - 1; i >= 0; i-- {
+		if q.key(q.items[i]) == k {
+			q.items = append(append(q.items[:i], q.items[i+1:]...), item)
+			return true
+		}
+	}
+	return false
+}
+
+// signal wakes the consumer; the caller holds q.mu
+func (q *Queue[T]) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Ready is signalled when frames are queued or the queue is closed
+func (q *Queue[T]) Ready() <-chan struct{} {
+	return q.ready
+}
+
+// Pop removes the oldest frame. It reports false when the queue is empty.
+func (q *Queue[T]) Pop() (T, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var item T
+	if len(q.items) == 0 {
+		return item, false
+	}
+	item = q.items[0]
+	q.items = q.items[1:]
+	return item, true
+}
+
+// Drain removes and returns every queued frame
+func (q *Queue[T]) Drain() []T {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	items := q.items
+	q.items = make([]T, 0, q.capacity)
+	return items
+}
+
+// Close stops accepting frames and wakes the consumer, which should write what is still queued
+// and then stop
+func (q *Queue[T]) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.signal()
+}
+
+// Closed reports whether Close was called
+func (q *Queue[T]) Closed() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.closed
+}
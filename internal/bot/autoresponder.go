@@ -0,0 +1,62 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// autoResponderDelay is how long the auto-responder waits, as a person would, before answering
+const autoResponderDelay = 1500 * time.Millisecond
+
+// AutoResponder is a demo bot answering on behalf of mentioned users with a canned reply
+type AutoResponder struct {
+	responses map[string]string
+}
+
+// NewAutoResponder creates the demo auto-responder
+func NewAutoResponder() *AutoResponder {
+	return &AutoResponder{
+		responses: map[string]string{
+			"John":       "I'll review the sales data and get back to you shortly.",
+			"Maria":      "Thanks for the mention. I'll help address this support request.",
+			"Carlos":     "I'll check the technical issues you've reported.",
+			"Sarah":      "I'll include this in our next marketing campaign.",
+			"Admin":      "This has been noted by the admin team.",
+			"TestClient": "Thank you for reaching out. As a client, I appreciate your attention.",
+			"Acme":       "Acme Corp acknowledges your message.",
+			"Globex":     "Globex Inc will respond to your inquiry soon.",
+		},
+	}
+}
+
+// Name implements Bot
+func (a *AutoResponder) Name() string {
+	return "autoresponder"
+}
+
+// Triggers implements Bot
+func (a *AutoResponder) Triggers() []Trigger {
+	return []Trigger{{Kind: OnAnyMention}}
+}
+
+// Handle implements Bot, replying once per mentioned user
+func (a *AutoResponder) Handle(ctx context.Context, event Event) ([]Reply, error) {
+	select {
+	case <-time.After(autoResponderDelay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	replies := make([]Reply, 0, len(event.Mentions))
+	for _, mention := range event.Mentions {
+		response := a.responses[mention]
+		if response == "" {
+			response = "Thanks for the mention. I'll get back to you soon."
+		}
+		replies = append(replies, Reply{
+			Content: fmt.Sprintf("%s %s (auto-reply for %s)", MentionOf(event.Sender), response, mention),
+		})
+	}
+	return replies, nil
+}
@@ -0,0 +1,239 @@
+// Package bot lets chat bots answer messages posted in chat rooms. A bot declares what it reacts
+// to, a mention of its name, a keyword or a slash command, and returns the messages it posts in
+// reply; the chat hub posts them as the bot's own user.
+package bot
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TriggerKind is what in a message wakes a bot up
+type TriggerKind int
+
+const (
+	// OnMention fires when the bot's name is mentioned, as in "@crmbot summary Acme"
+	OnMention TriggerKind = iota
+
+	// OnAnyMention fires when a user other than the sender and the bots is mentioned
+	OnAnyMention
+
+	// OnKeyword fires when the message contains the trigger's word, ignoring case
+	OnKeyword
+
+	// OnCommand fires when the message starts with "/" followed by the trigger's word
+	OnCommand
+)
+
+// Trigger is one condition under which a bot handles a message
+type Trigger struct {
+	Kind TriggerKind
+	Word string // Keyword or command name, without the "/"; unused for mentions
+}
+
+// Event is a message a bot was triggered by
+type Event struct {
+	Room      string
+	MessageID string
+	SenderID  string
+	Sender    string
+	Content   string
+	Mentions  []string // For OnAnyMention, only the mentioned users the bot answers for
+	Trigger   Trigger
+	Args      string // Content after the mention or command, trimmed
+}
+
+// Reply is a message a bot posts in the event's room. Mentions in its content are resolved like
+// those typed by users; see MentionOf.
+type Reply struct {
+	Content string
+}
+
+// Bot answers chat messages
+type Bot interface {
+	// Name is the user name the bot posts as and is mentioned by
+	Name() string
+
+	// Triggers lists the messages the bot handles
+	Triggers() []Trigger
+
+	// Handle returns the messages the bot posts in reply, if any
+	Handle(ctx context.Context, event Event) ([]Reply, error)
+}
+
+// Match is a bot triggered by a message, with the event to hand it
+type Match struct {
+	Bot   Bot
+	Event Event
+}
+
+// Registry holds the bots of a hub and limits how often each of them replies in a room
+type Registry struct {
+	mu     sync.RWMutex
+	bots   []Bot
+	limit  int
+	window time.Duration
+	recent map[string][]time.Time // When each bot last replied, keyed by bot name and room
+}
+
+// NewRegistry creates a registry letting each bot reply at most limit times per window in a room
+func NewRegistry(limit int, window time.Duration) *Registry {
+	return &Registry{
+		limit:  limit,
+		window: window,
+		recent: make(map[string][]time.Time),
+	}
+}
+
+// Register adds a bot
+func (r *Registry) Register(b Bot) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bots = append(r.bots, b)
+}
+
+// Bots returns the registered bots
+func (r *Registry) Bots() []Bot {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]Bot(nil), r.bots...)
+}
+
+// IsBot reports whether a name belongs to a registered bot
+func (r *Registry) IsBot(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, b := range r.bots {
+		if strings.EqualFold(b.Name(), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasCommand reports whether a registered bot answers a slash command
+func (r *Registry) HasCommand(name string) bool {
+	for _, b := range r.Bots() {
+		for _, trigger := range b.Triggers() {
+			if trigger.Kind == OnCommand && strings.EqualFold(trigger.Word, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Match returns the bots a message triggers, at most once per bot, skipping bots that used up
+// their replies in the room. Messages sent by bots trigger nothing.
+func (r *Registry) Match(event Event) []Match {
+	if r.IsBot(event.Sender) {
+		return nil
+	}
+
+	var matches []Match
+	for _, b := range r.Bots() {
+		for _, trigger := range b.Triggers() {
+			matched, ok := r.match(b, trigger, event)
+			if !ok {
+				continue
+			}
+			if r.allow(b.Name(), event.Room) {
+				matches = append(matches, Match{Bot: b, Event: matched})
+			}
+			break
+		}
+	}
+	return matches
+}
+
+// match checks one trigger, returning the event the bot is handed
+func (r *Registry) match(b Bot, trigger Trigger, event Event) (Event, bool) {
+	event.Trigger = trigger
+	content := strings.TrimSpace(event.Content)
+
+	switch trigger.Kind {
+	case OnMention:
+		for _, mention := range event.Mentions {
+			if strings.EqualFold(mention, b.Name()) {
+				event.Args = strings.TrimSpace(removeMention(content, mention))
+				return event, true
+			}
+		}
+
+	case OnAnyMention:
+		var users []string
+		for _, mention := range event.Mentions {
+			if !strings.EqualFold(mention, event.Sender) && !r.IsBot(mention) {
+				users = append(users, mention)
+			}
+		}
+		if len(users) > 0 {
+			event.Mentions = users
+			event.Args = content
+			return event, true
+		}
+
+	case OnKeyword:
+		for _, word := range strings.FieldsFunc(content, isSeparator) {
+			if strings.EqualFold(word, trigger.Word) {
+				event.Args = content
+				return event, true
+			}
+		}
+
+	case OnCommand:
+		name, args, _ := strings.Cut(content, " ")
+		if strings.EqualFold(name, "/"+trigger.Word) {
+			event.Args = strings.TrimSpace(args)
+			return event, true
+		}
+	}
+	return event, false
+}
+
+// allow records a reply of a bot in a room, reporting false when the bot already replied limit
+// times there in the last window
+func (r *Registry) allow(name, room string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := strings.ToLower(name) + ":" + room
+	cutoff := time.Now().Add(-r.window)
+	recent := r.recent[key][:0]
+	for _, at := range r.recent[key] {
+		if at.After(cutoff) {
+			recent = append(recent, at)
+		}
+	}
+	if len(recent) >= r.limit {
+		r.recent[key] = recent
+		return false
+	}
+	r.recent[key] = append(recent, time.Now())
+	return true
+}
+
+// MentionOf returns the mention of a user by name, quoting names that contain spaces
+func MentionOf(name string) string {
+	if strings.ContainsAny(name, " \t") {
+		return `@"` + name + `"`
+	}
+	return "@" + name
+}
+
+// removeMention removes the first "@name" from content
+func removeMention(content, name string) string {
+	lower := strings.ToLower(content)
+	i := strings.Index(lower, "@"+strings.ToLower(name))
+	if i < 0 {
+		return content
+	}
+	return content[:i] + content[i+1+len(name):]
+}
+
+// isSeparator splits a message into words for keyword triggers
+func isSeparator(r rune) bool {
+	return !(r == '_' || r == '-' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r > 127)
+}
@@ -0,0 +1,107 @@
+package bot
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// echoBot is a bot with the triggers a test gives it
+type echoBot struct {
+	name     string
+	triggers []Trigger
+}
+
+func (b echoBot) Name() string {
+	return b.name
+}
+
+func (b echoBot) Triggers() []Trigger {
+	return b.triggers
+}
+
+func (b echoBot) Handle(ctx context.Context, event Event) ([]Reply, error) {
+	return []Reply{{Content: event.Args}}, nil
+}
+
+func TestTriggers(t *testing.T) {
+	tests := []struct {
+		name     string
+		trigger  Trigger
+		content  string
+		mentions []string
+		matches  bool
+		args     string
+		answers  []string // The mentions handed to the bot, for OnAnyMention
+	}{
+		{name: "mention", trigger: Trigger{Kind: OnMention}, content: "@echo summary Acme", mentions: []string{"echo"}, matches: true, args: "summary Acme"},
+		{name: "mention in another case", trigger: Trigger{Kind: OnMention}, content: "hi @Echo", mentions: []string{"Echo"}, matches: true, args: "hi"},
+		{name: "mention of someone else", trigger: Trigger{Kind: OnMention}, content: "@maria hi", mentions: []string{"maria"}},
+		{name: "any mention", trigger: Trigger{Kind: OnAnyMention}, content: "@maria @ada @crmbot hi", mentions: []string{"maria", "ada", "crmbot"}, matches: true, args: "@maria @ada @crmbot hi", answers: []string{"maria"}},
+		{name: "any mention of the sender or bots only", trigger: Trigger{Kind: OnAnyMention}, content: "@ada @crmbot", mentions: []string{"ada", "crmbot"}},
+		{name: "keyword", trigger: Trigger{Kind: OnKeyword, Word: "invoice"}, content: "Where is the INVOICE?", matches: true, args: "Where is the INVOICE?"},
+		{name: "keyword inside a word", trigger: Trigger{Kind: OnKeyword, Word: "invoice"}, content: "invoices are late"},
+		{name: "command", trigger: Trigger{Kind: OnCommand, Word: "crm"}, content: "/crm  summary Acme ", matches: true, args: "summary Acme"},
+		{name: "command without arguments", trigger: Trigger{Kind: OnCommand, Word: "crm"}, content: "/CRM", matches: true},
+		{name: "command not at the start", trigger: Trigger{Kind: OnCommand, Word: "crm"}, content: "try /crm summary"},
+		{name: "command with a longer name", trigger: Trigger{Kind: OnCommand, Word: "crm"}, content: "/crmx summary"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := NewRegistry(10, time.Minute)
+			r.Register(echoBot{name: "echo", triggers: []Trigger{test.trigger}})
+			r.Register(echoBot{name: "crmbot"})
+
+			matches := r.Match(Event{Room: "acme", Sender: "ada", Content: test.content, Mentions: test.mentions})
+			if !test.matches {
+				if len(matches) != 0 {
+					t.Errorf("triggered %s with %+v, want nothing", matches[0].Bot.Name(), matches[0].Event)
+				}
+				return
+			}
+			if len(matches) != 1 || matches[0].Bot.Name() != "echo" {
+				t.Fatalf("got %d matches, want echo alone", len(matches))
+			}
+			event := matches[0].Event
+			if event.Trigger != test.trigger || event.Args != test.args {
+				t.Errorf("handed trigger %+v with args %q, want %+v with %q", event.Trigger, event.Args, test.trigger, test.args)
+			}
+			if test.answers != nil && (len(event.Mentions) != len(test.answers) || event.Mentions[0] != test.answers[0]) {
+				t.Errorf("handed mentions %v, want %v", event.Mentions, test.answers)
+			}
+		})
+	}
+}
+
+func TestBotsNeverAnswerBots(t *testing.T) {
+	r := NewRegistry(10, time.Minute)
+	r.Register(echoBot{name: "echo", triggers: []Trigger{{Kind: OnKeyword, Word: "hello"}, {Kind: OnAnyMention}}})
+	r.Register(echoBot{name: "crmbot", triggers: []Trigger{{Kind: OnMention}, {Kind: OnCommand, Word: "crm"}}})
+
+	// Each of these would trigger a bot were it sent by a user
+	for _, content := range []string{"hello", "@echo hello", "@ada hello", "/crm summary Acme"} {
+		for _, sender := range []string{"echo", "CRMBot"} {
+			event := Event{Room: "acme", Sender: sender, Content: content, Mentions: []string{"echo", "ada"}}
+			if matches := r.Match(event); len(matches) != 0 {
+				t.Errorf("%s saying %q triggered %s", sender, content, matches[0].Bot.Name())
+			}
+		}
+	}
+}
+
+func TestBotRepliesAreLimitedPerRoom(t *testing.T) {
+	r := NewRegistry(2, time.Hour)
+	r.Register(echoBot{name: "echo", triggers: []Trigger{{Kind: OnKeyword, Word: "hello"}}})
+
+	for i := 0; i < 2; i++ {
+		if matches := r.Match(Event{Room: "acme", Sender: "ada", Content: "hello"}); len(matches) != 1 {
+			t.Fatalf("message %d triggered %d bots, want 1", i+1, len(matches))
+		}
+	}
+	if matches := r.Match(Event{Room: "acme", Sender: "ada", Content: "hello"}); len(matches) != 0 {
+		t.Error("bot replied past its limit")
+	}
+	if matches := r.Match(Event{Room: "globex", Sender: "ada", Content: "hello"}); len(matches) != 1 {
+		t.Error("limit of one room applied to another")
+	}
+}
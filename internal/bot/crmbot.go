@@ -0,0 +1,110 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"crm-communication-api/models"
+)
+
+// crmSummaryEvents is how many timeline events a summary lists
+const crmSummaryEvents = 5
+
+// CRMBot answers questions about CRM clients, as in "@crmbot summary Acme" or "/crm summary Acme"
+type CRMBot struct {
+	db *gorm.DB
+}
+
+// NewCRMBot creates the CRM bot reading from db
+func NewCRMBot(db *gorm.DB) *CRMBot {
+	return &CRMBot{db: db}
+}
+
+// Name implements Bot
+func (c *CRMBot) Name() string {
+	return "crmbot"
+}
+
+// Triggers implements Bot
+func (c *CRMBot) Triggers() []Trigger {
+	return []Trigger{{Kind: OnMention}, {Kind: OnCommand, Word: "crm"}}
+}
+
+// Handle implements Bot
+func (c *CRMBot) Handle(ctx context.Context, event Event) ([]Reply, error) {
+	command, args, _ := strings.Cut(event.Args, " ")
+	args = strings.TrimSpace(args)
+
+	var content string
+	var err error
+	switch strings.ToLower(command) {
+	case "summary":
+		content, err = c.summary(ctx, args)
+	default:
+		content = "I know these commands:\n" +
+			"summary <client> - the client's contact details and latest timeline events"
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []Reply{{Content: MentionOf(event.Sender) + " " + content}}, nil
+}
+
+// summary describes the client matching a name or company and its latest timeline events
+func (c *CRMBot) summary(ctx context.Context, name string) (string, error) {
+	if name == "" {
+		return "Which client? Try: summary Acme", nil
+	}
+
+	var clients []models.Client
+	pattern := "%" + name + "%"
+	err := c.db.WithContext(ctx).
+		Where("name ILIKE ? OR company ILIKE ?", pattern, pattern).
+		Order("name").
+		Limit(6).
+		Find(&clients).Error
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case len(clients) == 0:
+		return fmt.Sprintf("I found no client matching %q.", name), nil
+	case len(clients) > 1 && !strings.EqualFold(clients[0].Name, name):
+		names := make([]string, 0, len(clients))
+		for _, client := range clients {
+			names = append(names, client.Name)
+		}
+		return fmt.Sprintf("Several clients match %q: %s. Which one?", name, strings.Join(names, ", ")), nil
+	}
+	client := clients[0]
+
+	var events []models.TimelineEvent
+	err = c.db.WithContext(ctx).
+		Where("client_id = ?", client.ID).
+		Order("event_time DESC").
+		Limit(crmSummaryEvents).
+		Find(&events).Error
+	if err != nil {
+		return "", err
+	}
+
+	var summary strings.Builder
+	fmt.Fprintf(&summary, "%s", client.Name)
+	if client.Company != "" {
+		fmt.Fprintf(&summary, " (%s)", client.Company)
+	}
+	fmt.Fprintf(&summary, ", %s", client.Email)
+	if len(events) == 0 {
+		summary.WriteString(". No timeline events yet.")
+		return summary.String(), nil
+	}
+	summary.WriteString(". Latest activity:")
+	for _, event := range events {
+		fmt.Fprintf(&summary, "\n- %s %s: %s", event.EventTime.Format("Jan 2 15:04"), event.EventType, event.Title)
+	}
+	return summary.String(), nil
+}
@@ -0,0 +1,158 @@
+// Package broker fans events out between the hubs of every API replica. Each hub publishes what
+// it delivers locally and delivers what other hubs publish, so clients connected to different
+// nodes see the same rooms and subscriptions.
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// ErrClosed is returned when publishing to or subscribing on a closed broker
+var ErrClosed = errors.New("broker closed")
+
+// Message is an event published on a topic
+type Message struct {
+	Origin string          `json:"origin"`         // ID of the hub that published the message, see NewOrigin
+	Key    string          `json:"key"`            // Room, client or user the event is addressed to
+	Kind   string          `json:"kind,omitempty"` // Type of the event, for topics that carry several
+	Data   json.RawMessage `json:"data"`
+}
+
+// Handler receives the messages published on a topic, including the subscriber's own. Handlers
+// are called one at a time per broker and must not block for long.
+type Handler func(Message)
+
+// Broker carries messages between hubs, in the same process or on other nodes
+type Broker interface {
+	// Publish sends a message to every subscriber of a topic
+	Publish(topic string, msg Message) error
+
+	// Subscribe calls handler for every message published on a topic until the returned
+	// function is called
+	Subscribe(topic string, handler Handler) (unsubscribe func(), err error)
+
+	// Close stops delivering messages
+	Close() error
+}
+
+// NewOrigin returns a unique ID for a hub, which it sets on the messages it publishes so it can
+// skip them when they are delivered back to it
+func NewOrigin() string {
+	return uuid.New().String()
+}
+
+// subscribers keeps the handlers of each topic; it is shared by the broker implementations
+type subscribers struct {
+	mu       sync.RWMutex
+	handlers map[string]map[int]Handler
+	nextID   int
+}
+
+// add registers a handler and reports whether it is the first one for its topic
+func (s *subscribers) add(topic string, handler Handler) (id int, first bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.handlers == nil {
+		s.handlers = make(map[string]map[int]Handler)
+	}
+	if _, exists := s.handlers[topic]; !exists {
+		s.handlers[topic] = make(map[int]Handler)
+		first = true
+	}
+	s.nextID++
+	s.handlers[topic][s.nextID] = handler
+	return s.nextID, first
+}
+
+// remove unregisters a handler
+func (s *subscribers) remove(topic string, id int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.handlers[topic], id)
+	if len(s.handlers[topic]) == 0 {
+		delete(s.handlers, topic)
+	}
+}
+
+// topics returns every topic with at least one handler
+func (s *subscribers) topics() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	topics := make([]string, 0, len(s.handlers))
+	for topic := range s.handlers {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// dispatch calls the handlers of a topic
+func (s *subscribers) dispatch(topic string, msg Message) {
+	s.mu.RLock()
+	handlers := make([]Handler, 0, len(s.handlers[topic]))
+	for _, handler := range s.handlers[topic] {
+		handlers = append(handlers, handler)
+	}
+	s.mu.RUnlock()
+
+	for _, handler := range handlers {
+		handler(msg)
+	}
+}
+
+// InProcess is a Broker for hubs running in the same process. It is the default for a single
+// node, and lets several hubs share events in tests.
+type InProcess struct {
+	subs subscribers
+
+	// Serializes delivery so handlers see messages in publish order
+	deliverMu sync.Mutex
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewInProcess creates an in-process broker
+func NewInProcess() *InProcess {
+	return &InProcess{}
+}
+
+// Publish delivers a message to the topic's handlers before returning
+func (b *InProcess) Publish(topic string, msg Message) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return ErrClosed
+	}
+
+	b.deliverMu.Lock()
+	defer b.deliverMu.Unlock()
+	b.subs.dispatch(topic, msg)
+	return nil
+}
+
+// Subscribe registers a handler for a topic
+func (b *InProcess) Subscribe(topic string, handler Handler) (func(), error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return nil, ErrClosed
+	}
+
+	id, _ := b.subs.add(topic, handler)
+	return func() { b.subs.remove(topic, id) }, nil
+}
+
+// Close stops delivering messages
+func (b *InProcess) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	return nil
+}
@@ -0,0 +1,187 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"gorm.io/gorm"
+)
+
+// maxNotifyPayload is the largest payload Postgres accepts in a NOTIFY, in bytes
+const maxNotifyPayload = 7999
+
+// reconnectDelay is how long the listener waits before reconnecting after losing its connection
+const reconnectDelay = 2 * time.Second
+
+// ErrPayloadTooLarge is returned when a message does not fit in a Postgres notification
+var ErrPayloadTooLarge = errors.New("message too large for a Postgres notification")
+
+// Postgres is a Broker that fans messages out between nodes with LISTEN/NOTIFY. Messages are
+// published on the shared gorm connection pool and received on a dedicated connection, which is
+// re-established, with its LISTENs, if it drops. Notifications sent while it is down are lost.
+type Postgres struct {
+	db   *gorm.DB
+	dsn  string
+	subs subscribers
+
+	// Set when a topic gained its first subscriber, with the function that interrupts the
+	// listener's current wait so it can LISTEN on the topic
+	mu         sync.Mutex
+	stale      bool
+	wakeListen context.CancelFunc
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewPostgres creates a broker that publishes through db and listens on its own connection to dsn
+func NewPostgres(db *gorm.DB, dsn string) *Postgres {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &Postgres{
+		db:     db,
+		dsn:    dsn,
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go b.listen()
+	return b
+}
+
+// Publish sends a message to every node listening on the topic, this one included
+func (b *Postgres) Publish(topic string, msg Message) error {
+	if b.ctx.Err() != nil {
+		return ErrClosed
+	}
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if len(payload) > maxNotifyPayload {
+		return fmt.Errorf("%w: %d bytes on %s", ErrPayloadTooLarge, len(payload), topic)
+	}
+
+	return b.db.WithContext(b.ctx).Exec("SELECT pg_notify(?, ?)", topic, string(payload)).Error
+}
+
+// Subscribe registers a handler for a topic, listening on it if it is new
+func (b *Postgres) Subscribe(topic string, handler Handler) (func(), error) {
+	if b.ctx.Err() != nil {
+		return nil, ErrClosed
+	}
+
+	id, first := b.subs.add(topic, handler)
+	if first {
+		b.wake()
+	}
+	return func() { b.subs.remove(topic, id) }, nil
+}
+
+// Close stops the listener and waits for it to exit
+func (b *Postgres) Close() error {
+	b.cancel()
+	<-b.done
+	return nil
+}
+
+// wake tells the listener to LISTEN on new topics, interrupting its wait for notifications
+func (b *Postgres) wake() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.stale = true
+	if b.wakeListen != nil {
+		b.wakeListen()
+	}
+}
+
+// listen keeps a listening connection open until the broker is closed
+func (b *Postgres) listen() {
+	defer close(b.done)
+
+	for b.ctx.Err() == nil {
+		conn, err := pgx.Connect(b.ctx, b.dsn)
+		if err != nil {
+			log.Printf("Broker failed to connect to Postgres: %v", err)
+		} else {
+			err = b.serve(conn)
+			conn.Close(context.Background())
+			if b.ctx.Err() == nil {
+				log.Printf("Broker lost its Postgres connection: %v", err)
+			}
+		}
+
+		select {
+		case <-time.After(reconnectDelay):
+		case <-b.ctx.Done():
+		}
+	}
+}
+
+// serve listens on every subscribed topic and dispatches notifications until the connection fails
+func (b *Postgres) serve(conn *pgx.Conn) error {
+	listening := make(map[string]bool)
+	for {
+		b.mu.Lock()
+		b.stale = false
+		b.mu.Unlock()
+
+		// LISTEN is idempotent, but skip the round trip for known topics
+		for _, topic := range b.subs.topics() {
+			if listening[topic] {
+				continue
+			}
+			if err := listenOn(b.ctx, conn, topic); err != nil {
+				return err
+			}
+			listening[topic] = true
+		}
+
+		// A topic subscribed while listening is picked up before waiting
+		waitCtx, cancel := context.WithCancel(b.ctx)
+		b.mu.Lock()
+		if b.stale {
+			b.mu.Unlock()
+			cancel()
+			continue
+		}
+		b.wakeListen = cancel
+		b.mu.Unlock()
+
+		notification, err := conn.WaitForNotification(waitCtx)
+
+		b.mu.Lock()
+		b.wakeListen = nil
+		b.mu.Unlock()
+		woken := waitCtx.Err() != nil
+		cancel()
+
+		if err != nil {
+			// Woken up by Subscribe; the connection is still usable
+			if woken && b.ctx.Err() == nil {
+				continue
+			}
+			return err
+		}
+
+		var msg Message
+		if err := json.Unmarshal([]byte(notification.Payload), &msg); err != nil {
+			log.Printf("Broker dropped a malformed notification on %s: %v", notification.Channel, err)
+			continue
+		}
+		b.subs.dispatch(notification.Channel, msg)
+	}
+}
+
+// listenOn starts listening on a topic
+func listenOn(ctx context.Context, conn *pgx.Conn, topic string) error {
+	_, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{topic}.Sanitize())
+	return err
+}
@@ -0,0 +1,210 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"crm-communication-api/internal/notify"
+	"crm-communication-api/internal/rbac"
+	"crm-communication-api/models"
+)
+
+// maxReminderDelay is the furthest ahead a reminder can be set
+const maxReminderDelay = 365 * 24 * time.Hour
+
+// Drafter drafts emails to clients for the /email command
+type Drafter interface {
+	DraftEmail(ctx context.Context, sender models.User, client models.Client, subject string) (*models.EmailDraft, error)
+}
+
+// DraftStore is a Drafter keeping drafts in the email_drafts table, where the email service picks
+// them up to be completed and sent
+type DraftStore struct {
+	db *gorm.DB
+}
+
+// NewDraftStore creates a draft store writing to db
+func NewDraftStore(db *gorm.DB) *DraftStore {
+	return &DraftStore{db: db}
+}
+
+// DraftEmail implements Drafter
+func (s *DraftStore) DraftEmail(ctx context.Context, sender models.User, client models.Client, subject string) (*models.EmailDraft, error) {
+	draft := &models.EmailDraft{
+		ClientID: client.ID,
+		UserID:   sender.ID,
+		To:       client.Email,
+		Subject:  subject,
+	}
+	if err := s.db.WithContext(ctx).Create(draft).Error; err != nil {
+		return nil, err
+	}
+	return draft, nil
+}
+
+// registerBuiltins adds the CRM commands
+func registerBuiltins(r *Router, drafter Drafter) {
+	r.Register(&Command{
+		Name:       "note",
+		Usage:      "<text>",
+		Summary:    "add a note to the client's timeline",
+		Permission: rbac.TimelineWrite,
+		MinArgs:    1,
+		Run:        runNote,
+	})
+	r.Register(&Command{
+		Name:       "assign",
+		Usage:      "@<user>",
+		Summary:    "make a user the client's owner",
+		Permission: rbac.ClientsAssign,
+		MinArgs:    1,
+		Run:        runAssign,
+	})
+	r.Register(&Command{
+		Name:       "remind",
+		Usage:      "<delay> <text>",
+		Summary:    "remind you of something in this conversation after a delay such as 30m, 2h or 1d",
+		Permission: rbac.MessagesWrite,
+		MinArgs:    2,
+		Run:        runRemind,
+	})
+	r.Register(&Command{
+		Name:       "email",
+		Usage:      "<subject>",
+		Summary:    "draft an email to the client",
+		Permission: rbac.EmailsWrite,
+		MinArgs:    1,
+		Run: func(ctx context.Context, db *gorm.DB, inv Invocation) (string, error) {
+			return runEmail(ctx, db, drafter, inv)
+		},
+	})
+}
+
+// runNote adds a note to the client's timeline
+func runNote(ctx context.Context, db *gorm.DB, inv Invocation) (string, error) {
+	id := uuid.New()
+	note := models.TimelineEvent{
+		ID:            id,
+		EventType:     "note",
+		Title:         "Note by " + inv.User.Name,
+		Content:       inv.Text,
+		ClientID:      inv.ClientID,
+		UserID:        inv.User.ID,
+		EventableType: "Note",
+		EventableID:   id,
+		EventTime:     time.Now(),
+	}
+	if err := db.WithContext(ctx).Create(&note).Error; err != nil {
+		return "", err
+	}
+	return "Note added to the client's timeline.", nil
+}
+
+// runAssign makes a user the owner of the client
+func runAssign(ctx context.Context, db *gorm.DB, inv Invocation) (string, error) {
+	name := strings.TrimPrefix(inv.Args[0], "@")
+	if name == "" {
+		return "", fmt.Errorf("%w: /assign @<user>", ErrUsage)
+	}
+
+	var owners []models.User
+	if err := db.WithContext(ctx).Where("name = ? OR email = ?", name, name).Limit(2).Find(&owners).Error; err != nil {
+		return "", err
+	}
+	switch len(owners) {
+	case 0:
+		return fmt.Sprintf("No user is called %s.", name), nil
+	case 2:
+		return fmt.Sprintf("Several users are called %s, use their email instead.", name), nil
+	}
+	owner := owners[0]
+
+	var client models.Client
+	if err := db.WithContext(ctx).Where("id = ?", inv.ClientID).First(&client).Error; err != nil {
+		return "", err
+	}
+
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.Client{}).Where("id = ?", inv.ClientID).Update("owner_id", owner.ID).Error; err != nil {
+			return err
+		}
+		id := uuid.New()
+		return tx.Create(&models.TimelineEvent{
+			ID:            id,
+			EventType:     "assignment",
+			Title:         "Assigned to " + owner.Name,
+			Content:       fmt.Sprintf("%s made %s the owner of this client", inv.User.Name, owner.Name),
+			ClientID:      inv.ClientID,
+			UserID:        inv.User.ID,
+			EventableType: "User",
+			EventableID:   owner.ID,
+			EventTime:     time.Now(),
+		}).Error
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// Owners who are away hear about it in their next digest
+	if owner.ID != inv.User.ID {
+		notify.Assigned(owner.ID, client, inv.User.Name)
+	}
+	return fmt.Sprintf("%s now owns this client.", owner.Name), nil
+}
+
+// runRemind schedules a reminder for the user in the conversation
+func runRemind(ctx context.Context, db *gorm.DB, inv Invocation) (string, error) {
+	delay, err := parseDelay(inv.Args[0])
+	if err != nil || delay <= 0 || delay > maxReminderDelay {
+		return "", fmt.Errorf("%w: /remind <delay> <text>, with a delay such as 30m, 2h or 1d of at most a year", ErrUsage)
+	}
+	text := strings.TrimSpace(strings.TrimPrefix(inv.Text, inv.Args[0]))
+
+	reminder := models.Reminder{
+		UserID:   inv.User.ID,
+		ClientID: inv.ClientID,
+		Room:     inv.Room,
+		Content:  text,
+		DueAt:    time.Now().Add(delay),
+	}
+	if err := db.WithContext(ctx).Create(&reminder).Error; err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("I will remind you at %s: %s", reminder.DueAt.Format("Jan 2 15:04 MST"), text), nil
+}
+
+// runEmail drafts an email to the client
+func runEmail(ctx context.Context, db *gorm.DB, drafter Drafter, inv Invocation) (string, error) {
+	var client models.Client
+	if err := db.WithContext(ctx).Where("id = ?", inv.ClientID).First(&client).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "This conversation has no client to email.", nil
+		}
+		return "", err
+	}
+
+	draft, err := drafter.DraftEmail(ctx, inv.User, client, inv.Text)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Drafted an email to %s with the subject %q (draft %s).", draft.To, draft.Subject, draft.ID), nil
+}
+
+// parseDelay reads a delay such as 90s, 30m, 2h or 1d
+func parseDelay(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
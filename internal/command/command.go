@@ -0,0 +1,205 @@
+// Package command runs the slash commands users type in chat, such as "/note Called back" or
+// "/remind 2h Send the quote". Commands are recognised by every path that posts messages; their
+// reply is only shown to the user who issued them and they are never stored as messages.
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"crm-communication-api/internal/rbac"
+	"crm-communication-api/models"
+)
+
+// Errors returned by Router.Run
+var (
+	ErrUnknownCommand = errors.New("unknown command")
+	ErrForbidden      = errors.New("not allowed to run this command")
+	ErrUsage          = errors.New("usage")
+)
+
+// Invocation is a command typed by a user in a conversation
+type Invocation struct {
+	User     models.User
+	ClientID uuid.UUID
+	ThreadID *uuid.UUID
+	ParentID *uuid.UUID
+	Room     string // Room the command was typed in, the conversation's ID
+	Name     string
+	Args     []string
+	Text     string // Everything after the command name, trimmed
+}
+
+// Handler runs a command and returns the reply shown to the user who issued it
+type Handler func(ctx context.Context, db *gorm.DB, inv Invocation) (string, error)
+
+// Command is a slash command
+type Command struct {
+	Name       string
+	Usage      string          // Arguments, as shown in help
+	Summary    string          // What the command does, as shown in help
+	Permission rbac.Permission // Permission needed to run the command; empty allows every user
+	MinArgs    int
+	Run        Handler
+}
+
+// allows reports whether a role may run the command
+func (c *Command) allows(db *gorm.DB, role string) (bool, error) {
+	if c.Permission == "" {
+		return true, nil
+	}
+	return rbac.Has(db, role, c.Permission)
+}
+
+// usage returns the command's help line
+func (c *Command) usage() string {
+	line := "/" + c.Name
+	if c.Usage != "" {
+		line += " " + c.Usage
+	}
+	return line + " - " + c.Summary
+}
+
+// Router holds the commands users can run
+type Router struct {
+	db       *gorm.DB
+	commands map[string]*Command
+}
+
+// NewRouter creates a router with the built-in commands; drafts are stored by drafter
+func NewRouter(db *gorm.DB, drafter Drafter) *Router {
+	r := &Router{db: db, commands: make(map[string]*Command)}
+	r.Register(&Command{
+		Name:    "help",
+		Usage:   "[command]",
+		Summary: "list the commands you can run, or explain one",
+		Run:     r.help,
+	})
+	registerBuiltins(r, drafter)
+	return r
+}
+
+// Register adds a command, replacing any command with the same name
+func (r *Router) Register(cmd *Command) {
+	r.commands[cmd.Name] = cmd
+}
+
+// Has reports whether a command exists
+func (r *Router) Has(name string) bool {
+	_, ok := r.commands[strings.ToLower(name)]
+	return ok
+}
+
+// Run checks an invocation against its command's permission and arguments, then runs it.
+// Wrong arguments return an error wrapping ErrUsage whose message shows the usage.
+func (r *Router) Run(ctx context.Context, inv Invocation) (string, error) {
+	cmd, ok := r.commands[strings.ToLower(inv.Name)]
+	if !ok {
+		return "", fmt.Errorf("%w /%s, type /help for the list", ErrUnknownCommand, inv.Name)
+	}
+	allowed, err := cmd.allows(r.db, inv.User.Role)
+	if err != nil {
+		return "", err
+	}
+	if !allowed {
+		return "", fmt.Errorf("%w: /%s", ErrForbidden, cmd.Name)
+	}
+	if len(inv.Args) < cmd.MinArgs {
+		return "", usageError(cmd)
+	}
+	return cmd.Run(ctx, r.db, inv)
+}
+
+// help lists the commands the user may run, or describes one
+func (r *Router) help(ctx context.Context, db *gorm.DB, inv Invocation) (string, error) {
+	if len(inv.Args) > 0 {
+		name := strings.TrimPrefix(strings.ToLower(inv.Args[0]), "/")
+		cmd, ok := r.commands[name]
+		if !ok {
+			return "", fmt.Errorf("%w /%s, type /help for the list", ErrUnknownCommand, name)
+		}
+		return cmd.usage(), nil
+	}
+
+	names := make([]string, 0, len(r.commands))
+	for name, cmd := range r.commands {
+		allowed, err := cmd.allows(db, inv.User.Role)
+		if err != nil {
+			return "", err
+		}
+		if allowed {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	lines := make([]string, 0, len(names)+1)
+	lines = append(lines, "Commands:")
+	for _, name := range names {
+		lines = append(lines, r.commands[name].usage())
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// usageError reports that a command was given the wrong arguments
+func usageError(cmd *Command) error {
+	return fmt.Errorf("%w: %s", ErrUsage, cmd.usage())
+}
+
+// Parse splits a message into a command name and its arguments. It reports false when the
+// message is not a command: commands start with "/" followed by a letter, and "//" escapes a
+// message that should start with a slash. Arguments are separated by spaces; double quotes group
+// words into one argument, as in /assign @"Jane Doe".
+func Parse(content string) (name string, args []string, text string, ok bool) {
+	content = strings.TrimSpace(content)
+	if len(content) < 2 || content[0] != '/' || !unicode.IsLetter(rune(content[1])) {
+		return "", nil, "", false
+	}
+
+	name, text, _ = strings.Cut(content[1:], " ")
+	text = strings.TrimSpace(text)
+	return strings.ToLower(name), splitArgs(text), text, true
+}
+
+// Unescape turns a message starting with "//" into one starting with a single "/", so users can
+// post a message that would otherwise be read as a command
+func Unescape(content string) string {
+	if strings.HasPrefix(strings.TrimSpace(content), "//") {
+		return strings.Replace(content, "//", "/", 1)
+	}
+	return content
+}
+
+// splitArgs splits text on spaces outside double quotes, dropping the quotes
+func splitArgs(text string) []string {
+	var args []string
+	var current strings.Builder
+	inQuotes, inArg := false, false
+	for _, r := range text {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			inArg = true
+		case unicode.IsSpace(r) && !inQuotes:
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args
+}
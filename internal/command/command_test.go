@@ -0,0 +1,147 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"gorm.io/gorm"
+
+	"crm-communication-api/internal/testdb"
+	"crm-communication-api/models"
+)
+
+// noDrafts is a Drafter for tests that never draft emails
+type noDrafts struct{}
+
+func (noDrafts) DraftEmail(ctx context.Context, sender models.User, client models.Client, subject string) (*models.EmailDraft, error) {
+	return nil, errors.New("no drafts in this test")
+}
+
+// openCommandTest creates a router on a test database holding a client
+func openCommandTest(t *testing.T) (*Router, *gorm.DB, models.Client) {
+	t.Helper()
+
+	db := testdb.Open(t, &models.User{}, &models.Client{}, &models.TimelineEvent{}, &models.Role{},
+		&models.WebhookSubscription{}, &models.WebhookDelivery{})
+	client := models.Client{Name: "Acme", Email: "acme@example.com"}
+	if err := db.Create(&client).Error; err != nil {
+		t.Fatal(err)
+	}
+	return NewRouter(db, noDrafts{}), db, client
+}
+
+// invocation parses a command typed by the user with a role in the client's conversation
+func invocation(t *testing.T, db *gorm.DB, role string, client models.Client, content string) Invocation {
+	t.Helper()
+
+	var user models.User
+	err := db.Where(models.User{Email: role + "@example.com"}).
+		Attrs(models.User{Name: "Ada " + role, Role: role}).
+		FirstOrCreate(&user).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, args, text, ok := Parse(content)
+	if !ok {
+		t.Fatalf("%q is not a command", content)
+	}
+	return Invocation{User: user, ClientID: client.ID, Room: client.ID.String(), Name: name, Args: args, Text: text}
+}
+
+func TestCommandsNeedTheirPermission(t *testing.T) {
+	router, db, client := openCommandTest(t)
+	custom := models.Role{Name: "notetaker", Permissions: "CLIENTS_READ,TIMELINE_WRITE"}
+	if err := db.Create(&custom).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		role    string
+		content string
+		allowed bool
+	}{
+		{role: "read-only", content: "/note Called back", allowed: false},
+		{role: "agent", content: "/note Called back", allowed: true},
+		{role: "notetaker", content: "/note Called back", allowed: true},
+		{role: "unknown", content: "/note Called back", allowed: false},
+		{role: "agent", content: "/assign @nobody", allowed: false},
+		{role: "manager", content: "/assign @nobody", allowed: true},
+		{role: "read-only", content: "/help", allowed: true},
+	}
+	for _, test := range tests {
+		_, err := router.Run(context.Background(), invocation(t, db, test.role, client, test.content))
+		if test.allowed && err != nil {
+			t.Errorf("%s running %q got %v, want it allowed", test.role, test.content, err)
+		}
+		if !test.allowed && !errors.Is(err, ErrForbidden) {
+			t.Errorf("%s running %q got %v, want ErrForbidden", test.role, test.content, err)
+		}
+	}
+
+	// Only the notes of the roles allowed to take them were added
+	var notes int64
+	if err := db.Model(&models.TimelineEvent{}).Where("event_type = ?", "note").Count(&notes).Error; err != nil {
+		t.Fatal(err)
+	}
+	if notes != 2 {
+		t.Errorf("%d notes added, want 2", notes)
+	}
+}
+
+func TestHelpListsTheCommandsTheUserMayRun(t *testing.T) {
+	router, db, client := openCommandTest(t)
+
+	reply, err := router.Run(context.Background(), invocation(t, db, "read-only", client, "/help"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(reply, "/help") || strings.Contains(reply, "/note") || strings.Contains(reply, "/assign") {
+		t.Errorf("help for a read-only user lists:\n%s", reply)
+	}
+
+	reply, err = router.Run(context.Background(), invocation(t, db, "manager", client, "/help"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(reply, "/note") || !strings.Contains(reply, "/assign") {
+		t.Errorf("help for a manager lists:\n%s", reply)
+	}
+}
+
+func TestCommandsCheckTheirArguments(t *testing.T) {
+	router, db, client := openCommandTest(t)
+
+	for _, content := range []string{"/note", "/remind 2h", "/remind soon Send the quote"} {
+		_, err := router.Run(context.Background(), invocation(t, db, "agent", client, content))
+		if !errors.Is(err, ErrUsage) {
+			t.Errorf("%q got %v, want a usage error", content, err)
+		}
+	}
+	if _, err := router.Run(context.Background(), invocation(t, db, "admin", client, "/unknown")); !errors.Is(err, ErrUnknownCommand) {
+		t.Errorf("unknown command got %v, want ErrUnknownCommand", err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		content string
+		name    string
+		args    []string
+		ok      bool
+	}{
+		{content: "/NOTE Called back", name: "note", args: []string{"Called", "back"}, ok: true},
+		{content: `/assign @"Jane Doe"`, name: "assign", args: []string{"@Jane Doe"}, ok: true},
+		{content: "  /help  ", name: "help", ok: true},
+		{content: "//not a command"},
+		{content: "/ 2 slashes"},
+		{content: "hello /note"},
+	}
+	for _, test := range tests {
+		name, args, _, ok := Parse(test.content)
+		if ok != test.ok || name != test.name || strings.Join(args, "|") != strings.Join(test.args, "|") {
+			t.Errorf("Parse(%q) = %q, %q, %v, want %q, %q, %v", test.content, name, args, ok, test.name, test.args, test.ok)
+		}
+	}
+}
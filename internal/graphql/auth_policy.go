@@ -0,0 +1,81 @@
+package graphql
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	gqlgen "github.com/99designs/gqlgen/graphql"
+	"github.com/99designs/gqlgen/graphql/handler/transport"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+
+	"crm-communication-api/auth"
+)
+
+// publicDirective marks the fields that can be queried without signing in
+const publicDirective = "public"
+
+// requireAuthentication rejects operations made without a valid access token unless every field
+// they select at the root is @public. The decision is made on the parsed and validated operation,
+// so aliases, fragments, comments and operation names cannot sneak a private field through.
+func requireAuthentication(ctx context.Context, next gqlgen.OperationHandler) gqlgen.ResponseHandler {
+	if _, err := auth.GetUserFromContext(ctx); err == nil {
+		return next(ctx)
+	}
+
+	opCtx := gqlgen.GetOperationContext(ctx)
+	if opCtx.Operation != nil && isPublic(opCtx.Operation.SelectionSet) {
+		return next(ctx)
+	}
+
+	return gqlgen.OneShot(&gqlgen.Response{Errors: gqlerror.List{{
+		Message:    "not authenticated",
+		Extensions: map[string]interface{}{"code": "UNAUTHENTICATED"},
+	}}})
+}
+
+// isPublic reports whether every field of a root selection set is @public, looking into inline
+// fragments and fragment spreads. Fields skipped with @skip or @include still count, and
+// introspection fields (__typename, __schema and __type) are public.
+func isPublic(selections ast.SelectionSet) bool {
+	for _, selection := range selections {
+		switch s := selection.(type) {
+		case *ast.Field:
+			if strings.HasPrefix(s.Name, "__") {
+				continue
+			}
+			if s.Definition == nil || s.Definition.Directives.ForName(publicDirective) == nil {
+				return false
+			}
+		case *ast.InlineFragment:
+			if !isPublic(s.SelectionSet) {
+				return false
+			}
+		case *ast.FragmentSpread:
+			if s.Definition == nil || !isPublic(s.Definition.SelectionSet) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// authenticateWebsocket attaches the identity of the access token in the connection_init payload,
+// {"Authorization": "Bearer <token>"}, to the operations of the connection. Browsers cannot set
+// headers on WebSocket requests, so subscriptions authenticate this way. Connections without a
+// token only run public operations; an invalid token closes the connection.
+func authenticateWebsocket(ctx context.Context, initPayload transport.InitPayload) (context.Context, *transport.InitPayload, error) {
+	token := strings.TrimPrefix(initPayload.Authorization(), "Bearer ")
+	if token == "" {
+		return ctx, nil, nil
+	}
+
+	claims, err := auth.ValidateAccessToken(token)
+	if err != nil {
+		return ctx, nil, errors.New("invalid token")
+	}
+	return auth.WithClaims(ctx, claims), nil, nil
+}
@@ -0,0 +1,165 @@
+package graphql
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/vektah/gqlparser/v2"
+
+	"crm-communication-api/internal/graphql/generated"
+	"crm-communication-api/internal/graphql/resolvers"
+)
+
+// graphqlResponse is the part of a GraphQL response the policy tests look at
+type graphqlResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []struct {
+		Message    string                 `json:"message"`
+		Extensions map[string]interface{} `json:"extensions"`
+	} `json:"errors"`
+}
+
+// post sends an operation to the real handler without an access token
+func post(t *testing.T, query, operationName string) graphqlResponse {
+	t.Helper()
+
+	body, err := json.Marshal(map[string]string{"query": query, "operationName": operationName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/graphql", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	NewHandler().ServeHTTP(rec, req)
+
+	var resp graphqlResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding response %q: %v", rec.Body.String(), err)
+	}
+	return resp
+}
+
+func TestPrivateOperationsNeedAToken(t *testing.T) {
+	tests := []struct {
+		name          string
+		query         string
+		operationName string
+	}{
+		{
+			name:  "private field",
+			query: `{ clients { id } }`,
+		},
+		{
+			name:  "aliased as a public field",
+			query: `{ login: clients { id } }`,
+		},
+		{
+			name:  "fragment spread",
+			query: `query { ...Everything } fragment Everything on Query { clients { id } }`,
+		},
+		{
+			name:  "inline fragment",
+			query: `query { ... on Query { clients { id } } }`,
+		},
+		{
+			name:          "operation named after a public field",
+			query:         `query Login { clients { id } }`,
+			operationName: "Login",
+		},
+		{
+			name:  "public and private fields together",
+			query: `mutation { login(input: {email: "a@example.com", password: "secret"}) { token } createClient(input: {name: "Acme", email: "acme@example.com"}) { id } }`,
+		},
+		{
+			name:          "private operation next to a public one",
+			query:         `mutation Login { login(input: {email: "a@example.com", password: "secret"}) { token } } query Clients { clients { id } }`,
+			operationName: "Clients",
+		},
+		{
+			name:  "introspection next to a private field",
+			query: `{ __typename clients { id } }`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := post(t, tt.query, tt.operationName)
+			if len(resp.Errors) != 1 || resp.Errors[0].Extensions["code"] != "UNAUTHENTICATED" {
+				t.Fatalf("errors = %+v, want a single UNAUTHENTICATED error", resp.Errors)
+			}
+			if len(resp.Data) > 0 && string(resp.Data) != "null" {
+				t.Errorf("data = %s, want none", resp.Data)
+			}
+		})
+	}
+}
+
+func TestIntrospectionNeedsNoToken(t *testing.T) {
+	resp := post(t, `{ __schema { queryType { name } } }`, "")
+	if len(resp.Errors) > 0 {
+		t.Fatalf("errors = %+v, want none", resp.Errors)
+	}
+	if want := `{"__schema":{"queryType":{"name":"Query"}}}`; string(resp.Data) != want {
+		t.Errorf("data = %s, want %s", resp.Data, want)
+	}
+}
+
+func TestIsPublic(t *testing.T) {
+	schema := generated.NewExecutableSchema(generated.Config{Resolvers: &resolvers.Resolver{}}).Schema()
+
+	tests := []struct {
+		name          string
+		query         string
+		operationName string
+		want          bool
+	}{
+		{
+			name:  "public field",
+			query: `mutation { login(input: {email: "a@example.com", password: "secret"}) { token } }`,
+			want:  true,
+		},
+		{
+			name:  "public fields in fragments",
+			query: `mutation { ...SignIn ... on Mutation { refreshToken(token: "t") { token } } } fragment SignIn on Mutation { login(input: {email: "a@example.com", password: "secret"}) { token } }`,
+			want:  true,
+		},
+		{
+			name:          "public operation next to a private one",
+			query:         `mutation Login { login(input: {email: "a@example.com", password: "secret"}) { token } } query Clients { clients { id } }`,
+			operationName: "Login",
+			want:          true,
+		},
+		{
+			name:  "introspection",
+			query: `{ __schema { queryType { name } } __typename }`,
+			want:  true,
+		},
+		{
+			name:  "private field aliased as a public one",
+			query: `mutation { login: createClient(input: {name: "Acme", email: "acme@example.com"}) { id } }`,
+			want:  false,
+		},
+		{
+			name:  "private field in a nested fragment",
+			query: `query { ... on Query { ...Clients } } fragment Clients on Query { clients { id } }`,
+			want:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := gqlparser.LoadQuery(schema, tt.query)
+			if err != nil {
+				t.Fatalf("loading query: %v", err)
+			}
+			op := doc.Operations.ForName(tt.operationName)
+			if op == nil {
+				t.Fatalf("no operation %q", tt.operationName)
+			}
+			if got := isPublic(op.SelectionSet); got != tt.want {
+				t.Errorf("isPublic() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
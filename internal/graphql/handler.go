@@ -10,7 +10,8 @@ import (
 	"github.com/99designs/gqlgen/graphql/handler/lru"
 	"github.com/99designs/gqlgen/graphql/handler/transport"
 	"github.com/99designs/gqlgen/graphql/playground"
-	"github.com/gorilla/websocket"
+	"github.com/coder/websocket"
+	"github.com/vektah/gqlparser/v2/ast"
 
 	"crm-communication-api/auth"
 	"crm-communication-api/internal/graphql/generated"
@@ -22,18 +23,21 @@ func NewHandler() *handler.Server {
 	// Create a new GraphQL handler
 	srv := handler.New(generated.NewExecutableSchema(generated.Config{
 		Resolvers: &resolvers.Resolver{},
+		Directives: generated.DirectiveRoot{
+			HasPermission: resolvers.HasPermission,
+			Public:        resolvers.Public,
+		},
 	}))
 
 	// Set up cors and WebSocket configuration
 	srv.AddTransport(transport.Websocket{
 		KeepAlivePingInterval: 10 * time.Second,
-		Upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool {
+		InitFunc:              authenticateWebsocket,
+		Implementation: transport.CoderWebsocketImplementation{
+			AcceptOptions: websocket.AcceptOptions{
 				// Allow all origins in development
-				return true
+				InsecureSkipVerify: true,
 			},
-			ReadBufferSize:  1024,
-			WriteBufferSize: 1024,
 		},
 	})
 
@@ -47,7 +51,10 @@ func NewHandler() *handler.Server {
 	srv.Use(extension.Introspection{})
 
 	// Add query cache to improve performance
-	srv.SetQueryCache(lru.New(1000))
+	srv.SetQueryCache(lru.New[*ast.QueryDocument](1000))
+
+	// Reject operations needing a signed in user when the request has no valid token
+	srv.AroundOperations(requireAuthentication)
 
 	return srv
 }
@@ -60,14 +67,14 @@ func RegisterRoutes(mux *http.ServeMux) {
 	// Create the GraphQL playground handler
 	playgroundHandler := playground.Handler("GraphQL Playground", "/graphql")
 
-	// Apply authentication middleware to GraphQL endpoint
-	authMiddleware := auth.Middleware()
+	// Attach the identity of requests with a valid token; the handler decides what needs one
+	authMiddleware := auth.Middleware
 
 	// Register routes
 	mux.Handle("/playground", playgroundHandler)
 	mux.Handle("/graphql", authMiddleware(graphqlHandler))
 
-	// WebSocket specific endpoint for subscriptions
+	// WebSocket specific endpoint for subscriptions, authenticated by the connection_init payload
 	mux.Handle("/ws", authMiddleware(graphqlHandler))
 
 	log.Println("GraphQL endpoint registered at /graphql")
@@ -3,6 +3,10 @@
 package model
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
 	"time"
 
 	"github.com/google/uuid"
@@ -26,6 +30,7 @@ type Client struct {
 	Messages  []*Message       `json:"messages,omitempty"`
 	Emails    []*Email         `json:"emails,omitempty"`
 	Timeline  []*TimelineEvent `json:"timeline,omitempty"`
+	TeamID    *uuid.UUID       `json:"teamId,omitempty"`
 }
 
 type CreateClientInput struct {
@@ -47,6 +52,14 @@ type CreateMessageInput struct {
 	Content  string      `json:"content"`
 	ClientID uuid.UUID   `json:"clientId"`
 	Mentions []uuid.UUID `json:"mentions,omitempty"`
+	ParentID *uuid.UUID  `json:"parentId,omitempty"`
+}
+
+type CreateWebhookInput struct {
+	URL      string     `json:"url"`
+	Events   []string   `json:"events"`
+	ClientID *uuid.UUID `json:"clientId,omitempty"`
+	Secret   *string    `json:"secret,omitempty"`
 }
 
 type Email struct {
@@ -69,31 +82,156 @@ type LoginInput struct {
 	Password string `json:"password"`
 }
 
+type Mention struct {
+	ID        uuid.UUID  `json:"id"`
+	Message   *Message   `json:"message"`
+	ClientID  uuid.UUID  `json:"clientId"`
+	ThreadID  *uuid.UUID `json:"threadId,omitempty"`
+	ParentID  *uuid.UUID `json:"parentId,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	SeenAt    *time.Time `json:"seenAt,omitempty"`
+}
+
+type MentionConnection struct {
+	Edges       []*MentionEdge `json:"edges"`
+	PageInfo    *PageInfo      `json:"pageInfo"`
+	UnseenCount int            `json:"unseenCount"`
+}
+
+type MentionEdge struct {
+	Cursor string   `json:"cursor"`
+	Node   *Mention `json:"node"`
+}
+
 type Message struct {
+	ID          uuid.UUID          `json:"id"`
+	Content     string             `json:"content"`
+	Sender      *User              `json:"sender"`
+	Client      *Client            `json:"client"`
+	Mentions    []*User            `json:"mentions,omitempty"`
+	CreatedAt   time.Time          `json:"createdAt"`
+	UpdatedAt   time.Time          `json:"updatedAt"`
+	EditedAt    *time.Time         `json:"editedAt,omitempty"`
+	ParentID    *uuid.UUID         `json:"parentId,omitempty"`
+	ReplyCount  int                `json:"replyCount"`
+	LastReplyAt *time.Time         `json:"lastReplyAt,omitempty"`
+	Replies     *MessageConnection `json:"replies"`
+	DeletedAt   *time.Time         `json:"deletedAt,omitempty"`
+	DeletedBy   *User              `json:"deletedBy,omitempty"`
+	Ephemeral   bool               `json:"ephemeral"`
+	Reactions   []*ReactionCount   `json:"reactions"`
+}
+
+type MessageConnection struct {
+	Edges      []*MessageEdge `json:"edges"`
+	PageInfo   *PageInfo      `json:"pageInfo"`
+	TotalCount int            `json:"totalCount"`
+}
+
+type MessageEdge struct {
+	Cursor string   `json:"cursor"`
+	Node   *Message `json:"node"`
+}
+
+type MessageRevision struct {
 	ID        uuid.UUID `json:"id"`
 	Content   string    `json:"content"`
-	Sender    *User     `json:"sender"`
-	Client    *Client   `json:"client"`
-	Mentions  []*User   `json:"mentions,omitempty"`
+	EditedBy  *User     `json:"editedBy"`
 	CreatedAt time.Time `json:"createdAt"`
-	UpdatedAt time.Time `json:"updatedAt"`
 }
 
 type Mutation struct {
 }
 
+type NotificationPreferences struct {
+	Mentions       bool        `json:"mentions"`
+	Assignments    bool        `json:"assignments"`
+	QuietStart     *string     `json:"quietStart,omitempty"`
+	QuietEnd       *string     `json:"quietEnd,omitempty"`
+	TimeZone       string      `json:"timeZone"`
+	MutedClientIds []uuid.UUID `json:"mutedClientIds"`
+}
+
+type NotificationPreferencesInput struct {
+	Mentions    *bool   `json:"mentions,omitempty"`
+	Assignments *bool   `json:"assignments,omitempty"`
+	QuietStart  *string `json:"quietStart,omitempty"`
+	QuietEnd    *string `json:"quietEnd,omitempty"`
+	TimeZone    *string `json:"timeZone,omitempty"`
+}
+
+type PageInfo struct {
+	HasNextPage bool    `json:"hasNextPage"`
+	EndCursor   *string `json:"endCursor,omitempty"`
+}
+
 type Query struct {
 }
 
+type ReactionCount struct {
+	Emoji   string      `json:"emoji"`
+	Count   int         `json:"count"`
+	UserIds []uuid.UUID `json:"userIds"`
+}
+
+type ReactionEvent struct {
+	MessageID uuid.UUID        `json:"messageId"`
+	ClientID  uuid.UUID        `json:"clientId"`
+	User      *User            `json:"user"`
+	Emoji     string           `json:"emoji"`
+	Added     bool             `json:"added"`
+	Reactions []*ReactionCount `json:"reactions"`
+}
+
+type ReadReceipt struct {
+	User      *User      `json:"user"`
+	ClientID  uuid.UUID  `json:"clientId"`
+	ThreadID  *uuid.UUID `json:"threadId,omitempty"`
+	ParentID  *uuid.UUID `json:"parentId,omitempty"`
+	MessageID uuid.UUID  `json:"messageId"`
+	ReadAt    time.Time  `json:"readAt"`
+}
+
 type RegisterInput struct {
 	Name     string `json:"name"`
 	Email    string `json:"email"`
 	Password string `json:"password"`
 }
 
+type Role struct {
+	Name        string       `json:"name"`
+	Description *string      `json:"description,omitempty"`
+	Permissions []Permission `json:"permissions"`
+	Builtin     bool         `json:"builtin"`
+}
+
+type RoleInput struct {
+	Name        string       `json:"name"`
+	Description *string      `json:"description,omitempty"`
+	Permissions []Permission `json:"permissions"`
+}
+
+type Session struct {
+	ID           uuid.UUID `json:"id"`
+	AuthProvider string    `json:"authProvider"`
+	UserAgent    *string   `json:"userAgent,omitempty"`
+	IPAddress    *string   `json:"ipAddress,omitempty"`
+	Current      bool      `json:"current"`
+	CreatedAt    time.Time `json:"createdAt"`
+	LastUsedAt   time.Time `json:"lastUsedAt"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+}
+
 type Subscription struct {
 }
 
+type Team struct {
+	ID        uuid.UUID `json:"id"`
+	Name      string    `json:"name"`
+	Members   []*User   `json:"members"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
 type TimelineEvent struct {
 	ID            uuid.UUID `json:"id"`
 	EventType     string    `json:"eventType"`
@@ -104,6 +242,13 @@ type TimelineEvent struct {
 	CreatedAt     time.Time `json:"createdAt"`
 }
 
+type UnreadCount struct {
+	ClientID uuid.UUID  `json:"clientId"`
+	ThreadID *uuid.UUID `json:"threadId,omitempty"`
+	ParentID *uuid.UUID `json:"parentId,omitempty"`
+	Count    int        `json:"count"`
+}
+
 type UpdateClientInput struct {
 	ID      uuid.UUID `json:"id"`
 	Name    *string   `json:"name,omitempty"`
@@ -113,6 +258,13 @@ type UpdateClientInput struct {
 	Notes   *string   `json:"notes,omitempty"`
 }
 
+type UpdateWebhookInput struct {
+	URL          *string  `json:"url,omitempty"`
+	Events       []string `json:"events,omitempty"`
+	Active       *bool    `json:"active,omitempty"`
+	RotateSecret *bool    `json:"rotateSecret,omitempty"`
+}
+
 type User struct {
 	ID        uuid.UUID `json:"id"`
 	Name      string    `json:"name"`
@@ -121,3 +273,113 @@ type User struct {
 	CreatedAt time.Time `json:"createdAt"`
 	UpdatedAt time.Time `json:"updatedAt"`
 }
+
+type Webhook struct {
+	ID        uuid.UUID  `json:"id"`
+	URL       string     `json:"url"`
+	Events    []string   `json:"events"`
+	ClientID  *uuid.UUID `json:"clientId,omitempty"`
+	Active    bool       `json:"active"`
+	Secret    *string    `json:"secret,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+}
+
+type WebhookDelivery struct {
+	ID             uuid.UUID  `json:"id"`
+	WebhookID      uuid.UUID  `json:"webhookId"`
+	Event          string     `json:"event"`
+	Payload        string     `json:"payload"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	LastStatusCode *int       `json:"lastStatusCode,omitempty"`
+	LastError      *string    `json:"lastError,omitempty"`
+	NextAttemptAt  *time.Time `json:"nextAttemptAt,omitempty"`
+	DeliveredAt    *time.Time `json:"deliveredAt,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+}
+
+type WebhookDeliveryConnection struct {
+	Edges    []*WebhookDeliveryEdge `json:"edges"`
+	PageInfo *PageInfo              `json:"pageInfo"`
+}
+
+type WebhookDeliveryEdge struct {
+	Cursor string           `json:"cursor"`
+	Node   *WebhookDelivery `json:"node"`
+}
+
+type Permission string
+
+const (
+	PermissionClientsRead      Permission = "CLIENTS_READ"
+	PermissionClientsWrite     Permission = "CLIENTS_WRITE"
+	PermissionClientsAssign    Permission = "CLIENTS_ASSIGN"
+	PermissionClientsAll       Permission = "CLIENTS_ALL"
+	PermissionMessagesWrite    Permission = "MESSAGES_WRITE"
+	PermissionMessagesModerate Permission = "MESSAGES_MODERATE"
+	PermissionMessagesPurge    Permission = "MESSAGES_PURGE"
+	PermissionTimelineWrite    Permission = "TIMELINE_WRITE"
+	PermissionTimelineModerate Permission = "TIMELINE_MODERATE"
+	PermissionEmailsWrite      Permission = "EMAILS_WRITE"
+	PermissionWebhooksManage   Permission = "WEBHOOKS_MANAGE"
+	PermissionUsersManage      Permission = "USERS_MANAGE"
+)
+
+var AllPermission = []Permission{
+	PermissionClientsRead,
+	PermissionClientsWrite,
+	PermissionClientsAssign,
+	PermissionClientsAll,
+	PermissionMessagesWrite,
+	PermissionMessagesModerate,
+	PermissionMessagesPurge,
+	PermissionTimelineWrite,
+	PermissionTimelineModerate,
+	PermissionEmailsWrite,
+	PermissionWebhooksManage,
+	PermissionUsersManage,
+}
+
+func (e Permission) IsValid() bool {
+	switch e {
+	case PermissionClientsRead, PermissionClientsWrite, PermissionClientsAssign, PermissionClientsAll, PermissionMessagesWrite, PermissionMessagesModerate, PermissionMessagesPurge, PermissionTimelineWrite, PermissionTimelineModerate, PermissionEmailsWrite, PermissionWebhooksManage, PermissionUsersManage:
+		return true
+	}
+	return false
+}
+
+func (e Permission) String() string {
+	return string(e)
+}
+
+func (e *Permission) UnmarshalGQL(v any) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = Permission(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid Permission", str)
+	}
+	return nil
+}
+
+func (e Permission) MarshalGQL(w io.Writer) {
+	_, _ = fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+func (e *Permission) UnmarshalJSON(b []byte) error {
+	s, err := strconv.Unquote(string(b))
+	if err != nil {
+		return err
+	}
+	return e.UnmarshalGQL(s)
+}
+
+func (e Permission) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	e.MarshalGQL(&buf)
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,221 @@
+package resolvers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/mail"
+	"strings"
+
+	"crm-communication-api/auth"
+	"crm-communication-api/database"
+	"crm-communication-api/internal/graphql/model"
+	"crm-communication-api/internal/rbac"
+	"crm-communication-api/models"
+
+	"github.com/99designs/gqlgen/graphql"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// Codes of the errors the auth mutations return
+const (
+	CodeBadUserInput       = "BAD_USER_INPUT"
+	CodeEmailTaken         = "EMAIL_TAKEN"
+	CodeInvalidCredentials = "INVALID_CREDENTIALS"
+	CodeInvalidToken       = "INVALID_TOKEN"
+)
+
+// minPasswordLength is the shortest password register accepts
+const minPasswordLength = 8
+
+// Auth providers recorded in the tokens
+const (
+	providerPassword = "password"
+	providerGoogle   = "google"
+)
+
+// dummyPasswordHash is compared against when no user has the email, so that login takes as long
+// for unknown emails as for wrong passwords
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+
+// Public implements the @public directive. It only marks the fields that need no access token;
+// the GraphQL handler checks every operation against it before any field resolves.
+func Public(ctx context.Context, obj interface{}, next graphql.Resolver) (interface{}, error) {
+	return next(ctx)
+}
+
+// Register creates a user with a password and signs them in
+func (r *mutationResolver) Register(ctx context.Context, input model.RegisterInput) (*model.Auth, error) {
+	name := strings.TrimSpace(input.Name)
+	if name == "" {
+		return nil, codedError(CodeBadUserInput, "a name is required")
+	}
+	email, err := normalizeEmail(input.Email)
+	if err != nil {
+		return nil, err
+	}
+	if len(input.Password) < minPasswordLength {
+		return nil, codedError(CodeBadUserInput, "the password must be at least 8 characters")
+	}
+
+	db := database.GetDB()
+
+	var count int64
+	if err := db.Model(&models.User{}).Where("LOWER(email) = ?", email).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, codedError(CodeEmailTaken, "a user with this email already exists")
+	}
+
+	// The password is hashed by BeforeCreate
+	user := models.User{
+		Name:     name,
+		Email:    email,
+		Password: input.Password,
+		Role:     rbac.DefaultRole,
+	}
+	if err := db.Create(&user).Error; err != nil {
+		log.Printf("Error creating user: %v", err)
+		return nil, err
+	}
+
+	log.Printf("Registered user %s", user.ID)
+	return issueAuth(ctx, db, &user, providerPassword)
+}
+
+// Login signs a user in with their email and password
+func (r *mutationResolver) Login(ctx context.Context, input model.LoginInput) (*model.Auth, error) {
+	email := strings.ToLower(strings.TrimSpace(input.Email))
+	if email == "" || input.Password == "" {
+		return nil, codedError(CodeBadUserInput, "email and password are required")
+	}
+
+	db := database.GetDB()
+
+	var user models.User
+	err := db.Where("LOWER(email) = ?", email).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(input.Password))
+		return nil, codedError(CodeInvalidCredentials, "invalid email or password")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Users who signed up with Google have no password to compare against
+	if user.Password == "" || user.ComparePassword(input.Password) != nil {
+		return nil, codedError(CodeInvalidCredentials, "invalid email or password")
+	}
+
+	return issueAuth(ctx, db, &user, providerPassword)
+}
+
+// GoogleLogin signs a user in with a Google ID token, linking the Google account to the user with
+// its email or creating one
+func (r *mutationResolver) GoogleLogin(ctx context.Context, input model.GoogleLoginInput) (*model.Auth, error) {
+	if input.IDToken == "" {
+		return nil, codedError(CodeBadUserInput, "an ID token is required")
+	}
+
+	info, err := auth.VerifyGoogleIDToken(ctx, input.IDToken)
+	if errors.Is(err, auth.ErrInvalidIDToken) {
+		return nil, codedError(CodeInvalidToken, "invalid Google ID token")
+	}
+	if err != nil {
+		log.Printf("Error verifying Google ID token: %v", err)
+		return nil, err
+	}
+
+	db := database.GetDB()
+
+	var user models.User
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var provider models.OAuthProvider
+		err := tx.Where("provider = ? AND provider_id = ?", providerGoogle, info.ID).First(&provider).Error
+		if err == nil {
+			return tx.Where("id = ?", provider.UserID).First(&user).Error
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		// First sign-in with this Google account: link it to the user with its email, or create one
+		email := strings.ToLower(info.Email)
+		err = tx.Where("LOWER(email) = ?", email).First(&user).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			user = models.User{Name: info.Name, Email: email, Role: rbac.DefaultRole}
+			if user.Name == "" {
+				user.Name = email
+			}
+			err = tx.Create(&user).Error
+		}
+		if err != nil {
+			return err
+		}
+		return tx.Create(&models.OAuthProvider{
+			UserID:     user.ID,
+			Provider:   providerGoogle,
+			ProviderID: info.ID,
+		}).Error
+	})
+	if err != nil {
+		log.Printf("Error signing in Google account %s: %v", info.ID, err)
+		return nil, err
+	}
+
+	return issueAuth(ctx, db, &user, providerGoogle)
+}
+
+// RefreshToken exchanges a refresh token for a new pair of tokens of the same session. Each refresh
+// token can be exchanged once; exchanging one again signs its session out.
+func (r *mutationResolver) RefreshToken(ctx context.Context, token string) (*model.Auth, error) {
+	tokens, err := auth.RotateRefreshToken(database.GetDB(), token, auth.DeviceFromContext(ctx))
+	if errors.Is(err, auth.ErrRefreshTokenReused) {
+		return nil, codedError(CodeInvalidToken, "refresh token already used, the session was signed out")
+	}
+	if errors.Is(err, auth.ErrInvalidRefreshToken) {
+		return nil, codedError(CodeInvalidToken, "invalid or expired refresh token")
+	}
+	if err != nil {
+		log.Printf("Error refreshing token: %v", err)
+		return nil, err
+	}
+
+	return authFromTokens(tokens), nil
+}
+
+// issueAuth signs a user in on the requesting device, starting a session
+func issueAuth(ctx context.Context, db *gorm.DB, user *models.User, provider string) (*model.Auth, error) {
+	tokens, err := auth.StartSession(db, user, provider, auth.DeviceFromContext(ctx))
+	if err != nil {
+		log.Printf("Error starting session of user %s: %v", user.ID, err)
+		return nil, err
+	}
+	return authFromTokens(tokens), nil
+}
+
+// authFromTokens converts the tokens of a session to the GraphQL model
+func authFromTokens(tokens *auth.Tokens) *model.Auth {
+	return &model.Auth{
+		Token:        tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		User:         userFromModel(tokens.User),
+	}
+}
+
+// normalizeEmail checks an email address and returns it lowercased
+func normalizeEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return "", codedError(CodeBadUserInput, "invalid email address")
+	}
+	return email, nil
+}
+
+// codedError creates a user error carrying one of the auth error codes
+func codedError(code, message string) error {
+	return &UserError{Message: message, Code: code}
+}
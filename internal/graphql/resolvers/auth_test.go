@@ -0,0 +1,139 @@
+package resolvers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"crm-communication-api/auth"
+	"crm-communication-api/database"
+	"crm-communication-api/internal/graphql/model"
+	"crm-communication-api/internal/testdb"
+	"crm-communication-api/models"
+)
+
+// useDevelopmentKeys signs tokens with development keys for the duration of a test
+func useDevelopmentKeys(t *testing.T) {
+	t.Helper()
+
+	t.Setenv("APP_ENV", "development")
+	t.Setenv("JWT_SIGNING_KEYS", "")
+	t.Setenv("REFRESH_TOKEN_SECRET_KEY", "")
+	if err := auth.ConfigureKeys(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// errorCode returns the code of a user error, or "" for other errors
+func errorCode(err error) string {
+	var userErr *UserError
+	if errors.As(err, &userErr) {
+		return userErr.Code
+	}
+	return ""
+}
+
+// checkAuth checks that an auth result carries a working access token for a user
+func checkAuth(t *testing.T, result *model.Auth, email string) {
+	t.Helper()
+
+	if result.User.Email != email || result.RefreshToken == "" {
+		t.Fatalf("signed in %s with refresh token %q, want %s", result.User.Email, result.RefreshToken, email)
+	}
+	claims, err := auth.ValidateAccessToken(result.Token)
+	if err != nil {
+		t.Fatalf("access token: %v", err)
+	}
+	if claims.UserID != result.User.ID.String() || claims.SessionID == "" {
+		t.Errorf("access token of user %s in session %q, want user %s in a session", claims.UserID, claims.SessionID, result.User.ID)
+	}
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	useDevelopmentKeys(t)
+	db := testdb.Open(t, &models.User{}, &models.Session{}, &models.RefreshToken{})
+	previous := database.DB
+	database.DB = db
+	t.Cleanup(func() { database.DB = previous })
+
+	r := &mutationResolver{&Resolver{}}
+	ctx := context.Background()
+
+	registered, err := r.Register(ctx, model.RegisterInput{Name: "Ada", Email: " Ada@Example.com ", Password: "correct horse"})
+	if err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	checkAuth(t, registered, "ada@example.com")
+
+	loggedIn, err := r.Login(ctx, model.LoginInput{Email: "ADA@example.com", Password: "correct horse"})
+	if err != nil {
+		t.Fatalf("Login() error = %v", err)
+	}
+	checkAuth(t, loggedIn, "ada@example.com")
+	if loggedIn.User.ID != registered.User.ID {
+		t.Errorf("Login() signed in user %s, want %s", loggedIn.User.ID, registered.User.ID)
+	}
+
+	registerTests := []struct {
+		name  string
+		input model.RegisterInput
+		code  string
+	}{
+		{"email taken", model.RegisterInput{Name: "Ada", Email: "ADA@example.com", Password: "another password"}, CodeEmailTaken},
+		{"short password", model.RegisterInput{Name: "Bob", Email: "bob@example.com", Password: "short"}, CodeBadUserInput},
+		{"invalid email", model.RegisterInput{Name: "Bob", Email: "Bob <bob@example.com>", Password: "long enough"}, CodeBadUserInput},
+		{"no name", model.RegisterInput{Name: " ", Email: "bob@example.com", Password: "long enough"}, CodeBadUserInput},
+	}
+	for _, tt := range registerTests {
+		if _, err := r.Register(ctx, tt.input); errorCode(err) != tt.code {
+			t.Errorf("Register() with %s error = %v, want %s", tt.name, err, tt.code)
+		}
+	}
+
+	loginTests := []struct {
+		name  string
+		input model.LoginInput
+		code  string
+	}{
+		{"wrong password", model.LoginInput{Email: "ada@example.com", Password: "wrong horse"}, CodeInvalidCredentials},
+		{"unknown email", model.LoginInput{Email: "eve@example.com", Password: "correct horse"}, CodeInvalidCredentials},
+		{"no password", model.LoginInput{Email: "ada@example.com"}, CodeBadUserInput},
+	}
+	for _, tt := range loginTests {
+		if _, err := r.Login(ctx, tt.input); errorCode(err) != tt.code {
+			t.Errorf("Login() with %s error = %v, want %s", tt.name, err, tt.code)
+		}
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	useDevelopmentKeys(t)
+	db := testdb.Open(t, &models.User{}, &models.Session{}, &models.RefreshToken{})
+	previous := database.DB
+	database.DB = db
+	t.Cleanup(func() { database.DB = previous })
+
+	r := &mutationResolver{&Resolver{}}
+	ctx := context.Background()
+
+	registered, err := r.Register(ctx, model.RegisterInput{Name: "Ada", Email: "ada@example.com", Password: "correct horse"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refreshed, err := r.RefreshToken(ctx, registered.RefreshToken)
+	if err != nil {
+		t.Fatalf("RefreshToken() error = %v", err)
+	}
+	checkAuth(t, refreshed, "ada@example.com")
+
+	if _, err := r.RefreshToken(ctx, registered.RefreshToken); errorCode(err) != CodeInvalidToken {
+		t.Errorf("RefreshToken() with a used token error = %v, want %s", err, CodeInvalidToken)
+	}
+	if _, err := r.RefreshToken(ctx, refreshed.RefreshToken); errorCode(err) != CodeInvalidToken {
+		t.Errorf("RefreshToken() in a signed out session error = %v, want %s", err, CodeInvalidToken)
+	}
+	if _, err := r.RefreshToken(ctx, "not-a-token"); errorCode(err) != CodeInvalidToken {
+		t.Errorf("RefreshToken() with garbage error = %v, want %s", err, CodeInvalidToken)
+	}
+}
@@ -0,0 +1,226 @@
+package resolvers
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"crm-communication-api/database"
+	"crm-communication-api/internal/graphql/model"
+	"crm-communication-api/internal/rbac"
+	"crm-communication-api/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Clients lists the clients visible to the current user by name
+func (r *queryResolver) Clients(ctx context.Context) ([]*model.Client, error) {
+	user, err := currentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	db := database.GetDB()
+
+	visible, err := rbac.ClientScope(db, user, "id")
+	if err != nil {
+		return nil, err
+	}
+	var clients []models.Client
+	if err := db.Scopes(visible).Order("name").Find(&clients).Error; err != nil {
+		return nil, err
+	}
+
+	result := make([]*model.Client, 0, len(clients))
+	for _, c := range clients {
+		result = append(result, clientFromModel(c))
+	}
+	return result, nil
+}
+
+// Client retrieves a single client by ID
+func (r *queryResolver) Client(ctx context.Context, id uuid.UUID) (*model.Client, error) {
+	if _, err := requireClientAccess(ctx, id); err != nil {
+		return nil, err
+	}
+
+	var client models.Client
+	if err := database.GetDB().Where("id = ?", id).First(&client).Error; err != nil {
+		return nil, err
+	}
+	return clientFromModel(client), nil
+}
+
+// CreateClient adds a client owned by the current user, so that it is visible to them whatever
+// their role
+func (r *mutationResolver) CreateClient(ctx context.Context, input model.CreateClientInput) (*model.Client, error) {
+	user, err := currentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	db := database.GetDB()
+
+	name := strings.TrimSpace(input.Name)
+	if name == "" {
+		return nil, Errorf("a name is required")
+	}
+	email, err := clientEmail(db, input.Email, uuid.Nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := models.Client{
+		Name:    name,
+		Email:   email,
+		Phone:   optionalString(input.Phone),
+		Company: optionalString(input.Company),
+		Notes:   optionalString(input.Notes),
+		OwnerID: &user.ID,
+	}
+	if err := db.Create(&client).Error; err != nil {
+		log.Printf("Error creating client: %v", err)
+		return nil, err
+	}
+	return clientFromModel(client), nil
+}
+
+// UpdateClient changes the fields of a client that are set in the input
+func (r *mutationResolver) UpdateClient(ctx context.Context, input model.UpdateClientInput) (*model.Client, error) {
+	if _, err := requireClientAccess(ctx, input.ID); err != nil {
+		return nil, err
+	}
+
+	db := database.GetDB()
+
+	var client models.Client
+	if err := db.Where("id = ?", input.ID).First(&client).Error; err != nil {
+		return nil, err
+	}
+
+	updates := map[string]interface{}{}
+	if input.Name != nil {
+		name := strings.TrimSpace(*input.Name)
+		if name == "" {
+			return nil, Errorf("a name is required")
+		}
+		updates["name"] = name
+	}
+	if input.Email != nil {
+		email, err := clientEmail(db, *input.Email, client.ID)
+		if err != nil {
+			return nil, err
+		}
+		updates["email"] = email
+	}
+	if input.Phone != nil {
+		updates["phone"] = optionalString(input.Phone)
+	}
+	if input.Company != nil {
+		updates["company"] = optionalString(input.Company)
+	}
+	if input.Notes != nil {
+		updates["notes"] = optionalString(input.Notes)
+	}
+	if len(updates) > 0 {
+		if err := db.Model(&client).Updates(updates).Error; err != nil {
+			log.Printf("Error updating client %s: %v", client.ID, err)
+			return nil, err
+		}
+		if err := db.Where("id = ?", client.ID).First(&client).Error; err != nil {
+			return nil, err
+		}
+	}
+	return clientFromModel(client), nil
+}
+
+// DeleteClient removes a client without history. Clients with messages, emails or timeline
+// events are kept, so that deleting one cannot erase conversations; purge those first.
+func (r *mutationResolver) DeleteClient(ctx context.Context, id uuid.UUID) (bool, error) {
+	user, err := requireClientAccess(ctx, id)
+	if err != nil {
+		return false, err
+	}
+
+	db := database.GetDB()
+
+	var deleted bool
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, history := range []struct {
+			model interface{}
+			name  string
+		}{
+			{&models.Message{}, "messages"},
+			{&models.Email{}, "emails"},
+			{&models.TimelineEvent{}, "timeline events"},
+		} {
+			var count int64
+			if err := tx.Unscoped().Model(history.model).Where("client_id = ?", id).Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				return Errorf("the client has %d %s and cannot be deleted", count, history.name)
+			}
+		}
+		if err := tx.Where("client_id = ?", id).Delete(&models.ChannelPreference{}).Error; err != nil {
+			return err
+		}
+		result := tx.Where("id = ?", id).Delete(&models.Client{})
+		deleted = result.RowsAffected > 0
+		return result.Error
+	})
+	if err != nil {
+		return false, err
+	}
+
+	log.Printf("User %s deleted client %s", user.ID, id)
+	return deleted, nil
+}
+
+// clientEmail checks the email address of a client, which no other client may have. id is the
+// client being updated, or uuid.Nil for a new client.
+func clientEmail(db *gorm.DB, email string, id uuid.UUID) (string, error) {
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return "", err
+	}
+	var count int64
+	if err := db.Model(&models.Client{}).Where("email = ? AND id <> ?", email, id).Count(&count).Error; err != nil {
+		return "", err
+	}
+	if count > 0 {
+		return "", codedError(CodeEmailTaken, "another client has this email address")
+	}
+	return email, nil
+}
+
+// optionalString returns the trimmed value of an optional input, or "" when it is not set
+func optionalString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return strings.TrimSpace(*s)
+}
+
+// clientFromModel converts a client to the GraphQL model
+func clientFromModel(c models.Client) *model.Client {
+	result := &model.Client{
+		ID:        c.ID,
+		Name:      c.Name,
+		Email:     c.Email,
+		CreatedAt: c.CreatedAt,
+		UpdatedAt: c.UpdatedAt,
+		TeamID:    c.TeamID,
+	}
+	if c.Phone != "" {
+		result.Phone = &c.Phone
+	}
+	if c.Company != "" {
+		result.Company = &c.Company
+	}
+	if c.Notes != "" {
+		result.Notes = &c.Notes
+	}
+	return result
+}
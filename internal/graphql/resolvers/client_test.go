@@ -0,0 +1,61 @@
+package resolvers
+
+import (
+	"context"
+	"testing"
+
+	"crm-communication-api/database"
+	"crm-communication-api/internal/graphql/model"
+	"crm-communication-api/internal/testdb"
+	"crm-communication-api/models"
+
+	"gorm.io/gorm"
+)
+
+func TestClientsAreOwnedByTheirCreatorAndKeptWithTheirHistory(t *testing.T) {
+	db := testdb.Open(t, &models.User{}, &models.Client{}, &models.TeamMember{}, &models.Message{},
+		&models.Email{}, &models.TimelineEvent{}, &models.ChannelPreference{})
+	previous := database.DB
+	database.DB = db
+	t.Cleanup(func() { database.DB = previous })
+
+	agent := models.User{Name: "Ada", Email: "ada@example.com", Role: "agent"}
+	if err := db.Create(&agent).Error; err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.WithValue(context.Background(), "user_id", agent.ID)
+	mutation := &mutationResolver{&Resolver{}}
+
+	created, err := mutation.CreateClient(ctx, model.CreateClientInput{Name: " Acme ", Email: "Sales@Acme.example"})
+	if err != nil {
+		t.Fatalf("CreateClient() error = %v", err)
+	}
+	if created.Name != "Acme" || created.Email != "sales@acme.example" {
+		t.Errorf("created %q <%s>, want Acme <sales@acme.example>", created.Name, created.Email)
+	}
+	if _, err := mutation.CreateClient(ctx, model.CreateClientInput{Name: "Acme again", Email: "sales@acme.example"}); err == nil {
+		t.Error("CreateClient() accepted an email address another client has")
+	}
+
+	// An agent sees the clients they own
+	if _, err := (&queryResolver{&Resolver{}}).Client(ctx, created.ID); err != nil {
+		t.Fatalf("Client() error = %v for the creator", err)
+	}
+
+	// A client with a message is kept. The message is stored without its hooks, which number it
+	// and record it in the timeline.
+	message := models.Message{Content: "Hello", SenderID: agent.ID, ClientID: created.ID}
+	if err := db.Session(&gorm.Session{SkipHooks: true}).Create(&message).Error; err != nil {
+		t.Fatal(err)
+	}
+	if deleted, err := mutation.DeleteClient(ctx, created.ID); err == nil || deleted {
+		t.Fatalf("DeleteClient() = %v, %v for a client with a message, want an error", deleted, err)
+	}
+
+	if err := db.Unscoped().Delete(&message).Error; err != nil {
+		t.Fatal(err)
+	}
+	if deleted, err := mutation.DeleteClient(ctx, created.ID); err != nil || !deleted {
+		t.Errorf("DeleteClient() = %v, %v for a client without history, want it deleted", deleted, err)
+	}
+}
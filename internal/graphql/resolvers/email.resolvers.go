@@ -7,132 +7,112 @@ import (
 
 	"crm-communication-api/database"
 	"crm-communication-api/internal/graphql/model"
+	"crm-communication-api/internal/rbac"
 	"crm-communication-api/models"
 
 	"github.com/google/uuid"
+	"gorm.io/gorm"
 )
 
-// CreateEmail handles the creation of a new email record
+// CreateEmail records an email sent to a client. The email's AfterCreate hook adds it to the
+// client's timeline.
 func (r *mutationResolver) CreateEmail(ctx context.Context, input model.CreateEmailInput) (*model.Email, error) {
-	// Get user from context (added by auth middleware)
-	userID, ok := ctx.Value("user_id").(uuid.UUID)
-	if !ok {
-		return nil, ErrUnauthenticated
+	user, err := requireClientAccess(ctx, input.ClientID)
+	if err != nil {
+		return nil, err
 	}
 
 	db := database.GetDB()
 
+	var client models.Client
+	if err := db.Where("id = ?", input.ClientID).First(&client).Error; err != nil {
+		return nil, err
+	}
+
 	// Create the email record
 	email := &models.Email{
-		Subject:     input.Subject,
-		Body:        input.Body,
-		SenderID:    userID,
-		ClientID:    input.ClientID,
-		ToAddresses: input.ToAddresses,
-		CcAddresses: input.CcAddresses,
-		BccAddresses: input.BccAddresses,
-		ExternalID:  input.ExternalID,
-		Status:      "sent", // Default status
-		CreatedAt:   time.Now(),
-		UpdatedAt:   time.Now(),
-	}
-
-	// Begin transaction
-	tx := db.Begin()
-	if err := tx.Create(email).Error; err != nil {
-		tx.Rollback()
+		ClientID: input.ClientID,
+		UserID:   user.ID,
+		GoogleID: uuid.New().String(), // Not imported from Gmail, so it gets an ID of its own
+		Subject:  input.Subject,
+		From:     user.Email,
+		To:       client.Email,
+		Body:     input.Content,
+		Received: time.Now(),
+	}
+	if err := db.Create(email).Error; err != nil {
 		log.Printf("Error creating email: %v", err)
 		return nil, err
 	}
+	email.User = &user
+	email.Client = &client
 
-	// Create timeline event for the email
-	timelineEvent := &models.TimelineEvent{
-		ClientID:      input.ClientID,
-		ActorID:       userID,
-		EventableType: "Email",
-		EventableID:   email.ID,
-		EventType:     "EmailSent",
-		Metadata:      map[string]interface{}{"subject": input.Subject},
-		CreatedAt:     time.Now(),
-	}
+	// Publish the email and its timeline event to subscriptions
+	result := emailFromModel(*email)
+	PublishEmail(input.ClientID, result)
 
-	if err := tx.Create(timelineEvent).Error; err != nil {
-		tx.Rollback()
-		log.Printf("Error creating timeline event: %v", err)
-		return nil, err
+	var timelineEvent models.TimelineEvent
+	if err := db.Where("eventable_type = ? AND eventable_id = ?", "Email", email.ID).First(&timelineEvent).Error; err != nil {
+		log.Printf("Error loading timeline event of email %s: %v", email.ID, err)
+	} else {
+		timelineEvent.User = user
+		timelineEvent.Client = client
+		PublishTimelineEvent(input.ClientID, timelineEventFromModel(timelineEvent))
 	}
 
-	// Commit transaction
-	if err := tx.Commit().Error; err != nil {
-		log.Printf("Error committing transaction: %v", err)
-		return nil, err
-	}
+	return result, nil
+}
 
-	// Convert to GraphQL model
-	result := &model.Email{
-		ID:          email.ID,
-		Subject:     email.Subject,
-		Body:        email.Body,
-		ClientID:    email.ClientID,
-		SenderID:    email.SenderID,
-		ToAddresses: email.ToAddresses,
-		CcAddresses: email.CcAddresses,
-		BccAddresses: email.BccAddresses,
-		ExternalID:  email.ExternalID,
-		Status:      email.Status,
-		CreatedAt:   email.CreatedAt,
-		UpdatedAt:   email.UpdatedAt,
-	}
-
-	// Publish to subscription
-	PublishEmail(input.ClientID, result)
+// DeleteEmail removes an email and its timeline event. Users may delete the emails they sent, and
+// users with TIMELINE_MODERATE any email of the clients they can see.
+func (r *mutationResolver) DeleteEmail(ctx context.Context, id uuid.UUID) (bool, error) {
+	db := database.GetDB()
 
-	// Create and publish timeline event
-	gqlTimelineEvent := &model.TimelineEvent{
-		ID:           timelineEvent.ID,
-		ClientID:     timelineEvent.ClientID,
-		ActorID:      timelineEvent.ActorID,
-		EventableType: timelineEvent.EventableType,
-		EventableID:  timelineEvent.EventableID,
-		EventType:    timelineEvent.EventType,
-		Metadata:     timelineEvent.Metadata,
-		CreatedAt:    timelineEvent.CreatedAt,
+	var email models.Email
+	if err := db.Where("id = ?", id).First(&email).Error; err != nil {
+		return false, err
+	}
+	user, err := requireOwnerOrPermission(ctx, email.ClientID, email.UserID, rbac.TimelineModerate)
+	if err != nil {
+		return false, err
 	}
-	PublishTimelineEvent(input.ClientID, gqlTimelineEvent)
 
-	return result, nil
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("eventable_type = ? AND eventable_id = ?", "Email", email.ID).Delete(&models.TimelineEvent{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&email).Error
+	})
+	if err != nil {
+		log.Printf("Error deleting email %s: %v", id, err)
+		return false, err
+	}
+
+	log.Printf("User %s deleted email %s", user.ID, id)
+	return true, nil
 }
 
 // Emails retrieves emails for a client
 func (r *queryResolver) Emails(ctx context.Context, clientID uuid.UUID) ([]*model.Email, error) {
+	if _, err := requireClientAccess(ctx, clientID); err != nil {
+		return nil, err
+	}
+
 	db := database.GetDB()
 
 	var dbEmails []models.Email
 	if err := db.Where("client_id = ?", clientID).
 		Order("created_at DESC").
-		Preload("Sender").
+		Preload("User").
+		Preload("Client").
 		Find(&dbEmails).Error; err != nil {
 		return nil, err
 	}
 
 	// Convert to GraphQL model
-	var result []*model.Email
+	result := make([]*model.Email, 0, len(dbEmails))
 	for _, e := range dbEmails {
-		email := &model.Email{
-			ID:          e.ID,
-			Subject:     e.Subject,
-			Body:        e.Body,
-			ClientID:    e.ClientID,
-			SenderID:    e.SenderID,
-			ToAddresses: e.ToAddresses,
-			CcAddresses: e.CcAddresses,
-			BccAddresses: e.BccAddresses,
-			ExternalID:  e.ExternalID,
-			Status:      e.Status,
-			CreatedAt:   e.CreatedAt,
-			UpdatedAt:   e.UpdatedAt,
-		}
-		result = append(result, email)
+		result = append(result, emailFromModel(e))
 	}
 
 	return result, nil
@@ -144,26 +124,34 @@ func (r *queryResolver) Email(ctx context.Context, id uuid.UUID) (*model.Email,
 
 	var dbEmail models.Email
 	if err := db.Where("id = ?", id).
-		Preload("Sender").
+		Preload("User").
+		Preload("Client").
 		First(&dbEmail).Error; err != nil {
 		return nil, err
 	}
+	if _, err := requireClientAccess(ctx, dbEmail.ClientID); err != nil {
+		return nil, err
+	}
 
-	// Convert to GraphQL model
+	return emailFromModel(dbEmail), nil
+}
+
+// emailFromModel converts an email, with its sender and client loaded, to the GraphQL model
+func emailFromModel(e models.Email) *model.Email {
 	result := &model.Email{
-		ID:          dbEmail.ID,
-		Subject:     dbEmail.Subject,
-		Body:        dbEmail.Body,
-		ClientID:    dbEmail.ClientID,
-		SenderID:    dbEmail.SenderID,
-		ToAddresses: dbEmail.ToAddresses,
-		CcAddresses: dbEmail.CcAddresses,
-		BccAddresses: dbEmail.BccAddresses,
-		ExternalID:  dbEmail.ExternalID,
-		Status:      dbEmail.Status,
-		CreatedAt:   dbEmail.CreatedAt,
-		UpdatedAt:   dbEmail.UpdatedAt,
+		ID:        e.ID,
+		Subject:   e.Subject,
+		Content:   e.Body,
+		Client:    &model.Client{ID: e.ClientID},
+		Sender:    &model.User{ID: e.UserID},
+		CreatedAt: e.CreatedAt,
+		UpdatedAt: e.UpdatedAt,
 	}
-
-	return result, nil
-}
\ No newline at end of file
+	if e.User != nil {
+		result.Sender = userFromModel(*e.User)
+	}
+	if e.Client != nil {
+		result.Client = clientFromModel(*e.Client)
+	}
+	return result
+}
@@ -0,0 +1,21 @@
+package resolvers
+
+import "testing"
+
+func TestUserErrorFormatsArgs(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{Errorf("unknown role %s", "auditor"), "unknown role auditor"},
+		{Errorf("%d users have the role %s, give them another role first", 3, "support"), "3 users have the role support, give them another role first"},
+		{Errorf("not allowed"), "not allowed"},
+		// Messages passed through without arguments are not treated as formats
+		{Errorf("100% done"), "100% done"},
+	}
+	for _, tt := range tests {
+		if got := tt.err.Error(); got != tt.want {
+			t.Errorf("Error() = %q, want %q", got, tt.want)
+		}
+	}
+}
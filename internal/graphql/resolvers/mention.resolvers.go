@@ -0,0 +1,227 @@
+package resolvers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"crm-communication-api/database"
+	"crm-communication-api/internal/graphql/model"
+	"crm-communication-api/internal/notify"
+	"crm-communication-api/internal/rbac"
+	chatws "crm-communication-api/internal/websocket"
+	"crm-communication-api/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Page sizes for the myMentions connection
+const (
+	defaultMentionsPageSize = 50
+	maxMentionsPageSize     = 200
+)
+
+// MarkMentionsSeen marks mentions of the current user seen, or all of them when ids is omitted
+func (r *mutationResolver) MarkMentionsSeen(ctx context.Context, ids []uuid.UUID) (int, error) {
+	// Get user from context (added by auth middleware)
+	userID, ok := ctx.Value("user_id").(uuid.UUID)
+	if !ok {
+		return 0, ErrUnauthenticated
+	}
+
+	marked, err := models.MarkMentionsSeen(database.GetDB(), userID, ids, time.Now())
+	if err != nil {
+		log.Printf("Error marking mentions seen: %v", err)
+		return 0, err
+	}
+
+	return int(marked), nil
+}
+
+// MyMentions returns a page of the current user's mentions in the clients they can see, newest
+// first. The cursor of each edge is the mention's ID.
+func (r *queryResolver) MyMentions(ctx context.Context, unreadOnly *bool, first *int, after *string) (*model.MentionConnection, error) {
+	user, err := currentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := defaultMentionsPageSize
+	if first != nil {
+		if *first < 0 {
+			return nil, Errorf("first must not be negative")
+		}
+		limit = *first
+	}
+	if limit > maxMentionsPageSize {
+		limit = maxMentionsPageSize
+	}
+
+	db := database.GetDB()
+
+	visible, err := rbac.ClientScope(db, user, "messages.client_id")
+	if err != nil {
+		return nil, err
+	}
+
+	var anchor *models.MessageMention
+	if after != nil {
+		afterID, err := uuid.Parse(*after)
+		if err != nil {
+			return nil, Errorf("invalid cursor")
+		}
+		var mention models.MessageMention
+		if err := db.Where("id = ? AND user_id = ?", afterID, user.ID).First(&mention).Error; err != nil {
+			return nil, Errorf("invalid cursor")
+		}
+		anchor = &mention
+	}
+
+	// Fetch one extra mention to know whether there is a next page
+	mentions, err := models.UserMentions(db, user.ID, visible, unreadOnly != nil && *unreadOnly, anchor, limit+1)
+	if err != nil {
+		return nil, err
+	}
+	hasNextPage := len(mentions) > limit
+	if hasNextPage {
+		mentions = mentions[:limit]
+	}
+
+	unseen, err := models.UnseenMentionCount(db, user.ID, visible)
+	if err != nil {
+		return nil, err
+	}
+
+	connection := &model.MentionConnection{
+		Edges:       make([]*model.MentionEdge, 0, len(mentions)),
+		PageInfo:    &model.PageInfo{HasNextPage: hasNextPage},
+		UnseenCount: int(unseen),
+	}
+	for _, mention := range mentions {
+		cursor := mention.ID.String()
+		connection.Edges = append(connection.Edges, &model.MentionEdge{Cursor: cursor, Node: mentionFromModel(mention)})
+		connection.PageInfo.EndCursor = &cursor
+	}
+
+	return connection, nil
+}
+
+// MentionCreated subscription resolver. Mention events are keyed by the mentioned user's ID.
+func (r *subscriptionResolver) MentionCreated(ctx context.Context) (<-chan *model.Mention, error) {
+	// Get user from context (added by auth middleware)
+	userID, ok := ctx.Value("user_id").(uuid.UUID)
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+
+	observer := NewObserver()
+	eventManager.Register(userID, observer)
+
+	mentionChan := make(chan *model.Mention, 1)
+
+	// Handle cleanup when subscription is closed
+	go func() {
+		<-ctx.Done()
+		eventManager.Unregister(userID, observer)
+		close(mentionChan)
+		log.Printf("MentionCreated subscription closed for user %s", userID.String())
+	}()
+
+	// Forward events to the typed channel
+	go func() {
+		for {
+			select {
+			case event := <-observer.events:
+				if mention, ok := event.(*model.Mention); ok {
+					mentionChan <- mention
+				}
+			case <-observer.closeCh:
+				return
+			}
+		}
+	}()
+
+	return mentionChan, nil
+}
+
+// NotifyMessageMentions tells the users mentioned in a new message that they were mentioned
+func NotifyMessageMentions(db *gorm.DB, messageID uuid.UUID) {
+	mentions, err := models.MessageMentions(db, messageID)
+	if err != nil {
+		log.Printf("Error loading the mentions of message %s: %v", messageID, err)
+		return
+	}
+	notifyMentions(mentions)
+}
+
+// NotifyAddedMentions tells users mentioned by an edit that they were mentioned
+func NotifyAddedMentions(db *gorm.DB, added []models.MessageMention) {
+	ids := make([]uuid.UUID, 0, len(added))
+	for _, mention := range added {
+		ids = append(ids, mention.ID)
+	}
+	mentions, err := models.MentionsByID(db, ids)
+	if err != nil {
+		log.Printf("Error loading added mentions: %v", err)
+		return
+	}
+	notifyMentions(mentions)
+}
+
+// notifyMentions sends mentions, loaded with their messages, to the mentioned users' mentionCreated
+// subscriptions and chat connections, whichever node and rooms they are on, and queues them for the
+// digest of users who are offline. Senders are not told about mentioning themselves. The mentions
+// are stored either way, so users who miss them find them with myMentions.
+func notifyMentions(mentions []models.MessageMention) {
+	for _, mention := range mentions {
+		if mention.UserID == mention.Message.SenderID {
+			continue
+		}
+		PublishMention(mention.UserID, mentionFromModel(mention))
+		sendMentionFrame(mention)
+		notify.Mentioned(mention)
+	}
+}
+
+// PublishMention publishes a new mention to the mentioned user's subscribers
+func PublishMention(userID uuid.UUID, mention *model.Mention) {
+	eventManager.Broadcast(userID, mention, "MentionCreated")
+}
+
+// sendMentionFrame sends a mention frame to every chat connection of the mentioned user
+func sendMentionFrame(mention models.MessageMention) {
+	payload, err := json.Marshal(models.WSMentionPayload{
+		MentionID: mention.ID,
+		MessageID: mention.MessageID,
+		Room:      mention.Message.ConversationID().String(),
+		ClientID:  mention.Message.ClientID,
+		Sender:    mention.Message.Sender.Name,
+		Content:   mention.Message.Content,
+		CreatedAt: mention.CreatedAt,
+	})
+	if err != nil {
+		log.Printf("Error encoding mention %s: %v", mention.ID, err)
+		return
+	}
+	frame, err := json.Marshal(models.WSMessage{Version: models.WSProtocolVersion, Type: models.WSTypeMention, Payload: payload})
+	if err != nil {
+		log.Printf("Error encoding mention %s: %v", mention.ID, err)
+		return
+	}
+	chatws.GlobalHub.SendToUser(mention.UserID, frame)
+}
+
+// mentionFromModel converts a mention, with its message loaded, to the GraphQL model
+func mentionFromModel(m models.MessageMention) *model.Mention {
+	return &model.Mention{
+		ID:        m.ID,
+		Message:   messageFromModel(m.Message),
+		ClientID:  m.Message.ClientID,
+		ThreadID:  m.Message.ThreadID,
+		ParentID:  m.Message.ParentID,
+		CreatedAt: m.CreatedAt,
+		SeenAt:    m.SeenAt,
+	}
+}
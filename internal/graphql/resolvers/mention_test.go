@@ -0,0 +1,66 @@
+package resolvers
+
+import (
+	"context"
+	"testing"
+
+	"crm-communication-api/database"
+	"crm-communication-api/internal/testdb"
+	"crm-communication-api/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+func TestMyMentionsLeavesOutInvisibleClients(t *testing.T) {
+	db := testdb.Open(t, &models.User{}, &models.Client{}, &models.TeamMember{}, &models.Message{}, &models.MessageMention{})
+	previous := database.DB
+	database.DB = db
+	t.Cleanup(func() { database.DB = previous })
+
+	agent := models.User{Name: "Ada", Email: "ada@example.com", Role: "agent"}
+	other := models.User{Name: "Bob", Email: "bob@example.com", Role: "agent"}
+	for _, user := range []*models.User{&agent, &other} {
+		if err := db.Create(user).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	owned := models.Client{Name: "Owned", Email: "owned@example.com", OwnerID: &agent.ID}
+	foreign := models.Client{Name: "Foreign", Email: "foreign@example.com", OwnerID: &other.ID}
+	for _, client := range []*models.Client{&owned, &foreign} {
+		if err := db.Create(client).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The agent is mentioned once in each client. Messages are stored without their hooks, which
+	// number them and record them in the timeline.
+	mentions := make(map[uuid.UUID]uuid.UUID)
+	for _, client := range []models.Client{owned, foreign} {
+		message := models.Message{Content: "@Ada", SenderID: other.ID, ClientID: client.ID}
+		if err := db.Session(&gorm.Session{SkipHooks: true}).Create(&message).Error; err != nil {
+			t.Fatal(err)
+		}
+		mention := models.MessageMention{MessageID: message.ID, UserID: agent.ID}
+		if err := db.Create(&mention).Error; err != nil {
+			t.Fatal(err)
+		}
+		mentions[client.ID] = mention.ID
+	}
+
+	r := &queryResolver{&Resolver{}}
+	ctx := context.WithValue(context.Background(), "user_id", agent.ID)
+	connection, err := r.MyMentions(ctx, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("MyMentions() error = %v", err)
+	}
+	if len(connection.Edges) != 1 || connection.Edges[0].Node.ID != mentions[owned.ID] {
+		t.Fatalf("MyMentions() returned %d mentions, want only the one in the owned client", len(connection.Edges))
+	}
+	if connection.Edges[0].Node.Message.Content != "@Ada" {
+		t.Errorf("mention of message %q, want its message loaded", connection.Edges[0].Node.Message.Content)
+	}
+	if connection.UnseenCount != 1 {
+		t.Errorf("UnseenCount = %d, want 1", connection.UnseenCount)
+	}
+}
@@ -2,15 +2,22 @@ package resolvers
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
-	"regexp"
+	"strings"
 	"time"
 
 	"crm-communication-api/database"
+	"crm-communication-api/internal/command"
 	"crm-communication-api/internal/graphql/model"
+	"crm-communication-api/internal/mention"
+	"crm-communication-api/internal/ratelimit"
+	"crm-communication-api/internal/rbac"
 	"crm-communication-api/models"
 
 	"github.com/google/uuid"
+	"gorm.io/gorm"
 )
 
 // CreateMessage handles the creation of a new message with @mention support
@@ -20,14 +27,37 @@ func (r *mutationResolver) CreateMessage(ctx context.Context, input model.Create
 	if !ok {
 		return nil, ErrUnauthenticated
 	}
+	if _, err := requireClientAccess(ctx, input.ClientID); err != nil {
+		return nil, err
+	}
 
 	db := database.GetDB()
 
+	// Messages spend from the same quotas as the chat's send frames
+	var sender models.User
+	if err := db.Where("id = ?", userID).First(&sender).Error; err != nil {
+		return nil, err
+	}
+	room := input.ClientID
+	if input.ParentID != nil {
+		room = *input.ParentID
+	}
+	if err := ratelimit.Allow(ratelimit.Message{UserID: userID.String(), Role: sender.Role, Room: room.String()}); err != nil {
+		return nil, err
+	}
+
+	// Slash commands are answered to the caller only and never stored
+	if name, args, text, ok := command.Parse(input.Content); ok {
+		return r.runCommand(ctx, db, userID, input, name, args, text)
+	}
+	input.Content = command.Unescape(input.Content)
+
 	// Create the message
 	message := &models.Message{
 		Content:   input.Content,
 		SenderID:  userID,
 		ClientID:  input.ClientID,
+		ParentID:  input.ParentID,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 	}
@@ -55,27 +85,21 @@ func (r *mutationResolver) CreateMessage(ctx context.Context, input model.Create
 			}
 		}
 	} else {
-		// Check for @mentions in the message content
-		mentions := extractMentionsFromContent(input.Content)
-		if len(mentions) > 0 {
-			// Find users by username/email
-			var users []models.User
-			if err := tx.Where("name IN ?", mentions).Find(&users).Error; err != nil {
-				log.Printf("Error finding mentioned users: %v", err)
-				// Continue without mentions in case of error
-			} else {
-				// Create mentions for found users
-				for _, user := range users {
-					mention := &models.MessageMention{
-						MessageID: message.ID,
-						UserID:    user.ID,
-						CreatedAt: time.Now(),
-					}
-					if err := tx.Create(mention).Error; err != nil {
-						log.Printf("Error creating mention from content: %v", err)
-						// Continue with other mentions
-					}
-				}
+		// Resolve the @mentions in the message content
+		mentions, err := mention.Resolve(tx, input.Content)
+		if err != nil {
+			log.Printf("Error resolving mentions: %v", err)
+			// Continue without mentions in case of error
+		}
+		for _, mentionedID := range mentions.UserIDs() {
+			mentioned := &models.MessageMention{
+				MessageID: message.ID,
+				UserID:    mentionedID,
+				CreatedAt: time.Now(),
+			}
+			if err := tx.Create(mentioned).Error; err != nil {
+				log.Printf("Error creating mention from content: %v", err)
+				// Continue with other mentions
 			}
 		}
 	}
@@ -90,24 +114,42 @@ func (r *mutationResolver) CreateMessage(ctx context.Context, input model.Create
 	result := &model.Message{
 		ID:        message.ID,
 		Content:   message.Content,
-		ClientID:  message.ClientID,
-		SenderID:  message.SenderID,
+		Client:    &model.Client{ID: message.ClientID},
+		Sender:    &model.User{ID: message.SenderID},
+		ParentID:  message.ParentID,
 		CreatedAt: message.CreatedAt,
 		UpdatedAt: message.UpdatedAt,
 	}
 
-	// Publish to subscription
+	// Publish to subscription and tell the mentioned users
 	PublishMessage(input.ClientID, result)
+	NotifyMessageMentions(db, message.ID)
+
+	// A reply also changes the reply count of its parent
+	if message.ParentID != nil {
+		var parent models.Message
+		if err := db.Where("id = ?", *message.ParentID).
+			Preload("Sender").
+			Preload("Mentions.User").
+			First(&parent).Error; err == nil {
+			PublishMessage(input.ClientID, messageFromModel(parent))
+		}
+	}
 
 	return result, nil
 }
 
-// DeleteMessage handles deleting a message
-func (r *mutationResolver) DeleteMessage(ctx context.Context, id uuid.UUID) (bool, error) {
+// EditMessage replaces the content of one of the current user's messages. The previous content
+// is kept as a revision and mentions are re-extracted from the new content.
+func (r *mutationResolver) EditMessage(ctx context.Context, id uuid.UUID, content string) (*model.Message, error) {
 	// Get user from context (added by auth middleware)
 	userID, ok := ctx.Value("user_id").(uuid.UUID)
 	if !ok {
-		return false, ErrUnauthenticated
+		return nil, ErrUnauthenticated
+	}
+
+	if strings.TrimSpace(content) == "" {
+		return nil, Errorf("message content must not be empty")
 	}
 
 	db := database.GetDB()
@@ -115,44 +157,201 @@ func (r *mutationResolver) DeleteMessage(ctx context.Context, id uuid.UUID) (boo
 	// Check if the message exists and belongs to the user
 	var message models.Message
 	if err := db.Where("id = ? AND sender_id = ?", id, userID).First(&message).Error; err != nil {
-		return false, err
+		return nil, err
+	}
+	if _, err := requireClientAccess(ctx, message.ClientID); err != nil {
+		return nil, err
+	}
+	if message.IsDeleted() {
+		return nil, Errorf("a deleted message cannot be edited")
 	}
 
-	// Begin transaction
-	tx := db.Begin()
+	edited, err := EditMessageContent(db, &message, userID, content)
+	if err != nil {
+		log.Printf("Error editing message: %v", err)
+		return nil, err
+	}
+	return messageFromModel(edited), nil
+}
 
-	// Delete mentions first
-	if err := tx.Where("message_id = ?", id).Delete(&models.MessageMention{}).Error; err != nil {
-		tx.Rollback()
+// EditMessageContent stores new content for a message, for editMessage and the chat's edit
+// frames. The previous content is kept as a revision, mentions are re-extracted and the users the
+// edit mentions are told. The edited message is published and returned with its sender and
+// mentions loaded.
+func EditMessageContent(db *gorm.DB, message *models.Message, editorID uuid.UUID, content string) (models.Message, error) {
+	var added []models.MessageMention
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Resolve @mentions in the new content
+		mentions, err := mention.Resolve(tx, content)
+		if err != nil {
+			return err
+		}
+
+		added, err = message.Edit(tx, editorID, content, mentions.UserIDs())
+		return err
+	})
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	// Reload the message with its sender and new mentions
+	var edited models.Message
+	if err := db.Where("id = ?", message.ID).
+		Preload("Sender").
+		Preload("Mentions.User").
+		First(&edited).Error; err != nil {
+		return models.Message{}, err
+	}
+
+	// Publish the update and tell users the edit mentions
+	PublishMessageChange(edited)
+	NotifyAddedMentions(db, added)
+
+	return edited, nil
+}
+
+// PublishMessageChange sends a message that was edited or deleted, with its sender and mentions
+// or deleter loaded, to the messageCreated subscribers of its client and to its chat room
+func PublishMessageChange(message models.Message) {
+	PublishMessage(message.ClientID, messageFromModel(message))
+	if rooms := currentChatRooms(); rooms != nil {
+		rooms.MessageChanged(message)
+	}
+}
+
+// MessageRevisions returns the earlier contents of a message, newest first
+func (r *queryResolver) MessageRevisions(ctx context.Context, messageID uuid.UUID) ([]*model.MessageRevision, error) {
+	db := database.GetDB()
+
+	var message models.Message
+	if err := db.Select("id", "client_id").Where("id = ?", messageID).First(&message).Error; err != nil {
+		return nil, err
+	}
+	if _, err := requireClientAccess(ctx, message.ClientID); err != nil {
+		return nil, err
+	}
+
+	var revisions []models.MessageRevision
+	if err := db.Where("message_id = ?", messageID).
+		Order("created_at DESC").
+		Preload("Editor").
+		Find(&revisions).Error; err != nil {
+		return nil, err
+	}
+
+	// Convert to GraphQL model
+	result := make([]*model.MessageRevision, 0, len(revisions))
+	for _, rev := range revisions {
+		result = append(result, &model.MessageRevision{
+			ID:        rev.ID,
+			Content:   rev.Content,
+			EditedBy:  userFromModel(rev.Editor),
+			CreatedAt: rev.CreatedAt,
+		})
+	}
+
+	return result, nil
+}
+
+// DeleteMessage turns a message into a tombstone. The row is kept with its content redacted so the
+// conversation and timeline still show that a message was deleted. Users may delete their own
+// messages, and users with MESSAGES_MODERATE any message of the clients they can see.
+func (r *mutationResolver) DeleteMessage(ctx context.Context, id uuid.UUID) (bool, error) {
+	// Get user from context (added by auth middleware)
+	userID, ok := ctx.Value("user_id").(uuid.UUID)
+	if !ok {
+		return false, ErrUnauthenticated
+	}
+
+	db := database.GetDB()
+
+	var message models.Message
+	if err := db.Where("id = ?", id).First(&message).Error; err != nil {
+		return false, err
+	}
+	if _, err := requireOwnerOrPermission(ctx, message.ClientID, message.SenderID, rbac.MessagesModerate); err != nil {
+		return false, err
+	}
+	if err := DeleteMessageBy(db, &message, userID); err != nil {
+		log.Printf("Error deleting message: %v", err)
 		return false, err
 	}
+	return true, nil
+}
 
-	// Delete timeline events for this message
-	if err := tx.Where("eventable_type = ? AND eventable_id = ?", "Message", id).Delete(&models.TimelineEvent{}).Error; err != nil {
-		tx.Rollback()
+// DeleteMessageBy turns a message into a tombstone deleted by a user, for deleteMessage and the
+// chat's delete frames, and publishes the tombstone. Deleting a deleted message does nothing.
+func DeleteMessageBy(db *gorm.DB, message *models.Message, deleterID uuid.UUID) error {
+	if message.IsDeleted() {
+		return nil
+	}
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		return message.SoftDelete(tx, deleterID)
+	}); err != nil {
+		return err
+	}
+
+	var tombstone models.Message
+	if err := db.Where("id = ?", message.ID).
+		Preload("Sender").
+		Preload("Deleter").
+		First(&tombstone).Error; err != nil {
+		return err
+	}
+	PublishMessageChange(tombstone)
+	return nil
+}
+
+// PurgeMessage permanently removes a message, deleted or not, with its mentions, revisions and
+// timeline events. Only users with MESSAGES_PURGE may purge, and every purge is recorded in the
+// audit log.
+func (r *mutationResolver) PurgeMessage(ctx context.Context, id uuid.UUID, reason string) (bool, error) {
+	// Get user from context (added by auth middleware)
+	userID, ok := ctx.Value("user_id").(uuid.UUID)
+	if !ok {
+		return false, ErrUnauthenticated
+	}
+
+	db := database.GetDB()
+
+	if _, err := requirePermission(ctx, rbac.MessagesPurge); err != nil {
 		return false, err
 	}
+	if strings.TrimSpace(reason) == "" {
+		return false, Errorf("a reason is required to purge a message")
+	}
 
-	// Delete the message
-	if err := tx.Delete(&message).Error; err != nil {
-		tx.Rollback()
+	var message models.Message
+	if err := db.Where("id = ?", id).First(&message).Error; err != nil {
+		return false, err
+	}
+	if _, err := requireClientAccess(ctx, message.ClientID); err != nil {
 		return false, err
 	}
 
-	// Commit transaction
-	if err := tx.Commit().Error; err != nil {
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		return message.Purge(tx, userID, reason)
+	}); err != nil {
+		log.Printf("Error purging message %s: %v", id, err)
 		return false, err
 	}
 
+	log.Printf("Audit: user %s purged message %s of client %s: %s", userID, id, message.ClientID, reason)
 	return true, nil
 }
 
 // Messages retrieves messages for a client
 func (r *queryResolver) Messages(ctx context.Context, clientID uuid.UUID) ([]*model.Message, error) {
+	if _, err := requireClientAccess(ctx, clientID); err != nil {
+		return nil, err
+	}
+
 	db := database.GetDB()
 
+	// Replies are listed under their parent
 	var dbMessages []models.Message
-	if err := db.Where("client_id = ?", clientID).
+	if err := db.Where("client_id = ? AND parent_id IS NULL", clientID).
 		Order("created_at DESC").
 		Preload("Sender").
 		Preload("Mentions.User").
@@ -166,10 +365,14 @@ func (r *queryResolver) Messages(ctx context.Context, clientID uuid.UUID) ([]*mo
 		message := &model.Message{
 			ID:        m.ID,
 			Content:   m.Content,
-			ClientID:  m.ClientID,
-			SenderID:  m.SenderID,
+			Client:    &model.Client{ID: m.ClientID},
+			Sender:    userFromModel(m.Sender),
 			CreatedAt: m.CreatedAt,
 			UpdatedAt: m.UpdatedAt,
+			EditedAt:    m.EditedAt,
+			DeletedAt:   m.DeletedAt,
+			ReplyCount:  m.ReplyCount,
+			LastReplyAt: m.LastReplyAt,
 		}
 		result = append(result, message)
 	}
@@ -188,38 +391,181 @@ func (r *queryResolver) Message(ctx context.Context, id uuid.UUID) (*model.Messa
 		First(&dbMessage).Error; err != nil {
 		return nil, err
 	}
+	if _, err := requireClientAccess(ctx, dbMessage.ClientID); err != nil {
+		return nil, err
+	}
 
 	// Convert to GraphQL model
 	result := &model.Message{
 		ID:        dbMessage.ID,
 		Content:   dbMessage.Content,
-		ClientID:  dbMessage.ClientID,
-		SenderID:  dbMessage.SenderID,
+		Client:    &model.Client{ID: dbMessage.ClientID},
+		Sender:    userFromModel(dbMessage.Sender),
 		CreatedAt: dbMessage.CreatedAt,
 		UpdatedAt: dbMessage.UpdatedAt,
+		EditedAt:    dbMessage.EditedAt,
+		DeletedAt:   dbMessage.DeletedAt,
+		ParentID:    dbMessage.ParentID,
+		ReplyCount:  dbMessage.ReplyCount,
+		LastReplyAt: dbMessage.LastReplyAt,
 	}
 
 	return result, nil
 }
 
-// Helper function to extract @mentions from message content
-func extractMentionsFromContent(content string) []string {
-	mentionRegex := regexp.MustCompile(`@(\w+)`)
-	matches := mentionRegex.FindAllStringSubmatch(content, -1)
-	
-	var mentions []string
-	for _, match := range matches {
-		if len(match) >= 2 {
-			mentions = append(mentions, match[1])
+// Replies returns a page of the replies to a message, oldest first. The cursor is the ID of
+// the last reply of the previous page.
+func (r *messageResolver) Replies(ctx context.Context, obj *model.Message, first *int, after *string) (*model.MessageConnection, error) {
+	limit := defaultRepliesPageSize
+	if first != nil {
+		if *first < 0 {
+			return nil, Errorf("first must not be negative")
 		}
+		limit = *first
+	}
+	if limit > maxRepliesPageSize {
+		limit = maxRepliesPageSize
 	}
-	
-	return mentions
+
+	db := database.GetDB()
+
+	var total int64
+	if err := db.Model(&models.Message{}).Where("parent_id = ?", obj.ID).Count(&total).Error; err != nil {
+		return nil, err
+	}
+
+	page := db.Where("parent_id = ?", obj.ID)
+	if after != nil {
+		afterID, err := uuid.Parse(*after)
+		if err != nil {
+			return nil, Errorf("invalid cursor")
+		}
+		var anchor models.Message
+		if err := db.Where("id = ? AND parent_id = ?", afterID, obj.ID).First(&anchor).Error; err != nil {
+			return nil, Errorf("invalid cursor")
+		}
+		page = page.Where("created_at > ? OR (created_at = ? AND id > ?)", anchor.CreatedAt, anchor.CreatedAt, anchor.ID)
+	}
+
+	// Fetch one extra reply to know whether there is a next page
+	var replies []models.Message
+	if err := page.Order("created_at ASC, id ASC").
+		Limit(limit + 1).
+		Preload("Sender").
+		Preload("Mentions.User").
+		Preload("Deleter").
+		Find(&replies).Error; err != nil {
+		return nil, err
+	}
+	hasNextPage := len(replies) > limit
+	if hasNextPage {
+		replies = replies[:limit]
+	}
+
+	connection := &model.MessageConnection{
+		Edges:      make([]*model.MessageEdge, 0, len(replies)),
+		PageInfo:   &model.PageInfo{HasNextPage: hasNextPage},
+		TotalCount: int(total),
+	}
+	for _, reply := range replies {
+		cursor := reply.ID.String()
+		connection.Edges = append(connection.Edges, &model.MessageEdge{Cursor: cursor, Node: messageFromModel(reply)})
+		connection.PageInfo.EndCursor = &cursor
+	}
+
+	return connection, nil
+}
+
+// messageFromModel converts a message, with its sender, mentioned users and deleter loaded, to the GraphQL model
+func messageFromModel(m models.Message) *model.Message {
+	mentions := make([]*model.User, 0, len(m.Mentions))
+	for _, mention := range m.Mentions {
+		mentions = append(mentions, userFromModel(mention.User))
+	}
+
+	result := &model.Message{
+		ID:          m.ID,
+		Content:     m.Content,
+		Sender:      userFromModel(m.Sender),
+		Mentions:    mentions,
+		CreatedAt:   m.CreatedAt,
+		UpdatedAt:   m.UpdatedAt,
+		EditedAt:    m.EditedAt,
+		DeletedAt:   m.DeletedAt,
+		ParentID:    m.ParentID,
+		ReplyCount:  m.ReplyCount,
+		LastReplyAt: m.LastReplyAt,
+	}
+	if m.Deleter != nil {
+		result.DeletedBy = userFromModel(*m.Deleter)
+	}
+	return result
 }
 
+// userFromModel converts a user to the GraphQL model
+func userFromModel(u models.User) *model.User {
+	return &model.User{
+		ID:        u.ID,
+		Name:      u.Name,
+		Email:     u.Email,
+		Role:      u.Role,
+		CreatedAt: u.CreatedAt,
+		UpdatedAt: u.UpdatedAt,
+	}
+}
+
+// runCommand runs a slash command passed to createMessage and returns its answer as an ephemeral
+// message
+func (r *mutationResolver) runCommand(ctx context.Context, db *gorm.DB, userID uuid.UUID, input model.CreateMessageInput, name string, args []string, text string) (*model.Message, error) {
+	var user models.User
+	if err := db.Where("id = ?", userID).First(&user).Error; err != nil {
+		return nil, ErrUnauthenticated
+	}
+
+	room := input.ClientID
+	if input.ParentID != nil {
+		room = *input.ParentID
+	}
+	reply, err := r.Commands.Run(ctx, command.Invocation{
+		User:     user,
+		ClientID: input.ClientID,
+		ParentID: input.ParentID,
+		Room:     room.String(),
+		Name:     name,
+		Args:     args,
+		Text:     text,
+	})
+	switch {
+	case errors.Is(err, command.ErrForbidden):
+		return nil, ErrForbidden
+	case errors.Is(err, command.ErrUsage), errors.Is(err, command.ErrUnknownCommand):
+		return nil, Errorf(err.Error())
+	case err != nil:
+		log.Printf("Error running command /%s: %v", name, err)
+		return nil, err
+	}
+
+	now := time.Now()
+	return &model.Message{
+		ID:        uuid.New(),
+		Content:   reply,
+		ParentID:  input.ParentID,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Ephemeral: true,
+	}, nil
+}
+
+// Page sizes for the replies connection
+const (
+	defaultRepliesPageSize = 50
+	maxRepliesPageSize     = 200
+)
+
 // Common errors
 var (
 	ErrUnauthenticated = Errorf("not authenticated")
+	ErrForbidden       = Errorf("not allowed")
 )
 
 // Errorf creates a formatted error
@@ -234,9 +580,21 @@ func Errorf(format string, args ...interface{}) error {
 type UserError struct {
 	Message string
 	Args    []interface{}
+	Code    string // Machine-readable reason, sent as the code extension when set
 }
 
-// Error implements the error interface
+// Error implements the error interface, formatting the message with its arguments
 func (e *UserError) Error() string {
-	return e.Message
+	if len(e.Args) == 0 {
+		return e.Message
+	}
+	return fmt.Sprintf(e.Message, e.Args...)
+}
+
+// Extensions adds the error's code to the GraphQL error
+func (e *UserError) Extensions() map[string]interface{} {
+	if e.Code == "" {
+		return nil
+	}
+	return map[string]interface{}{"code": e.Code}
 }
\ No newline at end of file
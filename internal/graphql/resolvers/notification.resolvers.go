@@ -0,0 +1,130 @@
+package resolvers
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"crm-communication-api/database"
+	"crm-communication-api/internal/graphql/model"
+	"crm-communication-api/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// MuteClient stops or resumes notifications about a client's conversations for the current user
+func (r *mutationResolver) MuteClient(ctx context.Context, clientID uuid.UUID, muted bool) (*model.NotificationPreferences, error) {
+	// Get user from context (added by auth middleware)
+	userID, ok := ctx.Value("user_id").(uuid.UUID)
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+
+	db := database.GetDB()
+
+	if _, err := requireClientAccess(ctx, clientID); err != nil {
+		return nil, err
+	}
+
+	if err := models.SetChannelMuted(db, userID, clientID, muted); err != nil {
+		log.Printf("Error muting client %s: %v", clientID, err)
+		return nil, err
+	}
+
+	return notificationPreferences(db, userID)
+}
+
+// UpdateNotificationPreferences changes the current user's notification preferences. Fields left
+// out of the input keep their current value.
+func (r *mutationResolver) UpdateNotificationPreferences(ctx context.Context, input model.NotificationPreferencesInput) (*model.NotificationPreferences, error) {
+	// Get user from context (added by auth middleware)
+	userID, ok := ctx.Value("user_id").(uuid.UUID)
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+
+	db := database.GetDB()
+
+	prefs, err := models.NotificationPreferenceFor(db, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if input.Mentions != nil {
+		prefs.Mentions = *input.Mentions
+	}
+	if input.Assignments != nil {
+		prefs.Assignments = *input.Assignments
+	}
+	if input.TimeZone != nil {
+		if *input.TimeZone == "" {
+			return nil, Errorf("timeZone must not be empty")
+		}
+		if _, err := time.LoadLocation(*input.TimeZone); err != nil {
+			return nil, Errorf("unknown time zone")
+		}
+		prefs.TimeZone = *input.TimeZone
+	}
+	if input.QuietStart != nil {
+		prefs.QuietStart = *input.QuietStart
+	}
+	if input.QuietEnd != nil {
+		prefs.QuietEnd = *input.QuietEnd
+	}
+
+	// Quiet hours are all or nothing
+	if (prefs.QuietStart == "") != (prefs.QuietEnd == "") {
+		return nil, Errorf("quietStart and quietEnd must be set together")
+	}
+	for _, clock := range []string{prefs.QuietStart, prefs.QuietEnd} {
+		if clock == "" {
+			continue
+		}
+		if _, err := models.ParseClock(clock); err != nil {
+			return nil, Errorf("quiet hours must be written HH:MM")
+		}
+	}
+
+	if err := db.Save(&prefs).Error; err != nil {
+		log.Printf("Error saving notification preferences: %v", err)
+		return nil, err
+	}
+
+	return notificationPreferences(db, userID)
+}
+
+// NotificationPreferences returns the current user's notification preferences
+func (r *queryResolver) NotificationPreferences(ctx context.Context) (*model.NotificationPreferences, error) {
+	// Get user from context (added by auth middleware)
+	userID, ok := ctx.Value("user_id").(uuid.UUID)
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+
+	return notificationPreferences(database.GetDB(), userID)
+}
+
+// notificationPreferences loads a user's preferences and muted clients as the GraphQL model
+func notificationPreferences(db *gorm.DB, userID uuid.UUID) (*model.NotificationPreferences, error) {
+	prefs, err := models.NotificationPreferenceFor(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	muted, err := models.MutedClients(db, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &model.NotificationPreferences{
+		Mentions:       prefs.Mentions,
+		Assignments:    prefs.Assignments,
+		TimeZone:       prefs.TimeZone,
+		MutedClientIds: muted,
+	}
+	if prefs.QuietStart != "" {
+		result.QuietStart = &prefs.QuietStart
+		result.QuietEnd = &prefs.QuietEnd
+	}
+	return result, nil
+}
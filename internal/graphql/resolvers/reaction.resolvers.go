@@ -0,0 +1,154 @@
+package resolvers
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"crm-communication-api/database"
+	"crm-communication-api/internal/graphql/model"
+	"crm-communication-api/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// AddReaction puts an emoji on a message for the current user
+func (r *mutationResolver) AddReaction(ctx context.Context, messageID uuid.UUID, emoji string) (*model.Message, error) {
+	return changeReaction(ctx, messageID, emoji, true)
+}
+
+// RemoveReaction takes the current user's emoji off a message
+func (r *mutationResolver) RemoveReaction(ctx context.Context, messageID uuid.UUID, emoji string) (*model.Message, error) {
+	return changeReaction(ctx, messageID, emoji, false)
+}
+
+// Reactions returns the aggregated reactions on a message
+func (r *messageResolver) Reactions(ctx context.Context, obj *model.Message) ([]*model.ReactionCount, error) {
+	counts, err := models.MessageReactionCounts(database.GetDB(), obj.ID)
+	if err != nil {
+		return nil, err
+	}
+	return reactionCountsFromModel(counts), nil
+}
+
+// ReactionChanged subscription resolver
+func (r *subscriptionResolver) ReactionChanged(ctx context.Context, clientID uuid.UUID) (<-chan *model.ReactionEvent, error) {
+	if _, err := requireClientAccess(ctx, clientID); err != nil {
+		return nil, err
+	}
+
+	observer := NewObserver()
+	eventManager.Register(clientID, observer)
+
+	reactionChan := make(chan *model.ReactionEvent, 1)
+
+	// Handle cleanup when subscription is closed
+	go func() {
+		<-ctx.Done()
+		eventManager.Unregister(clientID, observer)
+		close(reactionChan)
+		log.Printf("ReactionChanged subscription closed for client %s", clientID.String())
+	}()
+
+	// Forward events to the typed channel
+	go func() {
+		for {
+			select {
+			case event := <-observer.events:
+				if reaction, ok := event.(*model.ReactionEvent); ok {
+					reactionChan <- reaction
+				}
+			case <-observer.closeCh:
+				return
+			}
+		}
+	}()
+
+	return reactionChan, nil
+}
+
+// changeReaction adds or removes one of the current user's reactions and publishes the change.
+// Repeating an addition or removal returns the message without publishing.
+func changeReaction(ctx context.Context, messageID uuid.UUID, emoji string, add bool) (*model.Message, error) {
+	// Get user from context (added by auth middleware)
+	userID, ok := ctx.Value("user_id").(uuid.UUID)
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+
+	db := database.GetDB()
+
+	var message models.Message
+	if err := db.Where("id = ?", messageID).
+		Preload("Sender").
+		Preload("Mentions.User").
+		Preload("Deleter").
+		First(&message).Error; err != nil {
+		return nil, err
+	}
+	if _, err := requireClientAccess(ctx, message.ClientID); err != nil {
+		return nil, err
+	}
+
+	if err := ChangeMessageReaction(db, &message, userID, emoji, add); err != nil {
+		if errors.Is(err, models.ErrInvalidReaction) {
+			return nil, Errorf(err.Error())
+		}
+		log.Printf("Error changing reaction on message %s: %v", messageID, err)
+		return nil, err
+	}
+
+	return messageFromModel(message), nil
+}
+
+// ChangeMessageReaction adds or removes a user's reaction, for addReaction, removeReaction and the
+// chat's react and unreact frames. A change is published with the message's new reaction counts
+// to the reactionChanged subscribers of its client and to its chat room; repeating an addition or
+// removal changes nothing and publishes nothing.
+func ChangeMessageReaction(db *gorm.DB, message *models.Message, userID uuid.UUID, emoji string, add bool) error {
+	var changed bool
+	var err error
+	if add {
+		changed, err = models.AddReaction(db, message, userID, emoji)
+	} else {
+		changed, err = models.RemoveReaction(db, message.ID, userID, emoji)
+	}
+	if err != nil || !changed {
+		return err
+	}
+
+	var user models.User
+	if err := db.Where("id = ?", userID).First(&user).Error; err != nil {
+		return err
+	}
+	counts, err := models.MessageReactionCounts(db, message.ID)
+	if err != nil {
+		return err
+	}
+	PublishReaction(message.ClientID, &model.ReactionEvent{
+		MessageID: message.ID,
+		ClientID:  message.ClientID,
+		User:      userFromModel(user),
+		Emoji:     emoji,
+		Added:     add,
+		Reactions: reactionCountsFromModel(counts),
+	})
+	if rooms := currentChatRooms(); rooms != nil {
+		rooms.ReactionChanged(*message, user, emoji, add, counts)
+	}
+	return nil
+}
+
+// reactionCountsFromModel converts aggregated reactions to the GraphQL model
+func reactionCountsFromModel(counts []models.ReactionCount) []*model.ReactionCount {
+	result := make([]*model.ReactionCount, 0, len(counts))
+	for _, c := range counts {
+		result = append(result, &model.ReactionCount{
+			Emoji:   c.Emoji,
+			Count:   c.Count,
+			UserIds: c.UserIDs,
+		})
+	}
+	return result
+}
@@ -0,0 +1,199 @@
+package resolvers
+
+import (
+	"context"
+	"log"
+
+	"crm-communication-api/database"
+	"crm-communication-api/internal/graphql/model"
+	"crm-communication-api/internal/rbac"
+	"crm-communication-api/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// MarkRead moves the current user's read marker up to a message. Markers never move backwards,
+// so marking an older message returns the current marker unchanged.
+func (r *mutationResolver) MarkRead(ctx context.Context, messageID uuid.UUID) (*model.ReadReceipt, error) {
+	// Get user from context (added by auth middleware)
+	userID, ok := ctx.Value("user_id").(uuid.UUID)
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+
+	db := database.GetDB()
+
+	var message models.Message
+	if err := db.Where("id = ?", messageID).First(&message).Error; err != nil {
+		return nil, err
+	}
+	if _, err := requireClientAccess(ctx, message.ClientID); err != nil {
+		return nil, err
+	}
+
+	read, err := MarkMessageRead(db, userID, &message)
+	if err != nil {
+		log.Printf("Error marking message %s read: %v", messageID, err)
+		return nil, err
+	}
+
+	return readReceiptFromModel(read), nil
+}
+
+// UnreadCounts returns the current user's unread messages per conversation, of the clients they
+// can see
+func (r *queryResolver) UnreadCounts(ctx context.Context, clientID *uuid.UUID) ([]*model.UnreadCount, error) {
+	user, err := currentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	db := database.GetDB()
+
+	var visible []uuid.UUID
+	if clientID != nil {
+		if _, err := requireClientAccess(ctx, *clientID); err != nil {
+			return nil, err
+		}
+		visible = []uuid.UUID{*clientID}
+	} else {
+		scope, err := rbac.ClientScope(db, user, "id")
+		if err != nil {
+			return nil, err
+		}
+		if err := db.Model(&models.Client{}).Scopes(scope).Pluck("id", &visible).Error; err != nil {
+			return nil, err
+		}
+	}
+	isVisible := make(map[uuid.UUID]bool, len(visible))
+	for _, id := range visible {
+		isVisible[id] = true
+	}
+
+	counts, err := models.UnreadCounts(db, user.ID, clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert to GraphQL model
+	result := make([]*model.UnreadCount, 0, len(counts))
+	for _, c := range counts {
+		if !isVisible[c.ClientID] {
+			continue
+		}
+		result = append(result, &model.UnreadCount{
+			ClientID: c.ClientID,
+			ThreadID: c.ThreadID,
+			ParentID: c.ParentID,
+			Count:    c.Count,
+		})
+	}
+
+	return result, nil
+}
+
+// ReadReceipts returns every participant's read marker in a client's channel, a chat thread or
+// the replies to a message
+func (r *queryResolver) ReadReceipts(ctx context.Context, clientID uuid.UUID, threadID *uuid.UUID, parentID *uuid.UUID) ([]*model.ReadReceipt, error) {
+	if _, err := requireClientAccess(ctx, clientID); err != nil {
+		return nil, err
+	}
+
+	conversationID := clientID
+	if parentID != nil {
+		conversationID = *parentID
+	} else if threadID != nil {
+		conversationID = *threadID
+	}
+
+	reads, err := models.ReadMarkers(database.GetDB(), conversationID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert to GraphQL model
+	result := make([]*model.ReadReceipt, 0, len(reads))
+	for _, read := range reads {
+		if read.ClientID != clientID {
+			continue
+		}
+		result = append(result, readReceiptFromModel(read))
+	}
+
+	return result, nil
+}
+
+// MessageRead subscription resolver
+func (r *subscriptionResolver) MessageRead(ctx context.Context, clientID uuid.UUID) (<-chan *model.ReadReceipt, error) {
+	if _, err := requireClientAccess(ctx, clientID); err != nil {
+		return nil, err
+	}
+
+	observer := NewObserver()
+	eventManager.Register(clientID, observer)
+
+	receiptChan := make(chan *model.ReadReceipt, 1)
+
+	// Handle cleanup when subscription is closed
+	go func() {
+		<-ctx.Done()
+		eventManager.Unregister(clientID, observer)
+		close(receiptChan)
+		log.Printf("MessageRead subscription closed for client %s", clientID.String())
+	}()
+
+	// Forward events to the typed channel
+	go func() {
+		for {
+			select {
+			case event := <-observer.events:
+				if receipt, ok := event.(*model.ReadReceipt); ok {
+					receiptChan <- receipt
+				}
+			case <-observer.closeCh:
+				return
+			}
+		}
+	}()
+
+	return receiptChan, nil
+}
+
+// MarkMessageRead moves a user's read marker up to a message for markRead and the chat's read
+// frames. A marker that moved is published to the messageRead subscribers of the message's client
+// and to its chat room. It returns the marker with its user loaded, which is not the given message
+// if it was already further along.
+func MarkMessageRead(db *gorm.DB, userID uuid.UUID, message *models.Message) (models.MessageRead, error) {
+	var read models.MessageRead
+	_, advanced, err := models.MarkRead(db, userID, message)
+	if err != nil {
+		return read, err
+	}
+
+	if err := db.Preload("User").
+		Where("user_id = ? AND conversation_id = ?", userID, message.ConversationID()).
+		First(&read).Error; err != nil {
+		return read, err
+	}
+
+	if advanced {
+		PublishReadReceipt(read.ClientID, readReceiptFromModel(read))
+		if rooms := currentChatRooms(); rooms != nil {
+			rooms.MessageRead(read)
+		}
+	}
+	return read, nil
+}
+
+// readReceiptFromModel converts a read marker, with its user loaded, to the GraphQL model
+func readReceiptFromModel(read models.MessageRead) *model.ReadReceipt {
+	return &model.ReadReceipt{
+		User:      userFromModel(read.User),
+		ClientID:  read.ClientID,
+		ThreadID:  read.ThreadID,
+		ParentID:  read.ParentID,
+		MessageID: read.MessageID,
+		ReadAt:    read.ReadAt,
+	}
+}
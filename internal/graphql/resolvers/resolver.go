@@ -4,6 +4,7 @@ import (
         "sync"
 
         "crm-communication-api/database"
+        "crm-communication-api/internal/command"
         "gorm.io/gorm"
 )
 
@@ -14,14 +15,17 @@ import (
 // Resolver is the resolver root.
 type Resolver struct {
         DB           *gorm.DB
+        Commands     *command.Router // Slash commands recognised by createMessage
         mutex        sync.Mutex
         subscriptions map[string][]chan interface{}
 }
 
 // NewResolver creates a new resolver with database connection
 func NewResolver() *Resolver {
+        db := database.GetDB()
         return &Resolver{
-                DB:           database.GetDB(),
+                DB:           db,
+                Commands:     command.NewRouter(db, command.NewDraftStore(db)),
                 subscriptions: make(map[string][]chan interface{}),
         }
 }
@@ -0,0 +1,442 @@
+package resolvers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"regexp"
+	"strings"
+
+	"crm-communication-api/database"
+	"crm-communication-api/internal/graphql/model"
+	"crm-communication-api/internal/rbac"
+	"crm-communication-api/models"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// roleNamePattern is what custom role names look like; they are stored in users.role
+var roleNamePattern = regexp.MustCompile(`^[a-z0-9-]{1,20}$`)
+
+// HasPermission implements the @hasPermission directive: the field only resolves for users whose
+// role grants the permission
+func HasPermission(ctx context.Context, obj interface{}, next graphql.Resolver, permission model.Permission) (interface{}, error) {
+	if _, err := requirePermission(ctx, rbac.Permission(permission)); err != nil {
+		return nil, err
+	}
+	return next(ctx)
+}
+
+// Me returns the signed in user
+func (r *queryResolver) Me(ctx context.Context) (*model.User, error) {
+	user, err := currentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return userFromModel(user), nil
+}
+
+// Users lists every user
+func (r *queryResolver) Users(ctx context.Context) ([]*model.User, error) {
+	var users []models.User
+	if err := database.GetDB().Order("name").Find(&users).Error; err != nil {
+		return nil, err
+	}
+
+	result := make([]*model.User, 0, len(users))
+	for _, u := range users {
+		result = append(result, userFromModel(u))
+	}
+	return result, nil
+}
+
+// User retrieves a single user by ID
+func (r *queryResolver) User(ctx context.Context, id uuid.UUID) (*model.User, error) {
+	var user models.User
+	err := database.GetDB().Where("id = ?", id).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return userFromModel(user), nil
+}
+
+// Roles lists the built-in roles, then the custom roles by name
+func (r *queryResolver) Roles(ctx context.Context) ([]*model.Role, error) {
+	var custom []models.Role
+	if err := database.GetDB().Order("name").Find(&custom).Error; err != nil {
+		return nil, err
+	}
+
+	result := make([]*model.Role, 0, len(custom)+len(rbac.BuiltinRoles()))
+	for _, name := range rbac.BuiltinRoles() {
+		description := rbac.BuiltinDescription(name)
+		role := &model.Role{Name: name, Description: &description, Builtin: true}
+		for _, p := range rbac.BuiltinPermissions(name) {
+			role.Permissions = append(role.Permissions, model.Permission(p))
+		}
+		result = append(result, role)
+	}
+	for _, role := range custom {
+		result = append(result, roleFromModel(role))
+	}
+	return result, nil
+}
+
+// Teams lists every team with its members
+func (r *queryResolver) Teams(ctx context.Context) ([]*model.Team, error) {
+	db := database.GetDB()
+
+	var teams []models.Team
+	if err := db.Order("name").Find(&teams).Error; err != nil {
+		return nil, err
+	}
+
+	result := make([]*model.Team, 0, len(teams))
+	for _, team := range teams {
+		t, err := teamFromModel(db, team)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, t)
+	}
+	return result, nil
+}
+
+// AssignRole gives a user a built-in or custom role
+func (r *mutationResolver) AssignRole(ctx context.Context, userID uuid.UUID, role string) (*model.User, error) {
+	actor, err := currentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if actor.ID == userID {
+		return nil, Errorf("you cannot change your own role")
+	}
+
+	db := database.GetDB()
+
+	if !rbac.IsBuiltin(role) {
+		var count int64
+		if err := db.Model(&models.Role{}).Where("name = ?", role).Count(&count).Error; err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			return nil, Errorf("unknown role %s", role)
+		}
+	}
+
+	var user models.User
+	if err := db.Where("id = ?", userID).First(&user).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Model(&user).Update("role", role).Error; err != nil {
+		log.Printf("Error assigning role %s to user %s: %v", role, userID, err)
+		return nil, err
+	}
+	user.Role = role
+
+	log.Printf("Audit: user %s gave user %s the role %s", actor.ID, userID, role)
+	return userFromModel(user), nil
+}
+
+// CreateRole defines a custom role
+func (r *mutationResolver) CreateRole(ctx context.Context, input model.RoleInput) (*model.Role, error) {
+	if !roleNamePattern.MatchString(input.Name) {
+		return nil, Errorf("role names are up to 20 lowercase letters, digits and dashes")
+	}
+	if rbac.IsBuiltin(input.Name) {
+		return nil, Errorf("%s is a built-in role", input.Name)
+	}
+
+	db := database.GetDB()
+
+	var count int64
+	if err := db.Model(&models.Role{}).Where("name = ?", input.Name).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, Errorf("the role %s already exists", input.Name)
+	}
+
+	role := models.Role{Name: input.Name, Permissions: joinPermissions(input.Permissions)}
+	if input.Description != nil {
+		role.Description = strings.TrimSpace(*input.Description)
+	}
+	if err := db.Create(&role).Error; err != nil {
+		log.Printf("Error creating role %s: %v", input.Name, err)
+		return nil, err
+	}
+	return roleFromModel(role), nil
+}
+
+// UpdateRole replaces the description and permissions of a custom role
+func (r *mutationResolver) UpdateRole(ctx context.Context, input model.RoleInput) (*model.Role, error) {
+	if rbac.IsBuiltin(input.Name) {
+		return nil, Errorf("built-in roles cannot be changed")
+	}
+
+	db := database.GetDB()
+
+	var role models.Role
+	err := db.Where("name = ?", input.Name).First(&role).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, Errorf("unknown role %s", input.Name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	role.Permissions = joinPermissions(input.Permissions)
+	role.Description = ""
+	if input.Description != nil {
+		role.Description = strings.TrimSpace(*input.Description)
+	}
+	if err := db.Save(&role).Error; err != nil {
+		log.Printf("Error updating role %s: %v", input.Name, err)
+		return nil, err
+	}
+	return roleFromModel(role), nil
+}
+
+// DeleteRole removes a custom role no user has
+func (r *mutationResolver) DeleteRole(ctx context.Context, name string) (bool, error) {
+	if rbac.IsBuiltin(name) {
+		return false, Errorf("built-in roles cannot be deleted")
+	}
+
+	db := database.GetDB()
+
+	var users int64
+	if err := db.Model(&models.User{}).Where("role = ?", name).Count(&users).Error; err != nil {
+		return false, err
+	}
+	if users > 0 {
+		return false, Errorf("%d users have the role %s, give them another role first", users, name)
+	}
+
+	result := db.Where("name = ?", name).Delete(&models.Role{})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// CreateTeam creates an empty team
+func (r *mutationResolver) CreateTeam(ctx context.Context, name string) (*model.Team, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, Errorf("a name is required")
+	}
+
+	team := models.Team{Name: name}
+	if err := database.GetDB().Create(&team).Error; err != nil {
+		log.Printf("Error creating team %s: %v", name, err)
+		return nil, err
+	}
+	return &model.Team{ID: team.ID, Name: team.Name, Members: []*model.User{}, CreatedAt: team.CreatedAt}, nil
+}
+
+// DeleteTeam removes a team and its memberships; its clients are left without a team
+func (r *mutationResolver) DeleteTeam(ctx context.Context, id uuid.UUID) (bool, error) {
+	var deleted bool
+	err := database.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.Client{}).Where("team_id = ?", id).Update("team_id", nil).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("team_id = ?", id).Delete(&models.TeamMember{}).Error; err != nil {
+			return err
+		}
+		result := tx.Where("id = ?", id).Delete(&models.Team{})
+		deleted = result.RowsAffected > 0
+		return result.Error
+	})
+	if err != nil {
+		log.Printf("Error deleting team %s: %v", id, err)
+		return false, err
+	}
+	return deleted, nil
+}
+
+// AddTeamMember puts a user in a team
+func (r *mutationResolver) AddTeamMember(ctx context.Context, teamID uuid.UUID, userID uuid.UUID) (*model.Team, error) {
+	db := database.GetDB()
+
+	var team models.Team
+	if err := db.Where("id = ?", teamID).First(&team).Error; err != nil {
+		return nil, err
+	}
+	var user models.User
+	if err := db.Where("id = ?", userID).First(&user).Error; err != nil {
+		return nil, err
+	}
+
+	member := models.TeamMember{TeamID: teamID, UserID: userID}
+	if err := db.Where(member).FirstOrCreate(&member).Error; err != nil {
+		return nil, err
+	}
+	return teamFromModel(db, team)
+}
+
+// RemoveTeamMember takes a user out of a team
+func (r *mutationResolver) RemoveTeamMember(ctx context.Context, teamID uuid.UUID, userID uuid.UUID) (*model.Team, error) {
+	db := database.GetDB()
+
+	var team models.Team
+	if err := db.Where("id = ?", teamID).First(&team).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Where("team_id = ? AND user_id = ?", teamID, userID).Delete(&models.TeamMember{}).Error; err != nil {
+		return nil, err
+	}
+	return teamFromModel(db, team)
+}
+
+// AssignClientTeam gives a client to a team, or takes it from its team
+func (r *mutationResolver) AssignClientTeam(ctx context.Context, clientID uuid.UUID, teamID *uuid.UUID) (*model.Client, error) {
+	actor, err := requireClientAccess(ctx, clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	db := database.GetDB()
+
+	if teamID != nil {
+		var count int64
+		if err := db.Model(&models.Team{}).Where("id = ?", *teamID).Count(&count).Error; err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			return nil, Errorf("team not found")
+		}
+	}
+
+	var client models.Client
+	if err := db.Where("id = ?", clientID).First(&client).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Model(&client).Update("team_id", teamID).Error; err != nil {
+		log.Printf("Error assigning client %s to a team: %v", clientID, err)
+		return nil, err
+	}
+	client.TeamID = teamID
+
+	log.Printf("User %s assigned client %s to team %v", actor.ID, clientID, teamID)
+	return clientFromModel(client), nil
+}
+
+// currentUser loads the user making the request
+func currentUser(ctx context.Context) (models.User, error) {
+	// Get user from context (added by auth middleware)
+	userID, ok := ctx.Value("user_id").(uuid.UUID)
+	if !ok {
+		return models.User{}, ErrUnauthenticated
+	}
+
+	var user models.User
+	err := database.GetDB().Where("id = ?", userID).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return models.User{}, ErrUnauthenticated
+	}
+	return user, err
+}
+
+// requirePermission returns the current user if their role grants a permission
+func requirePermission(ctx context.Context, permission rbac.Permission) (models.User, error) {
+	user, err := currentUser(ctx)
+	if err != nil {
+		return models.User{}, err
+	}
+	allowed, err := rbac.Has(database.GetDB(), user.Role, permission)
+	if err != nil {
+		return models.User{}, err
+	}
+	if !allowed {
+		return models.User{}, ErrForbidden
+	}
+	return user, nil
+}
+
+// requireClientAccess returns the current user if they may see a client
+func requireClientAccess(ctx context.Context, clientID uuid.UUID) (models.User, error) {
+	user, err := currentUser(ctx)
+	if err != nil {
+		return models.User{}, err
+	}
+	allowed, err := rbac.CanAccessClient(database.GetDB(), user, clientID)
+	if err != nil {
+		return models.User{}, err
+	}
+	if !allowed {
+		return models.User{}, ErrForbidden
+	}
+	return user, nil
+}
+
+// requireOwnerOrPermission returns the current user if they may see a client and either own a
+// record of it or their role grants a permission, such as a moderator deleting other users'
+// messages
+func requireOwnerOrPermission(ctx context.Context, clientID, ownerID uuid.UUID, permission rbac.Permission) (models.User, error) {
+	user, err := requireClientAccess(ctx, clientID)
+	if err != nil {
+		return models.User{}, err
+	}
+	if user.ID == ownerID {
+		return user, nil
+	}
+	allowed, err := rbac.Has(database.GetDB(), user.Role, permission)
+	if err != nil {
+		return models.User{}, err
+	}
+	if !allowed {
+		return models.User{}, ErrForbidden
+	}
+	return user, nil
+}
+
+// roleFromModel converts a custom role to the GraphQL model
+func roleFromModel(r models.Role) *model.Role {
+	result := &model.Role{Name: r.Name, Permissions: []model.Permission{}}
+	if r.Description != "" {
+		result.Description = &r.Description
+	}
+	for _, p := range r.PermissionList() {
+		if permission := model.Permission(p); permission.IsValid() {
+			result.Permissions = append(result.Permissions, permission)
+		}
+	}
+	return result
+}
+
+// teamFromModel converts a team to the GraphQL model, loading its members
+func teamFromModel(db *gorm.DB, t models.Team) (*model.Team, error) {
+	var members []models.User
+	if err := db.Joins("JOIN team_members ON team_members.user_id = users.id").
+		Where("team_members.team_id = ?", t.ID).
+		Order("users.name").
+		Find(&members).Error; err != nil {
+		return nil, err
+	}
+
+	result := &model.Team{ID: t.ID, Name: t.Name, Members: make([]*model.User, 0, len(members)), CreatedAt: t.CreatedAt}
+	for _, u := range members {
+		result.Members = append(result.Members, userFromModel(u))
+	}
+	return result, nil
+}
+
+// joinPermissions stores permissions as Role.Permissions, without duplicates
+func joinPermissions(permissions []model.Permission) string {
+	seen := make(map[model.Permission]bool, len(permissions))
+	var names []string
+	for _, p := range permissions {
+		if !seen[p] {
+			seen[p] = true
+			names = append(names, string(p))
+		}
+	}
+	return strings.Join(names, ",")
+}
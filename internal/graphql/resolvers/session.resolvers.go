@@ -0,0 +1,103 @@
+package resolvers
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"crm-communication-api/auth"
+	"crm-communication-api/database"
+	"crm-communication-api/internal/graphql/model"
+	"crm-communication-api/models"
+
+	"github.com/google/uuid"
+)
+
+// Sessions lists the devices the current user is signed in on
+func (r *queryResolver) Sessions(ctx context.Context) ([]*model.Session, error) {
+	// Get user from context (added by auth middleware)
+	userID, ok := ctx.Value("user_id").(uuid.UUID)
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+
+	sessions, err := models.ActiveSessions(database.GetDB(), userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	current := currentSessionID(ctx)
+	result := make([]*model.Session, 0, len(sessions))
+	for _, session := range sessions {
+		result = append(result, sessionFromModel(session, current))
+	}
+	return result, nil
+}
+
+// RevokeSession signs one of the current user's sessions out
+func (r *mutationResolver) RevokeSession(ctx context.Context, id uuid.UUID) (bool, error) {
+	// Get user from context (added by auth middleware)
+	userID, ok := ctx.Value("user_id").(uuid.UUID)
+	if !ok {
+		return false, ErrUnauthenticated
+	}
+
+	revoked, err := models.RevokeSession(database.GetDB(), userID, id, models.RevokedLogout, time.Now())
+	if err != nil {
+		log.Printf("Error revoking session %s: %v", id, err)
+		return false, err
+	}
+	if !revoked {
+		return false, Errorf("session not found")
+	}
+
+	log.Printf("User %s revoked session %s", userID, id)
+	return true, nil
+}
+
+// LogoutEverywhere signs every session of the current user out
+func (r *mutationResolver) LogoutEverywhere(ctx context.Context) (int, error) {
+	// Get user from context (added by auth middleware)
+	userID, ok := ctx.Value("user_id").(uuid.UUID)
+	if !ok {
+		return 0, ErrUnauthenticated
+	}
+
+	revoked, err := models.RevokeUserSessions(database.GetDB(), userID, models.RevokedLogoutEverywhere, time.Now())
+	if err != nil {
+		log.Printf("Error revoking the sessions of user %s: %v", userID, err)
+		return 0, err
+	}
+
+	log.Printf("User %s signed out %d sessions", userID, revoked)
+	return int(revoked), nil
+}
+
+// currentSessionID returns the session of the request's access token, or uuid.Nil
+func currentSessionID(ctx context.Context) uuid.UUID {
+	claims, err := auth.GetUserFromContext(ctx)
+	if err != nil {
+		return uuid.Nil
+	}
+	id, _ := uuid.Parse(claims.SessionID)
+	return id
+}
+
+// sessionFromModel converts a session to the GraphQL model
+func sessionFromModel(s models.Session, current uuid.UUID) *model.Session {
+	result := &model.Session{
+		ID:           s.ID,
+		AuthProvider: s.AuthProvider,
+		Current:      s.ID == current,
+		CreatedAt:    s.CreatedAt,
+		LastUsedAt:   s.LastUsedAt,
+		ExpiresAt:    s.ExpiresAt,
+	}
+	if s.UserAgent != "" {
+		result.UserAgent = &s.UserAgent
+	}
+	if s.IPAddress != "" {
+		result.IPAddress = &s.IPAddress
+	}
+	return result
+}
@@ -2,11 +2,13 @@ package resolvers
 
 import (
 	"context"
-	"fmt"
+	"encoding/json"
 	"log"
 	"sync"
 
+	"crm-communication-api/internal/broker"
 	"crm-communication-api/internal/graphql/model"
+	"crm-communication-api/models"
 	"github.com/google/uuid"
 )
 
@@ -19,15 +21,90 @@ type Observer struct {
 type EventManager struct {
 	observers map[string][]*Observer
 	mu        sync.RWMutex
+
+	// Shares events with the event managers of other nodes; nil until UseBroker is called
+	broker broker.Broker
+	origin string
+}
+
+// eventsTopic is the broker topic on which event managers share subscription events
+const eventsTopic = "graphql_events"
+
+// eventTypes creates an empty event for each event type, to decode events published by other nodes
+var eventTypes = map[string]func() interface{}{
+	"MessageCreated":       func() interface{} { return &model.Message{} },
+	"EmailCreated":         func() interface{} { return &model.Email{} },
+	"TimelineEventCreated": func() interface{} { return &model.TimelineEvent{} },
+	"MessageRead":          func() interface{} { return &model.ReadReceipt{} },
+	"ReactionChanged":      func() interface{} { return &model.ReactionEvent{} },
+	"MentionCreated":       func() interface{} { return &model.Mention{} },
 }
 
 var (
 	// Global event manager instance
-	eventManager = &EventManager{
+	eventManager = NewEventManager()
+)
+
+// NewEventManager creates an event manager that only serves its own subscribers
+func NewEventManager() *EventManager {
+	return &EventManager{
 		observers: make(map[string][]*Observer),
+		origin:    broker.NewOrigin(),
 	}
+}
+
+// UseBroker makes the global event manager share events with the other nodes using b
+func UseBroker(b broker.Broker) error {
+	return eventManager.UseBroker(b)
+}
+
+// UseBroker publishes the events broadcast by this manager through b, and delivers the events
+// published by other managers to local observers
+func (m *EventManager) UseBroker(b broker.Broker) error {
+	if _, err := b.Subscribe(eventsTopic, m.receiveRemote); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.broker = b
+	m.mu.Unlock()
+	return nil
+}
+
+// ChatRooms sends changes to the rooms of the chat server. The changes made through GraphQL and
+// through chat frames are published by the same functions of this package, so GraphQL subscribers
+// and chat connections see both.
+type ChatRooms interface {
+	// MessageChanged sends a message that was edited or deleted, with its sender loaded, to its room
+	MessageChanged(message models.Message)
+
+	// ReactionChanged sends a reaction a user added to a message or removed from it, with the
+	// message's new reaction counts, to its room
+	ReactionChanged(message models.Message, user models.User, emoji string, added bool, reactions []models.ReactionCount)
+
+	// MessageRead sends a read marker that moved forward, with its user loaded, to its room
+	MessageRead(read models.MessageRead)
+}
+
+var (
+	// The chat rooms the publish functions send changes to; nil until UseChatRooms is called
+	chatRooms   ChatRooms
+	chatRoomsMu sync.RWMutex
 )
 
+// UseChatRooms makes the publish functions also send changes to rooms
+func UseChatRooms(rooms ChatRooms) {
+	chatRoomsMu.Lock()
+	defer chatRoomsMu.Unlock()
+	chatRooms = rooms
+}
+
+// currentChatRooms returns the chat rooms set with UseChatRooms, if any
+func currentChatRooms() ChatRooms {
+	chatRoomsMu.RLock()
+	defer chatRoomsMu.RUnlock()
+	return chatRooms
+}
+
 // Register adds a new observer for a specific client
 func (m *EventManager) Register(clientID uuid.UUID, observer *Observer) {
 	m.mu.Lock()
@@ -60,11 +137,52 @@ func (m *EventManager) Unregister(clientID uuid.UUID, observer *Observer) {
 	}
 }
 
-// Broadcast sends an event to all observers for a specific client
+// Broadcast sends an event to all observers for a specific client, on this node and, with a
+// broker, on every other node
 func (m *EventManager) Broadcast(clientID uuid.UUID, event interface{}, eventType string) {
+	m.deliver(clientID.String(), event, eventType)
+
+	m.mu.RLock()
+	b := m.broker
+	m.mu.RUnlock()
+	if b == nil {
+		return
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Event %s could not be encoded for the broker: %v", eventType, err)
+		return
+	}
+	msg := broker.Message{Origin: m.origin, Key: clientID.String(), Kind: eventType, Data: data}
+	if err := b.Publish(eventsTopic, msg); err != nil {
+		log.Printf("Event %s could not be published to other nodes: %v", eventType, err)
+	}
+}
+
+// receiveRemote delivers an event published by the event manager of another node
+func (m *EventManager) receiveRemote(msg broker.Message) {
+	if msg.Origin == m.origin {
+		return
+	}
+
+	newEvent, known := eventTypes[msg.Kind]
+	if !known {
+		log.Printf("Dropping event of unknown type %s from the broker", msg.Kind)
+		return
+	}
+	event := newEvent()
+	if err := json.Unmarshal(msg.Data, event); err != nil {
+		log.Printf("Dropping malformed %s event from the broker: %v", msg.Kind, err)
+		return
+	}
+	m.deliver(msg.Key, event, msg.Kind)
+}
+
+// deliver sends an event to the observers of a client on this node
+func (m *EventManager) deliver(key string, event interface{}, eventType string) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	key := clientID.String()
 	
 	for _, observer := range m.observers[key] {
 		select {
@@ -87,6 +205,10 @@ func NewObserver() *Observer {
 
 // MessageCreated subscription resolver
 func (r *subscriptionResolver) MessageCreated(ctx context.Context, clientID uuid.UUID) (<-chan *model.Message, error) {
+	if _, err := requireClientAccess(ctx, clientID); err != nil {
+		return nil, err
+	}
+
 	observer := NewObserver()
 	eventManager.Register(clientID, observer)
 	
@@ -119,6 +241,10 @@ func (r *subscriptionResolver) MessageCreated(ctx context.Context, clientID uuid
 
 // EmailCreated subscription resolver
 func (r *subscriptionResolver) EmailCreated(ctx context.Context, clientID uuid.UUID) (<-chan *model.Email, error) {
+	if _, err := requireClientAccess(ctx, clientID); err != nil {
+		return nil, err
+	}
+
 	observer := NewObserver()
 	eventManager.Register(clientID, observer)
 	
@@ -151,6 +277,10 @@ func (r *subscriptionResolver) EmailCreated(ctx context.Context, clientID uuid.U
 
 // TimelineEventCreated subscription resolver
 func (r *subscriptionResolver) TimelineEventCreated(ctx context.Context, clientID uuid.UUID) (<-chan *model.TimelineEvent, error) {
+	if _, err := requireClientAccess(ctx, clientID); err != nil {
+		return nil, err
+	}
+
 	observer := NewObserver()
 	eventManager.Register(clientID, observer)
 	
@@ -194,4 +324,14 @@ func PublishEmail(clientID uuid.UUID, email *model.Email) {
 // PublishTimelineEvent publishes a timeline event to all subscribers
 func PublishTimelineEvent(clientID uuid.UUID, event *model.TimelineEvent) {
 	eventManager.Broadcast(clientID, event, "TimelineEventCreated")
-}
\ No newline at end of file
+}
+
+// PublishReadReceipt publishes a read marker that moved forward to all subscribers
+func PublishReadReceipt(clientID uuid.UUID, receipt *model.ReadReceipt) {
+	eventManager.Broadcast(clientID, receipt, "MessageRead")
+}
+
+// PublishReaction publishes a reaction being added or removed to all subscribers
+func PublishReaction(clientID uuid.UUID, event *model.ReactionEvent) {
+	eventManager.Broadcast(clientID, event, "ReactionChanged")
+}
@@ -0,0 +1,319 @@
+package resolvers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/url"
+	"strings"
+
+	"crm-communication-api/database"
+	"crm-communication-api/internal/graphql/model"
+	"crm-communication-api/internal/rbac"
+	"crm-communication-api/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Page sizes for the webhookDeliveries connection
+const (
+	defaultDeliveriesPageSize = 50
+	maxDeliveriesPageSize     = 200
+)
+
+// minWebhookSecretLength is the shortest secret accepted from createWebhook
+const minWebhookSecretLength = 16
+
+// CreateWebhook subscribes a URL to events. Only users with WEBHOOKS_MANAGE manage webhooks.
+func (r *mutationResolver) CreateWebhook(ctx context.Context, input model.CreateWebhookInput) (*model.Webhook, error) {
+	actor, err := requirePermission(ctx, rbac.WebhooksManage)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateWebhookURL(input.URL); err != nil {
+		return nil, err
+	}
+	events, err := webhookEvents(input.Events)
+	if err != nil {
+		return nil, err
+	}
+
+	db := database.GetDB()
+
+	if input.ClientID != nil {
+		var client models.Client
+		if err := db.Where("id = ?", *input.ClientID).First(&client).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	secret := ""
+	if input.Secret != nil {
+		if len(*input.Secret) < minWebhookSecretLength {
+			return nil, Errorf("the secret must be at least 16 characters")
+		}
+		secret = *input.Secret
+	} else if secret, err = newWebhookSecret(); err != nil {
+		return nil, err
+	}
+
+	webhook := models.WebhookSubscription{
+		URL:       input.URL,
+		Events:    events,
+		ClientID:  input.ClientID,
+		Secret:    secret,
+		Active:    true,
+		CreatedBy: actor.ID,
+	}
+	if err := db.Create(&webhook).Error; err != nil {
+		log.Printf("Error creating webhook: %v", err)
+		return nil, err
+	}
+
+	log.Printf("Audit: user %s created webhook %s to %s for %s", actor.ID, webhook.ID, webhook.URL, webhook.Events)
+	result := webhookFromModel(webhook)
+	if input.Secret == nil {
+		result.Secret = &secret
+	}
+	return result, nil
+}
+
+// UpdateWebhook changes, pauses or resumes a webhook. Fields left out of the input keep their
+// current value.
+func (r *mutationResolver) UpdateWebhook(ctx context.Context, id uuid.UUID, input model.UpdateWebhookInput) (*model.Webhook, error) {
+	actor, err := requirePermission(ctx, rbac.WebhooksManage)
+	if err != nil {
+		return nil, err
+	}
+
+	db := database.GetDB()
+
+	var webhook models.WebhookSubscription
+	if err := db.Where("id = ?", id).First(&webhook).Error; err != nil {
+		return nil, err
+	}
+
+	if input.URL != nil {
+		if err := validateWebhookURL(*input.URL); err != nil {
+			return nil, err
+		}
+		webhook.URL = *input.URL
+	}
+	if input.Events != nil {
+		events, err := webhookEvents(input.Events)
+		if err != nil {
+			return nil, err
+		}
+		webhook.Events = events
+	}
+	if input.Active != nil {
+		webhook.Active = *input.Active
+	}
+	rotated := input.RotateSecret != nil && *input.RotateSecret
+	if rotated {
+		if webhook.Secret, err = newWebhookSecret(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := db.Save(&webhook).Error; err != nil {
+		log.Printf("Error updating webhook %s: %v", id, err)
+		return nil, err
+	}
+
+	log.Printf("Audit: user %s updated webhook %s", actor.ID, id)
+	result := webhookFromModel(webhook)
+	if rotated {
+		result.Secret = &webhook.Secret
+	}
+	return result, nil
+}
+
+// DeleteWebhook removes a webhook with its delivery log; deliveries still pending are not sent
+func (r *mutationResolver) DeleteWebhook(ctx context.Context, id uuid.UUID) (bool, error) {
+	actor, err := requirePermission(ctx, rbac.WebhooksManage)
+	if err != nil {
+		return false, err
+	}
+
+	db := database.GetDB()
+
+	var webhook models.WebhookSubscription
+	if err := db.Where("id = ?", id).First(&webhook).Error; err != nil {
+		return false, err
+	}
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("subscription_id = ?", id).Delete(&models.WebhookDelivery{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&webhook).Error
+	}); err != nil {
+		log.Printf("Error deleting webhook %s: %v", id, err)
+		return false, err
+	}
+
+	log.Printf("Audit: user %s deleted webhook %s to %s", actor.ID, id, webhook.URL)
+	return true, nil
+}
+
+// Webhooks lists every webhook, oldest first
+func (r *queryResolver) Webhooks(ctx context.Context) ([]*model.Webhook, error) {
+	if _, err := requirePermission(ctx, rbac.WebhooksManage); err != nil {
+		return nil, err
+	}
+
+	var webhooks []models.WebhookSubscription
+	if err := database.GetDB().Order("created_at").Find(&webhooks).Error; err != nil {
+		return nil, err
+	}
+
+	result := make([]*model.Webhook, 0, len(webhooks))
+	for _, webhook := range webhooks {
+		result = append(result, webhookFromModel(webhook))
+	}
+	return result, nil
+}
+
+// WebhookDeliveries returns a page of a webhook's delivery log, newest first. The cursor of each
+// edge is the delivery's ID.
+func (r *queryResolver) WebhookDeliveries(ctx context.Context, webhookID uuid.UUID, status *string, first *int, after *string) (*model.WebhookDeliveryConnection, error) {
+	if _, err := requirePermission(ctx, rbac.WebhooksManage); err != nil {
+		return nil, err
+	}
+
+	limit := defaultDeliveriesPageSize
+	if first != nil {
+		if *first < 0 {
+			return nil, Errorf("first must not be negative")
+		}
+		limit = *first
+	}
+	if limit > maxDeliveriesPageSize {
+		limit = maxDeliveriesPageSize
+	}
+
+	state := ""
+	if status != nil {
+		switch *status {
+		case models.DeliveryPending, models.DeliveryDelivered, models.DeliveryFailed:
+			state = *status
+		default:
+			return nil, Errorf("status must be pending, delivered or failed")
+		}
+	}
+
+	db := database.GetDB()
+
+	var anchor *models.WebhookDelivery
+	if after != nil {
+		afterID, err := uuid.Parse(*after)
+		if err != nil {
+			return nil, Errorf("invalid cursor")
+		}
+		var delivery models.WebhookDelivery
+		if err := db.Where("id = ? AND subscription_id = ?", afterID, webhookID).First(&delivery).Error; err != nil {
+			return nil, Errorf("invalid cursor")
+		}
+		anchor = &delivery
+	}
+
+	// Fetch one extra delivery to know whether there is a next page
+	deliveries, err := models.WebhookDeliveries(db, webhookID, state, anchor, limit+1)
+	if err != nil {
+		return nil, err
+	}
+	hasNextPage := len(deliveries) > limit
+	if hasNextPage {
+		deliveries = deliveries[:limit]
+	}
+
+	connection := &model.WebhookDeliveryConnection{
+		Edges:    make([]*model.WebhookDeliveryEdge, 0, len(deliveries)),
+		PageInfo: &model.PageInfo{HasNextPage: hasNextPage},
+	}
+	for _, delivery := range deliveries {
+		cursor := delivery.ID.String()
+		connection.Edges = append(connection.Edges, &model.WebhookDeliveryEdge{Cursor: cursor, Node: webhookDeliveryFromModel(delivery)})
+		connection.PageInfo.EndCursor = &cursor
+	}
+
+	return connection, nil
+}
+
+// validateWebhookURL accepts absolute http and https URLs
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return Errorf("the webhook URL must be an absolute http or https URL")
+	}
+	return nil
+}
+
+// webhookEvents checks the events a webhook subscribes to and returns them as stored
+func webhookEvents(events []string) (string, error) {
+	if len(events) == 0 {
+		return "", Errorf("a webhook needs at least one event")
+	}
+	seen := make(map[string]bool, len(events))
+	var unique []string
+	for _, event := range events {
+		if !models.IsWebhookEvent(event) {
+			return "", Errorf("unknown webhook event, use message.created, email.created or timeline_event.created")
+		}
+		if !seen[event] {
+			seen[event] = true
+			unique = append(unique, event)
+		}
+	}
+	return strings.Join(unique, ","), nil
+}
+
+// newWebhookSecret generates a random signing secret
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// webhookFromModel converts a webhook subscription to the GraphQL model, without its secret
+func webhookFromModel(w models.WebhookSubscription) *model.Webhook {
+	return &model.Webhook{
+		ID:        w.ID,
+		URL:       w.URL,
+		Events:    w.EventList(),
+		ClientID:  w.ClientID,
+		Active:    w.Active,
+		CreatedAt: w.CreatedAt,
+		UpdatedAt: w.UpdatedAt,
+	}
+}
+
+// webhookDeliveryFromModel converts a webhook delivery to the GraphQL model
+func webhookDeliveryFromModel(d models.WebhookDelivery) *model.WebhookDelivery {
+	result := &model.WebhookDelivery{
+		ID:          d.ID,
+		WebhookID:   d.SubscriptionID,
+		Event:       d.Event,
+		Payload:     d.Payload,
+		Status:      d.Status,
+		Attempts:    d.Attempts,
+		DeliveredAt: d.DeliveredAt,
+		CreatedAt:   d.CreatedAt,
+	}
+	if d.LastStatusCode != 0 {
+		result.LastStatusCode = &d.LastStatusCode
+	}
+	if d.LastError != "" {
+		result.LastError = &d.LastError
+	}
+	if d.Status == models.DeliveryPending {
+		result.NextAttemptAt = &d.NextAttemptAt
+	}
+	return result
+}
@@ -0,0 +1,251 @@
+// Package mention finds and resolves the mentions in chat messages. Every path that stores
+// messages, the WebSocket chat, GraphQL and bots, uses it so a mention means the same everywhere.
+//
+// Supported forms are @username, @"Full Name", @email@example.com, @here and @channel. Names
+// and emails are matched against users first, then against clients by name, company or email.
+package mention
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"crm-communication-api/models"
+)
+
+// Kind is what a mention refers to
+type Kind string
+
+const (
+	KindUser      Kind = "user"      // A user, whose ID is set
+	KindClient    Kind = "client"    // A CRM client, whose ID is set
+	KindHere      Kind = "here"      // Everyone online in the conversation
+	KindChannel   Kind = "channel"   // Everyone in the conversation
+	KindAmbiguous Kind = "ambiguous" // Several users or clients match; see Candidates
+	KindUnknown   Kind = "unknown"   // Nobody matches
+)
+
+// Mention is one mention in a message. Start and End are byte offsets into the content, End
+// exclusive, spanning the "@" and any quotes, so clients can highlight it.
+type Mention struct {
+	Kind       Kind        `json:"kind"`
+	Name       string      `json:"name"` // As written, without the "@" and quotes
+	Start      int         `json:"start"`
+	End        int         `json:"end"`
+	ID         *uuid.UUID  `json:"id,omitempty"`
+	Candidates []uuid.UUID `json:"candidates,omitempty"` // Set on ambiguous mentions
+	email      bool
+}
+
+// Result is the resolved mentions of a message
+type Result struct {
+	Mentions []Mention
+}
+
+// UserIDs returns the users mentioned, once each
+func (r Result) UserIDs() []uuid.UUID {
+	return r.ids(KindUser)
+}
+
+// ClientIDs returns the clients mentioned, once each
+func (r Result) ClientIDs() []uuid.UUID {
+	return r.ids(KindClient)
+}
+
+// ids returns the IDs of the mentions of a kind, once each
+func (r Result) ids(kind Kind) []uuid.UUID {
+	seen := make(map[uuid.UUID]bool)
+	var ids []uuid.UUID
+	for _, m := range r.Mentions {
+		if m.Kind == kind && m.ID != nil && !seen[*m.ID] {
+			seen[*m.ID] = true
+			ids = append(ids, *m.ID)
+		}
+	}
+	return ids
+}
+
+// Names returns the names mentioned, once each and in order, leaving out @here and @channel
+func (r Result) Names() []string {
+	seen := make(map[string]bool)
+	names := []string{}
+	for _, m := range r.Mentions {
+		if m.Kind == KindHere || m.Kind == KindChannel || seen[m.Name] {
+			continue
+		}
+		seen[m.Name] = true
+		names = append(names, m.Name)
+	}
+	return names
+}
+
+// Broadcast reports whether the message mentions @here or @channel
+func (r Result) Broadcast() (here, channel bool) {
+	for _, m := range r.Mentions {
+		here = here || m.Kind == KindHere
+		channel = channel || m.Kind == KindChannel
+	}
+	return here, channel
+}
+
+// Parse finds the mentions in content without resolving them: every mention is KindUnknown,
+// except @here and @channel. A mention starts with an "@" at the start of the content or after a
+// character that is not part of a word, so addresses in running text are not mentions.
+func Parse(content string) []Mention {
+	var mentions []Mention
+	for i := 0; i < len(content); i++ {
+		if content[i] != '@' || !boundary(content, i) {
+			continue
+		}
+
+		m, ok := scan(content, i)
+		if !ok {
+			continue
+		}
+		mentions = append(mentions, m)
+		i = m.End - 1
+	}
+	return mentions
+}
+
+// boundary reports whether a mention can start at i
+func boundary(content string, i int) bool {
+	if i == 0 {
+		return true
+	}
+	r, _ := utf8.DecodeLastRuneInString(content[:i])
+	return !isNameRune(r) && r != '@'
+}
+
+// scan reads the mention whose "@" is at start
+func scan(content string, start int) (Mention, bool) {
+	rest := content[start+1:]
+
+	// @"Full Name"
+	if strings.HasPrefix(rest, `"`) {
+		end := strings.IndexByte(rest[1:], '"')
+		if end <= 0 {
+			return Mention{}, false
+		}
+		name := strings.TrimSpace(rest[1 : end+1])
+		if name == "" {
+			return Mention{}, false
+		}
+		return Mention{Kind: KindUnknown, Name: name, Start: start, End: start + end + 3}, true
+	}
+
+	// @name or @email, without trailing punctuation
+	n := strings.IndexFunc(rest, func(r rune) bool { return !isNameRune(r) && r != '@' })
+	if n < 0 {
+		n = len(rest)
+	}
+	name := strings.TrimRight(rest[:n], ".-@")
+	if first, _ := utf8.DecodeRuneInString(name); !unicode.IsLetter(first) && !unicode.IsDigit(first) && first != '_' {
+		return Mention{}, false
+	}
+
+	m := Mention{Kind: KindUnknown, Name: name, Start: start, End: start + 1 + len(name)}
+	switch {
+	case strings.Contains(name, "@"):
+		m.email = true
+	case strings.EqualFold(name, "here"):
+		m.Kind = KindHere
+	case strings.EqualFold(name, "channel"):
+		m.Kind = KindChannel
+	}
+	return m, true
+}
+
+// isNameRune reports whether r can be part of a mentioned name or email
+func isNameRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.' || r == '-' || r == '+'
+}
+
+// Resolve finds the mentions in content and resolves them to users and clients
+func Resolve(db *gorm.DB, content string) (Result, error) {
+	results, err := ResolveAll(db, []string{content})
+	if err != nil {
+		return Result{}, err
+	}
+	return results[0], nil
+}
+
+// ResolveAll resolves the mentions of several messages with one lookup of users and one of
+// clients, returning a result per content
+func ResolveAll(db *gorm.DB, contents []string) ([]Result, error) {
+	results := make([]Result, len(contents))
+	var keys []string
+	for i, content := range contents {
+		results[i].Mentions = Parse(content)
+		for _, m := range results[i].Mentions {
+			if m.Kind == KindUnknown {
+				keys = append(keys, strings.ToLower(m.Name))
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return results, nil
+	}
+
+	var users []models.User
+	if err := db.Where("LOWER(name) IN ? OR LOWER(email) IN ?", keys, keys).Find(&users).Error; err != nil {
+		return nil, err
+	}
+	var clients []models.Client
+	err := db.Where("LOWER(name) IN ? OR LOWER(company) IN ? OR LOWER(email) IN ?", keys, keys, keys).Find(&clients).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range results {
+		for j := range results[i].Mentions {
+			m := &results[i].Mentions[j]
+			if m.Kind == KindUnknown {
+				resolve(m, users, clients)
+			}
+		}
+	}
+	return results, nil
+}
+
+// resolve matches a mention against users, then clients. An email matches exactly one account;
+// a name can match several, which makes the mention ambiguous.
+func resolve(m *Mention, users []models.User, clients []models.Client) {
+	var userIDs []uuid.UUID
+	for _, u := range users {
+		if m.email && strings.EqualFold(u.Email, m.Name) || !m.email && strings.EqualFold(u.Name, m.Name) {
+			userIDs = append(userIDs, u.ID)
+		}
+	}
+	if settle(m, KindUser, userIDs) {
+		return
+	}
+
+	var clientIDs []uuid.UUID
+	for _, c := range clients {
+		if m.email && strings.EqualFold(c.Email, m.Name) ||
+			!m.email && (strings.EqualFold(c.Name, m.Name) || strings.EqualFold(c.Company, m.Name)) {
+			clientIDs = append(clientIDs, c.ID)
+		}
+	}
+	settle(m, KindClient, clientIDs)
+}
+
+// settle sets the outcome of matching a mention against one kind of account, reporting whether
+// anything matched
+func settle(m *Mention, kind Kind, ids []uuid.UUID) bool {
+	switch len(ids) {
+	case 0:
+		return false
+	case 1:
+		m.Kind = kind
+		m.ID = &ids[0]
+	default:
+		m.Kind = KindAmbiguous
+		m.Candidates = ids
+	}
+	return true
+}
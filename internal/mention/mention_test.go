@@ -0,0 +1,166 @@
+package mention
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"crm-communication-api/models"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []Mention
+	}{
+		{
+			name:    "username",
+			content: "hi @alice",
+			want:    []Mention{{Kind: KindUnknown, Name: "alice", Start: 3, End: 9}},
+		},
+		{
+			name:    "quoted full name",
+			content: `ask @"Ada Lovelace" about it`,
+			want:    []Mention{{Kind: KindUnknown, Name: "Ada Lovelace", Start: 4, End: 19}},
+		},
+		{
+			name:    "email",
+			content: "cc @bob@example.com please",
+			want:    []Mention{{Kind: KindUnknown, Name: "bob@example.com", Start: 3, End: 19, email: true}},
+		},
+		{
+			name:    "here and channel",
+			content: "@here and @Channel",
+			want: []Mention{
+				{Kind: KindHere, Name: "here", Start: 0, End: 5},
+				{Kind: KindChannel, Name: "Channel", Start: 10, End: 18},
+			},
+		},
+		{
+			name:    "trailing punctuation",
+			content: "thanks @alice. And @bob-, @carol@example.com.",
+			want: []Mention{
+				{Kind: KindUnknown, Name: "alice", Start: 7, End: 13},
+				{Kind: KindUnknown, Name: "bob", Start: 19, End: 23},
+				{Kind: KindUnknown, Name: "carol@example.com", Start: 26, End: 44, email: true},
+			},
+		},
+		{
+			name:    "multi-byte text",
+			content: "héllo @José, ça va? @\"Zoë Ünal\"",
+			want: []Mention{
+				{Kind: KindUnknown, Name: "José", Start: 7, End: 13},
+				{Kind: KindUnknown, Name: "Zoë Ünal", Start: 23, End: 36},
+			},
+		},
+		{
+			name:    "address in running text",
+			content: "write to alice@example.com",
+		},
+		{
+			name:    "no name",
+			content: `@ @. @"" @"unclosed`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Parse(tt.content)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Parse(%q) = %+v, want %+v", tt.content, got, tt.want)
+			}
+			for _, m := range got {
+				if m.Start < 0 || m.End > len(tt.content) || tt.content[m.Start] != '@' {
+					t.Errorf("mention %q spans %d..%d, which does not start at an @", m.Name, m.Start, m.End)
+				}
+			}
+		})
+	}
+}
+
+func TestResolve(t *testing.T) {
+	ada := uuid.New()
+	ada2 := uuid.New()
+	bob := uuid.New()
+	acme := uuid.New()
+	users := []models.User{
+		{ID: ada, Name: "Ada Lovelace", Email: "ada@example.com"},
+		{ID: ada2, Name: "Ada Lovelace", Email: "ada.l@example.com"},
+		{ID: bob, Name: "Bob", Email: "bob@example.com"},
+	}
+	clients := []models.Client{
+		{ID: acme, Name: "Wile E.", Company: "Acme", Email: "orders@acme.example"},
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		want    []Mention
+	}{
+		{
+			name:    "name",
+			content: "@bob",
+			want:    []Mention{{Kind: KindUser, Name: "bob", Start: 0, End: 4, ID: &bob}},
+		},
+		{
+			name:    "email picks one of two users with the same name",
+			content: "@ada@example.com",
+			want:    []Mention{{Kind: KindUser, Name: "ada@example.com", Start: 0, End: 16, ID: &ada, email: true}},
+		},
+		{
+			name:    "ambiguous name",
+			content: `@"Ada Lovelace"`,
+			want:    []Mention{{Kind: KindAmbiguous, Name: "Ada Lovelace", Start: 0, End: 15, Candidates: []uuid.UUID{ada, ada2}}},
+		},
+		{
+			name:    "client by company",
+			content: "@acme",
+			want:    []Mention{{Kind: KindClient, Name: "acme", Start: 0, End: 5, ID: &acme}},
+		},
+		{
+			name:    "nobody",
+			content: "@nobody",
+			want:    []Mention{{Kind: KindUnknown, Name: "nobody", Start: 0, End: 7}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Parse(tt.content)
+			for i := range got {
+				if got[i].Kind == KindUnknown {
+					resolve(&got[i], users, clients)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("resolved %q = %+v, want %+v", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResultDedupes(t *testing.T) {
+	alice := uuid.New()
+	acme := uuid.New()
+	result := Result{Mentions: []Mention{
+		{Kind: KindUser, Name: "alice", ID: &alice},
+		{Kind: KindClient, Name: "acme", ID: &acme},
+		{Kind: KindHere, Name: "here"},
+		{Kind: KindUser, Name: "alice", ID: &alice},
+		{Kind: KindUser, Name: "alice@example.com", ID: &alice},
+		{Kind: KindAmbiguous, Name: "Ada", Candidates: []uuid.UUID{uuid.New(), uuid.New()}},
+	}}
+
+	if got, want := result.UserIDs(), []uuid.UUID{alice}; !reflect.DeepEqual(got, want) {
+		t.Errorf("UserIDs() = %v, want %v", got, want)
+	}
+	if got, want := result.ClientIDs(), []uuid.UUID{acme}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ClientIDs() = %v, want %v", got, want)
+	}
+	if got, want := result.Names(), []string{"alice", "acme", "alice@example.com", "Ada"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Names() = %v, want %v", got, want)
+	}
+	if here, channel := result.Broadcast(); !here || channel {
+		t.Errorf("Broadcast() = %v, %v, want true, false", here, channel)
+	}
+}
@@ -0,0 +1,304 @@
+// Package notify keeps users from missing what concerns them while they are offline. Mentions and
+// clients assigned to an offline user are queued as notifications, and each user is emailed a
+// digest of their queued notifications on a fixed interval, outside their quiet hours. Mentions
+// the user has seen or read by then are left out of the digest.
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"crm-communication-api/models"
+)
+
+// Presence tells whether a user is connected, in which case nothing is queued for them
+type Presence interface {
+	Online(userID uuid.UUID) bool
+}
+
+// Digest is the email sent to a user about their queued notifications
+type Digest struct {
+	UserID        uuid.UUID
+	To            string
+	Name          string
+	Subject       string
+	Body          string
+	Notifications []models.Notification
+}
+
+// Sender delivers digests
+type Sender interface {
+	Send(ctx context.Context, digest Digest) error
+}
+
+// Notifier queues notifications and sends the digests
+type Notifier struct {
+	db       *gorm.DB
+	sender   Sender
+	presence Presence
+	interval time.Duration
+}
+
+// New creates a notifier sending digests through sender every interval. presence may be nil, in
+// which case every user counts as offline.
+func New(db *gorm.DB, sender Sender, presence Presence, interval time.Duration) *Notifier {
+	return &Notifier{db: db, sender: sender, presence: presence, interval: interval}
+}
+
+var (
+	// The notifier the package-level functions use; nil until Use is called
+	current   *Notifier
+	currentMu sync.RWMutex
+)
+
+// Use makes n the notifier that Mentioned and Assigned queue notifications with
+func Use(n *Notifier) {
+	currentMu.Lock()
+	defer currentMu.Unlock()
+	current = n
+}
+
+// notifier returns the notifier set with Use, if any
+func notifier() *Notifier {
+	currentMu.RLock()
+	defer currentMu.RUnlock()
+	return current
+}
+
+// Mentioned queues a mention, with its message and sender loaded, if the mentioned user is offline.
+// It does nothing until a notifier is set with Use; failures are logged.
+func Mentioned(mention models.MessageMention) {
+	if n := notifier(); n != nil {
+		if err := n.Mentioned(mention); err != nil {
+			log.Printf("Failed to queue the notification of mention %s: %v", mention.ID, err)
+		}
+	}
+}
+
+// Assigned queues the assignment of a client to a user if the user is offline. It does nothing
+// until a notifier is set with Use; failures are logged.
+func Assigned(ownerID uuid.UUID, client models.Client, assignedBy string) {
+	if n := notifier(); n != nil {
+		if err := n.Assigned(ownerID, client, assignedBy); err != nil {
+			log.Printf("Failed to queue the assignment of client %s: %v", client.ID, err)
+		}
+	}
+}
+
+// Mentioned queues a mention, with its message and sender loaded, if the mentioned user is offline
+func (n *Notifier) Mentioned(mention models.MessageMention) error {
+	message := mention.Message
+	if mention.UserID == message.SenderID || n.online(mention.UserID) {
+		return nil
+	}
+
+	return n.queue(models.Notification{
+		UserID:    mention.UserID,
+		Kind:      models.NotificationMention,
+		ClientID:  message.ClientID,
+		MentionID: &mention.ID,
+		Title:     message.Sender.Name + " mentioned you",
+		Body:      message.Content,
+	})
+}
+
+// Assigned queues the assignment of a client to a user if the user is offline
+func (n *Notifier) Assigned(ownerID uuid.UUID, client models.Client, assignedBy string) error {
+	if n.online(ownerID) {
+		return nil
+	}
+
+	return n.queue(models.Notification{
+		UserID:   ownerID,
+		Kind:     models.NotificationAssignment,
+		ClientID: client.ID,
+		Title:    assignedBy + " made you the owner of " + client.Name,
+	})
+}
+
+// online reports whether a user is connected
+func (n *Notifier) online(userID uuid.UUID) bool {
+	return n.presence != nil && n.presence.Online(userID)
+}
+
+// queue stores a notification unless the user's preferences turn it away
+func (n *Notifier) queue(notification models.Notification) error {
+	prefs, err := models.NotificationPreferenceFor(n.db, notification.UserID)
+	if err != nil {
+		return err
+	}
+	if !prefs.Allows(notification.Kind) {
+		return nil
+	}
+	muted, err := models.ChannelMuted(n.db, notification.UserID, notification.ClientID)
+	if err != nil || muted {
+		return err
+	}
+	return n.db.Create(&notification).Error
+}
+
+// Run sends digests every interval until ctx is done
+func (n *Notifier) Run(ctx context.Context) {
+	ticker := time.NewTicker(n.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := n.Flush(ctx, now); err != nil {
+				log.Printf("Failed to send notification digests: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Flush sends a digest to every user with queued notifications who is offline and outside their
+// quiet hours at now. A digest that fails to send is queued again for the next flush.
+func (n *Notifier) Flush(ctx context.Context, now time.Time) error {
+	userIDs, err := models.PendingNotificationUsers(n.db)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, userID := range userIDs {
+		if err := n.flushUser(ctx, userID, now); err != nil {
+			errs = append(errs, fmt.Errorf("digest for user %s: %w", userID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// flushUser sends one user their digest, if it is time to
+func (n *Notifier) flushUser(ctx context.Context, userID uuid.UUID, now time.Time) error {
+	// Users who came back online are not emailed; what they have not read by the time they leave
+	// goes out in a later digest
+	if n.online(userID) {
+		return nil
+	}
+	prefs, err := models.NotificationPreferenceFor(n.db, userID)
+	if err != nil {
+		return err
+	}
+	if quiet, err := prefs.Quiet(now); err != nil || quiet {
+		return err
+	}
+
+	claimed, err := models.ClaimNotifications(n.db, userID, now)
+	if err != nil {
+		return err
+	}
+	pending, err := n.unanswered(claimed)
+	if err != nil || len(pending) == 0 {
+		return n.release(claimed, err)
+	}
+
+	var user models.User
+	if err := n.db.Where("id = ?", userID).First(&user).Error; err != nil {
+		return n.release(claimed, err)
+	}
+	digest, err := n.compose(user, pending)
+	if err != nil {
+		return n.release(claimed, err)
+	}
+	if err := n.sender.Send(ctx, digest); err != nil {
+		return n.release(claimed, err)
+	}
+	return nil
+}
+
+// release queues claimed notifications again after err, returning err
+func (n *Notifier) release(claimed []models.Notification, err error) error {
+	if err == nil {
+		return nil
+	}
+	if releaseErr := models.ReleaseNotifications(n.db, claimed); releaseErr != nil {
+		return errors.Join(err, releaseErr)
+	}
+	return err
+}
+
+// unanswered leaves out mentions the user marked seen, mentions whose message was deleted and
+// mentions in conversations the user has read past the message since
+func (n *Notifier) unanswered(notifications []models.Notification) ([]models.Notification, error) {
+	var mentionIDs []uuid.UUID
+	for _, notification := range notifications {
+		if notification.MentionID != nil {
+			mentionIDs = append(mentionIDs, *notification.MentionID)
+		}
+	}
+	mentions, err := models.MentionsByID(n.db, mentionIDs)
+	if err != nil {
+		return nil, err
+	}
+	open := make(map[uuid.UUID]bool, len(mentions))
+	for _, mention := range mentions {
+		if mention.SeenAt != nil {
+			continue
+		}
+		var read int64
+		err := n.db.Model(&models.MessageRead{}).
+			Where("user_id = ? AND conversation_id = ? AND message_created_at >= ?", mention.UserID, mention.Message.ConversationID(), mention.Message.CreatedAt).
+			Count(&read).Error
+		if err != nil {
+			return nil, err
+		}
+		open[mention.ID] = read == 0
+	}
+
+	pending := make([]models.Notification, 0, len(notifications))
+	for _, notification := range notifications {
+		if notification.MentionID == nil || open[*notification.MentionID] {
+			pending = append(pending, notification)
+		}
+	}
+	return pending, nil
+}
+
+// compose writes the digest of a user's notifications, oldest first
+func (n *Notifier) compose(user models.User, notifications []models.Notification) (Digest, error) {
+	var clientIDs []uuid.UUID
+	for _, notification := range notifications {
+		clientIDs = append(clientIDs, notification.ClientID)
+	}
+	var clients []models.Client
+	if err := n.db.Where("id IN ?", clientIDs).Find(&clients).Error; err != nil {
+		return Digest{}, err
+	}
+	names := make(map[uuid.UUID]string, len(clients))
+	for _, client := range clients {
+		names[client.ID] = client.Name
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "Hi %s,\n\nHere is what happened while you were away:\n\n", user.Name)
+	for _, notification := range notifications {
+		fmt.Fprintf(&body, "- %s: %s (%s)\n", names[notification.ClientID], notification.Title, notification.CreatedAt.UTC().Format("Jan 2 15:04 MST"))
+		if notification.Body != "" {
+			fmt.Fprintf(&body, "  %s\n", notification.Body)
+		}
+	}
+
+	subject := "1 thing you missed"
+	if len(notifications) > 1 {
+		subject = fmt.Sprintf("%d things you missed", len(notifications))
+	}
+	return Digest{
+		UserID:        user.ID,
+		To:            user.Email,
+		Name:          user.Name,
+		Subject:       subject,
+		Body:          body.String(),
+		Notifications: notifications,
+	}, nil
+}
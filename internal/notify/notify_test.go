@@ -0,0 +1,200 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"crm-communication-api/internal/testdb"
+	"crm-communication-api/models"
+)
+
+// onlineUsers is the presence of the users in the set
+type onlineUsers map[uuid.UUID]bool
+
+func (o onlineUsers) Online(userID uuid.UUID) bool {
+	return o[userID]
+}
+
+// failingSender fails to send every digest
+type failingSender struct{}
+
+func (failingSender) Send(ctx context.Context, digest Digest) error {
+	return errors.New("mail server down")
+}
+
+// openNotifyTest stores Ada, Bob and their client Acme in a test database
+func openNotifyTest(t *testing.T) (db *gorm.DB, ada, bob models.User, client models.Client) {
+	t.Helper()
+
+	db = testdb.Open(t, &models.User{}, &models.Client{}, &models.Message{}, &models.MessageMention{},
+		&models.MessageRead{}, &models.Notification{}, &models.NotificationPreference{}, &models.ChannelPreference{})
+	ada = models.User{Name: "Ada", Email: "ada@example.com", Role: "agent"}
+	bob = models.User{Name: "Bob", Email: "bob@example.com", Role: "agent"}
+	client = models.Client{Name: "Acme", Email: "acme@example.com"}
+	for _, row := range []interface{}{&ada, &bob, &client} {
+		if err := db.Create(row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db, ada, bob, client
+}
+
+// storeMention stores a message of a sender mentioning a user in a client's channel and returns
+// the mention as it is notified. The message is stored without its hooks, which number it and
+// record it in the timeline.
+func storeMention(t *testing.T, db *gorm.DB, sender, mentioned models.User, client models.Client) models.MessageMention {
+	t.Helper()
+
+	message := models.Message{Content: "@" + mentioned.Name + " can you call them back?", SenderID: sender.ID, ClientID: client.ID, Sender: sender}
+	if err := db.Session(&gorm.Session{SkipHooks: true}).Omit("Sender").Create(&message).Error; err != nil {
+		t.Fatal(err)
+	}
+	mention := models.MessageMention{MessageID: message.ID, UserID: mentioned.ID}
+	if err := db.Create(&mention).Error; err != nil {
+		t.Fatal(err)
+	}
+	mention.Message = message
+	return mention
+}
+
+// pendingNotifications returns how many notifications wait for a digest
+func pendingNotifications(t *testing.T, db *gorm.DB) int64 {
+	t.Helper()
+
+	var count int64
+	if err := db.Model(&models.Notification{}).Where("sent_at IS NULL").Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestOfflineUsersGetADigest(t *testing.T) {
+	db, ada, bob, client := openNotifyTest(t)
+	outbox := NewOutbox()
+	notifier := New(db, outbox, onlineUsers{}, time.Minute)
+
+	if err := notifier.Mentioned(storeMention(t, db, bob, ada, client)); err != nil {
+		t.Fatal(err)
+	}
+	if err := notifier.Assigned(ada.ID, client, "Bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := notifier.Flush(context.Background(), time.Now()); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+
+	sent := outbox.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("sent %d digests, want 1", len(sent))
+	}
+	digest := sent[0]
+	if digest.To != "ada@example.com" || digest.Subject != "2 things you missed" || len(digest.Notifications) != 2 {
+		t.Errorf("digest to %s about %q with %d notifications, want ada@example.com about 2 things", digest.To, digest.Subject, len(digest.Notifications))
+	}
+	for _, want := range []string{"Acme: Bob mentioned you", "@Ada can you call them back?", "Acme: Bob made you the owner of Acme"} {
+		if !strings.Contains(digest.Body, want) {
+			t.Errorf("digest body %q does not contain %q", digest.Body, want)
+		}
+	}
+
+	// Sent notifications are not sent again
+	if err := notifier.Flush(context.Background(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if len(outbox.Sent()) != 1 || pendingNotifications(t, db) != 0 {
+		t.Errorf("sent %d digests with %d notifications pending, want 1 and none", len(outbox.Sent()), pendingNotifications(t, db))
+	}
+}
+
+func TestNothingIsQueuedForOnlineOrMutedUsers(t *testing.T) {
+	db, ada, bob, client := openNotifyTest(t)
+	online := onlineUsers{}
+	notifier := New(db, NewOutbox(), online, time.Minute)
+
+	online[ada.ID] = true
+	if err := notifier.Mentioned(storeMention(t, db, bob, ada, client)); err != nil {
+		t.Fatal(err)
+	}
+	delete(online, ada.ID)
+
+	if err := models.SetChannelMuted(db, ada.ID, client.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := notifier.Assigned(ada.ID, client, "Bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	if pending := pendingNotifications(t, db); pending != 0 {
+		t.Errorf("queued %d notifications, want none", pending)
+	}
+}
+
+func TestSeenMentionsAreLeftOut(t *testing.T) {
+	db, ada, bob, client := openNotifyTest(t)
+	outbox := NewOutbox()
+	notifier := New(db, outbox, onlineUsers{}, time.Minute)
+
+	if err := notifier.Mentioned(storeMention(t, db, bob, ada, client)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := models.MarkMentionsSeen(db, ada.ID, nil, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := notifier.Flush(context.Background(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if sent := outbox.Sent(); len(sent) != 0 {
+		t.Errorf("sent %d digests about a seen mention, want none", len(sent))
+	}
+}
+
+func TestDigestsWaitForQuietHoursToEnd(t *testing.T) {
+	db, ada, _, client := openNotifyTest(t)
+	outbox := NewOutbox()
+	notifier := New(db, outbox, onlineUsers{}, time.Minute)
+
+	prefs := models.DefaultNotificationPreference(ada.ID)
+	prefs.QuietStart, prefs.QuietEnd = "22:00", "07:00"
+	if err := db.Create(&prefs).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := notifier.Assigned(ada.ID, client, "Bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	night := time.Date(2026, 10, 16, 23, 0, 0, 0, time.UTC)
+	if err := notifier.Flush(context.Background(), night); err != nil {
+		t.Fatal(err)
+	}
+	if len(outbox.Sent()) != 0 || pendingNotifications(t, db) != 1 {
+		t.Fatalf("sent %d digests in quiet hours with %d notifications pending, want none and 1", len(outbox.Sent()), pendingNotifications(t, db))
+	}
+
+	if err := notifier.Flush(context.Background(), night.Add(9*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if len(outbox.Sent()) != 1 {
+		t.Errorf("sent %d digests after quiet hours, want 1", len(outbox.Sent()))
+	}
+}
+
+func TestFailedDigestsAreQueuedAgain(t *testing.T) {
+	db, ada, _, client := openNotifyTest(t)
+	notifier := New(db, failingSender{}, onlineUsers{}, time.Minute)
+
+	if err := notifier.Assigned(ada.ID, client, "Bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := notifier.Flush(context.Background(), time.Now()); err == nil {
+		t.Error("Flush() succeeded with a failing sender")
+	}
+	if pending := pendingNotifications(t, db); pending != 1 {
+		t.Errorf("%d notifications pending after a failed digest, want 1", pending)
+	}
+}
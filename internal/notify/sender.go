@@ -0,0 +1,91 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+)
+
+// SMTPSender emails digests through an SMTP server
+type SMTPSender struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// NewSMTPSender creates a sender using the SMTP server at addr ("host:port") with the From address
+// from. Without a username the server is used without authentication.
+func NewSMTPSender(addr, username, password, from string) *SMTPSender {
+	s := &SMTPSender{addr: addr, from: from}
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		s.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return s
+}
+
+// Send implements Sender
+func (s *SMTPSender) Send(ctx context.Context, digest Digest) error {
+	if strings.ContainsAny(digest.To, "\r\n") || strings.ContainsAny(digest.Subject, "\r\n") {
+		return fmt.Errorf("invalid digest header for %s", digest.To)
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", s.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", digest.To)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", digest.Subject)
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(digest.Body, "\n", "\r\n"))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(s.addr, s.auth, s.from, []string{digest.To}, []byte(msg.String()))
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// LogSender writes digests to the log instead of sending them, for development without an SMTP
+// server
+type LogSender struct{}
+
+// Send implements Sender
+func (LogSender) Send(ctx context.Context, digest Digest) error {
+	log.Printf("Digest for %s <%s>: %s\n%s", digest.Name, digest.To, digest.Subject, digest.Body)
+	return nil
+}
+
+// Outbox keeps digests in memory, for tests
+type Outbox struct {
+	mu      sync.Mutex
+	digests []Digest
+}
+
+// NewOutbox creates an empty outbox
+func NewOutbox() *Outbox {
+	return &Outbox{}
+}
+
+// Send implements Sender
+func (o *Outbox) Send(ctx context.Context, digest Digest) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.digests = append(o.digests, digest)
+	return nil
+}
+
+// Sent returns the digests sent so far
+func (o *Outbox) Sent() []Digest {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]Digest(nil), o.digests...)
+}
@@ -0,0 +1,285 @@
+// Package ratelimit keeps users from flooding conversations. Every message spends a token from
+// three buckets: the sender's, the connection's it was sent on and the room's. Buckets refill at a
+// steady rate up to their size, and a message is only accepted when all three have a token left.
+// Users who keep hitting the limits are muted for a while. Quotas are kept in memory, per node.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scopes of the buckets a message spends from, as reported by Error
+const (
+	ScopeUser       = "user"
+	ScopeConnection = "connection"
+	ScopeRoom       = "room"
+	ScopeMuted      = "muted"
+)
+
+// DefaultRole is the key of Config.Roles used for roles without limits of their own
+const DefaultRole = "default"
+
+// sweepInterval is how often full buckets and expired mutes are forgotten
+const sweepInterval = time.Minute
+
+// Rate is a bucket of Burst tokens refilled at Burst tokens per Per. A zero Rate is unlimited.
+type Rate struct {
+	Burst int
+	Per   time.Duration
+}
+
+// ParseRate reads a rate written "<burst>/<duration>", such as "10/10s"
+func ParseRate(s string) (Rate, error) {
+	burst, per, ok := strings.Cut(strings.TrimSpace(s), "/")
+	n, err := strconv.Atoi(burst)
+	if !ok || err != nil || n <= 0 {
+		return Rate{}, fmt.Errorf("invalid rate %q, use <messages>/<duration> such as 10/10s", s)
+	}
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return Rate{}, fmt.Errorf("invalid rate %q, use <messages>/<duration> such as 10/10s", s)
+	}
+	return Rate{Burst: n, Per: d}, nil
+}
+
+// String writes the rate as ParseRate reads it
+func (r Rate) String() string {
+	return fmt.Sprintf("%d/%s", r.Burst, r.Per)
+}
+
+// unlimited reports whether the rate lets everything through
+func (r Rate) unlimited() bool {
+	return r.Burst <= 0 || r.Per <= 0
+}
+
+// Limits are the user and connection rates of a role
+type Limits struct {
+	User       Rate
+	Connection Rate
+}
+
+// Config sets the rates of a limiter
+type Config struct {
+	// Rates per role, with DefaultRole for the others
+	Roles map[string]Limits
+
+	// Rate of every room, shared by everyone posting in it
+	Room Rate
+
+	// Users rejected MuteAfter times within MuteWindow are muted for MuteFor. Zero never mutes.
+	MuteAfter  int
+	MuteWindow time.Duration
+	MuteFor    time.Duration
+}
+
+// Message describes a message about to be posted
+type Message struct {
+	UserID     string
+	Role       string
+	Connection string // Empty for messages not sent on a chat connection, such as createMessage
+	Room       string
+}
+
+// Error rejects a message over the limits
+type Error struct {
+	Scope      string        // The bucket that ran out, or ScopeMuted
+	RetryAfter time.Duration // How long until the message would be accepted
+}
+
+// Error implements error
+func (e *Error) Error() string {
+	wait := time.Duration(math.Ceil(e.RetryAfter.Seconds())) * time.Second
+	switch e.Scope {
+	case ScopeMuted:
+		return fmt.Sprintf("muted for sending too many messages, try again in %s", wait)
+	case ScopeConnection:
+		return fmt.Sprintf("too many messages on this connection, try again in %s", wait)
+	case ScopeRoom:
+		return fmt.Sprintf("too many messages in this room, try again in %s", wait)
+	default:
+		return fmt.Sprintf("too many messages, try again in %s", wait)
+	}
+}
+
+// bucket is a token bucket
+type bucket struct {
+	tokens float64
+	at     time.Time // When tokens was last computed
+}
+
+// offender records the rejections of a user
+type offender struct {
+	strikes    []time.Time
+	mutedUntil time.Time
+}
+
+// Limiter applies a Config to messages. It is safe for concurrent use.
+type Limiter struct {
+	mu        sync.Mutex
+	config    Config
+	buckets   map[string]*bucket // Keyed by scope and ID
+	offenders map[string]*offender
+	swept     time.Time
+}
+
+// New creates a limiter
+func New(config Config) *Limiter {
+	return &Limiter{
+		config:    config,
+		buckets:   make(map[string]*bucket),
+		offenders: make(map[string]*offender),
+	}
+}
+
+var (
+	// The limiter the package-level functions use; nil until Use is called
+	current   *Limiter
+	currentMu sync.RWMutex
+)
+
+// Use makes l the limiter Allow applies, so that every entry point shares its quotas
+func Use(l *Limiter) {
+	currentMu.Lock()
+	defer currentMu.Unlock()
+	current = l
+}
+
+// Allow spends a message from the quotas of the limiter set with Use, returning an *Error when the
+// message must be rejected. Everything is allowed until a limiter is set.
+func Allow(msg Message) error {
+	currentMu.RLock()
+	l := current
+	currentMu.RUnlock()
+	if l == nil {
+		return nil
+	}
+	return l.Allow(msg, time.Now())
+}
+
+// Allow spends a message from the sender's, the connection's and the room's buckets at now,
+// returning an *Error when one of them is empty or the sender is muted. Rejected messages spend
+// nothing.
+func (l *Limiter) Allow(msg Message, now time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.swept) >= sweepInterval {
+		l.sweep(now)
+	}
+
+	if o := l.offenders[msg.UserID]; o != nil && now.Before(o.mutedUntil) {
+		return &Error{Scope: ScopeMuted, RetryAfter: o.mutedUntil.Sub(now)}
+	}
+
+	limits, ok := l.config.Roles[msg.Role]
+	if !ok {
+		limits = l.config.Roles[DefaultRole]
+	}
+	checks := []struct {
+		scope string
+		key   string
+		rate  Rate
+	}{
+		{ScopeUser, msg.UserID, limits.User},
+		{ScopeConnection, msg.Connection, limits.Connection},
+		{ScopeRoom, msg.Room, l.config.Room},
+	}
+
+	// Check every bucket before spending from any
+	spend := make([]*bucket, 0, len(checks))
+	for _, check := range checks {
+		if check.key == "" || check.rate.unlimited() {
+			continue
+		}
+		b := l.refill(check.scope+":"+check.key, check.rate, now)
+		if b.tokens < 1 {
+			wait := time.Duration((1 - b.tokens) * float64(check.rate.Per) / float64(check.rate.Burst))
+			err := &Error{Scope: check.scope, RetryAfter: wait}
+			// A busy room is not the sender's doing, so it does not count towards muting them
+			if check.scope == ScopeRoom {
+				return err
+			}
+			return l.reject(msg.UserID, err, now)
+		}
+		spend = append(spend, b)
+	}
+	for _, b := range spend {
+		b.tokens--
+	}
+	return nil
+}
+
+// refill returns a bucket with the tokens it gained since it was last used
+func (l *Limiter) refill(key string, rate Rate, now time.Time) *bucket {
+	b := l.buckets[key]
+	if b == nil {
+		b = &bucket{tokens: float64(rate.Burst), at: now}
+		l.buckets[key] = b
+		return b
+	}
+	if elapsed := now.Sub(b.at); elapsed > 0 {
+		b.tokens = math.Min(float64(rate.Burst), b.tokens+elapsed.Seconds()*float64(rate.Burst)/rate.Per.Seconds())
+		b.at = now
+	}
+	return b
+}
+
+// reject counts a rejection against a user, muting them when they reach MuteAfter, and returns err
+// or the mute
+func (l *Limiter) reject(userID string, err *Error, now time.Time) error {
+	if l.config.MuteAfter <= 0 || userID == "" {
+		return err
+	}
+
+	o := l.offenders[userID]
+	if o == nil {
+		o = &offender{}
+		l.offenders[userID] = o
+	}
+	cutoff := now.Add(-l.config.MuteWindow)
+	strikes := o.strikes[:0]
+	for _, at := range o.strikes {
+		if at.After(cutoff) {
+			strikes = append(strikes, at)
+		}
+	}
+	o.strikes = append(strikes, now)
+
+	if len(o.strikes) >= l.config.MuteAfter {
+		o.strikes = nil
+		o.mutedUntil = now.Add(l.config.MuteFor)
+		return &Error{Scope: ScopeMuted, RetryAfter: l.config.MuteFor}
+	}
+	return err
+}
+
+// sweep forgets buckets that refilled, which a new bucket would match, and offenders with no
+// recent strike or mute
+func (l *Limiter) sweep(now time.Time) {
+	l.swept = now
+	longest := l.config.Room.Per
+	for _, limits := range l.config.Roles {
+		if limits.User.Per > longest {
+			longest = limits.User.Per
+		}
+		if limits.Connection.Per > longest {
+			longest = limits.Connection.Per
+		}
+	}
+	for key, b := range l.buckets {
+		if now.Sub(b.at) >= longest {
+			delete(l.buckets, key)
+		}
+	}
+	for userID, o := range l.offenders {
+		recent := len(o.strikes) > 0 && now.Sub(o.strikes[len(o.strikes)-1]) < l.config.MuteWindow
+		if !recent && !now.Before(o.mutedUntil) {
+			delete(l.offenders, userID)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package ratelimit
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// scope returns the scope of a rejection, or "" when the message was allowed
+func scope(t *testing.T, err error) string {
+	t.Helper()
+
+	if err == nil {
+		return ""
+	}
+	var limit *Error
+	if !errors.As(err, &limit) {
+		t.Fatalf("got %v, want an *Error", err)
+	}
+	return limit.Scope
+}
+
+func TestBucketsRefillAtTheirRate(t *testing.T) {
+	l := New(Config{Roles: map[string]Limits{DefaultRole: {User: Rate{Burst: 2, Per: 10 * time.Second}}}})
+	msg := Message{UserID: "ada", Role: "agent", Room: "acme"}
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if err := l.Allow(msg, now); err != nil {
+			t.Fatalf("message %d of the burst rejected: %v", i+1, err)
+		}
+	}
+	err := l.Allow(msg, now)
+	if scope(t, err) != ScopeUser {
+		t.Fatalf("message over the burst got %v, want a %s rejection", err, ScopeUser)
+	}
+	if wait := err.(*Error).RetryAfter; wait != 5*time.Second {
+		t.Errorf("retry after %s, want the 5s a token takes to refill", wait)
+	}
+
+	// A token is back after 5s, but only one
+	if err := l.Allow(msg, now.Add(5*time.Second)); err != nil {
+		t.Errorf("message once a token refilled rejected: %v", err)
+	}
+	if scope(t, l.Allow(msg, now.Add(5*time.Second))) != ScopeUser {
+		t.Error("second message after a single token refilled was allowed")
+	}
+
+	// Buckets refill up to their burst, not past it
+	later := now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		if err := l.Allow(msg, later); err != nil {
+			t.Fatalf("message %d after a long pause rejected: %v", i+1, err)
+		}
+	}
+	if scope(t, l.Allow(msg, later)) != ScopeUser {
+		t.Error("bucket refilled past its burst")
+	}
+}
+
+func TestEveryBucketLimitsMessages(t *testing.T) {
+	one := Rate{Burst: 1, Per: time.Minute}
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		config Config
+		second Message // Sent after a first message from ada on conn-1 in acme
+		want   string
+	}{
+		{
+			name:   "user across connections and rooms",
+			config: Config{Roles: map[string]Limits{DefaultRole: {User: one}}},
+			second: Message{UserID: "ada", Role: "agent", Connection: "conn-2", Room: "globex"},
+			want:   ScopeUser,
+		},
+		{
+			name:   "connection",
+			config: Config{Roles: map[string]Limits{DefaultRole: {Connection: one}}},
+			second: Message{UserID: "ada", Role: "agent", Connection: "conn-1", Room: "globex"},
+			want:   ScopeConnection,
+		},
+		{
+			name:   "room shared by its members",
+			config: Config{Room: one},
+			second: Message{UserID: "bob", Role: "agent", Connection: "conn-2", Room: "acme"},
+			want:   ScopeRoom,
+		},
+		{
+			name:   "roles with limits of their own",
+			config: Config{Roles: map[string]Limits{DefaultRole: {User: one}, "admin": {}}},
+			second: Message{UserID: "ada", Role: "admin", Connection: "conn-1", Room: "acme"},
+			want:   "",
+		},
+		{
+			name:   "other users, connections and rooms",
+			config: Config{Roles: map[string]Limits{DefaultRole: {User: one, Connection: one}}, Room: one},
+			second: Message{UserID: "bob", Role: "agent", Connection: "conn-2", Room: "globex"},
+			want:   "",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := New(test.config)
+			first := Message{UserID: "ada", Role: "agent", Connection: "conn-1", Room: "acme"}
+			if err := l.Allow(first, now); err != nil {
+				t.Fatalf("first message rejected: %v", err)
+			}
+			if got := scope(t, l.Allow(test.second, now)); got != test.want {
+				t.Errorf("second message rejected by %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRejectedMessagesSpendNothing(t *testing.T) {
+	l := New(Config{
+		Roles: map[string]Limits{DefaultRole: {User: Rate{Burst: 2, Per: time.Minute}}},
+		Room:  Rate{Burst: 1, Per: time.Minute},
+	})
+	now := time.Now()
+
+	if err := l.Allow(Message{UserID: "bob", Role: "agent", Room: "acme"}, now); err != nil {
+		t.Fatal(err)
+	}
+	// Acme is full, which must not cost ada a token
+	for i := 0; i < 3; i++ {
+		if scope(t, l.Allow(Message{UserID: "ada", Role: "agent", Room: "acme"}, now)) != ScopeRoom {
+			t.Fatal("message in a full room allowed")
+		}
+	}
+	for _, room := range []string{"globex", "initech"} {
+		if err := l.Allow(Message{UserID: "ada", Role: "agent", Room: room}, now); err != nil {
+			t.Fatalf("message in %s rejected: %v", room, err)
+		}
+	}
+}
+
+func TestMutesExpire(t *testing.T) {
+	l := New(Config{
+		Roles:      map[string]Limits{DefaultRole: {User: Rate{Burst: 1, Per: time.Second}}},
+		MuteAfter:  3,
+		MuteWindow: time.Minute,
+		MuteFor:    10 * time.Minute,
+	})
+	msg := Message{UserID: "ada", Role: "agent", Room: "acme"}
+	now := time.Now()
+
+	if err := l.Allow(msg, now); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if scope(t, l.Allow(msg, now)) != ScopeUser {
+			t.Fatalf("rejection %d did not come from the user's bucket", i+1)
+		}
+	}
+	err := l.Allow(msg, now)
+	if scope(t, err) != ScopeMuted || err.(*Error).RetryAfter != 10*time.Minute {
+		t.Fatalf("third rejection got %v, want a 10m mute", err)
+	}
+
+	// Muted users wait even though their bucket refilled
+	if scope(t, l.Allow(msg, now.Add(9*time.Minute))) != ScopeMuted {
+		t.Error("message allowed before the mute expired")
+	}
+	if err := l.Allow(msg, now.Add(10*time.Minute)); err != nil {
+		t.Errorf("message once the mute expired rejected: %v", err)
+	}
+}
+
+func TestStrikesOutsideTheWindowDoNotMute(t *testing.T) {
+	l := New(Config{
+		Roles:      map[string]Limits{DefaultRole: {User: Rate{Burst: 1, Per: time.Hour}}},
+		MuteAfter:  2,
+		MuteWindow: time.Minute,
+		MuteFor:    10 * time.Minute,
+	})
+	msg := Message{UserID: "ada", Role: "agent", Room: "acme"}
+	now := time.Now()
+
+	if err := l.Allow(msg, now); err != nil {
+		t.Fatal(err)
+	}
+	if scope(t, l.Allow(msg, now)) != ScopeUser {
+		t.Fatal("message over the burst allowed")
+	}
+	if got := scope(t, l.Allow(msg, now.Add(2*time.Minute))); got != ScopeUser {
+		t.Errorf("strike outside the window rejected by %q, want %q", got, ScopeUser)
+	}
+}
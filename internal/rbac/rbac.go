@@ -0,0 +1,216 @@
+// Package rbac decides what users may do. A user's role grants permissions: the built-in roles
+// are defined here, custom roles are stored in the roles table. Access to a client's
+// conversations, emails and timeline additionally requires the client to be visible to the user:
+// users with CLIENTS_ALL see every client, everyone else the clients of their teams and the
+// clients they own.
+package rbac
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"crm-communication-api/models"
+)
+
+// Permission allows a kind of operation. The values are the names of the GraphQL Permission enum.
+type Permission string
+
+const (
+	ClientsRead      Permission = "CLIENTS_READ"      // See the clients visible to the user and their history
+	ClientsWrite     Permission = "CLIENTS_WRITE"     // Create and edit clients
+	ClientsAssign    Permission = "CLIENTS_ASSIGN"    // Change a client's owner or team
+	ClientsAll       Permission = "CLIENTS_ALL"       // See every client, not only those of the user's teams
+	MessagesWrite    Permission = "MESSAGES_WRITE"    // Post, edit and react to messages
+	MessagesModerate Permission = "MESSAGES_MODERATE" // Delete other users' messages
+	MessagesPurge    Permission = "MESSAGES_PURGE"    // Erase messages permanently
+	TimelineWrite    Permission = "TIMELINE_WRITE"    // Add timeline events
+	TimelineModerate Permission = "TIMELINE_MODERATE" // Edit and delete other users' timeline events
+	EmailsWrite      Permission = "EMAILS_WRITE"      // Send emails to clients
+	WebhooksManage   Permission = "WEBHOOKS_MANAGE"   // Manage webhook subscriptions
+	UsersManage      Permission = "USERS_MANAGE"      // Assign roles, manage custom roles and teams
+)
+
+// All lists every permission
+var All = []Permission{
+	ClientsRead, ClientsWrite, ClientsAssign, ClientsAll,
+	MessagesWrite, MessagesModerate, MessagesPurge,
+	TimelineWrite, TimelineModerate,
+	EmailsWrite, WebhooksManage, UsersManage,
+}
+
+// Built-in roles
+const (
+	RoleAdmin    = "admin"
+	RoleManager  = "manager"
+	RoleAgent    = "agent"
+	RoleReadOnly = "read-only"
+
+	// RoleUser is the role users were given before roles had permissions; it grants what agent does
+	RoleUser = "user"
+)
+
+// DefaultRole is the role of new users
+const DefaultRole = RoleAgent
+
+var agentPermissions = []Permission{ClientsRead, ClientsWrite, MessagesWrite, TimelineWrite, EmailsWrite}
+
+// builtin maps the built-in roles to their permissions
+var builtin = map[string][]Permission{
+	RoleAdmin: All,
+	RoleManager: {
+		ClientsRead, ClientsWrite, ClientsAssign, ClientsAll,
+		MessagesWrite, MessagesModerate,
+		TimelineWrite, TimelineModerate,
+		EmailsWrite,
+	},
+	RoleAgent:    agentPermissions,
+	RoleReadOnly: {ClientsRead},
+	RoleUser:     agentPermissions,
+}
+
+// descriptions describes the built-in roles
+var descriptions = map[string]string{
+	RoleAdmin:    "Every permission",
+	RoleManager:  "Every client, moderation and assignment; no purging, webhooks or user management",
+	RoleAgent:    "The clients of their teams and the clients they own",
+	RoleReadOnly: "Reads the clients of their teams and the clients they own",
+	RoleUser:     "Former default role, same as agent",
+}
+
+// Valid reports whether p is one of the permissions
+func Valid(p Permission) bool {
+	for _, known := range All {
+		if p == known {
+			return true
+		}
+	}
+	return false
+}
+
+// IsBuiltin reports whether role is one of the built-in roles, which cannot be changed
+func IsBuiltin(role string) bool {
+	_, ok := builtin[role]
+	return ok
+}
+
+// BuiltinRoles returns the names of the built-in roles, sorted
+func BuiltinRoles() []string {
+	names := make([]string, 0, len(builtin))
+	for name := range builtin {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// BuiltinPermissions returns the permissions of a built-in role, or nil for other roles
+func BuiltinPermissions(role string) []Permission {
+	return append([]Permission(nil), builtin[role]...)
+}
+
+// BuiltinDescription returns the description of a built-in role
+func BuiltinDescription(role string) string {
+	return descriptions[role]
+}
+
+// Permissions returns the permissions a role grants. Unknown roles grant nothing.
+func Permissions(db *gorm.DB, role string) (map[Permission]bool, error) {
+	granted := make(map[Permission]bool)
+	if perms, ok := builtin[role]; ok {
+		for _, p := range perms {
+			granted[p] = true
+		}
+		return granted, nil
+	}
+	if role == "" {
+		return granted, nil
+	}
+
+	var custom models.Role
+	err := db.Where("name = ?", role).First(&custom).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return granted, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range custom.PermissionList() {
+		if Valid(Permission(p)) {
+			granted[Permission(p)] = true
+		}
+	}
+	return granted, nil
+}
+
+// Has reports whether a role grants a permission
+func Has(db *gorm.DB, role string, p Permission) (bool, error) {
+	if perms, ok := builtin[role]; ok {
+		for _, granted := range perms {
+			if granted == p {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	granted, err := Permissions(db, role)
+	if err != nil {
+		return false, err
+	}
+	return granted[p], nil
+}
+
+// CanAccessClient reports whether a user may see a client: they need CLIENTS_READ, and either
+// CLIENTS_ALL, ownership of the client or membership of its team. Unknown clients are not
+// accessible.
+func CanAccessClient(db *gorm.DB, user models.User, clientID uuid.UUID) (bool, error) {
+	granted, err := Permissions(db, user.Role)
+	if err != nil {
+		return false, err
+	}
+	if !granted[ClientsRead] {
+		return false, nil
+	}
+
+	var client models.Client
+	err = db.Select("id", "owner_id", "team_id").Where("id = ?", clientID).First(&client).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if granted[ClientsAll] {
+		return true, nil
+	}
+	if client.OwnerID != nil && *client.OwnerID == user.ID {
+		return true, nil
+	}
+	if client.TeamID == nil {
+		return false, nil
+	}
+
+	var count int64
+	err = db.Model(&models.TeamMember{}).Where("team_id = ? AND user_id = ?", *client.TeamID, user.ID).Count(&count).Error
+	return count > 0, err
+}
+
+// ClientScope returns a scope restricting a query to the rows whose column, a client ID, names a
+// client the user may see, as in db.Scopes(scope).Find(&messages)
+func ClientScope(db *gorm.DB, user models.User, column string) (func(*gorm.DB) *gorm.DB, error) {
+	granted, err := Permissions(db, user.Role)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case !granted[ClientsRead]:
+		return func(tx *gorm.DB) *gorm.DB { return tx.Where("1 = 0") }, nil
+	case granted[ClientsAll]:
+		return func(tx *gorm.DB) *gorm.DB { return tx }, nil
+	}
+	return func(tx *gorm.DB) *gorm.DB {
+		return tx.Where(column+" IN (SELECT id FROM clients WHERE owner_id = ? OR team_id IN (SELECT team_id FROM team_members WHERE user_id = ?))", user.ID, user.ID)
+	}, nil
+}
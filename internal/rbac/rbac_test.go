@@ -0,0 +1,136 @@
+package rbac
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"crm-communication-api/internal/testdb"
+	"crm-communication-api/models"
+)
+
+// clientNames returns the names of the clients a user may see through ClientScope, sorted
+func clientNames(t *testing.T, db *gorm.DB, user models.User) []string {
+	t.Helper()
+
+	scope, err := ClientScope(db, user, "id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	if err := db.Model(&models.Client{}).Scopes(scope).Order("name").Pluck("name", &names).Error; err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestClientAccessFollowsRolesAndTeams(t *testing.T) {
+	db := testdb.Open(t, &models.User{}, &models.Client{}, &models.Role{}, &models.Team{}, &models.TeamMember{})
+
+	// The user under test owns one client and is in the team working on another
+	self := models.User{Name: "Ada", Email: "ada@example.com"}
+	other := models.User{Name: "Bob", Email: "bob@example.com"}
+	for _, user := range []*models.User{&self, &other} {
+		if err := db.Create(user).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	sales := models.Team{Name: "Sales"}
+	support := models.Team{Name: "Support"}
+	for _, team := range []*models.Team{&sales, &support} {
+		if err := db.Create(team).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Create(&models.TeamMember{TeamID: sales.ID, UserID: self.ID}).Error; err != nil {
+		t.Fatal(err)
+	}
+	clients := []models.Client{
+		{Name: "Owned", Email: "owned@example.com", OwnerID: &self.ID},
+		{Name: "Team", Email: "team@example.com", OwnerID: &other.ID, TeamID: &sales.ID},
+		{Name: "Other team", Email: "other@example.com", OwnerID: &other.ID, TeamID: &support.ID},
+		{Name: "Unassigned", Email: "unassigned@example.com"},
+	}
+	for i := range clients {
+		if err := db.Create(&clients[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Create(&models.Role{Name: "auditor", Permissions: "CLIENTS_READ,CLIENTS_ALL"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	everyone := "Other team,Owned,Team,Unassigned"
+	theirs := "Owned,Team"
+	tests := []struct {
+		role    string
+		visible string // Names of the clients the role sees, sorted
+	}{
+		{role: RoleAdmin, visible: everyone},
+		{role: RoleManager, visible: everyone},
+		{role: RoleAgent, visible: theirs},
+		{role: RoleUser, visible: theirs},
+		{role: RoleReadOnly, visible: theirs},
+		{role: "auditor", visible: everyone},
+		{role: "unknown", visible: ""},
+		{role: "", visible: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.role, func(t *testing.T) {
+			user := self
+			user.Role = test.role
+
+			var accessible []string
+			for _, client := range clients {
+				ok, err := CanAccessClient(db, user, client.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ok {
+					accessible = append(accessible, client.Name)
+				}
+			}
+			sort.Strings(accessible)
+			if got := strings.Join(accessible, ","); got != test.visible {
+				t.Errorf("CanAccessClient allows %q, want %q", got, test.visible)
+			}
+			if got := strings.Join(clientNames(t, db, user), ","); got != test.visible {
+				t.Errorf("ClientScope lists %q, want %q", got, test.visible)
+			}
+
+			if ok, err := CanAccessClient(db, user, uuid.New()); ok || err != nil {
+				t.Errorf("CanAccessClient of an unknown client = %v, %v, want false", ok, err)
+			}
+		})
+	}
+}
+
+func TestBuiltinRolesGrantTheirPermissions(t *testing.T) {
+	tests := []struct {
+		role       string
+		permission Permission
+		granted    bool
+	}{
+		{RoleAdmin, UsersManage, true},
+		{RoleManager, MessagesModerate, true},
+		{RoleManager, MessagesPurge, false},
+		{RoleAgent, MessagesWrite, true},
+		{RoleAgent, ClientsAssign, false},
+		{RoleUser, EmailsWrite, true},
+		{RoleReadOnly, ClientsRead, true},
+		{RoleReadOnly, MessagesWrite, false},
+	}
+	db := testdb.Open(t, &models.Role{})
+	for _, test := range tests {
+		granted, err := Has(db, test.role, test.permission)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if granted != test.granted {
+			t.Errorf("%s has %s = %v, want %v", test.role, test.permission, granted, test.granted)
+		}
+	}
+}
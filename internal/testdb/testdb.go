@@ -0,0 +1,125 @@
+// Package testdb opens throwaway databases for tests. The models are written for Postgres; the
+// databases are in-memory SQLite without the Postgres-only column defaults, and new rows get
+// their UUID primary keys from a callback instead of gen_random_uuid(). Row locks are dropped from
+// raw SQL: SQLite cannot parse them, and locks the whole database on writes anyway.
+package testdb
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/uuid"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+)
+
+// postgresDefaults are the column defaults SQLite cannot parse
+var postgresDefaults = []string{"gen_random_uuid()", "now()"}
+
+// rowLocks are the locking clauses of raw SQL that SQLite cannot parse
+var rowLocks = []string{"FOR UPDATE SKIP LOCKED"}
+
+// seq names each database so tests do not share one
+var seq atomic.Int64
+
+// Open creates an empty database with tables for the given models, closed when the test ends
+func Open(t testing.TB, models ...interface{}) *gorm.DB {
+	t.Helper()
+
+	dsn := fmt.Sprintf("file:testdb%d?mode=memory&cache=shared", seq.Add(1))
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("opening test database: %v", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	if err := db.Callback().Create().Before("gorm:create").Register("testdb:uuid", generateUUIDs); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Callback().Row().Before("gorm:row").Register("testdb:row_locks", dropRowLocks); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Callback().Raw().Before("gorm:raw").Register("testdb:row_locks", dropRowLocks); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, model := range models {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(model); err != nil {
+			t.Fatalf("parsing %T: %v", model, err)
+		}
+		dropPostgresDefaults(stmt.Schema, make(map[*schema.Schema]bool))
+	}
+	if err := db.AutoMigrate(models...); err != nil {
+		t.Fatalf("migrating test database: %v", err)
+	}
+	return db
+}
+
+// dropPostgresDefaults removes the defaults SQLite cannot parse from a parsed model and the models
+// it is related to, whose tables AutoMigrate creates as well
+func dropPostgresDefaults(s *schema.Schema, seen map[*schema.Schema]bool) {
+	if s == nil || seen[s] {
+		return
+	}
+	seen[s] = true
+
+	for _, field := range s.Fields {
+		for _, fn := range postgresDefaults {
+			if strings.EqualFold(field.DefaultValue, fn) {
+				field.DefaultValue = ""
+				field.HasDefaultValue = false
+				field.DefaultValueInterface = nil
+			}
+		}
+	}
+	for _, rel := range s.Relationships.Relations {
+		dropPostgresDefaults(rel.FieldSchema, seen)
+		dropPostgresDefaults(rel.JoinTable, seen)
+	}
+}
+
+// generateUUIDs sets the UUID primary keys left empty on the rows being created
+func generateUUIDs(db *gorm.DB) {
+	if db.Statement.Schema == nil || db.Statement.Schema.PrioritizedPrimaryField == nil {
+		return
+	}
+	field := db.Statement.Schema.PrioritizedPrimaryField
+	if field.FieldType != reflect.TypeOf(uuid.UUID{}) {
+		return
+	}
+
+	setID := func(row reflect.Value) {
+		if _, zero := field.ValueOf(db.Statement.Context, row); zero {
+			field.Set(db.Statement.Context, row, uuid.New())
+		}
+	}
+	switch rv := db.Statement.ReflectValue; rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			setID(reflect.Indirect(rv.Index(i)))
+		}
+	case reflect.Struct:
+		setID(rv)
+	}
+}
+
+// dropRowLocks removes the row locks from a raw statement
+func dropRowLocks(db *gorm.DB) {
+	sql := db.Statement.SQL.String()
+	for _, lock := range rowLocks {
+		sql = strings.ReplaceAll(sql, lock, "")
+	}
+	if sql != db.Statement.SQL.String() {
+		db.Statement.SQL.Reset()
+		db.Statement.SQL.WriteString(sql)
+	}
+}
@@ -0,0 +1,198 @@
+// Package webhook sends the deliveries queued in webhook_deliveries to the URLs of their
+// subscriptions. Each delivery is a JSON POST signed with the subscription's secret; deliveries
+// that fail are retried with exponential backoff until they succeed or run out of attempts.
+// Several nodes may run a dispatcher on the same database: each delivery is claimed by one of them.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+
+	"crm-communication-api/models"
+)
+
+// Headers sent with every delivery
+const (
+	HeaderID        = "X-Webhook-Id"        // The delivery's ID, the same on every attempt
+	HeaderEvent     = "X-Webhook-Event"     // The event, such as message.created
+	HeaderTimestamp = "X-Webhook-Timestamp" // Unix time of the attempt
+	HeaderSignature = "X-Webhook-Signature" // "sha256=" and the hex HMAC of "<timestamp>.<body>"
+)
+
+const (
+	// MaxAttempts is how many times a delivery is sent before it is marked failed
+	MaxAttempts = 10
+
+	// Retry delays start at baseBackoff and double after each failed attempt, up to maxBackoff
+	baseBackoff = 30 * time.Second
+	maxBackoff  = 6 * time.Hour
+
+	// requestTimeout bounds each attempt
+	requestTimeout = 10 * time.Second
+
+	// batchSize is how many due deliveries are claimed at a time
+	batchSize = 50
+
+	// maxErrorBody is how much of a failed response's body is kept in the delivery log
+	maxErrorBody = 512
+)
+
+// Dispatcher sends due webhook deliveries
+type Dispatcher struct {
+	db       *gorm.DB
+	client   *http.Client
+	interval time.Duration
+}
+
+// NewDispatcher creates a dispatcher looking for due deliveries every interval. client may be nil
+// to use a client with a 10 second timeout.
+func NewDispatcher(db *gorm.DB, client *http.Client, interval time.Duration) *Dispatcher {
+	if client == nil {
+		client = &http.Client{Timeout: requestTimeout}
+	}
+	return &Dispatcher{db: db, client: client, interval: interval}
+}
+
+// Sign returns the signature of a delivery body sent at timestamp, as carried by HeaderSignature.
+// Receivers compute it with the subscription's secret and compare it with hmac.Equal.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Backoff returns how long to wait before the next attempt after a delivery failed attempts times
+func Backoff(attempts int) time.Duration {
+	delay := baseBackoff
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= maxBackoff {
+			return maxBackoff
+		}
+	}
+	return delay
+}
+
+// Run sends due deliveries every interval until ctx is done
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := d.Dispatch(ctx, time.Now()); err != nil {
+				log.Printf("Failed to send webhook deliveries: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Dispatch sends every delivery due at now and records the outcome of each attempt
+func (d *Dispatcher) Dispatch(ctx context.Context, now time.Time) error {
+	// A claim lasts long enough for every delivery of the batch to time out
+	lease := time.Duration(batchSize)*requestTimeout + time.Minute
+
+	for {
+		claimed, err := models.ClaimWebhookDeliveries(d.db, now, lease, batchSize)
+		if err != nil {
+			return err
+		}
+		for _, delivery := range claimed {
+			if err := d.attempt(ctx, delivery); err != nil {
+				return err
+			}
+		}
+		if len(claimed) < batchSize || ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// attempt sends a delivery once and stores the outcome. Only failing to store it is an error.
+func (d *Dispatcher) attempt(ctx context.Context, delivery models.WebhookDelivery) error {
+	var subscription models.WebhookSubscription
+	err := d.db.Where("id = ?", delivery.SubscriptionID).First(&subscription).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	// Deliveries of removed or disabled subscriptions are not sent
+	if err != nil || !subscription.Active {
+		return d.record(delivery, map[string]interface{}{
+			"status":     models.DeliveryFailed,
+			"last_error": "subscription disabled",
+		})
+	}
+
+	attempts := delivery.Attempts + 1
+	statusCode, err := d.send(ctx, subscription, delivery)
+	updates := map[string]interface{}{"attempts": attempts, "last_status_code": statusCode}
+	switch {
+	case err == nil:
+		updates["status"] = models.DeliveryDelivered
+		updates["delivered_at"] = time.Now()
+		updates["last_error"] = ""
+	case attempts >= MaxAttempts:
+		updates["status"] = models.DeliveryFailed
+		updates["last_error"] = err.Error()
+	default:
+		updates["next_attempt_at"] = time.Now().Add(Backoff(attempts))
+		updates["last_error"] = err.Error()
+	}
+	return d.record(delivery, updates)
+}
+
+// record stores the outcome of an attempt
+func (d *Dispatcher) record(delivery models.WebhookDelivery, updates map[string]interface{}) error {
+	return d.db.Model(&models.WebhookDelivery{}).Where("id = ?", delivery.ID).Updates(updates).Error
+}
+
+// send posts a delivery to its subscription's URL and returns the response status, or 0 when no
+// response was received. Any status outside 2xx is an error.
+func (d *Dispatcher) send(ctx context.Context, subscription models.WebhookSubscription, delivery models.WebhookDelivery) (int, error) {
+	body := []byte(delivery.Payload)
+	timestamp := time.Now().Unix()
+
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, subscription.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "crm-communication-api-webhooks")
+	req.Header.Set(HeaderID, delivery.ID.String())
+	req.Header.Set(HeaderEvent, delivery.Event)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(subscription.Secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		excerpt, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return resp.StatusCode, fmt.Errorf("receiver answered %s: %s", resp.Status, bytes.TrimSpace(excerpt))
+	}
+	// Drain the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxErrorBody))
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,260 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"crm-communication-api/internal/testdb"
+	"crm-communication-api/models"
+)
+
+// receiver is a webhook endpoint answering with a fixed status and recording what it received
+type receiver struct {
+	mu       sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.requests = append(rc.requests, r)
+	rc.bodies = append(rc.bodies, body)
+	w.WriteHeader(rc.status)
+}
+
+func (rc *receiver) setStatus(status int) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.status = status
+}
+
+func (rc *receiver) received() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return len(rc.requests)
+}
+
+// openWebhookTest creates a database of subscriptions and a local receiver answering 200, and
+// returns a dispatcher sending to it
+func openWebhookTest(t *testing.T) (*gorm.DB, *Dispatcher, *receiver, string) {
+	t.Helper()
+
+	rc := &receiver{status: http.StatusOK}
+	server := httptest.NewServer(rc)
+	t.Cleanup(server.Close)
+
+	db := testdb.Open(t, &models.WebhookSubscription{}, &models.WebhookDelivery{})
+	return db, NewDispatcher(db, server.Client(), time.Minute), rc, server.URL
+}
+
+// subscribe creates a subscription of a URL to message.created
+func subscribe(t *testing.T, db *gorm.DB, url string, active bool) models.WebhookSubscription {
+	t.Helper()
+
+	subscription := models.WebhookSubscription{
+		URL:       url,
+		Events:    models.WebhookMessageCreated,
+		Secret:    "whsec_test",
+		Active:    active,
+		CreatedBy: uuid.New(),
+	}
+	if err := db.Create(&subscription).Error; err != nil {
+		t.Fatal(err)
+	}
+	return subscription
+}
+
+// enqueue queues a message.created event and returns its deliveries
+func enqueue(t *testing.T, db *gorm.DB) []models.WebhookDelivery {
+	t.Helper()
+
+	clientID := uuid.New()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		return models.EnqueueWebhooks(tx, models.WebhookMessageCreated, clientID, map[string]string{"content": "hello"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var deliveries []models.WebhookDelivery
+	if err := db.Order("created_at").Find(&deliveries).Error; err != nil {
+		t.Fatal(err)
+	}
+	return deliveries
+}
+
+// dispatch sends the deliveries due at now
+func dispatch(t *testing.T, dispatcher *Dispatcher, now time.Time) {
+	t.Helper()
+
+	if err := dispatcher.Dispatch(context.Background(), now); err != nil {
+		t.Fatalf("Dispatch() error = %v", err)
+	}
+}
+
+// reload reads a delivery back from the database
+func reload(t *testing.T, db *gorm.DB, delivery models.WebhookDelivery) models.WebhookDelivery {
+	t.Helper()
+
+	var stored models.WebhookDelivery
+	if err := db.Where("id = ?", delivery.ID).First(&stored).Error; err != nil {
+		t.Fatal(err)
+	}
+	return stored
+}
+
+func TestDeliveriesAreSigned(t *testing.T) {
+	db, dispatcher, rc, url := openWebhookTest(t)
+	subscription := subscribe(t, db, url, true)
+	deliveries := enqueue(t, db)
+	if len(deliveries) != 1 {
+		t.Fatalf("queued %d deliveries, want 1", len(deliveries))
+	}
+	delivery := deliveries[0]
+
+	dispatch(t, dispatcher, time.Now())
+	if rc.received() != 1 {
+		t.Fatalf("receiver got %d requests, want 1", rc.received())
+	}
+
+	req, body := rc.requests[0], rc.bodies[0]
+	if string(body) != delivery.Payload {
+		t.Errorf("body = %s, want the delivery's payload %s", body, delivery.Payload)
+	}
+	if req.Header.Get(HeaderID) != delivery.ID.String() || req.Header.Get(HeaderEvent) != models.WebhookMessageCreated {
+		t.Errorf("delivery headers = %s, %s, want %s, %s", req.Header.Get(HeaderID), req.Header.Get(HeaderEvent), delivery.ID, models.WebhookMessageCreated)
+	}
+	timestamp, err := strconv.ParseInt(req.Header.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		t.Fatalf("timestamp header: %v", err)
+	}
+	// Receivers recompute the signature from the raw body and the timestamp
+	want := Sign(subscription.Secret, timestamp, body)
+	if got := req.Header.Get(HeaderSignature); !hmac.Equal([]byte(got), []byte(want)) {
+		t.Errorf("signature = %s, want %s", got, want)
+	}
+	if wrong := Sign("another secret", timestamp, body); hmac.Equal([]byte(req.Header.Get(HeaderSignature)), []byte(wrong)) {
+		t.Error("signature matches another secret")
+	}
+
+	stored := reload(t, db, delivery)
+	if stored.Status != models.DeliveryDelivered || stored.Attempts != 1 || stored.LastStatusCode != http.StatusOK || stored.DeliveredAt == nil {
+		t.Errorf("delivery = %s after %d attempts with status %d, want delivered after 1 with 200", stored.Status, stored.Attempts, stored.LastStatusCode)
+	}
+}
+
+func TestFailedDeliveriesAreRetriedWithBackoff(t *testing.T) {
+	db, dispatcher, rc, url := openWebhookTest(t)
+	subscribe(t, db, url, true)
+	delivery := enqueue(t, db)[0]
+
+	rc.setStatus(http.StatusInternalServerError)
+	before := time.Now()
+	dispatch(t, dispatcher, before)
+
+	failed := reload(t, db, delivery)
+	if failed.Status != models.DeliveryPending || failed.Attempts != 1 || failed.LastStatusCode != http.StatusInternalServerError || failed.LastError == "" {
+		t.Fatalf("delivery = %s after %d attempts with status %d and error %q, want pending after 1 with 500",
+			failed.Status, failed.Attempts, failed.LastStatusCode, failed.LastError)
+	}
+	if retryIn := failed.NextAttemptAt.Sub(before); retryIn < Backoff(1) || retryIn > Backoff(1)+time.Minute {
+		t.Errorf("next attempt in %v, want %v", retryIn, Backoff(1))
+	}
+
+	// Nothing is sent again before the backoff is over
+	rc.setStatus(http.StatusNoContent)
+	dispatch(t, dispatcher, time.Now())
+	if rc.received() != 1 {
+		t.Fatalf("receiver got %d requests before the backoff was over, want 1", rc.received())
+	}
+
+	dispatch(t, dispatcher, failed.NextAttemptAt)
+	retried := reload(t, db, delivery)
+	if retried.Status != models.DeliveryDelivered || retried.Attempts != 2 || retried.LastError != "" {
+		t.Errorf("retried delivery = %s after %d attempts with error %q, want delivered after 2", retried.Status, retried.Attempts, retried.LastError)
+	}
+	if rc.received() != 2 {
+		t.Errorf("receiver got %d requests, want 2", rc.received())
+	}
+}
+
+func TestDeliveriesFailAfterMaxAttempts(t *testing.T) {
+	db, dispatcher, rc, url := openWebhookTest(t)
+	subscribe(t, db, url, true)
+	delivery := enqueue(t, db)[0]
+
+	rc.setStatus(http.StatusBadGateway)
+	for i := 1; i <= MaxAttempts; i++ {
+		dispatch(t, dispatcher, reload(t, db, delivery).NextAttemptAt)
+		stored := reload(t, db, delivery)
+		want := models.DeliveryPending
+		if i == MaxAttempts {
+			want = models.DeliveryFailed
+		}
+		if stored.Status != want || stored.Attempts != i {
+			t.Fatalf("after attempt %d delivery = %s with %d attempts, want %s", i, stored.Status, stored.Attempts, want)
+		}
+	}
+	// A failed delivery is never due again
+	dispatch(t, dispatcher, time.Now().Add(365*24*time.Hour))
+	if rc.received() != MaxAttempts {
+		t.Errorf("receiver got %d requests, want %d", rc.received(), MaxAttempts)
+	}
+}
+
+func TestDisabledSubscriptionsAreNotSent(t *testing.T) {
+	db, dispatcher, rc, url := openWebhookTest(t)
+	active := subscribe(t, db, url, true)
+	subscribe(t, db, url, false)
+
+	// Events are not queued for disabled subscriptions
+	deliveries := enqueue(t, db)
+	if len(deliveries) != 1 || deliveries[0].SubscriptionID != active.ID {
+		t.Fatalf("queued %d deliveries, want one for the active subscription", len(deliveries))
+	}
+
+	// Nor sent once a subscription is disabled after they were queued
+	if err := db.Model(&active).Update("active", false).Error; err != nil {
+		t.Fatal(err)
+	}
+	dispatch(t, dispatcher, time.Now())
+	if rc.received() != 0 {
+		t.Errorf("receiver got %d requests, want none", rc.received())
+	}
+	stored := reload(t, db, deliveries[0])
+	if stored.Status != models.DeliveryFailed || stored.Attempts != 0 || stored.LastError != "subscription disabled" {
+		t.Errorf("delivery = %s after %d attempts with error %q, want failed without attempts", stored.Status, stored.Attempts, stored.LastError)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{9, 128 * time.Minute},
+		{10, 256 * time.Minute},
+		{11, maxBackoff},
+		{50, maxBackoff},
+	}
+	for _, tt := range tests {
+		if got := Backoff(tt.attempts); got != tt.want {
+			t.Errorf("Backoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
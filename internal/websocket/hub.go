@@ -4,9 +4,28 @@ import (
 	"log"
 	"sync"
 
+	"crm-communication-api/internal/backpressure"
+	"crm-communication-api/internal/broker"
 	"github.com/google/uuid"
 )
 
+// hubTopic is the broker topic on which hubs share room broadcasts and messages to users
+const hubTopic = "websocket_hub"
+
+// Kinds of broker messages published by hubs
+const (
+	kindRoom = "room"
+	kindUser = "user"
+)
+
+const (
+	// sendBufferSize is how many messages a client can have waiting before the hub's policy applies
+	sendBufferSize = 256
+
+	// spillLimit is how many messages the spill policy queues before it disconnects the client
+	spillLimit = 4096
+)
+
 // Hub maintains the set of active clients and broadcasts messages
 type Hub struct {
 	// Map of client connections indexed by userID
@@ -23,13 +42,24 @@ type Hub struct {
 
 	// Lock for thread safety
 	mu sync.RWMutex
+
+	// Shares broadcasts with the hubs of other nodes; nil until UseBroker is called
+	broker broker.Broker
+	origin string
+
+	// What happens to a message for a client whose send queue is full
+	policy backpressure.Policy
+
+	// Receive the messages for users delivered on this node, for connections served outside
+	// the hub
+	userSinks []func(userID uuid.UUID, message []byte)
 }
 
 // Client represents a connected websocket client
 type Client struct {
 	hub      *Hub
 	userID   uuid.UUID
-	send     chan []byte
+	send     *backpressure.Queue[[]byte]
 	roomSubs map[uuid.UUID]bool
 	mu       sync.RWMutex
 }
@@ -44,6 +74,91 @@ func NewHub() *Hub {
 		rooms:      make(map[uuid.UUID]map[*Client]bool),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		origin:     broker.NewOrigin(),
+		policy:     backpressure.DefaultPolicy,
+	}
+}
+
+// SetSlowConsumerPolicy chooses what happens to a message for a client whose send queue is
+// full, for the clients created afterwards. Hub messages are opaque, so Coalesce has nothing to
+// replace and discards the oldest message like DropOldest.
+func (h *Hub) SetSlowConsumerPolicy(policy backpressure.Policy) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.policy = policy
+}
+
+// NewClient creates a client of the hub for a user, whose send queue applies the hub's slow
+// consumer policy
+func (h *Hub) NewClient(userID uuid.UUID) *Client {
+	h.mu.RLock()
+	policy := h.policy
+	h.mu.RUnlock()
+
+	return &Client{
+		hub:      h,
+		userID:   userID,
+		send:     backpressure.NewQueue(policy, sendBufferSize, spillLimit, func([]byte) string { return "" }),
+		roomSubs: make(map[uuid.UUID]bool),
+	}
+}
+
+// sendOrShed queues a message for a client, and disconnects the client when its queue's policy
+// gives up on it. The caller holds h.mu for reading.
+func (h *Hub) sendOrShed(client *Client, message []byte) {
+	if client.send.Push(message) {
+		return
+	}
+
+	// Unregister asynchronously: the run loop needs the lock the caller holds
+	backpressure.Count(client.send.Policy(), backpressure.EventDisconnected)
+	go func() { h.unregister <- client }()
+}
+
+// UseBroker publishes the hub's room broadcasts and messages to users through b, and delivers
+// the ones published by hubs on other nodes to local clients
+func (h *Hub) UseBroker(b broker.Broker) error {
+	if _, err := b.Subscribe(hubTopic, h.receiveRemote); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	h.broker = b
+	h.mu.Unlock()
+	return nil
+}
+
+// receiveRemote delivers a broadcast published by the hub of another node
+func (h *Hub) receiveRemote(msg broker.Message) {
+	if msg.Origin == h.origin {
+		return
+	}
+
+	id, err := uuid.Parse(msg.Key)
+	if err != nil {
+		log.Printf("Dropping broker message with invalid key %q", msg.Key)
+		return
+	}
+	switch msg.Kind {
+	case kindRoom:
+		h.deliverToRoom(id, msg.Data)
+	case kindUser:
+		h.deliverToUser(id, msg.Data)
+	}
+}
+
+// publish shares a broadcast with the other nodes, if the hub has a broker
+func (h *Hub) publish(kind string, id uuid.UUID, message []byte) {
+	h.mu.RLock()
+	b := h.broker
+	h.mu.RUnlock()
+	if b == nil {
+		return
+	}
+
+	// Data must be valid JSON; hub messages are JSON frames
+	msg := broker.Message{Origin: h.origin, Key: id.String(), Kind: kind, Data: message}
+	if err := b.Publish(hubTopic, msg); err != nil {
+		log.Printf("Failed to publish %s broadcast for %s to other nodes: %v", kind, id, err)
 	}
 }
 
@@ -61,7 +176,7 @@ func (h *Hub) Run() {
 			h.mu.Lock()
 			if _, ok := h.clients[client.userID]; ok {
 				delete(h.clients, client.userID)
-				close(client.send)
+				client.send.Close()
 				
 				// Remove client from all rooms
 				client.mu.RLock()
@@ -120,36 +235,50 @@ func (h *Hub) UnsubscribeFromRoom(client *Client, roomID uuid.UUID) {
 	log.Printf("Client %s unsubscribed from room %s", client.userID, roomID)
 }
 
-// BroadcastToRoom sends a message to all clients in a room
+// BroadcastToRoom sends a message to all clients in a room, on every node
 func (h *Hub) BroadcastToRoom(roomID uuid.UUID, message []byte) {
+	h.deliverToRoom(roomID, message)
+	h.publish(kindRoom, roomID, message)
+}
+
+// deliverToRoom sends a message to the clients of a room connected to this node
+func (h *Hub) deliverToRoom(roomID uuid.UUID, message []byte) {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 	
 	if room, exists := h.rooms[roomID]; exists {
 		for client := range room {
-			select {
-			case client.send <- message:
-				// Message sent successfully
-			default:
-				// Failed to send, client may be slow or disconnected
-				go h.unregister <- client
-			}
+			h.sendOrShed(client, message)
 		}
 	}
 }
 
-// SendToUser sends a message to a specific user
+// SendToUser sends a message to a specific user, on whichever node they are connected to
 func (h *Hub) SendToUser(userID uuid.UUID, message []byte) {
+	h.deliverToUser(userID, message)
+	h.publish(kindUser, userID, message)
+}
+
+// OnUserMessage registers a function receiving every message sent to a user with SendToUser that
+// reaches this node, so connections served by another hub, such as the chat server's, get them too.
+// The function must not call back into the hub.
+func (h *Hub) OnUserMessage(sink func(userID uuid.UUID, message []byte)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.userSinks = append(h.userSinks, sink)
+}
+
+// deliverToUser sends a message to a user connected to this node
+func (h *Hub) deliverToUser(userID uuid.UUID, message []byte) {
 	h.mu.RLock()
-	defer h.mu.RUnlock()
-	
 	if client, exists := h.clients[userID]; exists {
-		select {
-		case client.send <- message:
-			// Message sent successfully
-		default:
-			// Failed to send, client may be slow or disconnected
-			go h.unregister <- client
-		}
+		h.sendOrShed(client, message)
+	}
+	sinks := h.userSinks
+	h.mu.RUnlock()
+
+	// Sinks may block, so they run without the lock
+	for _, sink := range sinks {
+		sink(userID, message)
 	}
 }
\ No newline at end of file
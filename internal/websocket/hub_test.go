@@ -0,0 +1,53 @@
+package websocket
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"crm-communication-api/internal/backpressure"
+	"github.com/google/uuid"
+)
+
+func TestDropOldestKeepsTheNewestMessages(t *testing.T) {
+	h := NewHub()
+	h.SetSlowConsumerPolicy(backpressure.DropOldest)
+	client := h.NewClient(uuid.New())
+	h.clients[client.userID] = client
+
+	for i := 0; i <= sendBufferSize; i++ {
+		h.SendToUser(client.userID, []byte(strconv.Itoa(i)))
+	}
+
+	queued := client.send.Drain()
+	if len(queued) != sendBufferSize || string(queued[0]) != "1" || string(queued[len(queued)-1]) != strconv.Itoa(sendBufferSize) {
+		t.Errorf("queued %d messages from %s to %s, want the last %d", len(queued), queued[0], queued[len(queued)-1], sendBufferSize)
+	}
+	if client.send.Closed() {
+		t.Error("client disconnected, want it kept")
+	}
+}
+
+func TestDisconnectUnregistersSlowClients(t *testing.T) {
+	h := NewHub()
+	go h.Run()
+	client := h.NewClient(uuid.New())
+	h.register <- client
+
+	for i := 0; i <= sendBufferSize; i++ {
+		h.SendToUser(client.userID, []byte(strconv.Itoa(i)))
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for !client.send.Closed() {
+		if time.Now().After(deadline) {
+			t.Fatal("slow client still connected")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if _, ok := h.clients[client.userID]; ok {
+		t.Error("slow client still registered")
+	}
+}
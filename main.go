@@ -3,6 +3,7 @@ package main
 import (
         "context"
         "encoding/json"
+        "expvar"
         "fmt"
         "log"
         "net/http"
@@ -15,38 +16,130 @@ import (
 
         "github.com/google/uuid"
         "github.com/gorilla/websocket"
+        "gorm.io/gorm"
         
+        "crm-communication-api/auth"
         "crm-communication-api/database"
+        "crm-communication-api/internal/backpressure"
+        "crm-communication-api/internal/bot"
+        "crm-communication-api/internal/broker"
+        "crm-communication-api/internal/command"
+        "crm-communication-api/internal/graphql"
+        "crm-communication-api/internal/graphql/resolvers"
+        "crm-communication-api/internal/mention"
+        "crm-communication-api/internal/notify"
+        "crm-communication-api/internal/ratelimit"
+        "crm-communication-api/internal/webhook"
+        chatws "crm-communication-api/internal/websocket"
+        "crm-communication-api/models"
 )
 
 const defaultPort = "5000"
 
+// webhookPollInterval is how often queued webhook deliveries are looked for
+const webhookPollInterval = 5 * time.Second
+
 // Message represents a simple chat message
 type ChatMessage struct {
-        ID        string    `json:"id"`
-        Sender    string    `json:"sender"`
-        Content   string    `json:"content"`
-        Mentions  []string  `json:"mentions,omitempty"`
-        Timestamp time.Time `json:"timestamp"`
+        ID          string                 `json:"id"`
+        Sender      string                 `json:"sender"`
+        SenderID    string                 `json:"sender_id,omitempty"`
+        Content     string                 `json:"content"`
+        Mentions    []string               `json:"mentions,omitempty"`
+        MentionSpans []mention.Mention     `json:"mention_spans,omitempty"` // Where each mention is in the content and who it refers to
+        Room        string                 `json:"room,omitempty"`
+        Seq         int64                  `json:"seq,omitempty"` // Position in the room, set once the message is stored
+        ParentID    string                 `json:"parent_id,omitempty"` // Set on replies; the room is then the parent's ID
+        ReplyCount  int                    `json:"reply_count,omitempty"`
+        LastReplyAt *time.Time             `json:"last_reply_at,omitempty"`
+        History     bool                   `json:"history,omitempty"` // Replayed from the database rather than live
+        Timestamp   time.Time              `json:"timestamp"`
+        EditedAt    *time.Time             `json:"edited_at,omitempty"`
+        DeletedAt   *time.Time             `json:"deleted_at,omitempty"` // Set on tombstones, whose content is empty
+        Reactions   []models.ReactionCount `json:"reactions,omitempty"`
 }
 
-// ChatHub maintains the set of active clients and broadcasts messages
+// ChatHub maintains the set of active clients and broadcasts messages to their rooms
 type ChatHub struct {
         // Registered clients
         clients map[*ChatClient]bool
 
+        // Room membership indexed by client or chat thread ID
+        rooms map[string]map[*ChatClient]bool
+
         // Register requests from clients
         register chan *ChatClient
 
         // Unregister requests from clients
         unregister chan *ChatClient
 
+        // Requests to join or leave additional rooms
+        subscribe   chan roomSubscription
+        unsubscribe chan roomSubscription
+
         // Inbound messages from clients
         broadcast chan ChatMessage
 
-        // Message history
-        history     []ChatMessage
-        historyLock sync.RWMutex
+        // Frames addressed to a single client, such as acks, errors and history pages
+        deliver chan chatDelivery
+
+        // Frames other than chat messages for every member of a room, such as read receipts
+        publish chan roomFrame
+
+        // Presence of every user seen since startup, indexed by user ID
+        presence map[string]*userPresence
+
+        // Presence of the room members connected to other nodes, indexed by room, and when this
+        // node last shared the presence of its own members
+        remoteMembers    map[string]map[remoteMemberKey]remoteMember
+        presenceSharedAt time.Time
+
+        // Frames for this node's rooms published by hubs on other nodes, and frames queued for them
+        broker   broker.Broker
+        origin   string
+        remote   chan roomFrame
+        outbound chan broker.Message
+
+        // Users typing in each room, indexed by room then user ID, with when their indicator expires
+        typists map[string]map[string]time.Time
+
+        // Activity from clients, typing indicators and presence roster lookups
+        heartbeat      chan *ChatClient
+        typing         chan typingUpdate
+        rosterRequests chan rosterRequest
+
+        // Frames kept for connections closed for being slow, indexed by resume token, and
+        // checks that a new connection can resume one
+        parked       map[string]*parkedSession
+        resumeChecks chan resumeCheck
+
+        // Bots answering the messages posted by users and slash commands users can run; nil
+        // disables them
+        bots     *bot.Registry
+        commands *command.Router
+
+        // Frames for every connection of a user, such as due reminders and mentions
+        notices chan userFrame
+}
+
+// roomSubscription asks the hub to add a client to, or remove it from, a room
+type roomSubscription struct {
+        client *ChatClient
+        room   string
+}
+
+// roomFrame is a frame for every member of a room. Frames published by hubs on other nodes
+// carry the origin of the hub.
+type roomFrame struct {
+        room   string
+        frame  models.WSMessage
+        origin string
+}
+
+// chatDelivery is a batch of frames for one client
+type chatDelivery struct {
+        client *ChatClient
+        frames []models.WSMessage
 }
 
 // ChatClient represents a single websocket connection
@@ -56,84 +149,209 @@ type ChatClient struct {
         // The websocket connection
         conn *websocket.Conn
 
-        // Buffered channel of outbound messages
-        send chan ChatMessage
+        // Outbound frames, queued according to the connection's backpressure policy
+        send *backpressure.Queue[models.WSMessage]
+
+        // Token a new connection presents to resume this one if it is closed for being slow,
+        // and the token of the connection this one resumes, if any
+        resumeToken string
+        resumes     string
+
+        // Close code and reason the hub set when it closed the connection, if not a plain close
+        closeCode   int
+        closeReason string
 
-        // User information
+        // User information, taken from the access token
         userID   string
         username string
+        role     string
+
+        // When the access token expires, and fresh expiries from mid-connection auth frames
+        expiresAt time.Time
+        reauth    chan time.Time
+
+        // Room (client or chat thread ID) joined in the handshake, used when a frame names no room
+        room string
+
+        // Rooms this connection belongs to, maintained by the hub
+        roomSubs map[string]bool
+        mu       sync.RWMutex
 }
 
-// Initialize a new chat hub
-func newChatHub() *ChatHub {
+// Initialize a new chat hub. Hubs sharing a broker deliver each other's room frames; b may be nil
+// for a hub that only serves its own connections, and bots and commands may be nil for a hub
+// without bots or slash commands.
+func newChatHub(b broker.Broker, bots *bot.Registry, commands *command.Router) *ChatHub {
         return &ChatHub{
-                clients:    make(map[*ChatClient]bool),
-                register:   make(chan *ChatClient),
-                unregister: make(chan *ChatClient),
-                broadcast:  make(chan ChatMessage),
-                history:    make([]ChatMessage, 0),
+                clients:        make(map[*ChatClient]bool),
+                rooms:          make(map[string]map[*ChatClient]bool),
+                register:       make(chan *ChatClient),
+                unregister:     make(chan *ChatClient),
+                subscribe:      make(chan roomSubscription),
+                unsubscribe:    make(chan roomSubscription),
+                broadcast:      make(chan ChatMessage),
+                deliver:        make(chan chatDelivery),
+                publish:        make(chan roomFrame),
+                broker:         b,
+                origin:         broker.NewOrigin(),
+                remote:         make(chan roomFrame),
+                presence:       make(map[string]*userPresence),
+                remoteMembers:  make(map[string]map[remoteMemberKey]remoteMember),
+                typists:        make(map[string]map[string]time.Time),
+                heartbeat:      make(chan *ChatClient),
+                typing:         make(chan typingUpdate),
+                rosterRequests: make(chan rosterRequest),
+                parked:         make(map[string]*parkedSession),
+                resumeChecks:   make(chan resumeCheck),
+                bots:           bots,
+                commands:       commands,
+                notices:        make(chan userFrame),
         }
 }
 
 // Run the chat hub
 func (h *ChatHub) run() {
+        sweep := time.NewTicker(presenceSweepInterval)
+        defer sweep.Stop()
+
+        h.connectBroker()
+
         for {
                 select {
                 case client := <-h.register:
                         h.clients[client] = true
-                        // Send chat history to new client
-                        h.historyLock.RLock()
-                        for _, msg := range h.history {
-                                client.send <- msg
-                        }
-                        h.historyLock.RUnlock()
+                        h.startSession(client)
+                        h.joinRoom(client, client.room)
+                        h.trackConnect(client)
+                        h.introduce(client, client.room)
 
                 case client := <-h.unregister:
                         if _, ok := h.clients[client]; ok {
-                                delete(h.clients, client)
-                                close(client.send)
+                                h.removeClient(client)
+                        }
+
+                case sub := <-h.subscribe:
+                        if _, ok := h.clients[sub.client]; ok {
+                                h.joinRoom(sub.client, sub.room)
+                                h.introduce(sub.client, sub.room)
+                        }
+
+                case sub := <-h.unsubscribe:
+                        if p, ok := h.presence[sub.client.userID]; ok {
+                                h.stopTyping(sub.room, p)
                         }
+                        h.leaveRoom(sub.client, sub.room)
 
                 case message := <-h.broadcast:
-                        // Store in history
-                        h.historyLock.Lock()
-                        h.history = append(h.history, message)
-                        h.historyLock.Unlock()
-
-                        // Send to all clients
-                        for client := range h.clients {
-                                select {
-                                case client.send <- message:
-                                default:
-                                        close(client.send)
-                                        delete(h.clients, client)
+                        // Send to the members of the room only; a sent message ends its author's typing indicator
+                        if p, ok := h.presence[message.SenderID]; ok {
+                                h.stopTyping(message.Room, p)
+                        }
+                        h.fanOut(message.Room, newFrame(models.WSTypeMessage, "", message), nil)
+
+                case rf := <-h.publish:
+                        h.fanOut(rf.room, rf.frame, nil)
+
+                case rf := <-h.remote:
+                        // Presence another node shares again is only recorded
+                        if rf.frame.Type == models.WSTypePresence && !h.trackRemotePresence(rf) {
+                                continue
+                        }
+                        h.broadcastFrame(rf.room, rf.frame, nil)
+
+                case delivery := <-h.deliver:
+                        // Skip clients that disconnected while the frames were prepared
+                        if _, ok := h.clients[delivery.client]; !ok {
+                                continue
+                        }
+                        for _, frame := range delivery.frames {
+                                if !h.push(delivery.client, frame) {
+                                        break
                                 }
                         }
+
+                case client := <-h.heartbeat:
+                        h.touch(client)
+
+                case update := <-h.typing:
+                        h.setTyping(update)
+
+                case req := <-h.rosterRequests:
+                        if req.local {
+                                req.reply <- h.localPresence(req.room)
+                        } else {
+                                req.reply <- h.roomRoster(req.room)
+                        }
+
+                case check := <-h.resumeChecks:
+                        check.reply <- h.canResume(check)
+
+                case notice := <-h.notices:
+                        h.notifyUser(notice)
+
+                case now := <-sweep.C:
+                        h.sweepPresence(now)
+                        h.expireParked(now)
                 }
         }
 }
 
-// Parse mentions from message content
-func parseMentions(content string) []string {
-        words := strings.Fields(content)
-        mentions := []string{}
-        
-        for _, word := range words {
-                if strings.HasPrefix(word, "@") && len(word) > 1 {
-                        // Remove any non-alphanumeric characters from the end of the mention
-                        mention := word[1:]
-                        mention = strings.TrimFunc(mention, func(r rune) bool {
-                                return !((r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || 
-                                           (r >= '0' && r <= '9') || r == '_' || r == '.')
-                        })
-                        
-                        if mention != "" {
-                                mentions = append(mentions, mention)
-                        }
+// joinRoom adds a client to a room. It must only be called from the run loop.
+func (h *ChatHub) joinRoom(client *ChatClient, room string) {
+        if _, exists := h.rooms[room]; !exists {
+                h.rooms[room] = make(map[*ChatClient]bool)
+        }
+        h.rooms[room][client] = true
+
+        client.mu.Lock()
+        client.roomSubs[room] = true
+        client.mu.Unlock()
+}
+
+// leaveRoom removes a client from a room. It must only be called from the run loop.
+func (h *ChatHub) leaveRoom(client *ChatClient, room string) {
+        if members, exists := h.rooms[room]; exists {
+                delete(members, client)
+                // Clean up empty rooms
+                if len(members) == 0 {
+                        delete(h.rooms, room)
                 }
         }
-        
-        return mentions
+
+        client.mu.Lock()
+        delete(client.roomSubs, room)
+        client.mu.Unlock()
+}
+
+// removeClient drops a client from the hub and all its rooms and closes its send queue.
+// It must only be called from the run loop.
+func (h *ChatHub) removeClient(client *ChatClient) {
+        delete(h.clients, client)
+        rooms := client.subscribedRooms()
+        for _, room := range rooms {
+                h.leaveRoom(client, room)
+        }
+        client.send.Close()
+        h.trackDisconnect(client, rooms)
+}
+
+// subscribedRooms returns the rooms the client currently belongs to
+func (c *ChatClient) subscribedRooms() []string {
+        c.mu.RLock()
+        defer c.mu.RUnlock()
+
+        rooms := make([]string, 0, len(c.roomSubs))
+        for room := range c.roomSubs {
+                rooms = append(rooms, room)
+        }
+        return rooms
+}
+
+// isSubscribed reports whether the client belongs to a room
+func (c *ChatClient) isSubscribed(room string) bool {
+        c.mu.RLock()
+        defer c.mu.RUnlock()
+        return c.roomSubs[room]
 }
 
 // Process incoming messages
@@ -160,34 +378,18 @@ func (c *ChatClient) readPump() {
                         break
                 }
 
-                // Parse the message
-                var messageData struct {
-                        Content string `json:"content"`
-                }
-                if err := json.Unmarshal(msgBytes, &messageData); err != nil {
-                        log.Printf("error parsing message: %v", err)
+                // Parse the envelope; malformed frames are answered rather than dropped
+                var frame models.WSMessage
+                if err := json.Unmarshal(msgBytes, &frame); err != nil {
+                        c.replyError("", models.WSErrBadFrame, "frame is not a valid JSON envelope")
                         continue
                 }
 
-                // Create a new message with parsed mentions
-                mentions := parseMentions(messageData.Content)
-                message := ChatMessage{
-                        ID:        uuid.New().String(),
-                        Sender:    c.username,
-                        Content:   messageData.Content,
-                        Mentions:  mentions,
-                        Timestamp: time.Now(),
-                }
-
-                // Send the message to hub for broadcasting
-                c.hub.broadcast <- message
+                // Any frame, including ping, counts as activity for presence
+                c.hub.heartbeat <- c
 
-                // Store message in database and create timeline event
-                go storeMessageInDatabase(message, c.username, mentions)
-                
-                // Auto-respond to mentions for demo purposes
-                if len(mentions) > 0 {
-                    go autoRespondToMentions(c.hub, mentions, c.username, message.ID)
+                if !c.handleFrame(frame) {
+                        break
                 }
         }
 }
@@ -195,31 +397,58 @@ func (c *ChatClient) readPump() {
 // Send messages to the client
 func (c *ChatClient) writePump() {
         ticker := time.NewTicker(54 * time.Second)
+        expiry, expired := expiryTimer(c.expiresAt)
         defer func() {
                 ticker.Stop()
+                if expiry != nil {
+                        expiry.Stop()
+                }
                 c.conn.Close()
         }()
 
         for {
                 select {
-                case message, ok := <-c.send:
-                        c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-                        if !ok {
-                                // The hub closed the channel
-                                c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-                                return
+                case <-expired:
+                        // Tell the client to refresh its token and reconnect
+                        closeWithCode(c.conn, closeTokenExpired, "token expired")
+                        return
+
+                case expiresAt := <-c.reauth:
+                        if expiry != nil {
+                                expiry.Stop()
                         }
+                        expiry, expired = expiryTimer(expiresAt)
 
-                        w, err := c.conn.NextWriter(websocket.TextMessage)
-                        if err != nil {
-                                return
+                case <-c.send.Ready():
+                        for {
+                                frame, ok := c.send.Pop()
+                                if !ok {
+                                        break
+                                }
+
+                                c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+                                w, err := c.conn.NextWriter(websocket.TextMessage)
+                                if err != nil {
+                                        return
+                                }
+
+                                // Marshal the frame to JSON
+                                frameJSON, _ := json.Marshal(frame)
+                                w.Write(frameJSON)
+
+                                if err := w.Close(); err != nil {
+                                        return
+                                }
                         }
-                        
-                        // Marshal the message to JSON
-                        messageJSON, _ := json.Marshal(message)
-                        w.Write(messageJSON)
 
-                        if err := w.Close(); err != nil {
+                        if c.send.Closed() {
+                                // The hub closed the queue, possibly because the client was too slow
+                                if c.closeCode != 0 {
+                                        closeWithCode(c.conn, c.closeCode, c.closeReason)
+                                        return
+                                }
+                                c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+                                c.conn.WriteMessage(websocket.CloseMessage, []byte{})
                                 return
                         }
 
@@ -236,49 +465,129 @@ func (c *ChatClient) writePump() {
 var upgrader = websocket.Upgrader{
         ReadBufferSize:  1024,
         WriteBufferSize: 1024,
+        Subprotocols:    []string{auth.WebSocketTokenProtocol},
         CheckOrigin: func(r *http.Request) bool {
                 return true // Allow all connections for testing
         },
 }
 
+// roomFromRequest returns the room a connection asks to join: a CRM client ID or a chat thread ID
+func roomFromRequest(r *http.Request) string {
+        if threadID := r.URL.Query().Get("thread_id"); threadID != "" {
+                return threadID
+        }
+        return r.URL.Query().Get("client_id")
+}
+
 // ServeWs handles WebSocket requests from clients
 func serveWs(hub *ChatHub, w http.ResponseWriter, r *http.Request) {
+        // Every connection must join the room of a client or chat thread
+        room := roomFromRequest(r)
+        if room == "" {
+                http.Error(w, "client_id or thread_id is required", http.StatusBadRequest)
+                return
+        }
+        query, err := historyQueryFromRequest(r)
+        if err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+        policy, err := slowPolicyFromRequest(r)
+        if err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+
+        // A token in the handshake is validated before upgrading
+        var claims *auth.Claims
+        if token := auth.WebSocketToken(r); token != "" {
+                claims, err = auth.ValidateAccessToken(token)
+                if err != nil {
+                        http.Error(w, "Unauthorized: Invalid token", http.StatusUnauthorized)
+                        return
+                }
+        }
+
         conn, err := upgrader.Upgrade(w, r, nil)
         if err != nil {
                 log.Println(err)
                 return
         }
 
-        // Get user ID and name from query parameters (in a real app, this would come from auth)
-        userID := r.URL.Query().Get("user_id")
-        username := r.URL.Query().Get("username")
-        
-        if userID == "" || username == "" {
-                // Generate random IDs for testing
-                userID = uuid.New().String()
-                username = fmt.Sprintf("User-%s", userID[:5])
+        // Without a token in the handshake the first frame must authenticate the connection
+        if claims == nil {
+                claims, err = authenticateFirstFrame(conn)
+                if err != nil {
+                        closeWithCode(conn, closeUnauthorized, err.Error())
+                        return
+                }
+        }
+
+        // Users only join the rooms of the clients visible to them. The room is checked once the
+        // user is known, and rooms that do not exist are refused like forbidden ones.
+        if err := checkRoomAccess(claims.UserID, room); err != nil {
+                refuseRoom(conn, err)
+                return
+        }
+
+        // A connection closed for being slow is resumed with the frames it missed, if the user may
+        // still join every room of the session
+        resumes := r.URL.Query().Get("resume_token")
+        if resumes != "" {
+                rooms, ok := hub.checkResume(resumes, claims.UserID)
+                if !ok {
+                        resumes = ""
+                }
+                for _, resumed := range rooms {
+                        if err := checkRoomAccess(claims.UserID, resumed); err != nil {
+                                refuseRoom(conn, err)
+                                return
+                        }
+                }
         }
 
         // Create a new client
         client := &ChatClient{
-                hub:      hub,
-                conn:     conn,
-                send:     make(chan ChatMessage, 256),
-                userID:   userID,
-                username: username,
+                hub:         hub,
+                conn:        conn,
+                send:        newSendQueue(policy),
+                resumeToken: newResumeToken(),
+                resumes:     resumes,
+                userID:      claims.UserID,
+                username:    claims.Name,
+                role:        claims.Role,
+                expiresAt:   tokenExpiry(claims),
+                reauth:      make(chan time.Time, 1),
+                room:        room,
+                roomSubs:    make(map[string]bool),
         }
-        
-        // Register client
+
+        // Register the client, then load the history requested in the handshake, including when
+        // the resume token expired, and put it ahead of what the room sent meanwhile. Loading after
+        // joining means no message falls between the history and the live frames.
         client.hub.register <- client
+        if resumes == "" {
+                history, err := loadHandshakeHistory(room, query)
+                if err != nil {
+                        log.Printf("error loading history for room %s: %v", room, err)
+                        client.hub.unregister <- client
+                        closeWithCode(conn, websocket.CloseInternalServerErr, "failed to load chat history")
+                        return
+                }
+                client.send.Rewrite(func(queued []models.WSMessage) []models.WSMessage {
+                        return withReplay(history, queued)
+                })
+        }
 
         // Send welcome message
         welcomeMsg := ChatMessage{
                 ID:        uuid.New().String(),
                 Sender:    "System",
-                Content:   fmt.Sprintf("Welcome to the chat, %s!", username),
+                Content:   fmt.Sprintf("Welcome to the chat, %s!", client.username),
+                Room:      room,
                 Timestamp: time.Now(),
         }
-        client.send <- welcomeMsg
+        client.send.Push(newFrame(models.WSTypeMessage, "", welcomeMsg))
 
         // Start goroutines for reading and writing
         go client.writePump()
@@ -303,8 +612,21 @@ const chatTestHTML = `<!DOCTYPE html>
         .message .sender { font-weight: bold; }
         .message .time { color: #999; font-size: 12px; }
         .message .content { margin-top: 5px; }
+        .message .deleted { color: #999; font-style: italic; }
+        .message .replies { font-size: 0.8em; color: #2196F3; }
+        .reaction { display: inline-block; margin: 2px 4px 0 0; padding: 0 6px; border: 1px solid #ddd; border-radius: 10px; cursor: pointer; font-size: 0.85em; }
+        .reaction.mine { background-color: #e6f7ff; border-color: #2196F3; }
         .mention { background-color: #e6f7ff; padding: 2px 4px; border-radius: 2px; font-weight: bold; }
+        .mention-client { background-color: #f6ffed; }
+        .mention-here, .mention-channel { background-color: #fff7e6; }
+        .mention-ambiguous { text-decoration: underline dotted; }
+        .notice { color: #666; font-style: italic; white-space: pre-line; margin: 6px 0; }
         #status { margin-bottom: 10px; color: #999; }
+        #readReceipts { color: #999; font-size: 12px; }
+        #typing { height: 18px; color: #999; font-size: 12px; font-style: italic; }
+        .presence-online { color: #4CAF50; }
+        .presence-away { color: #FF9800; }
+        .presence-offline { color: #999; }
         .user-list { border: 1px solid #ccc; padding: 10px; margin-bottom: 10px; }
         .user-list h3 { margin-top: 0; margin-bottom: 10px; }
         .user-list ul { list-style: none; padding: 0; margin: 0; }
@@ -350,17 +672,22 @@ const chatTestHTML = `<!DOCTYPE html>
     <div class="instructions">
         <h3>Testing Instructions</h3>
         <ul>
-            <li>Enter your username and click "Connect" to join the chat</li>
+            <li>Paste an access token (from login) and click "Connect" to join the chat</li>
             <li>Type <strong>@</strong> followed by a name to mention someone (e.g., @John)</li>
             <li>When typing @, a dropdown with suggested users will appear</li>
             <li>Click on a user in the sidebar to mention them automatically</li>
+            <li>Double-click one of your messages to edit or delete it</li>
+            <li>Click "Reply" under a message to open its thread</li>
+            <li>Click a reaction to add or remove yours</li>
             <li>System will notify when users are mentioned in messages</li>
         </ul>
     </div>
     
     <div>
-        <label for="username">Username:</label>
-        <input type="text" id="username" value="TestUser" />
+        <label for="token">Access token:</label>
+        <input type="password" id="token" />
+        <label for="room">Client or thread ID:</label>
+        <input type="text" id="room" value="{{DEMO_ROOM}}" size="38" />
         <button onclick="connect()">Connect</button>
     </div>
     
@@ -368,7 +695,10 @@ const chatTestHTML = `<!DOCTYPE html>
     
     <div class="container">
         <div class="chat-area">
+            <button type="button" onclick="loadMore()">Load earlier messages</button>
             <div id="messages"></div>
+            <div id="readReceipts"></div>
+            <div id="typing"></div>
             
             <form id="messageForm" onsubmit="sendMessage(event)">
                 <div id="mentionsDropdown" class="mentions-dropdown">
@@ -380,6 +710,11 @@ const chatTestHTML = `<!DOCTYPE html>
         </div>
         
         <div class="sidebar">
+            <div class="user-list">
+                <h3>In this room</h3>
+                <ul id="presenceList"></ul>
+            </div>
+            
             <div class="user-list">
                 <h3>Users</h3>
                 <ul id="userList">
@@ -405,6 +740,25 @@ const chatTestHTML = `<!DOCTYPE html>
     <script>
         let socket;
         let username = '';
+        let userId = '';
+        let room = '';
+        
+        // History paging state: the oldest message shown and where an earlier page is inserted
+        let oldestMessageId = null;
+        let pageStarted = false;
+        let insertBeforeEl = null;
+        
+        // Presence of the room's members and who is typing, keyed by user ID
+        let presence = {};
+        let typists = {};
+        
+        // How far each participant has read, keyed by user ID, and the latest message shown
+        let readers = {};
+        let latestMessageId = null;
+        let lastTypingSent = 0;
+        let heartbeatTimer = null;
+        let resumeToken = null;
+        let lastSeq = 0;
         
         // Predefined list of users for testing mentions
         const suggestedUsers = [
@@ -412,10 +766,28 @@ const chatTestHTML = `<!DOCTYPE html>
             'TestClient', 'Acme', 'Globex', 'System'
         ];
         
-        function connect() {
-            username = document.getElementById('username').value;
-            if (!username) {
-                alert('Please enter a username');
+        // connect opens the room; with a resume token it picks up a connection the server closed
+        // for being slow, keeping the messages already shown
+        function connect(resumeWith) {
+            const token = document.getElementById('token').value.trim();
+            if (!token) {
+                alert('Please enter an access token');
+                return;
+            }
+            
+            // The display name comes from the token's claims
+            try {
+                const claims = JSON.parse(atob(token.split('.')[1].replace(/-/g, '+').replace(/_/g, '/')));
+                username = claims.name;
+                userId = claims.user_id;
+            } catch (e) {
+                alert('That does not look like an access token');
+                return;
+            }
+            
+            room = document.getElementById('room').value;
+            if (!room) {
+                alert('Please enter a client or thread ID');
                 return;
             }
             
@@ -425,16 +797,37 @@ const chatTestHTML = `<!DOCTYPE html>
             }
             
             const statusEl = document.getElementById('status');
-            statusEl.textContent = 'Connecting...';
+            statusEl.textContent = resumeWith ? 'Reconnecting...' : 'Connecting...';
+            if (!resumeWith) {
+                document.getElementById('messages').innerHTML = '';
+                oldestMessageId = null;
+                pageStarted = false;
+                insertBeforeEl = null;
+                presence = {};
+                typists = {};
+                readers = {};
+                latestMessageId = null;
+                lastSeq = 0;
+                renderPresence();
+                renderTyping();
+                renderReadReceipts();
+            }
             
             // Create WebSocket connection
             const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
-            const wsUrl = protocol + '//' + window.location.host + '/ws/chat?username=' + encodeURIComponent(username);
-            socket = new WebSocket(wsUrl);
+            let wsUrl = protocol + '//' + window.location.host + '/ws/chat?client_id=' + encodeURIComponent(room);
+            if (resumeWith) {
+                // resume_from only matters if the server no longer has the session
+                wsUrl += '&resume_token=' + encodeURIComponent(resumeWith);
+                if (lastSeq) {
+                    wsUrl += '&resume_from=' + lastSeq;
+                }
+            }
+            socket = new WebSocket(wsUrl, ['bearer', token]);
             
             // Connection opened
             socket.addEventListener('open', function (event) {
-                statusEl.textContent = 'Connected as ' + username;
+                statusEl.textContent = 'Connected as ' + username + ' in ' + room;
                 statusEl.style.color = '#4CAF50';
                 
                 // Add the current user to the list
@@ -446,27 +839,114 @@ const chatTestHTML = `<!DOCTYPE html>
                     userItem.onclick = function() { mentionUser(username); };
                     userList.appendChild(userItem);
                 }
+                
+                // Keep the user online while the page is visible; the server marks silent users away
+                clearInterval(heartbeatTimer);
+                heartbeatTimer = setInterval(function() {
+                    if (socket.readyState === WebSocket.OPEN && document.visibilityState === 'visible') {
+                        sendFrame('ping');
+                    }
+                }, 60000);
             });
             
             // Listen for messages
             socket.addEventListener('message', function (event) {
-                const message = JSON.parse(event.data);
-                displayMessage(message);
+                const frame = JSON.parse(event.data);
+                if (frame.type === 'error') {
+                    statusEl.textContent = 'Error: ' + frame.payload.message + ' (' + frame.payload.code + ')';
+                    statusEl.style.color = 'red';
+                    return;
+                }
+                if (frame.type === 'notice') {
+                    // Answers to slash commands and reminders are only shown to this user
+                    const noticeDiv = document.createElement('div');
+                    noticeDiv.className = 'notice';
+                    noticeDiv.textContent = frame.payload.content + ' (only visible to you)';
+                    document.getElementById('messages').appendChild(noticeDiv);
+                    return;
+                }
+                if (frame.type === 'mention') {
+                    // Mentions arrive from every room, including rooms this page has not joined
+                    const mentionDiv = document.createElement('div');
+                    mentionDiv.className = 'notice';
+                    mentionDiv.textContent = frame.payload.sender + ' mentioned you in room ' + frame.payload.room + ': ' + frame.payload.content;
+                    document.getElementById('messages').appendChild(mentionDiv);
+                    return;
+                }
+                if (frame.type === 'session') {
+                    resumeToken = frame.payload.resume_token;
+                    return;
+                }
+                if (frame.type === 'presence') {
+                    presence[frame.payload.user_id] = frame.payload;
+                    renderPresence();
+                    return;
+                }
+                if (frame.type === 'typing_started') {
+                    typists[frame.payload.user_id] = frame.payload.name;
+                    renderTyping();
+                    return;
+                }
+                if (frame.type === 'typing_stopped') {
+                    delete typists[frame.payload.user_id];
+                    renderTyping();
+                    return;
+                }
+                if (frame.type === 'message_updated' || frame.type === 'message_deleted') {
+                    updateMessage(frame.payload);
+                    return;
+                }
+                if (frame.type === 'reaction_added' || frame.type === 'reaction_removed') {
+                    const reactionsDiv = document.querySelector('#msg-' + frame.payload.message_id + ' .reactions');
+                    if (reactionsDiv) {
+                        renderReactions(reactionsDiv, frame.payload.message_id, frame.payload.reactions);
+                    }
+                    return;
+                }
+                if (frame.type === 'read') {
+                    readers[frame.payload.user_id] = frame.payload;
+                    renderReadReceipts();
+                    return;
+                }
+                if (frame.type !== 'message') {
+                    return;
+                }
+                
+                const message = frame.payload;
+                if (document.getElementById('msg-' + message.id)) {
+                    return;
+                }
+                if (message.seq > lastSeq) {
+                    lastSeq = message.seq;
+                }
+                if (message.history && !pageStarted) {
+                    oldestMessageId = message.id;
+                    pageStarted = true;
+                }
+                displayMessage(message, message.history ? insertBeforeEl : null);
                 
-                // Auto-respond to mentions of the current user
-                if (message.mentions && message.mentions.includes(username) && message.sender !== username) {
-                    setTimeout(() => {
-                        const response = {
-                            content: '@' + message.sender + ' Thanks for mentioning me! I will get back to you soon.'
-                        };
-                        socket.send(JSON.stringify(response));
-                    }, 1000);
+                // Mark the newest persisted message as read while the page is visible;
+                // system notices are not persisted
+                if ((!message.history || !insertBeforeEl) && message.sender !== 'System') {
+                    latestMessageId = message.id;
+                    renderReadReceipts();
+                    markRead();
                 }
             });
             
             // Connection closed
             socket.addEventListener('close', function (event) {
+                clearInterval(heartbeatTimer);
                 statusEl.textContent = 'Disconnected';
+                if (event.code === 4001) {
+                    statusEl.textContent = 'Disconnected: unauthorized';
+                } else if (event.code === 4002) {
+                    statusEl.textContent = 'Disconnected: token expired, refresh it and reconnect';
+                } else if (event.code === 4003 && resumeToken) {
+                    // Closed for reading too slowly; resume to receive what was missed
+                    connect(resumeToken);
+                    return;
+                }
                 statusEl.style.color = '#999';
             });
             
@@ -488,17 +968,91 @@ const chatTestHTML = `<!DOCTYPE html>
             const content = inputEl.value.trim();
             
             if (content) {
-                socket.send(JSON.stringify({ content: content }));
+                sendFrame('send', { content: content });
                 inputEl.value = '';
+                lastTypingSent = 0;
                 hideMentionsDropdown();
             }
         }
         
-        function displayMessage(message) {
+        // Tell the room the user is typing, at most every few seconds; the server expires the indicator
+        function sendTyping() {
+            if (!socket || socket.readyState !== WebSocket.OPEN) {
+                return;
+            }
+            const now = Date.now();
+            if (now - lastTypingSent > 3000) {
+                lastTypingSent = now;
+                sendFrame('typing', { typing: true });
+            }
+        }
+        
+        function renderPresence() {
+            const list = document.getElementById('presenceList');
+            list.innerHTML = '';
+            Object.values(presence).forEach(member => {
+                const item = document.createElement('li');
+                item.className = 'presence-' + member.status;
+                item.textContent = member.name + ' (' + member.status + ')';
+                if (member.status !== 'online') {
+                    item.title = 'Last seen ' + new Date(member.last_seen).toLocaleString();
+                }
+                item.onclick = function() { mentionUser(member.name); };
+                list.appendChild(item);
+            });
+        }
+        
+        function markRead() {
+            if (latestMessageId && document.visibilityState === 'visible' && socket.readyState === WebSocket.OPEN) {
+                sendFrame('read', { message_id: latestMessageId });
+            }
+        }
+        document.addEventListener('visibilitychange', function() {
+            if (socket) {
+                markRead();
+            }
+        });
+        
+        function renderReadReceipts() {
+            const seenBy = Object.values(readers)
+                .filter(r => r.message_id === latestMessageId && r.name !== username)
+                .map(r => r.name);
+            document.getElementById('readReceipts').textContent = seenBy.length === 0 ? '' : 'Seen by ' + seenBy.join(', ');
+        }
+        
+        function renderTyping() {
+            const names = Object.values(typists);
+            document.getElementById('typing').textContent = names.length === 0 ? '' :
+                names.join(', ') + (names.length === 1 ? ' is typing...' : ' are typing...');
+        }
+        
+        // Send a protocol frame; its ID matches the ack or error frame that answers it
+        let frameCounter = 0;
+        function sendFrame(type, payload) {
+            frameCounter++;
+            const id = 'f' + frameCounter;
+            socket.send(JSON.stringify({ v: 1, type: type, id: id, payload: payload }));
+            return id;
+        }
+        
+        // Ask the server for the page of history before the oldest message shown
+        function loadMore() {
+            if (!socket || socket.readyState !== WebSocket.OPEN || !oldestMessageId) {
+                return;
+            }
+            
+            const messagesEl = document.getElementById('messages');
+            insertBeforeEl = messagesEl.firstChild;
+            pageStarted = false;
+            sendFrame('load_more', { before_id: oldestMessageId, limit: 50 });
+        }
+        
+        function displayMessage(message, beforeEl) {
             const messagesEl = document.getElementById('messages');
             
             const messageDiv = document.createElement('div');
             messageDiv.className = 'message';
+            messageDiv.id = 'msg-' + message.id;
             
             const headerDiv = document.createElement('div');
             const senderSpan = document.createElement('span');
@@ -507,7 +1061,7 @@ const chatTestHTML = `<!DOCTYPE html>
             
             const timeSpan = document.createElement('span');
             timeSpan.className = 'time';
-            timeSpan.textContent = ' ' + new Date(message.timestamp).toLocaleTimeString();
+            timeSpan.textContent = ' ' + new Date(message.timestamp).toLocaleTimeString() + (message.edited_at ? ' (edited)' : '');
             
             headerDiv.appendChild(senderSpan);
             headerDiv.appendChild(timeSpan);
@@ -515,14 +1069,15 @@ const chatTestHTML = `<!DOCTYPE html>
             const contentDiv = document.createElement('div');
             contentDiv.className = 'content';
             
+            // Double-click your own messages to edit them
+            if (message.sender === username && !message.deleted_at) {
+                messageDiv.title = 'Double-click to edit';
+                messageDiv.ondblclick = function() { editMessage(message.id, contentDiv.textContent); };
+            }
+            
             // Highlight mentions in content
-            let content = message.content;
+            const content = highlightMentions(message);
             if (message.mentions && message.mentions.length > 0) {
-                message.mentions.forEach(mention => {
-                    const regex = new RegExp('@' + mention, 'g');
-                    content = content.replace(regex, '<span class="mention">@' + mention + '</span>');
-                });
-                
                 // If the current user is mentioned, highlight the message
                 if (username && message.mentions.includes(username)) {
                     messageDiv.style.backgroundColor = '#fffbeb';
@@ -541,12 +1096,130 @@ const chatTestHTML = `<!DOCTYPE html>
             messageDiv.appendChild(headerDiv);
             messageDiv.appendChild(contentDiv);
             
+            // Persisted messages can be reacted to, unless they were deleted
+            if (message.sender !== 'System' && !message.deleted_at) {
+                const reactionsDiv = document.createElement('div');
+                reactionsDiv.className = 'reactions';
+                renderReactions(reactionsDiv, message.id, message.reactions);
+                messageDiv.appendChild(reactionsDiv);
+            }
+            
+            // Top-level messages link to their thread of replies
+            if (!message.parent_id && message.sender !== 'System') {
+                const repliesLink = document.createElement('a');
+                repliesLink.className = 'replies';
+                repliesLink.href = '#';
+                repliesLink.textContent = repliesLabel(message);
+                repliesLink.onclick = function(e) { e.preventDefault(); openThread(message.id); };
+                messageDiv.appendChild(repliesLink);
+            }
+            
+            if (beforeEl) {
+                messagesEl.insertBefore(messageDiv, beforeEl);
+                return;
+            }
             messagesEl.appendChild(messageDiv);
             messagesEl.scrollTop = messagesEl.scrollHeight;
         }
         
+        // Mention spans are byte offsets into the UTF-8 content, so the content is cut as bytes
+        function highlightMentions(message) {
+            if (message.deleted_at) {
+                return '<span class="deleted">Message deleted</span>';
+            }
+            const bytes = new TextEncoder().encode(message.content);
+            const decoder = new TextDecoder();
+            let content = '';
+            let at = 0;
+            (message.mention_spans || []).forEach(span => {
+                const kind = span.kind === 'unknown' ? '' : ' mention-' + span.kind;
+                content += decoder.decode(bytes.slice(at, span.start));
+                content += '<span class="mention' + kind + '">' + decoder.decode(bytes.slice(span.start, span.end)) + '</span>';
+                at = span.end;
+            });
+            return content + decoder.decode(bytes.slice(at));
+        }
+        
+        // Show a message's reactions; clicking one toggles the current user's reaction, and the
+        // quick reactions that nobody used yet are offered after them
+        const quickReactions = ['👍', '❤️', '😂', '🎉'];
+        function renderReactions(reactionsDiv, messageId, reactions) {
+            reactionsDiv.innerHTML = '';
+            const used = {};
+            (reactions || []).forEach(reaction => {
+                used[reaction.emoji] = true;
+                const mine = reaction.user_ids.includes(userId);
+                reactionsDiv.appendChild(reactionButton(messageId, reaction.emoji, reaction.emoji + ' ' + reaction.count, mine));
+            });
+            quickReactions.filter(emoji => !used[emoji]).forEach(emoji => {
+                reactionsDiv.appendChild(reactionButton(messageId, emoji, emoji, false));
+            });
+        }
+        
+        function reactionButton(messageId, emoji, label, mine) {
+            const button = document.createElement('span');
+            button.className = mine ? 'reaction mine' : 'reaction';
+            button.textContent = label;
+            button.onclick = function() {
+                sendFrame(mine ? 'unreact' : 'react', { message_id: messageId, emoji: emoji });
+            };
+            return button;
+        }
+        
+        function repliesLabel(message) {
+            if (!message.reply_count) {
+                return 'Reply';
+            }
+            return message.reply_count + (message.reply_count === 1 ? ' reply' : ' replies');
+        }
+        
+        // Join the room of a message's replies, whose ID is the message ID
+        function openThread(id) {
+            document.getElementById('room').value = id;
+            connect();
+        }
+        
+        // Edit a message; clearing its content deletes it
+        function editMessage(id, current) {
+            const content = prompt('Edit message (clear it to delete the message)', current);
+            if (content === null || content === current) {
+                return;
+            }
+            if (!content.trim()) {
+                if (confirm('Delete this message?')) {
+                    sendFrame('delete', { message_id: id });
+                }
+                return;
+            }
+            sendFrame('edit', { message_id: id, content: content.trim() });
+        }
+        
+        // Replace the content of a message that was edited, or whose replies changed
+        function updateMessage(message) {
+            const messageDiv = document.getElementById('msg-' + message.id);
+            if (!messageDiv) {
+                return;
+            }
+            messageDiv.querySelector('.content').innerHTML = highlightMentions(message);
+            const repliesLink = messageDiv.querySelector('.replies');
+            if (repliesLink) {
+                repliesLink.textContent = repliesLabel(message);
+            }
+            if (message.deleted_at) {
+                messageDiv.ondblclick = null;
+                messageDiv.title = '';
+                const reactionsDiv = messageDiv.querySelector('.reactions');
+                if (reactionsDiv) {
+                    reactionsDiv.remove();
+                }
+                return;
+            }
+            messageDiv.querySelector('.time').textContent = ' ' + new Date(message.timestamp).toLocaleTimeString() + (message.edited_at ? ' (edited)' : '');
+        }
+        
         // Handle input for @mentions autocomplete
         function handleInput(event) {
+            sendTyping();
             const input = event.target;
             const text = input.value;
             const cursorPos = input.selectionStart;
@@ -704,176 +1377,144 @@ const homeHTML = `<html>
 </body>
 </html>`;
 
-// min returns the smaller of a and b
-func min(a, b int) int {
-    if a < b {
-        return a
+// postMessage resolves the mentions in a chat message, persists it and then broadcasts it to its
+// room, so that everything a client sees live can also be replayed from the database. It returns
+// the message as broadcast.
+func postMessage(hub *ChatHub, message ChatMessage) (ChatMessage, error) {
+    target, err := resolveRoom(message.Room)
+    if err != nil {
+        return message, err
+    }
+    if target.ParentID != nil {
+        message.ParentID = target.ParentID.String()
     }
-    return b
-}
 
-// parseMentions extracts @username mentions from a message
-func parseMentions(content string) []string {
-    mentionsMap := make(map[string]bool)
-    words := strings.Fields(content)
-    
-    for _, word := range words {
-        if strings.HasPrefix(word, "@") {
-            mention := strings.TrimPrefix(word, "@")
-            // Remove any trailing punctuation
-            mention = strings.TrimRight(mention, ",.!?:;")
-            if mention != "" {
-                mentionsMap[mention] = true
-            }
-        }
+    mentions, err := mention.Resolve(database.DB, message.Content)
+    if err != nil {
+        return message, fmt.Errorf("failed to resolve mentions: %w", err)
     }
-    
-    // Convert map to slice
-    mentions := make([]string, 0, len(mentionsMap))
-    for mention := range mentionsMap {
-        mentions = append(mentions, mention)
+    message.Mentions = mentions.Names()
+    message.MentionSpans = mentions.Mentions
+
+    seq, err := storeMessageInDatabase(message, target, message.Sender, mentions.UserIDs())
+    if err != nil {
+        return message, err
+    }
+    message.Seq = seq
+    hub.broadcast <- message
+    if messageID, err := uuid.Parse(message.ID); err == nil {
+        resolvers.NotifyMessageMentions(database.DB, messageID)
     }
-    
-    return mentions
-}
 
-// autoRespondToMentions creates automatic responses when users are mentioned
-func autoRespondToMentions(hub *ChatHub, mentions []string, sender string, replyToID string) {
-    // Wait a moment before responding
-    time.Sleep(1500 * time.Millisecond)
-    
-    // Define some predefined responses by username
-    responses := map[string]string{
-        "John":       "I'll review the sales data and get back to you shortly.",
-        "Maria":      "Thanks for the mention. I'll help address this support request.",
-        "Carlos":     "I'll check the technical issues you've reported.",
-        "Sarah":      "I'll include this in our next marketing campaign.",
-        "Admin":      "This has been noted by the admin team.",
-        "TestClient": "Thank you for reaching out. As a client, I appreciate your attention.",
-        "Acme":       "Acme Corp acknowledges your message.",
-        "Globex":     "Globex Inc will respond to your inquiry soon.",
+    // A reply also changes the reply count shown on its parent
+    if target.ParentID != nil {
+        publishParentUpdate(hub, *target.ParentID)
     }
-    
-    // Create default response for users not in the map
-    defaultResponse := "Thanks for the mention. I'll get back to you soon."
-    
-    // Send a response for each mentioned user
-    for _, mention := range mentions {
-        responseText := responses[mention]
-        if responseText == "" {
-            responseText = defaultResponse
-        }
-        
-        // Don't respond to the sender mentioning themselves
-        if mention == sender {
-            continue
-        }
-        
-        // Create a response message
-        responseMsg := ChatMessage{
-            ID:        uuid.New().String(),
-            Sender:    mention,
-            Content:   fmt.Sprintf("@%s %s", sender, responseText),
-            Mentions:  []string{sender},
-            Timestamp: time.Now(),
-        }
-        
-        // Broadcast the response
-        hub.broadcast <- responseMsg
-        
-        // Store the response in the database
-        go storeMessageInDatabase(responseMsg, mention, []string{sender})
+    return message, nil
+}
+
+// publishParentUpdate sends a message with new replies to the room it was posted in
+func publishParentUpdate(hub *ChatHub, parentID uuid.UUID) {
+    var parent models.Message
+    if err := database.DB.Preload("Sender").Preload("Mentions.User").Where("id = ?", parentID).First(&parent).Error; err != nil {
+        log.Printf("error loading parent message %s: %v", parentID, err)
+        return
     }
+
+    room := parent.ConversationID().String()
+    updated := chatMessageFromModel(parent, room)
+    updated.History = false
+    hub.publish <- roomFrame{room: room, frame: newFrame(models.WSTypeMessageUpdated, "", updated)}
 }
 
-// storeMessageInDatabase stores the message in the database and creates timeline events
-func storeMessageInDatabase(message ChatMessage, senderUsername string, mentions []string) {
+// storeMessageInDatabase stores the message in the room it was posted to and returns its sequence
+// number in the room; the message's AfterCreate hook adds the matching event to the client's timeline
+func storeMessageInDatabase(message ChatMessage, target chatRoom, senderUsername string, mentions []uuid.UUID) (seq int64, err error) {
     defer func() {
         // Recover from any panics to prevent crashing the whole application
         if r := recover(); r != nil {
             log.Printf("Recovered from database error: %v", r)
+            err = fmt.Errorf("database error: %v", r)
         }
     }()
 
-    // Get user ID or create a user if not exists
-    var user database.User
-    result := database.DB.Where("username = ?", senderUsername).First(&user)
-    if result.Error != nil {
+    messageID, err := uuid.Parse(message.ID)
+    if err != nil {
+        return 0, fmt.Errorf("invalid message ID %q: %w", message.ID, err)
+    }
+
+    // Authenticated senders are looked up by ID; bots and simulated users by name,
+    // creating a user if not exists
+    var user models.User
+    if senderID, parseErr := uuid.Parse(message.SenderID); parseErr == nil {
+        if err := database.DB.Where("id = ?", senderID).First(&user).Error; err != nil {
+            return 0, fmt.Errorf("unknown sender %s: %w", message.SenderID, err)
+        }
+    } else if result := database.DB.Where("name = ?", senderUsername).First(&user); result.Error != nil {
         // Create a new user
-        user = database.User{
-            Username: senderUsername,
-            Email:    senderUsername + "@example.com", // Placeholder email
+        user = models.User{
+            Name:  senderUsername,
+            Email: senderUsername + "@example.com", // Placeholder email
+        }
+        if err := database.DB.Create(&user).Error; err != nil {
+            return 0, fmt.Errorf("failed to create sender %s: %w", senderUsername, err)
         }
-        database.DB.Create(&user)
     }
 
-    // Create the message record
-    dbMessage := database.Message{
-        SenderID: user.ID,
-        Content:  message.Content,
-    }
-    
-    // Convert mentions to JSON string
-    if len(mentions) > 0 {
-        mentionsJSON, _ := json.Marshal(mentions)
-        dbMessage.Mentions = string(mentionsJSON)
-    }
-    
-    // Save message to database
-    result = database.DB.Create(&dbMessage)
-    if result.Error != nil {
-        log.Printf("Error storing message: %v", result.Error)
-        return
+    // Create the message record, keeping the ID that was broadcast to clients
+    dbMessage := models.Message{
+        ID:        messageID,
+        Content:   message.Content,
+        SenderID:  user.ID,
+        ClientID:  target.ClientID,
+        ThreadID:  target.ThreadID,
+        ParentID:  target.ParentID,
+        CreatedAt: message.Timestamp,
+        UpdatedAt: message.Timestamp,
     }
-    
-    // Create timeline events for the message
-    log.Printf("Timeline Event: User %s sent a message", senderUsername)
-    
-    // In a real app, we would create timeline events for each client mentioned
-    // For now, we'll create a generic timeline event without a specific client
-    // In production, we'd need to determine which clients were mentioned and create events for each
-    
-    // Let's create a simple timeline event
-    timelineDetails, _ := json.Marshal(map[string]interface{}{
-        "message_id": dbMessage.ID,
-        "sender": senderUsername,
-        "content_preview": message.Content[:min(50, len(message.Content))],
-        "has_mentions": len(mentions) > 0,
-    })
-    
-    // Find first client (for demo purposes only)
-    var client database.Client
-    clientResult := database.DB.First(&client)
-    
-    // Only create timeline event if we have a client
-    if clientResult.Error == nil {
-        timelineEvent := database.TimelineEvent{
-            ClientID:  client.ID,
-            EventType: "message",
-            Details:   string(timelineDetails),
-        }
-        database.DB.Create(&timelineEvent)
-        
-        if len(mentions) > 0 {
-            log.Printf("Timeline Event: User %s mentioned users: %v", senderUsername, mentions)
+
+    err = database.DB.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Create(&dbMessage).Error; err != nil {
+            return fmt.Errorf("failed to store message: %w", err)
         }
-    }
+
+        if len(mentions) == 0 {
+            return nil
+        }
+
+        // Record mentions of known users
+        for _, userID := range mentions {
+            mentioned := models.MessageMention{
+                MessageID: dbMessage.ID,
+                UserID:    userID,
+            }
+            if err := tx.Create(&mentioned).Error; err != nil {
+                return fmt.Errorf("failed to store mention: %w", err)
+            }
+        }
+
+        log.Printf("Timeline Event: User %s mentioned users: %v", senderUsername, message.Mentions)
+        return nil
+    })
+    return dbMessage.Seq, err
 }
 
-// simulateTwoUserChat creates a simulated chat between two virtual users
-func simulateTwoUserChat(hub *ChatHub) {
+// simulateTwoUserChat creates a simulated chat between two virtual users in the given room
+func simulateTwoUserChat(hub *ChatHub, room string) {
     log.Println("Starting automated chat simulation between two virtual users...")
     
     // Create two virtual users
     user1 := &VirtualUser{
         ID:       uuid.New().String(),
         Username: "SimBot1",
+        Room:     room,
         hub:      hub,
     }
     
     user2 := &VirtualUser{
         ID:       uuid.New().String(),
         Username: "SimBot2",
+        Room:     room,
         hub:      hub,
     }
     
@@ -921,6 +1562,7 @@ func simulateTwoUserChat(hub *ChatHub) {
 type VirtualUser struct {
     ID       string
     Username string
+    Room     string
     hub      *ChatHub
     client   *ChatClient
 }
@@ -932,7 +1574,9 @@ func (vu *VirtualUser) Connect() {
         hub:      vu.hub,
         userID:   vu.ID,
         username: vu.Username,
-        send:     make(chan ChatMessage, 256),
+        room:     vu.Room,
+        send:     newSendQueue(backpressure.DropOldest),
+        roomSubs: make(map[string]bool),
     }
     
     // Register with the hub
@@ -940,8 +1584,21 @@ func (vu *VirtualUser) Connect() {
     
     // Start a goroutine to handle received messages
     go func() {
-        for message := range vu.client.send {
-            log.Printf("[%s received]: %s: %s", vu.Username, message.Sender, message.Content)
+        for range vu.client.send.Ready() {
+            for {
+                frame, ok := vu.client.send.Pop()
+                if !ok {
+                    break
+                }
+                var message ChatMessage
+                if frame.Type != models.WSTypeMessage || json.Unmarshal(frame.Payload, &message) != nil {
+                    continue
+                }
+                log.Printf("[%s received]: %s: %s", vu.Username, message.Sender, message.Content)
+            }
+            if vu.client.send.Closed() {
+                return
+            }
         }
     }()
     
@@ -953,55 +1610,69 @@ func (vu *VirtualUser) SendMessage(content string) {
     // Create a unique message ID
     messageID := uuid.New().String()
     
-    // Parse mentions in the message
-    mentions := parseMentions(content)
-    
-    // Create the message
+    // Create the message; its mentions are resolved when it is posted
     message := ChatMessage{
         ID:        messageID,
         Sender:    vu.Username,
         Content:   content,
-        Mentions:  mentions,
+        Room:      vu.Room,
         Timestamp: time.Now(),
     }
     
-    // Send to the hub
-    vu.hub.broadcast <- message
-    
-    // Store in database
-    go storeMessageInDatabase(message, vu.Username, mentions)
+    // Store in database and send to the hub
+    if _, err := postMessage(vu.hub, message); err != nil {
+        log.Printf("[%s] error storing message: %v", vu.Username, err)
+        return
+    }
     
     log.Printf("[%s sent]: %s", vu.Username, content)
 }
 
-// createTestData adds some test data to the database if needed
-func createTestData() {
+// createTestData adds some test data to the database if needed and returns the
+// ID of the demo client whose room the chat simulation uses
+func createTestData() string {
+    // Reuse an existing client if there is one
+    var testClient models.Client
+    if err := database.DB.Order("created_at").First(&testClient).Error; err == nil {
+        return testClient.ID.String()
+    }
+
     // Create a test client if none exist
-    var count int64
-    database.DB.Model(&database.Client{}).Count(&count)
-    
-    if count == 0 {
-        testClient := database.Client{
-            Name:  "Test Client",
-            Email: "test.client@example.com",
-            Phone: "555-123-4567",
-        }
-        
-        result := database.DB.Create(&testClient)
-        if result.Error != nil {
-            log.Printf("Error creating test client: %v", result.Error)
-        } else {
-            log.Println("Created test client for demo purposes")
-        }
+    testClient = models.Client{
+        Name:  "Test Client",
+        Email: "test.client@example.com",
+        Phone: "555-123-4567",
+    }
+
+    result := database.DB.Create(&testClient)
+    if result.Error != nil {
+        log.Printf("Error creating test client: %v", result.Error)
+    } else {
+        log.Println("Created test client for demo purposes")
     }
+
+    return testClient.ID.String()
 }
 
 func main() {
+        // Load the keys signing tokens, refusing to start without them outside development
+        if err := auth.ConfigureKeys(); err != nil {
+                log.Fatalf("Failed to configure token signing keys: %v", err)
+        }
+
         // Initialize database
         database.InitDB()
+
+        // Make sure the tables used by the chat and the GraphQL API exist
+        if err := database.DB.AutoMigrate(&models.User{}, &models.Client{}, &models.ChatThread{}, &models.Message{}, &models.RoomSequence{}, &models.MessageMention{}, &models.MessageRevision{}, &models.Reaction{}, &models.AuditLog{}, &models.MessageRead{}, &models.TimelineEvent{}, &models.Reminder{}, &models.Email{}, &models.EmailAttachment{}, &models.EmailDraft{}, &models.Notification{}, &models.NotificationPreference{}, &models.ChannelPreference{}, &models.WebhookSubscription{}, &models.WebhookDelivery{}, &models.OAuthProvider{}, &models.Session{}, &models.RefreshToken{}, &models.Role{}, &models.Team{}, &models.TeamMember{}); err != nil {
+                log.Fatalf("Failed to migrate database: %v", err)
+        }
+        if err := models.BackfillSequences(database.DB); err != nil {
+                log.Fatalf("Failed to number existing messages: %v", err)
+        }
         
         // Create test data
-        createTestData()
+        demoRoom := createTestData()
         
         port := os.Getenv("PORT")
         if port == "" {
@@ -1021,22 +1692,62 @@ func main() {
                 w.Write([]byte(homeHTML))
         })
 
+        // Share events with the other replicas, then create the hubs on top of the broker
+        eventBroker := newBroker()
+        defer eventBroker.Close()
+        if err := resolvers.UseBroker(eventBroker); err != nil {
+                log.Fatalf("Failed to connect GraphQL subscriptions to the broker: %v", err)
+        }
+        if err := chatws.GlobalHub.UseBroker(eventBroker); err != nil {
+                log.Fatalf("Failed to connect the WebSocket hub to the broker: %v", err)
+        }
+
+        // Send frames and createMessage share the same quotas
+        ratelimit.Use(newRateLimiter())
+
         // Create a new hub
-        hub := newChatHub()
+        commands := command.NewRouter(database.DB, command.NewDraftStore(database.DB))
+        hub := newChatHub(eventBroker, newBotRegistry(), commands)
+        chatws.GlobalHub.OnUserMessage(hub.receiveUserFrame)
+        resolvers.UseChatRooms(hub)
         go hub.run()
+        go hub.deliverReminders()
+
+        // Queue what offline users miss and email them digests
+        notifier := newNotifier(hub)
+        notify.Use(notifier)
+        go notifier.Run(context.Background())
+
+        // Send the webhook deliveries queued as messages, emails and timeline events are stored
+        go webhook.NewDispatcher(database.DB, nil, webhookPollInterval).Run(context.Background())
         
-        // Start the automated chat simulation
-        go simulateTwoUserChat(hub)
+        // Start the automated chat simulation in the demo room
+        go simulateTwoUserChat(hub, demoRoom)
+
+        // Serve the GraphQL API and its subscriptions, with the identity of requests attached by
+        // auth.Middleware
+        graphql.RegisterRoutes(mux)
 
         // Add chat test route
         mux.HandleFunc("/ws/chat", func(w http.ResponseWriter, r *http.Request) {
                 serveWs(hub, w, r)
         })
 
+        // Expose backpressure drop counters, along with the standard runtime metrics
+        mux.Handle("/debug/vars", expvar.Handler())
+
+        // Publish the keys verifying access tokens, for other services
+        mux.HandleFunc("/.well-known/jwks.json", auth.JWKSHandler)
+
+        // Add presence roster route
+        mux.HandleFunc("/api/presence", func(w http.ResponseWriter, r *http.Request) {
+                servePresence(hub, w, r)
+        })
+
         // Add test page for chat
         mux.HandleFunc("/chat-test", func(w http.ResponseWriter, r *http.Request) {
                 w.Header().Set("Content-Type", "text/html")
-                w.Write([]byte(chatTestHTML))
+                w.Write([]byte(strings.Replace(chatTestHTML, "{{DEMO_ROOM}}", demoRoom, 1)))
         })
 
         // Create a new server
@@ -1,3 +1,8 @@
+//go:build ignore
+
+// Standalone program, left out of the server build: it declares its own main, and its own chat
+// types where it has some, in package main. Run it with go run main_simple.go
+
 package main
 
 import (
@@ -369,7 +374,7 @@ func main() {
 					
 					// Create WebSocket connection
 					const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
-					const wsUrl = `${protocol}//${window.location.host}/ws/chat?username=` + encodeURIComponent(username);
+					const wsUrl = protocol + '//' + window.location.host + '/ws/chat?username=' + encodeURIComponent(username);
 					socket = new WebSocket(wsUrl);
 					
 					// Connection opened
@@ -1,3 +1,8 @@
+//go:build ignore
+
+// Standalone program, left out of the server build: it declares its own main, and its own chat
+// types where it has some, in package main. Run it with go run minimal.go
+
 package main
 
 import (
@@ -77,7 +82,7 @@ func main() {
 		`
 		
 		w.Header().Set("Content-Type", "text/html")
-		fmt.Fprintf(w, html)
+		fmt.Fprint(w, html)
 	})
 
 	// Add a status endpoint
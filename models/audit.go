@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Actions recorded in the audit log
+const (
+	AuditActionPurgeMessage = "purge_message"
+)
+
+// AuditLog records an administrative action that removed or changed data, for compliance
+type AuditLog struct {
+	ID         uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	ActorID    uuid.UUID `gorm:"type:uuid;not null;index" json:"actorId"`
+	Action     string    `gorm:"type:varchar(50);not null" json:"action"`
+	EntityType string    `gorm:"type:varchar(50);not null" json:"entityType"`
+	EntityID   uuid.UUID `gorm:"type:uuid;not null;index" json:"entityId"`
+	Reason     string    `gorm:"type:text" json:"reason"`
+	Details    string    `gorm:"type:text" json:"details"`
+	CreatedAt  time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"createdAt"`
+
+	// Relations
+	Actor User `gorm:"foreignKey:ActorID" json:"actor"`
+}
+
+// BeforeCreate is called before inserting a new audit log entry into the database
+func (a *AuditLog) BeforeCreate(tx *gorm.DB) error {
+	// Generate UUID if not set
+	if a.ID == uuid.Nil {
+		a.ID = uuid.New()
+	}
+	return nil
+}
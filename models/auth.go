@@ -11,9 +11,11 @@ import (
 type RefreshToken struct {
 	ID        uuid.UUID `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
 	UserID    uuid.UUID `json:"user_id" gorm:"type:uuid;index;not null"`
-	Token     string    `json:"token" gorm:"type:text;not null"`
+	SessionID uuid.UUID `json:"session_id" gorm:"type:uuid;index"` // The session whose family of tokens it belongs to
+	Token     string    `json:"token" gorm:"type:text;not null;index"` // SHA-256 of the token, see auth.HashToken
 	CreatedAt time.Time `json:"created_at" gorm:"type:timestamp;not null;default:now()"`
 	ExpiresAt time.Time `json:"expires_at" gorm:"type:timestamp;not null"`
+	UsedAt    *time.Time `json:"used_at" gorm:"type:timestamp"` // When it was rotated; using it again revokes the session
 	
 	// Relations
 	User      *User     `json:"user" gorm:"foreignKey:UserID"`
@@ -58,23 +60,3 @@ type Email struct {
 	User       *User          `json:"user" gorm:"foreignKey:UserID"`
 	Timeline   []TimelineEvent `json:"timeline" gorm:"polymorphic:Eventable"`
 }
-
-// TimelineEvent represents an event in a client's timeline (chat, email, or other interaction)
-type TimelineEvent struct {
-	ID            uuid.UUID      `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
-	ClientID      uuid.UUID      `json:"client_id" gorm:"type:uuid;index;not null"`
-	UserID        uuid.UUID      `json:"user_id" gorm:"type:uuid;index;not null"`
-	EventableType string         `json:"eventable_type" gorm:"type:varchar(255);not null"`
-	EventableID   uuid.UUID      `json:"eventable_id" gorm:"type:uuid;not null"`
-	EventType     string         `json:"event_type" gorm:"type:varchar(50);not null"` // chat_message, email_sent, email_received, note, etc.
-	Title         string         `json:"title" gorm:"type:varchar(255);not null"`
-	Content       string         `json:"content" gorm:"type:text"`
-	EventTime     time.Time      `json:"event_time" gorm:"type:timestamp;not null"`
-	CreatedAt     time.Time      `json:"created_at" gorm:"type:timestamp;not null;default:now()"`
-	UpdatedAt     time.Time      `json:"updated_at" gorm:"type:timestamp;not null;default:now()"`
-	DeletedAt     gorm.DeletedAt `json:"-" gorm:"index"`
-	
-	// Relations
-	Client       *Client        `json:"client" gorm:"foreignKey:ClientID"`
-	User         *User          `json:"user" gorm:"foreignKey:UserID"`
-}
\ No newline at end of file
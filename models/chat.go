@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/google/uuid"
@@ -35,21 +36,203 @@ type Mention struct {
 	CreatedAt time.Time `json:"created_at"`
 }
 
-// MessageRead tracks when a user reads a message
-type MessageRead struct {
-	ID        uuid.UUID `json:"id" gorm:"type:uuid;primary_key"`
-	MessageID uuid.UUID `json:"message_id" gorm:"type:uuid"`
-	UserID    uuid.UUID `json:"user_id" gorm:"type:uuid"`
+// WSProtocolVersion is the version of the chat WebSocket protocol spoken by the server
+const WSProtocolVersion = 1
+
+// Frame types sent by clients
+const (
+	WSTypeAuth        = "auth"
+	WSTypeSend        = "send"
+	WSTypeEdit        = "edit"
+	WSTypeDelete      = "delete"
+	WSTypeTyping      = "typing"
+	WSTypeRead        = "read"
+	WSTypeReact       = "react"
+	WSTypeUnreact     = "unreact"
+	WSTypeSubscribe   = "subscribe"
+	WSTypeUnsubscribe = "unsubscribe"
+	WSTypeLoadMore    = "load_more"
+	WSTypePing        = "ping"
+)
+
+// Frame types sent by the server
+const (
+	WSTypeMessage         = "message"
+	WSTypeMessageUpdated  = "message_updated"
+	WSTypeMessageDeleted  = "message_deleted"
+	WSTypeAck             = "ack"
+	WSTypeError           = "error"
+	WSTypePong            = "pong"
+	WSTypePresence        = "presence"
+	WSTypeTypingStarted   = "typing_started"
+	WSTypeTypingStopped   = "typing_stopped"
+	WSTypeReactionAdded   = "reaction_added"
+	WSTypeReactionRemoved = "reaction_removed"
+	WSTypeSession         = "session"
+	WSTypeNotice          = "notice"
+	WSTypeMention         = "mention"
+)
+
+// WSTypeRead frames are also sent by the server, with a WSReadEventPayload, when a
+// participant's read marker in a room moves forward
+
+// Presence statuses reported in presence frames and the presence roster
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
+// Error codes carried in error frames
+const (
+	WSErrBadFrame           = "bad_frame"           // The frame is not a JSON envelope
+	WSErrUnsupportedVersion = "unsupported_version" // The envelope version is not WSProtocolVersion
+	WSErrUnknownType        = "unknown_type"        // The frame type is not part of the protocol
+	WSErrInvalidPayload     = "invalid_payload"     // The payload is missing fields or malformed
+	WSErrNotSubscribed      = "not_subscribed"      // The frame targets a room the connection has not joined
+	WSErrNotFound           = "not_found"           // The room or message does not exist
+	WSErrUnauthorized       = "unauthorized"        // The token in an auth frame is invalid
+	WSErrForbidden          = "forbidden"           // The user may not act on the message
+	WSErrRateLimited        = "rate_limited"        // The user, connection or room sent too many messages
+	WSErrMuted              = "muted"               // The user is muted for sending too many messages
+	WSErrInternal           = "internal_error"      // The server failed to process the frame
+)
+
+// WSMessage is the versioned envelope of every frame exchanged over the chat WebSocket
+type WSMessage struct {
+	Version int             `json:"v"`
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"` // Chosen by the client and echoed in the ack or error answering the frame
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// WSAuthPayload carries an access token, either as the first frame or to replace an expiring one
+type WSAuthPayload struct {
+	Token string `json:"token"`
+}
+
+// WSSendPayload posts a new message; Room defaults to the room joined in the handshake
+type WSSendPayload struct {
+	Room    string `json:"room,omitempty"`
+	Content string `json:"content"`
+}
+
+// WSEditPayload replaces the content of a message
+type WSEditPayload struct {
+	MessageID uuid.UUID `json:"message_id"`
+	Content   string    `json:"content"`
+}
+
+// WSDeletePayload deletes a message
+type WSDeletePayload struct {
+	MessageID uuid.UUID `json:"message_id"`
+}
+
+// WSTypingPayload signals that the user started or stopped typing in a room
+type WSTypingPayload struct {
+	Room   string `json:"room,omitempty"`
+	Typing bool   `json:"typing"`
+}
+
+// WSReadPayload marks a room as read up to and including a message
+type WSReadPayload struct {
+	Room      string    `json:"room,omitempty"`
+	MessageID uuid.UUID `json:"message_id"`
+}
+
+// WSReadEventPayload reports how far a participant has read in a room
+type WSReadEventPayload struct {
+	Room      string    `json:"room"`
+	UserID    string    `json:"user_id"`
+	Name      string    `json:"name"`
+	MessageID uuid.UUID `json:"message_id"`
 	ReadAt    time.Time `json:"read_at"`
 }
 
-// WSMessage represents a WebSocket message structure
-type WSMessage struct {
-	Type      string      `json:"type"`
-	ChatID    uuid.UUID   `json:"chat_id"`
-	MessageID uuid.UUID   `json:"message_id,omitempty"`
-	UserID    uuid.UUID   `json:"user_id"`
-	Content   string      `json:"content,omitempty"`
-	Timestamp time.Time   `json:"timestamp"`
-	Mentions  []uuid.UUID `json:"mentions,omitempty"`
-}
\ No newline at end of file
+// WSReactPayload puts an emoji on a message or takes it off
+type WSReactPayload struct {
+	MessageID uuid.UUID `json:"message_id"`
+	Emoji     string    `json:"emoji"`
+}
+
+// WSReactionEventPayload reports that a user added or removed a reaction, with the message's
+// reaction counts after the change
+type WSReactionEventPayload struct {
+	Room      string          `json:"room"`
+	MessageID uuid.UUID       `json:"message_id"`
+	UserID    string          `json:"user_id"`
+	Name      string          `json:"name"`
+	Emoji     string          `json:"emoji"`
+	Reactions []ReactionCount `json:"reactions"`
+}
+
+// WSRoomPayload names the room to subscribe to or unsubscribe from
+type WSRoomPayload struct {
+	Room       string `json:"room"`
+	ResumeFrom int64  `json:"resume_from,omitempty"` // Subscribe only: replay every message after this sequence number instead of the recent history
+}
+
+// WSLoadMorePayload asks for the page of history before a message
+type WSLoadMorePayload struct {
+	Room     string `json:"room,omitempty"`
+	BeforeID string `json:"before_id"`
+	Limit    int    `json:"limit,omitempty"`
+}
+
+// WSAckPayload confirms a frame was processed
+type WSAckPayload struct {
+	MessageID string `json:"message_id,omitempty"` // ID of the persisted message for send frames
+	Count     int    `json:"count,omitempty"`      // Number of messages delivered for load_more and subscribe frames
+}
+
+// WSPresencePayload reports a user's presence; it is also the entry type of the presence roster
+type WSPresencePayload struct {
+	UserID   string    `json:"user_id"`
+	Name     string    `json:"name"`
+	Status   string    `json:"status"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// WSTypingEventPayload reports that a user started or stopped typing in a room
+type WSTypingEventPayload struct {
+	Room   string `json:"room"`
+	UserID string `json:"user_id"`
+	Name   string `json:"name"`
+}
+
+// WSSessionPayload starts every connection. ResumeToken lets the client resume the connection
+// without gaps if the server closes it for being too slow; Resumed reports whether this connection
+// resumed one, in which case the Replayed frames it missed follow.
+type WSSessionPayload struct {
+	ResumeToken string `json:"resume_token"`
+	Policy      string `json:"policy"` // What happens when the client falls behind: drop_oldest, coalesce, disconnect or spill
+	Resumed     bool   `json:"resumed"`
+	Replayed    int    `json:"replayed,omitempty"`
+}
+
+// WSNoticePayload is a message only shown to one user, such as the reply to a slash command or
+// a reminder; it is not stored
+type WSNoticePayload struct {
+	Room    string `json:"room"`
+	Command string `json:"command,omitempty"` // Command the notice answers, without the "/"
+	Content string `json:"content"`
+}
+
+// WSMentionPayload tells a user they were mentioned in a message. It is sent to every connection
+// of the user, whichever rooms the connection joined.
+type WSMentionPayload struct {
+	MentionID uuid.UUID `json:"mention_id"`
+	MessageID uuid.UUID `json:"message_id"`
+	Room      string    `json:"room"` // Conversation the message was posted in
+	ClientID  uuid.UUID `json:"client_id"`
+	Sender    string    `json:"sender"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WSErrorPayload reports why a frame was rejected
+type WSErrorPayload struct {
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	RetryAfter int    `json:"retry_after,omitempty"` // Seconds to wait before sending again, on rate_limited and muted errors
+}
@@ -15,10 +15,14 @@ type Client struct {
 	Phone     string    `gorm:"type:varchar(20)" json:"phone"`
 	Company   string    `gorm:"type:varchar(100)" json:"company"`
 	Notes     string    `gorm:"type:text" json:"notes"`
+	OwnerID   *uuid.UUID `gorm:"type:uuid;index" json:"ownerId,omitempty"` // User responsible for the client, set with /assign
+	TeamID    *uuid.UUID `gorm:"type:uuid;index" json:"teamId,omitempty"` // Team working on the client, whose members can access it
 	CreatedAt time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"createdAt"`
 	UpdatedAt time.Time `gorm:"default:CURRENT_TIMESTAMP;autoUpdateTime" json:"updatedAt"`
 	
 	// Relations
+	Owner         *User           `gorm:"foreignKey:OwnerID" json:"owner,omitempty"`
+	Team          *Team           `gorm:"foreignKey:TeamID" json:"team,omitempty"`
 	Messages      []Message       `gorm:"foreignKey:ClientID" json:"messages,omitempty"`
 	Emails        []Email         `gorm:"foreignKey:ClientID" json:"emails,omitempty"`
 	TimelineEvents []TimelineEvent `gorm:"foreignKey:ClientID" json:"timeline,omitempty"`
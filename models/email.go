@@ -29,8 +29,30 @@ func (ea *EmailAttachment) BeforeCreate(tx *gorm.DB) error {
         return nil
 }
 
+// EmailDraft is an email to a client started in chat with /email, to be completed and sent from
+// the email service
+type EmailDraft struct {
+        ID        uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+        ClientID  uuid.UUID `gorm:"type:uuid;not null;index" json:"clientId"`
+        UserID    uuid.UUID `gorm:"type:uuid;not null;index" json:"userId"`
+        To        string    `gorm:"type:varchar(255);not null" json:"to"`
+        Subject   string    `gorm:"type:varchar(255);not null" json:"subject"`
+        Body      string    `gorm:"type:text" json:"body"`
+        CreatedAt time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"createdAt"`
+        UpdatedAt time.Time `gorm:"default:CURRENT_TIMESTAMP;autoUpdateTime" json:"updatedAt"`
+}
+
+// BeforeCreate is called before inserting a new email draft into the database
+func (d *EmailDraft) BeforeCreate(tx *gorm.DB) error {
+        // Generate UUID if not set
+        if d.ID == uuid.Nil {
+                d.ID = uuid.New()
+        }
+        return nil
+}
+
 // AfterCreate is called after inserting a new email into the database
-// It creates a timeline event for the email
+// It creates a timeline event for the email and queues webhooks
 func (e *Email) AfterCreate(tx *gorm.DB) error {
         timelineEvent := TimelineEvent{
                 EventType:     "email",
@@ -43,5 +65,8 @@ func (e *Email) AfterCreate(tx *gorm.DB) error {
                 EventTime:     time.Now(),
         }
         
-        return tx.Create(&timelineEvent).Error
+        if err := tx.Create(&timelineEvent).Error; err != nil {
+                return err
+        }
+        return EnqueueWebhooks(tx, WebhookEmailCreated, e.ClientID, e.webhookData())
 }
\ No newline at end of file
@@ -0,0 +1,85 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// UserMentions returns a page of the mentions of a user, newest first, with their messages and
+// senders loaded. visible restricts the messages.client_id column to the clients the user may see,
+// so that mentions in clients the user lost access to are left out. With after set, the page starts
+// after that mention; with unseenOnly, mentions the user already marked seen are left out.
+func UserMentions(db *gorm.DB, userID uuid.UUID, visible func(*gorm.DB) *gorm.DB, unseenOnly bool, after *MessageMention, limit int) ([]MessageMention, error) {
+	scope := visibleMentions(db, userID, visible)
+	if unseenOnly {
+		scope = scope.Where("message_mentions.seen_at IS NULL")
+	}
+	if after != nil {
+		scope = scope.Where("message_mentions.created_at < ? OR (message_mentions.created_at = ? AND message_mentions.id < ?)",
+			after.CreatedAt, after.CreatedAt, after.ID)
+	}
+
+	var mentions []MessageMention
+	err := withMentionMessage(scope).
+		Select("message_mentions.*").
+		Order("message_mentions.created_at DESC, message_mentions.id DESC").
+		Limit(limit).
+		Find(&mentions).Error
+	return mentions, err
+}
+
+// MentionsByID loads mentions with their messages and senders, as they are sent to the users
+// mentioned
+func MentionsByID(db *gorm.DB, ids []uuid.UUID) ([]MessageMention, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	var mentions []MessageMention
+	err := withMentionMessage(db).Where("id IN ?", ids).Find(&mentions).Error
+	return mentions, err
+}
+
+// MessageMentions loads the mentions of a message with the message and its sender
+func MessageMentions(db *gorm.DB, messageID uuid.UUID) ([]MessageMention, error) {
+	var mentions []MessageMention
+	err := withMentionMessage(db).Where("message_id = ?", messageID).Find(&mentions).Error
+	return mentions, err
+}
+
+// withMentionMessage preloads the message of mentions, with its sender and mentioned users
+func withMentionMessage(db *gorm.DB) *gorm.DB {
+	return db.Preload("Message").
+		Preload("Message.Sender").
+		Preload("Message.Mentions.User")
+}
+
+// visibleMentions scopes a query to the mentions of a user in messages of the clients visible
+// lets through, see UserMentions
+func visibleMentions(db *gorm.DB, userID uuid.UUID, visible func(*gorm.DB) *gorm.DB) *gorm.DB {
+	return db.Model(&MessageMention{}).
+		Joins("JOIN messages ON messages.id = message_mentions.message_id").
+		Where("message_mentions.user_id = ?", userID).
+		Scopes(visible)
+}
+
+// UnseenMentionCount returns how many mentions of a user, in the clients visible lets through, are
+// not marked seen
+func UnseenMentionCount(db *gorm.DB, userID uuid.UUID, visible func(*gorm.DB) *gorm.DB) (int64, error) {
+	var count int64
+	err := visibleMentions(db, userID, visible).Where("message_mentions.seen_at IS NULL").Count(&count).Error
+	return count, err
+}
+
+// MarkMentionsSeen marks mentions of a user seen, or every unseen mention of the user when ids is
+// empty, and returns how many were marked. Mentions of other users are never marked.
+func MarkMentionsSeen(db *gorm.DB, userID uuid.UUID, ids []uuid.UUID, at time.Time) (int64, error) {
+	scope := db.Model(&MessageMention{}).Where("user_id = ? AND seen_at IS NULL", userID)
+	if len(ids) > 0 {
+		scope = scope.Where("id IN ?", ids)
+	}
+	result := scope.Update("seen_at", at)
+	return result.RowsAffected, result.Error
+}
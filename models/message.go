@@ -1,6 +1,8 @@
 package models
 
 import (
+        "errors"
+        "fmt"
         "time"
 
         "github.com/google/uuid"
@@ -13,36 +15,97 @@ type Message struct {
         Content   string    `gorm:"type:text;not null" json:"content"`
         SenderID  uuid.UUID `gorm:"type:uuid;not null" json:"senderId"`
         ClientID  uuid.UUID `gorm:"type:uuid;not null" json:"clientId"`
+        ThreadID  *uuid.UUID `gorm:"type:uuid;index" json:"threadId,omitempty"` // Set when the message belongs to a ChatThread
+        ParentID  *uuid.UUID `gorm:"type:uuid;index" json:"parentId,omitempty"` // Set on replies to another message
+        Seq       int64     `gorm:"not null;default:0;index" json:"seq"` // Position in its conversation, see RoomSequence
+        ReplyCount  int        `gorm:"not null;default:0" json:"replyCount"`
+        LastReplyAt *time.Time `json:"lastReplyAt,omitempty"`
+        EditedAt  *time.Time `json:"editedAt,omitempty"` // Set when the content was last edited
+        DeletedAt *time.Time `gorm:"index" json:"deletedAt,omitempty"` // Set when the message was deleted; its content is redacted
+        DeletedBy *uuid.UUID `gorm:"type:uuid" json:"deletedBy,omitempty"`
         CreatedAt time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"createdAt"`
         UpdatedAt time.Time `gorm:"default:CURRENT_TIMESTAMP;autoUpdateTime" json:"updatedAt"`
         
         // Relations
         Sender   User          `gorm:"foreignKey:SenderID" json:"sender"`
         Client   Client        `gorm:"foreignKey:ClientID" json:"client"`
+        Deleter  *User         `gorm:"foreignKey:DeletedBy" json:"-"`
         Mentions []MessageMention `gorm:"foreignKey:MessageID" json:"mentions,omitempty"`
+        Revisions []MessageRevision `gorm:"foreignKey:MessageID" json:"-"`
 }
 
+// ErrInvalidParent is returned when a reply names a parent message that does not exist, is
+// deleted, is itself a reply, or belongs to another client
+var ErrInvalidParent = errors.New("invalid parent message")
+
 // MessageMention represents a mention of a user in a message
 type MessageMention struct {
         ID        uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
         MessageID uuid.UUID `gorm:"type:uuid;not null" json:"messageId"`
-        UserID    uuid.UUID `gorm:"type:uuid;not null" json:"userId"`
-        CreatedAt time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"createdAt"`
+        UserID    uuid.UUID `gorm:"type:uuid;not null;index:idx_message_mentions_user" json:"userId"`
+        CreatedAt time.Time `gorm:"default:CURRENT_TIMESTAMP;index:idx_message_mentions_user" json:"createdAt"`
+        SeenAt    *time.Time `json:"seenAt,omitempty"` // Set once the mentioned user marked the mention seen
         
         // Relations
         Message Message `gorm:"foreignKey:MessageID" json:"-"`
         User    User    `gorm:"foreignKey:UserID" json:"user"`
 }
 
+// MessageRevision keeps the content a message had before an edit
+type MessageRevision struct {
+        ID        uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+        MessageID uuid.UUID `gorm:"type:uuid;not null;index" json:"messageId"`
+        Content   string    `gorm:"type:text;not null" json:"content"`
+        EditedBy  uuid.UUID `gorm:"type:uuid;not null" json:"editedBy"`
+        CreatedAt time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"createdAt"` // When this content was replaced
+
+        // Relations
+        Editor User `gorm:"foreignKey:EditedBy" json:"editor"`
+}
+
 // BeforeCreate is called before inserting a new message into the database
 func (m *Message) BeforeCreate(tx *gorm.DB) error {
         // Generate UUID if not set
         if m.ID == uuid.Nil {
                 m.ID = uuid.New()
         }
+
+        // Replies go to a live top-level message and join its conversation
+        if m.ParentID != nil {
+                var parent Message
+                if err := tx.Where("id = ?", *m.ParentID).First(&parent).Error; err != nil {
+                        if errors.Is(err, gorm.ErrRecordNotFound) {
+                                return fmt.Errorf("%w: %s not found", ErrInvalidParent, *m.ParentID)
+                        }
+                        return err
+                }
+                if parent.ParentID != nil || parent.IsDeleted() || parent.ClientID != m.ClientID {
+                        return fmt.Errorf("%w: cannot reply to %s", ErrInvalidParent, parent.ID)
+                }
+                m.ThreadID = parent.ThreadID
+        }
+
+        // Number the message within its conversation
+        seq, err := NextSeq(tx, m.ConversationID())
+        if err != nil {
+                return fmt.Errorf("failed to number message: %w", err)
+        }
+        m.Seq = seq
         return nil
 }
 
+// ConversationID identifies the conversation a message belongs to: the reply thread of its parent,
+// its chat thread, or the client's main channel
+func (m *Message) ConversationID() uuid.UUID {
+        if m.ParentID != nil {
+                return *m.ParentID
+        }
+        if m.ThreadID != nil {
+                return *m.ThreadID
+        }
+        return m.ClientID
+}
+
 // BeforeCreate is called before inserting a new message mention into the database
 func (mm *MessageMention) BeforeCreate(tx *gorm.DB) error {
         // Generate UUID if not set
@@ -52,12 +115,184 @@ func (mm *MessageMention) BeforeCreate(tx *gorm.DB) error {
         return nil
 }
 
+// BeforeCreate is called before inserting a new message revision into the database
+func (mr *MessageRevision) BeforeCreate(tx *gorm.DB) error {
+        // Generate UUID if not set
+        if mr.ID == uuid.Nil {
+                mr.ID = uuid.New()
+        }
+        return nil
+}
+
+// Edit replaces the content of a message, keeping the previous content as a revision, and brings
+// its mentions and timeline event in line with the new content. mentionIDs are the users mentioned
+// in the new content. It returns the mentions of users who were not mentioned before, so they can
+// be notified, and should run inside a transaction.
+func (m *Message) Edit(tx *gorm.DB, editorID uuid.UUID, content string, mentionIDs []uuid.UUID) ([]MessageMention, error) {
+        revision := MessageRevision{
+                MessageID: m.ID,
+                Content:   m.Content,
+                EditedBy:  editorID,
+        }
+        if err := tx.Create(&revision).Error; err != nil {
+                return nil, err
+        }
+
+        now := time.Now()
+        if err := tx.Model(m).Updates(map[string]interface{}{"content": content, "edited_at": now}).Error; err != nil {
+                return nil, err
+        }
+        m.Content = content
+        m.EditedAt = &now
+
+        // Drop mentions that are no longer in the content and add the new ones
+        removed := tx.Where("message_id = ?", m.ID)
+        if len(mentionIDs) > 0 {
+                removed = removed.Where("user_id NOT IN ?", mentionIDs)
+        }
+        if err := removed.Delete(&MessageMention{}).Error; err != nil {
+                return nil, err
+        }
+
+        var existing []MessageMention
+        if err := tx.Where("message_id = ?", m.ID).Find(&existing).Error; err != nil {
+                return nil, err
+        }
+        mentioned := make(map[uuid.UUID]bool, len(existing))
+        for _, mention := range existing {
+                mentioned[mention.UserID] = true
+        }
+        var added []MessageMention
+        for _, userID := range mentionIDs {
+                if mentioned[userID] {
+                        continue
+                }
+                mentioned[userID] = true
+                mention := MessageMention{MessageID: m.ID, UserID: userID}
+                if err := tx.Create(&mention).Error; err != nil {
+                        return nil, err
+                }
+                added = append(added, mention)
+        }
+
+        // Keep the timeline entry for the message in step with its content
+        err := tx.Model(&TimelineEvent{}).
+                Where("eventable_type = ? AND eventable_id = ?", "Message", m.ID).
+                Update("content", content).Error
+        return added, err
+}
+
+// IsDeleted reports whether the message is a tombstone
+func (m *Message) IsDeleted() bool {
+        return m.DeletedAt != nil
+}
+
+// SoftDelete turns the message into a tombstone: its content and the content of its revisions
+// are redacted, its mentions and reactions are removed and its timeline event shows it was deleted. The row
+// itself is kept so the conversation shows where the message was. It should run inside a transaction.
+func (m *Message) SoftDelete(tx *gorm.DB, deletedBy uuid.UUID) error {
+        now := time.Now()
+        if err := tx.Model(m).Updates(map[string]interface{}{"content": "", "deleted_at": now, "deleted_by": deletedBy}).Error; err != nil {
+                return err
+        }
+        m.Content = ""
+        m.DeletedAt = &now
+        m.DeletedBy = &deletedBy
+
+        if err := tx.Model(&MessageRevision{}).Where("message_id = ?", m.ID).Update("content", "").Error; err != nil {
+                return err
+        }
+        if err := tx.Where("message_id = ?", m.ID).Delete(&MessageMention{}).Error; err != nil {
+                return err
+        }
+        if err := tx.Where("message_id = ?", m.ID).Delete(&Reaction{}).Error; err != nil {
+                return err
+        }
+
+        return tx.Model(&TimelineEvent{}).
+                Where("eventable_type = ? AND eventable_id = ?", "Message", m.ID).
+                Updates(map[string]interface{}{"title": "Message deleted", "content": "Message deleted"}).Error
+}
+
+// Purge permanently removes the message with its mentions, reactions, revisions and timeline events, and
+// records who purged it and why in the audit log. It should run inside a transaction.
+func (m *Message) Purge(tx *gorm.DB, actorID uuid.UUID, reason string) error {
+        // Replies to a purged message are kept and move to the main conversation, numbered after
+        // its messages so clients catching up on it by sequence number receive them
+        var replies []Message
+        if err := tx.Where("parent_id = ?", m.ID).Order("created_at, id").Find(&replies).Error; err != nil {
+                return err
+        }
+        for i := range replies {
+                reply := &replies[i]
+                reply.ParentID = nil
+                seq, err := NextSeq(tx, reply.ConversationID())
+                if err != nil {
+                        return fmt.Errorf("failed to renumber reply %s: %w", reply.ID, err)
+                }
+                if err := tx.Model(reply).UpdateColumns(map[string]interface{}{"parent_id": nil, "seq": seq}).Error; err != nil {
+                        return err
+                }
+        }
+        if err := tx.Where("message_id = ?", m.ID).Delete(&MessageMention{}).Error; err != nil {
+                return err
+        }
+        if err := tx.Where("message_id = ?", m.ID).Delete(&Reaction{}).Error; err != nil {
+                return err
+        }
+        if err := tx.Where("message_id = ?", m.ID).Delete(&MessageRevision{}).Error; err != nil {
+                return err
+        }
+        if err := tx.Where("eventable_type = ? AND eventable_id = ?", "Message", m.ID).Delete(&TimelineEvent{}).Error; err != nil {
+                return err
+        }
+        if err := tx.Delete(m).Error; err != nil {
+                return err
+        }
+        if m.ParentID != nil {
+                err := tx.Model(&Message{}).Where("id = ?", *m.ParentID).UpdateColumns(map[string]interface{}{
+                        "reply_count":   gorm.Expr("reply_count - 1"),
+                        "last_reply_at": gorm.Expr("(SELECT MAX(created_at) FROM messages WHERE parent_id = ?)", *m.ParentID),
+                }).Error
+                if err != nil {
+                        return err
+                }
+        }
+
+        audit := AuditLog{
+                ActorID:    actorID,
+                Action:     AuditActionPurgeMessage,
+                EntityType: "Message",
+                EntityID:   m.ID,
+                Reason:     reason,
+                Details:    fmt.Sprintf("client %s, sent by %s at %s", m.ClientID, m.SenderID, m.CreatedAt.Format(time.RFC3339)),
+        }
+        return tx.Create(&audit).Error
+}
+
 // AfterCreate is called after inserting a new message into the database
-// It creates a timeline event for the message
+// It creates a timeline event for the message, counts replies on their parent and queues webhooks
 func (m *Message) AfterCreate(tx *gorm.DB) error {
+        title := "New message sent"
+        if m.ParentID != nil {
+                title = "New reply sent"
+
+                repliedAt := m.CreatedAt
+                if repliedAt.IsZero() {
+                        repliedAt = time.Now()
+                }
+                err := tx.Model(&Message{}).Where("id = ?", *m.ParentID).UpdateColumns(map[string]interface{}{
+                        "reply_count":   gorm.Expr("reply_count + 1"),
+                        "last_reply_at": repliedAt,
+                }).Error
+                if err != nil {
+                        return err
+                }
+        }
+
         timelineEvent := TimelineEvent{
                 EventType:     "message",
-                Title:         "New message sent",
+                Title:         title,
                 Content:       m.Content,
                 ClientID:      m.ClientID,
                 UserID:        m.SenderID,
@@ -66,5 +301,8 @@ func (m *Message) AfterCreate(tx *gorm.DB) error {
                 EventTime:     time.Now(),
         }
         
-        return tx.Create(&timelineEvent).Error
+        if err := tx.Create(&timelineEvent).Error; err != nil {
+                return err
+        }
+        return EnqueueWebhooks(tx, WebhookMessageCreated, m.ClientID, m.webhookData())
 }
\ No newline at end of file
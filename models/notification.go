@@ -0,0 +1,177 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Kinds of notification
+const (
+	NotificationMention    = "mention"
+	NotificationAssignment = "assignment"
+)
+
+// Notification is something a user missed while offline, waiting to be sent in their next digest
+type Notification struct {
+	ID        uuid.UUID  `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	UserID    uuid.UUID  `json:"user_id" gorm:"type:uuid;not null;index"`
+	Kind      string     `json:"kind" gorm:"type:varchar(20);not null"`
+	ClientID  uuid.UUID  `json:"client_id" gorm:"type:uuid;not null"`
+	MentionID *uuid.UUID `json:"mention_id,omitempty" gorm:"type:uuid"` // Set on mentions
+	Title     string     `json:"title" gorm:"type:varchar(255);not null"`
+	Body      string     `json:"body" gorm:"type:text"`
+	CreatedAt time.Time  `json:"created_at" gorm:"default:CURRENT_TIMESTAMP"`
+	SentAt    *time.Time `json:"sent_at,omitempty" gorm:"index"` // Set once the notification went out in a digest
+}
+
+// NotificationPreference is how a user wants to be notified of what they missed. Users without a
+// row get DefaultNotificationPreference.
+type NotificationPreference struct {
+	UserID      uuid.UUID `json:"user_id" gorm:"type:uuid;primary_key"`
+	Mentions    bool      `json:"mentions" gorm:"not null"`           // Digests include mentions
+	Assignments bool      `json:"assignments" gorm:"not null"`        // Digests include clients assigned to the user
+	QuietStart  string    `json:"quiet_start" gorm:"type:varchar(5)"` // "22:00"; no digest is sent from QuietStart to QuietEnd
+	QuietEnd    string    `json:"quiet_end" gorm:"type:varchar(5)"`   // "07:30"
+	TimeZone    string    `json:"time_zone" gorm:"type:varchar(64);not null"`
+	UpdatedAt   time.Time `json:"updated_at" gorm:"default:CURRENT_TIMESTAMP;autoUpdateTime"`
+}
+
+// ChannelPreference overrides a user's preferences for one client's conversations
+type ChannelPreference struct {
+	UserID   uuid.UUID `json:"user_id" gorm:"type:uuid;primary_key"`
+	ClientID uuid.UUID `json:"client_id" gorm:"type:uuid;primary_key"`
+	Muted    bool      `json:"muted" gorm:"not null"` // Nothing from the client's conversations is queued
+}
+
+// DefaultNotificationPreference returns the preferences of a user who never set any
+func DefaultNotificationPreference(userID uuid.UUID) NotificationPreference {
+	return NotificationPreference{UserID: userID, Mentions: true, Assignments: true, TimeZone: "UTC"}
+}
+
+// BeforeCreate is called before inserting a new notification into the database
+func (n *Notification) BeforeCreate(tx *gorm.DB) error {
+	// Generate UUID if not set
+	if n.ID == uuid.Nil {
+		n.ID = uuid.New()
+	}
+	return nil
+}
+
+// Allows reports whether the preferences let a kind of notification be queued
+func (p NotificationPreference) Allows(kind string) bool {
+	switch kind {
+	case NotificationMention:
+		return p.Mentions
+	case NotificationAssignment:
+		return p.Assignments
+	}
+	return true
+}
+
+// Quiet reports whether t falls in the user's quiet hours. Quiet hours may span midnight; without
+// both ends set there are none.
+func (p NotificationPreference) Quiet(t time.Time) (bool, error) {
+	if p.QuietStart == "" || p.QuietEnd == "" {
+		return false, nil
+	}
+	loc, err := time.LoadLocation(p.TimeZone)
+	if err != nil {
+		return false, err
+	}
+	start, err := ParseClock(p.QuietStart)
+	if err != nil {
+		return false, err
+	}
+	end, err := ParseClock(p.QuietEnd)
+	if err != nil {
+		return false, err
+	}
+
+	local := t.In(loc)
+	now := local.Hour()*60 + local.Minute()
+	if start <= end {
+		return now >= start && now < end, nil
+	}
+	return now >= start || now < end, nil
+}
+
+// ParseClock reads a time of day written as "HH:MM" and returns it in minutes after midnight
+func ParseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, use HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// NotificationPreferenceFor returns a user's preferences, or the defaults if they never set any
+func NotificationPreferenceFor(db *gorm.DB, userID uuid.UUID) (NotificationPreference, error) {
+	var prefs []NotificationPreference
+	if err := db.Where("user_id = ?", userID).Limit(1).Find(&prefs).Error; err != nil {
+		return NotificationPreference{}, err
+	}
+	if len(prefs) == 0 {
+		return DefaultNotificationPreference(userID), nil
+	}
+	return prefs[0], nil
+}
+
+// ChannelMuted reports whether a user muted a client's conversations
+func ChannelMuted(db *gorm.DB, userID, clientID uuid.UUID) (bool, error) {
+	var count int64
+	err := db.Model(&ChannelPreference{}).
+		Where("user_id = ? AND client_id = ? AND muted", userID, clientID).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// PendingNotificationUsers returns the users with notifications waiting for a digest
+func PendingNotificationUsers(db *gorm.DB) ([]uuid.UUID, error) {
+	var userIDs []uuid.UUID
+	err := db.Model(&Notification{}).Where("sent_at IS NULL").Distinct().Pluck("user_id", &userIDs).Error
+	return userIDs, err
+}
+
+// ClaimNotifications marks a user's pending notifications as sent and returns them, oldest first.
+// Rows claimed by another node are skipped, so each notification is returned once.
+func ClaimNotifications(db *gorm.DB, userID uuid.UUID, now time.Time) ([]Notification, error) {
+	var claimed []Notification
+	err := db.Raw(`UPDATE notifications SET sent_at = ? WHERE id IN (
+		SELECT id FROM notifications WHERE sent_at IS NULL AND user_id = ?
+		FOR UPDATE SKIP LOCKED
+	) RETURNING *`, now, userID).Scan(&claimed).Error
+	// RETURNING gives no order
+	sort.Slice(claimed, func(i, j int) bool { return claimed[i].CreatedAt.Before(claimed[j].CreatedAt) })
+	return claimed, err
+}
+
+// ReleaseNotifications puts claimed notifications back in the queue, after a digest failed to send
+func ReleaseNotifications(db *gorm.DB, notifications []Notification) error {
+	ids := make([]uuid.UUID, 0, len(notifications))
+	for _, n := range notifications {
+		ids = append(ids, n.ID)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return db.Model(&Notification{}).Where("id IN ?", ids).Update("sent_at", nil).Error
+}
+
+// MutedClients returns the clients whose conversations a user muted
+func MutedClients(db *gorm.DB, userID uuid.UUID) ([]uuid.UUID, error) {
+	clientIDs := []uuid.UUID{}
+	err := db.Model(&ChannelPreference{}).Where("user_id = ? AND muted", userID).Order("client_id").Pluck("client_id", &clientIDs).Error
+	return clientIDs, err
+}
+
+// SetChannelMuted mutes or unmutes a client's conversations for a user
+func SetChannelMuted(db *gorm.DB, userID, clientID uuid.UUID, muted bool) error {
+	if !muted {
+		return db.Where("user_id = ? AND client_id = ?", userID, clientID).Delete(&ChannelPreference{}).Error
+	}
+	return db.Save(&ChannelPreference{UserID: userID, ClientID: clientID, Muted: true}).Error
+}
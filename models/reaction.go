@@ -0,0 +1,126 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// maxEmojiLength caps the size of a reaction in bytes; it fits emoji built from several code
+// points, such as flags and skin tone or ZWJ sequences
+const maxEmojiLength = 32
+
+// ErrInvalidReaction is returned when a reaction is empty, too long, contains spaces or targets
+// a deleted message
+var ErrInvalidReaction = errors.New("invalid reaction")
+
+// Reaction is an emoji a user put on a message. A user can put each emoji on a message once.
+type Reaction struct {
+	ID        uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	MessageID uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_reactions_message_user_emoji" json:"messageId"`
+	UserID    uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_reactions_message_user_emoji" json:"userId"`
+	Emoji     string    `gorm:"type:varchar(32);not null;uniqueIndex:idx_reactions_message_user_emoji" json:"emoji"`
+	CreatedAt time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"createdAt"`
+
+	// Relations
+	User User `gorm:"foreignKey:UserID" json:"user"`
+}
+
+// ReactionCount is how many users put an emoji on a message, and who they are
+type ReactionCount struct {
+	Emoji   string      `json:"emoji"`
+	Count   int         `json:"count"`
+	UserIDs []uuid.UUID `json:"user_ids"`
+}
+
+// BeforeCreate is called before inserting a new reaction into the database
+func (r *Reaction) BeforeCreate(tx *gorm.DB) error {
+	// Generate UUID if not set
+	if r.ID == uuid.Nil {
+		r.ID = uuid.New()
+	}
+	return nil
+}
+
+// ValidateEmoji checks that a reaction is a single short token
+func ValidateEmoji(emoji string) error {
+	if emoji == "" || len(emoji) > maxEmojiLength || strings.IndexFunc(emoji, unicode.IsSpace) >= 0 {
+		return fmt.Errorf("%w: %q", ErrInvalidReaction, emoji)
+	}
+	return nil
+}
+
+// AddReaction puts an emoji on a message for a user. It reports false, without an error, when
+// the user had already reacted with that emoji. Reactions do not create timeline events.
+func AddReaction(db *gorm.DB, message *Message, userID uuid.UUID, emoji string) (bool, error) {
+	if err := ValidateEmoji(emoji); err != nil {
+		return false, err
+	}
+	if message.IsDeleted() {
+		return false, fmt.Errorf("%w: message %s is deleted", ErrInvalidReaction, message.ID)
+	}
+
+	result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&Reaction{
+		MessageID: message.ID,
+		UserID:    userID,
+		Emoji:     emoji,
+	})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// RemoveReaction takes a user's emoji off a message. It reports false, without an error, when
+// there was no such reaction.
+func RemoveReaction(db *gorm.DB, messageID, userID uuid.UUID, emoji string) (bool, error) {
+	result := db.Where("message_id = ? AND user_id = ? AND emoji = ?", messageID, userID, emoji).Delete(&Reaction{})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// ReactionCounts aggregates the reactions on each of the given messages. Emoji are listed in
+// the order they were first used on a message; messages without reactions are omitted.
+func ReactionCounts(db *gorm.DB, messageIDs []uuid.UUID) (map[uuid.UUID][]ReactionCount, error) {
+	counts := make(map[uuid.UUID][]ReactionCount)
+	if len(messageIDs) == 0 {
+		return counts, nil
+	}
+
+	var reactions []Reaction
+	if err := db.Where("message_id IN ?", messageIDs).Order("created_at ASC, id ASC").Find(&reactions).Error; err != nil {
+		return nil, err
+	}
+
+	for _, reaction := range reactions {
+		summary := counts[reaction.MessageID]
+		i := 0
+		for i < len(summary) && summary[i].Emoji != reaction.Emoji {
+			i++
+		}
+		if i == len(summary) {
+			summary = append(summary, ReactionCount{Emoji: reaction.Emoji})
+		}
+		summary[i].Count++
+		summary[i].UserIDs = append(summary[i].UserIDs, reaction.UserID)
+		counts[reaction.MessageID] = summary
+	}
+	return counts, nil
+}
+
+// MessageReactionCounts aggregates the reactions on one message
+func MessageReactionCounts(db *gorm.DB, messageID uuid.UUID) ([]ReactionCount, error) {
+	counts, err := ReactionCounts(db, []uuid.UUID{messageID})
+	if err != nil {
+		return nil, err
+	}
+	return counts[messageID], nil
+}
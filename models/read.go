@@ -0,0 +1,100 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// MessageRead is a user's read marker in a conversation: the latest message they have read in
+// a client's channel, a chat thread or the replies to a message. There is one row per user per conversation and the
+// marker only ever moves forward.
+type MessageRead struct {
+	ID               uuid.UUID  `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	UserID           uuid.UUID  `json:"user_id" gorm:"type:uuid;not null;uniqueIndex:idx_message_reads_user_conversation"`
+	ConversationID   uuid.UUID  `json:"conversation_id" gorm:"type:uuid;not null;uniqueIndex:idx_message_reads_user_conversation"`
+	ClientID         uuid.UUID  `json:"client_id" gorm:"type:uuid;not null;index"`
+	ThreadID         *uuid.UUID `json:"thread_id,omitempty" gorm:"type:uuid"`
+	ParentID         *uuid.UUID `json:"parent_id,omitempty" gorm:"type:uuid"`
+	MessageID        uuid.UUID  `json:"message_id" gorm:"type:uuid;not null"`
+	MessageCreatedAt time.Time  `json:"message_created_at" gorm:"not null"` // Orders markers without loading the message
+	ReadAt           time.Time  `json:"read_at" gorm:"not null"`
+
+	// Relations
+	User User `gorm:"foreignKey:UserID" json:"user"`
+}
+
+// UnreadCount is the number of messages from other users after a user's read marker in one conversation
+type UnreadCount struct {
+	ClientID uuid.UUID  `json:"client_id"`
+	ThreadID *uuid.UUID `json:"thread_id,omitempty"`
+	ParentID *uuid.UUID `json:"parent_id,omitempty"`
+	Count    int        `json:"count"`
+}
+
+// BeforeCreate is called before inserting a new read marker into the database
+func (mr *MessageRead) BeforeCreate(tx *gorm.DB) error {
+	// Generate UUID if not set
+	if mr.ID == uuid.Nil {
+		mr.ID = uuid.New()
+	}
+	return nil
+}
+
+// MarkRead moves a user's read marker in the message's conversation up to the message.
+// It reports false, without an error, when the marker was already at or past it.
+func MarkRead(db *gorm.DB, userID uuid.UUID, message *Message) (*MessageRead, bool, error) {
+	read := &MessageRead{
+		UserID:           userID,
+		ConversationID:   message.ConversationID(),
+		ClientID:         message.ClientID,
+		ThreadID:         message.ThreadID,
+		ParentID:         message.ParentID,
+		MessageID:        message.ID,
+		MessageCreatedAt: message.CreatedAt,
+		ReadAt:           time.Now(),
+	}
+
+	result := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "conversation_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"message_id", "message_created_at", "read_at"}),
+		Where: clause.Where{Exprs: []clause.Expression{
+			clause.Expr{SQL: "(message_reads.message_created_at, message_reads.message_id) < (excluded.message_created_at, excluded.message_id)"},
+		}},
+	}).Create(read)
+	if result.Error != nil {
+		return nil, false, result.Error
+	}
+	return read, result.RowsAffected > 0, nil
+}
+
+// ReadMarkers returns the read markers of every user in a conversation
+func ReadMarkers(db *gorm.DB, conversationID uuid.UUID) ([]MessageRead, error) {
+	var reads []MessageRead
+	err := db.Preload("User").
+		Where("conversation_id = ?", conversationID).
+		Order("message_created_at DESC").
+		Find(&reads).Error
+	return reads, err
+}
+
+// UnreadCounts counts, per conversation, the messages from other users that a user has not
+// read. A nil clientID counts across all clients; conversations with nothing unread are omitted.
+func UnreadCounts(db *gorm.DB, userID uuid.UUID, clientID *uuid.UUID) ([]UnreadCount, error) {
+	query := db.Table("messages").
+		Select("messages.client_id, messages.thread_id, messages.parent_id, COUNT(*) AS count").
+		Joins("LEFT JOIN message_reads ON message_reads.user_id = ? AND message_reads.conversation_id = COALESCE(messages.parent_id, messages.thread_id, messages.client_id)", userID).
+		Where("messages.sender_id <> ? AND messages.deleted_at IS NULL", userID).
+		Where("message_reads.id IS NULL OR (messages.created_at, messages.id) > (message_reads.message_created_at, message_reads.message_id)")
+	if clientID != nil {
+		query = query.Where("messages.client_id = ?", *clientID)
+	}
+
+	var counts []UnreadCount
+	err := query.Group("messages.client_id, messages.thread_id, messages.parent_id").
+		Order("messages.client_id, messages.thread_id, messages.parent_id").
+		Scan(&counts).Error
+	return counts, err
+}
@@ -0,0 +1,44 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Reminder is a note a user asked to be shown again, with /remind, in the conversation they set it in
+type Reminder struct {
+	ID        uuid.UUID  `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	UserID    uuid.UUID  `json:"user_id" gorm:"type:uuid;not null;index"`
+	ClientID  uuid.UUID  `json:"client_id" gorm:"type:uuid;not null"`
+	Room      string     `json:"room" gorm:"type:varchar(36);not null"` // Conversation the reminder was set in
+	Content   string     `json:"content" gorm:"type:text;not null"`
+	DueAt     time.Time  `json:"due_at" gorm:"not null;index"`
+	SentAt    *time.Time `json:"sent_at,omitempty"` // Set once the reminder was delivered
+	CreatedAt time.Time  `json:"created_at" gorm:"default:CURRENT_TIMESTAMP"`
+}
+
+// BeforeCreate is called before inserting a new reminder into the database
+func (r *Reminder) BeforeCreate(tx *gorm.DB) error {
+	// Generate UUID if not set
+	if r.ID == uuid.Nil {
+		r.ID = uuid.New()
+	}
+	return nil
+}
+
+// ClaimDueReminders marks the reminders of the given users that are due as sent and returns them.
+// Rows claimed by another node are skipped, so each reminder is returned once.
+func ClaimDueReminders(db *gorm.DB, userIDs []uuid.UUID, now time.Time) ([]Reminder, error) {
+	if len(userIDs) == 0 {
+		return nil, nil
+	}
+
+	var due []Reminder
+	err := db.Raw(`UPDATE reminders SET sent_at = ? WHERE id IN (
+		SELECT id FROM reminders WHERE sent_at IS NULL AND due_at <= ? AND user_id IN ?
+		ORDER BY due_at FOR UPDATE SKIP LOCKED
+	) RETURNING *`, now, now, userIDs).Scan(&due).Error
+	return due, err
+}
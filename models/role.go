@@ -0,0 +1,55 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Role is a custom role an admin defined. The built-in roles (admin, manager, agent and
+// read-only) are not stored; see internal/rbac.
+type Role struct {
+	Name        string    `gorm:"type:varchar(20);primary_key" json:"name"` // The value of User.Role
+	Description string    `gorm:"type:text" json:"description"`
+	Permissions string    `gorm:"type:text;not null" json:"permissions"` // Comma-separated, such as "CLIENTS_READ,MESSAGES_WRITE"
+	CreatedAt   time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"createdAt"`
+	UpdatedAt   time.Time `gorm:"default:CURRENT_TIMESTAMP;autoUpdateTime" json:"updatedAt"`
+}
+
+// PermissionList returns the role's permissions
+func (r Role) PermissionList() []string {
+	var list []string
+	for _, p := range strings.Split(r.Permissions, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			list = append(list, p)
+		}
+	}
+	return list
+}
+
+// Team is a group of users working on the same clients. Users without access to every client
+// only see the clients of their teams and the clients they own.
+type Team struct {
+	ID        uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	Name      string    `gorm:"type:varchar(100);unique;not null" json:"name"`
+	CreatedAt time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"createdAt"`
+	UpdatedAt time.Time `gorm:"default:CURRENT_TIMESTAMP;autoUpdateTime" json:"updatedAt"`
+}
+
+// BeforeCreate is called before inserting a new team into the database
+func (t *Team) BeforeCreate(tx *gorm.DB) error {
+	// Generate UUID if not set
+	if t.ID == uuid.Nil {
+		t.ID = uuid.New()
+	}
+	return nil
+}
+
+// TeamMember puts a user in a team
+type TeamMember struct {
+	TeamID    uuid.UUID `gorm:"type:uuid;primary_key" json:"teamId"`
+	UserID    uuid.UUID `gorm:"type:uuid;primary_key;index" json:"userId"`
+	CreatedAt time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"createdAt"`
+}
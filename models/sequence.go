@@ -0,0 +1,61 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// RoomSequence holds the last sequence number given to a message in a conversation. Sequence
+// numbers start at 1 and grow by one with every message, so a client that knows the last number
+// it received can ask for exactly the messages it missed.
+type RoomSequence struct {
+	RoomID  uuid.UUID `gorm:"type:uuid;primary_key" json:"room_id"` // ConversationID of the numbered messages
+	LastSeq int64     `gorm:"not null" json:"last_seq"`
+}
+
+// NextSeq allocates the next sequence number of a conversation. The conversation's row stays
+// locked until tx commits, so messages are numbered in the order they are committed and a
+// rolled-back message leaves no gap.
+func NextSeq(tx *gorm.DB, roomID uuid.UUID) (int64, error) {
+	var seq int64
+	err := tx.Raw(`INSERT INTO room_sequences (room_id, last_seq) VALUES (?, 1)
+		ON CONFLICT (room_id) DO UPDATE SET last_seq = room_sequences.last_seq + 1
+		RETURNING last_seq`, roomID).Scan(&seq).Error
+	return seq, err
+}
+
+// BackfillSequences numbers the messages stored before they had sequence numbers, oldest first
+// after any already numbered message of their conversation. It is a no-op once every message has
+// one.
+func BackfillSequences(db *gorm.DB) error {
+	var unnumbered int64
+	if err := db.Model(&Message{}).Where("seq = 0").Count(&unnumbered).Error; err != nil {
+		return err
+	}
+	if unnumbered == 0 {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		// Keep other replicas from numbering messages while the counters are rebuilt
+		if err := tx.Exec("LOCK TABLE room_sequences IN EXCLUSIVE MODE").Error; err != nil {
+			return err
+		}
+
+		err := tx.Exec(`UPDATE messages SET seq = numbered.seq FROM (
+			SELECT m.id, COALESCE(rs.last_seq, 0) + ROW_NUMBER() OVER (
+				PARTITION BY COALESCE(m.parent_id, m.thread_id, m.client_id)
+				ORDER BY m.created_at, m.id) AS seq
+			FROM messages m
+			LEFT JOIN room_sequences rs ON rs.room_id = COALESCE(m.parent_id, m.thread_id, m.client_id)
+			WHERE m.seq = 0
+		) numbered WHERE messages.id = numbered.id`).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Exec(`INSERT INTO room_sequences (room_id, last_seq)
+			SELECT COALESCE(parent_id, thread_id, client_id), MAX(seq) FROM messages GROUP BY 1
+			ON CONFLICT (room_id) DO UPDATE SET last_seq = GREATEST(room_sequences.last_seq, excluded.last_seq)`).Error
+	})
+}
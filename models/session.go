@@ -0,0 +1,89 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Reasons a session was revoked
+const (
+	RevokedLogout           = "logout"            // The user signed the device out
+	RevokedLogoutEverywhere = "logout_everywhere" // The user signed every device out
+	RevokedReuse            = "reuse"             // A rotated refresh token was used again
+)
+
+// Session is a device a user signed in on. Every sign-in starts a session, and each refresh token
+// exchanged for a new one passes the session on, so the session is the family of refresh tokens
+// descending from that sign-in.
+type Session struct {
+	ID            uuid.UUID  `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	UserID        uuid.UUID  `json:"user_id" gorm:"type:uuid;not null;index"`
+	AuthProvider  string     `json:"auth_provider" gorm:"type:varchar(50);not null"`
+	UserAgent     string     `json:"user_agent" gorm:"type:text"`
+	IPAddress     string     `json:"ip_address" gorm:"type:varchar(64)"`     // Of the sign-in or the last refresh
+	ExpiresAt     time.Time  `json:"expires_at" gorm:"not null"`             // When its latest refresh token expires
+	LastUsedAt    time.Time  `json:"last_used_at" gorm:"not null"`           // When a refresh token was last issued
+	RevokedAt     *time.Time `json:"revoked_at,omitempty" gorm:"index"`      // Set once the session is signed out
+	RevokedReason string     `json:"revoked_reason" gorm:"type:varchar(20)"` // See RevokedLogout
+	CreatedAt     time.Time  `json:"created_at" gorm:"default:CURRENT_TIMESTAMP"`
+}
+
+// BeforeCreate is called before inserting a new session into the database
+func (s *Session) BeforeCreate(tx *gorm.DB) error {
+	// Generate UUID if not set
+	if s.ID == uuid.Nil {
+		s.ID = uuid.New()
+	}
+	return nil
+}
+
+// Active reports whether the session can still be refreshed at now
+func (s Session) Active(now time.Time) bool {
+	return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
+
+// ActiveSessions returns a user's sessions that are neither revoked nor expired, most recently
+// used first
+func ActiveSessions(db *gorm.DB, userID uuid.UUID, now time.Time) ([]Session, error) {
+	var sessions []Session
+	err := db.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, now).
+		Order("last_used_at DESC").
+		Find(&sessions).Error
+	return sessions, err
+}
+
+// RevokeSession signs out one of a user's sessions and deletes its refresh tokens, reporting
+// whether it was active
+func RevokeSession(db *gorm.DB, userID, sessionID uuid.UUID, reason string, now time.Time) (bool, error) {
+	n, err := revokeSessions(db, reason, now, "id = ? AND user_id = ?", sessionID, userID)
+	return n > 0, err
+}
+
+// RevokeUserSessions signs out every session of a user and deletes their refresh tokens, returning
+// how many were active
+func RevokeUserSessions(db *gorm.DB, userID uuid.UUID, reason string, now time.Time) (int64, error) {
+	return revokeSessions(db, reason, now, "user_id = ?", userID)
+}
+
+// revokeSessions revokes the sessions matching a condition that are not revoked yet
+func revokeSessions(db *gorm.DB, reason string, now time.Time, query string, args ...interface{}) (int64, error) {
+	var revoked int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var ids []uuid.UUID
+		if err := tx.Model(&Session{}).Where(query, args...).Where("revoked_at IS NULL").Pluck("id", &ids).Error; err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		if err := tx.Model(&Session{}).Where("id IN ?", ids).
+			Updates(map[string]interface{}{"revoked_at": now, "revoked_reason": reason}).Error; err != nil {
+			return err
+		}
+		revoked = int64(len(ids))
+		return tx.Where("session_id IN ?", ids).Delete(&RefreshToken{}).Error
+	})
+	return revoked, err
+}
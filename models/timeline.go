@@ -33,4 +33,10 @@ func (t *TimelineEvent) BeforeCreate(tx *gorm.DB) error {
                 t.ID = uuid.New()
         }
         return nil
-}
\ No newline at end of file
+}
+
+// AfterCreate is called after inserting a new timeline event into the database
+// It queues webhooks for the event
+func (t *TimelineEvent) AfterCreate(tx *gorm.DB) error {
+        return EnqueueWebhooks(tx, WebhookTimelineEventCreated, t.ClientID, t.webhookData())
+}
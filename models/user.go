@@ -14,13 +14,14 @@ type User struct {
 	Name      string    `gorm:"type:varchar(100);not null" json:"name"`
 	Email     string    `gorm:"type:varchar(100);unique;not null" json:"email"`
 	Password  string    `gorm:"type:varchar(100)" json:"-"` // Password is not exposed in JSON
-	Role      string    `gorm:"type:varchar(20);default:'user'" json:"role"`
+	Avatar    string    `gorm:"type:varchar(255)" json:"avatar"` // Picture of the Google account, if any
+	Role      string    `gorm:"type:varchar(20);default:'agent'" json:"role"`
 	CreatedAt time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"createdAt"`
 	UpdatedAt time.Time `gorm:"default:CURRENT_TIMESTAMP;autoUpdateTime" json:"updatedAt"`
 	
 	// Relations
 	Messages      []Message       `gorm:"foreignKey:SenderID" json:"-"`
-	Emails        []Email         `gorm:"foreignKey:SenderID" json:"-"`
+	Emails        []Email         `gorm:"foreignKey:UserID" json:"-"`
 	TimelineEvents []TimelineEvent `gorm:"foreignKey:UserID" json:"-"`
 }
 
@@ -0,0 +1,252 @@
+package models
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Events webhooks can subscribe to
+const (
+	WebhookMessageCreated       = "message.created"
+	WebhookEmailCreated         = "email.created"
+	WebhookTimelineEventCreated = "timeline_event.created"
+)
+
+// WebhookEvents lists every event webhooks can subscribe to
+var WebhookEvents = []string{WebhookMessageCreated, WebhookEmailCreated, WebhookTimelineEventCreated}
+
+// States of a webhook delivery
+const (
+	DeliveryPending   = "pending"   // Waiting for its next attempt
+	DeliveryDelivered = "delivered" // The receiver answered with a 2xx status
+	DeliveryFailed    = "failed"    // Given up on after the last attempt
+)
+
+// WebhookSubscription sends the events it subscribes to, as signed JSON, to a URL
+type WebhookSubscription struct {
+	ID        uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	URL       string     `gorm:"type:text;not null" json:"url"`
+	Events    string     `gorm:"type:text;not null" json:"events"`          // Comma-separated, see WebhookEvents
+	ClientID  *uuid.UUID `gorm:"type:uuid;index" json:"clientId,omitempty"` // Only this client's events when set
+	Secret    string     `gorm:"type:varchar(255);not null" json:"-"`       // Key of the HMAC signing each delivery
+	Active    bool       `gorm:"not null" json:"active"`
+	CreatedBy uuid.UUID  `gorm:"type:uuid;not null" json:"createdBy"`
+	CreatedAt time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"createdAt"`
+	UpdatedAt time.Time  `gorm:"default:CURRENT_TIMESTAMP;autoUpdateTime" json:"updatedAt"`
+}
+
+// WebhookDelivery is one event to send to one subscription, kept with the outcome of its last
+// attempt as the delivery log
+type WebhookDelivery struct {
+	ID             uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	SubscriptionID uuid.UUID  `gorm:"type:uuid;not null;index" json:"subscriptionId"`
+	Event          string     `gorm:"type:varchar(50);not null" json:"event"`
+	Payload        string     `gorm:"type:text;not null" json:"payload"` // The JSON body sent
+	Status         string     `gorm:"type:varchar(20);not null;index:idx_webhook_deliveries_due" json:"status"`
+	Attempts       int        `gorm:"not null;default:0" json:"attempts"`
+	NextAttemptAt  time.Time  `gorm:"not null;index:idx_webhook_deliveries_due" json:"nextAttemptAt"`
+	LastStatusCode int        `json:"lastStatusCode,omitempty"` // HTTP status of the last attempt, 0 if none was received
+	LastError      string     `gorm:"type:text" json:"lastError,omitempty"`
+	DeliveredAt    *time.Time `json:"deliveredAt,omitempty"`
+	CreatedAt      time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"createdAt"`
+	UpdatedAt      time.Time  `gorm:"default:CURRENT_TIMESTAMP;autoUpdateTime" json:"updatedAt"`
+}
+
+// WebhookPayload is the JSON body of a delivery
+type WebhookPayload struct {
+	ID        uuid.UUID   `json:"id"` // The delivery's ID, the same on every attempt
+	Event     string      `json:"event"`
+	ClientID  uuid.UUID   `json:"client_id"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// webhookMessage is the data of a message.created delivery
+type webhookMessage struct {
+	ID        uuid.UUID  `json:"id"`
+	ClientID  uuid.UUID  `json:"client_id"`
+	ThreadID  *uuid.UUID `json:"thread_id,omitempty"`
+	ParentID  *uuid.UUID `json:"parent_id,omitempty"`
+	SenderID  uuid.UUID  `json:"sender_id"`
+	Content   string     `json:"content"`
+	Seq       int64      `json:"seq"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// webhookEmail is the data of an email.created delivery
+type webhookEmail struct {
+	ID       uuid.UUID `json:"id"`
+	ClientID uuid.UUID `json:"client_id"`
+	UserID   uuid.UUID `json:"user_id"`
+	Subject  string    `json:"subject"`
+	From     string    `json:"from"`
+	To       string    `json:"to"`
+	Snippet  string    `json:"snippet"`
+	ThreadID string    `json:"thread_id"`
+	Received time.Time `json:"received"`
+}
+
+// webhookTimelineEvent is the data of a timeline_event.created delivery
+type webhookTimelineEvent struct {
+	ID            uuid.UUID `json:"id"`
+	ClientID      uuid.UUID `json:"client_id"`
+	UserID        uuid.UUID `json:"user_id"`
+	EventType     string    `json:"event_type"`
+	Title         string    `json:"title"`
+	Content       string    `json:"content"`
+	EventableType string    `json:"eventable_type"`
+	EventableID   uuid.UUID `json:"eventable_id"`
+	EventTime     time.Time `json:"event_time"`
+}
+
+// BeforeCreate is called before inserting a new webhook subscription into the database
+func (w *WebhookSubscription) BeforeCreate(tx *gorm.DB) error {
+	// Generate UUID if not set
+	if w.ID == uuid.Nil {
+		w.ID = uuid.New()
+	}
+	return nil
+}
+
+// BeforeCreate is called before inserting a new webhook delivery into the database
+func (d *WebhookDelivery) BeforeCreate(tx *gorm.DB) error {
+	// Generate UUID if not set
+	if d.ID == uuid.Nil {
+		d.ID = uuid.New()
+	}
+	return nil
+}
+
+// EventList returns the events the subscription receives
+func (w WebhookSubscription) EventList() []string {
+	return strings.Split(w.Events, ",")
+}
+
+// Receives reports whether the subscription receives an event
+func (w WebhookSubscription) Receives(event string) bool {
+	for _, e := range w.EventList() {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// IsWebhookEvent reports whether webhooks can subscribe to an event
+func IsWebhookEvent(event string) bool {
+	for _, e := range WebhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// EnqueueWebhooks queues a delivery of an event to every active subscription receiving it. It is
+// called from the AfterCreate hooks with their transaction, so deliveries are queued exactly when
+// the record they describe is stored.
+func EnqueueWebhooks(tx *gorm.DB, event string, clientID uuid.UUID, data interface{}) error {
+	var subscriptions []WebhookSubscription
+	if err := tx.Where("active AND (client_id IS NULL OR client_id = ?)", clientID).Find(&subscriptions).Error; err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, subscription := range subscriptions {
+		if !subscription.Receives(event) {
+			continue
+		}
+		delivery := WebhookDelivery{
+			ID:             uuid.New(),
+			SubscriptionID: subscription.ID,
+			Event:          event,
+			Status:         DeliveryPending,
+			NextAttemptAt:  now,
+		}
+		payload, err := json.Marshal(WebhookPayload{ID: delivery.ID, Event: event, ClientID: clientID, CreatedAt: now, Data: data})
+		if err != nil {
+			return err
+		}
+		delivery.Payload = string(payload)
+		if err := tx.Create(&delivery).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ClaimWebhookDeliveries returns up to limit deliveries due at now, and pushes their next attempt
+// back by lease so that no other node claims them while they are being sent
+func ClaimWebhookDeliveries(db *gorm.DB, now time.Time, lease time.Duration, limit int) ([]WebhookDelivery, error) {
+	var claimed []WebhookDelivery
+	err := db.Raw(`UPDATE webhook_deliveries SET next_attempt_at = ? WHERE id IN (
+		SELECT id FROM webhook_deliveries WHERE status = ? AND next_attempt_at <= ?
+		ORDER BY next_attempt_at LIMIT ?
+		FOR UPDATE SKIP LOCKED
+	) RETURNING *`, now.Add(lease), DeliveryPending, now, limit).Scan(&claimed).Error
+	return claimed, err
+}
+
+// WebhookDeliveries returns a page of a subscription's deliveries, newest first, optionally only
+// those in one state. after is the last delivery of the previous page.
+func WebhookDeliveries(db *gorm.DB, subscriptionID uuid.UUID, status string, after *WebhookDelivery, limit int) ([]WebhookDelivery, error) {
+	query := db.Where("subscription_id = ?", subscriptionID)
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if after != nil {
+		query = query.Where("(created_at, id) < (?, ?)", after.CreatedAt, after.ID)
+	}
+
+	var deliveries []WebhookDelivery
+	err := query.Order("created_at DESC, id DESC").Limit(limit).Find(&deliveries).Error
+	return deliveries, err
+}
+
+// webhookData returns the data of the message.created delivery of a message
+func (m *Message) webhookData() webhookMessage {
+	return webhookMessage{
+		ID:        m.ID,
+		ClientID:  m.ClientID,
+		ThreadID:  m.ThreadID,
+		ParentID:  m.ParentID,
+		SenderID:  m.SenderID,
+		Content:   m.Content,
+		Seq:       m.Seq,
+		CreatedAt: m.CreatedAt,
+	}
+}
+
+// webhookData returns the data of the email.created delivery of an email
+func (e *Email) webhookData() webhookEmail {
+	return webhookEmail{
+		ID:       e.ID,
+		ClientID: e.ClientID,
+		UserID:   e.UserID,
+		Subject:  e.Subject,
+		From:     e.From,
+		To:       e.To,
+		Snippet:  e.Snippet,
+		ThreadID: e.ThreadID,
+		Received: e.Received,
+	}
+}
+
+// webhookData returns the data of the timeline_event.created delivery of a timeline event
+func (t *TimelineEvent) webhookData() webhookTimelineEvent {
+	return webhookTimelineEvent{
+		ID:            t.ID,
+		ClientID:      t.ClientID,
+		UserID:        t.UserID,
+		EventType:     t.EventType,
+		Title:         t.Title,
+		Content:       t.Content,
+		EventableType: t.EventableType,
+		EventableID:   t.EventableID,
+		EventTime:     t.EventTime,
+	}
+}
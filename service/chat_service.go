@@ -1,8 +1,12 @@
+//go:build ignore
+
+// The service layer is not built: it was written against the github.com/your-org packages and a
+// database API this module does not have. The GraphQL resolvers and the chat server replace it.
+
 package service
 
 import (
 	"context"
-	"regexp"
 	"strings"
 	"sync"
 	"time"
@@ -10,6 +14,9 @@ import (
 	"github.com/your-org/crm-communication-api/database"
 	"github.com/your-org/crm-communication-api/graph/model"
 	"github.com/your-org/crm-communication-api/util"
+
+	gormdb "crm-communication-api/database"
+	"crm-communication-api/internal/mention"
 )
 
 // ChatService handles chat-related operations
@@ -89,23 +96,17 @@ func (s *ChatService) extractMentions(ctx context.Context, content string, menti
 			}
 		}
 	} else {
-		// Extract @mentions from content
-		re := regexp.MustCompile(`@(\w+)`)
-		matches := re.FindAllStringSubmatch(content, -1)
-		
-		for _, match := range matches {
-			if len(match) > 1 {
-				username := match[1]
-				// In a real implementation, you would look up users by username
-				// For simplicity, we'll just log this
-				s.logger.Info("Found mention", "username", username)
-				// Example lookup (not implemented in the DB service)
-				// user, err := s.db.GetUserByUsername(ctx, username)
-				// if err == nil && !mentionMap[user.ID] {
-				// 	mentions = append(mentions, user)
-				// 	mentionMap[user.ID] = true
-				// }
+		// Resolve the mentions in the content as the chat and GraphQL API do
+		result, err := mention.Resolve(gormdb.GetDB(), content)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range result.UserIDs() {
+			user, err := s.db.GetUser(ctx, id.String())
+			if err != nil {
+				return nil, err
 			}
+			mentions = append(mentions, user)
 		}
 	}
 	
@@ -259,9 +260,13 @@ func (s *ChatService) broadcastToMentionSubscribers(userID string, msg *model.Ch
 
 // FormatChatContent formats the chat content with highlighted mentions
 func (s *ChatService) FormatChatContent(content string) string {
-	// Replace @username mentions with styled spans
-	re := regexp.MustCompile(`@(\w+)`)
-	formattedContent := re.ReplaceAllString(content, `<span class="mention">@$1</span>`)
+	// Wrap mentions in styled spans, working back from the end so earlier offsets stay valid
+	formattedContent := content
+	mentions := mention.Parse(content)
+	for i := len(mentions) - 1; i >= 0; i-- {
+		m := mentions[i]
+		formattedContent = formattedContent[:m.Start] + `<span class="mention">` + formattedContent[m.Start:m.End] + `</span>` + formattedContent[m.End:]
+	}
 	
 	// Add line breaks for improved readability
 	formattedContent = strings.Replace(formattedContent, "\n", "<br>", -1)
@@ -1,3 +1,8 @@
+//go:build ignore
+
+// Standalone program, left out of the server build: it declares its own main, and its own chat
+// types where it has some, in package main. Run it with go run simple_chat.go
+
 package main
 
 import (
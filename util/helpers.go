@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+
+	"crm-communication-api/internal/mention"
 )
 
 // GenerateRandomString generates a random string of the specified length
@@ -20,22 +22,10 @@ func GenerateRandomString(length int) string {
 	return base64.URLEncoding.EncodeToString(b)[:length]
 }
 
-// ExtractMentions extracts @mentions from text
+// ExtractMentions extracts the names and emails mentioned in text, once each, leaving out @here
+// and @channel. Mentions are parsed by the mention package, so they are read as in chat messages.
 func ExtractMentions(text string) []string {
-	re := regexp.MustCompile(`@(\w+)`)
-	matches := re.FindAllStringSubmatch(text, -1)
-	
-	var mentions []string
-	mentionMap := make(map[string]bool)
-	
-	for _, match := range matches {
-		if len(match) > 1 && !mentionMap[match[1]] {
-			mentions = append(mentions, match[1])
-			mentionMap[match[1]] = true
-		}
-	}
-	
-	return mentions
+	return mention.Result{Mentions: mention.Parse(text)}.Names()
 }
 
 // FormatEmailAddress formats a name and email address
@@ -3,7 +3,6 @@ package util
 import (
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"runtime"
 	"strings"
@@ -1,433 +1,202 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
-	"fmt"
-	"log"
+	"errors"
 	"net/http"
-	"sync"
+	"net/http/httptest"
+	"strings"
+	"testing"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
-)
-
-// Message represents a simple chat message
-type ChatMessage struct {
-	ID        string    `json:"id"`
-	Sender    string    `json:"sender"`
-	Content   string    `json:"content"`
-	Mentions  []string  `json:"mentions,omitempty"`
-	Timestamp time.Time `json:"timestamp"`
-}
+	"gorm.io/gorm"
 
-// ChatHub maintains the set of active clients and broadcasts messages
-type ChatHub struct {
-	// Registered clients
-	clients map[*ChatClient]bool
+	"crm-communication-api/auth"
+	"crm-communication-api/database"
+	"crm-communication-api/internal/broker"
+	"crm-communication-api/internal/testdb"
+	"crm-communication-api/models"
+)
 
-	// Register requests from clients
-	register chan *ChatClient
+// startChatServer runs a hub and serves /ws/chat from it, and returns the URL to dial
+func startChatServer(t *testing.T, hub *ChatHub) string {
+	t.Helper()
 
-	// Unregister requests from clients
-	unregister chan *ChatClient
+	go hub.run()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/chat"
+}
 
-	// Inbound messages from clients
-	broadcast chan ChatMessage
+// dialChat connects a user to a room with an access token in the handshake. url may carry
+// other handshake parameters.
+func dialChat(t *testing.T, url string, user models.User, room string) *websocket.Conn {
+	t.Helper()
 
-	// Message history
-	history     []ChatMessage
-	historyLock sync.RWMutex
+	token, err := auth.GenerateJWT(&user, "local", "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := http.Header{"Authorization": {"Bearer " + token}}
+	separator := "?"
+	if strings.Contains(url, "?") {
+		separator = "&"
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(url+separator+"client_id="+room, header)
+	if err != nil {
+		t.Fatalf("dialing as %s: %v", user.Name, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
 }
 
-// ChatClient represents a single websocket connection
-type ChatClient struct {
-	hub *ChatHub
+// readFrame reads frames from a connection until one of a type arrives
+func readFrame(t *testing.T, conn *websocket.Conn, frameType string) models.WSMessage {
+	t.Helper()
 
-	// The websocket connection
-	conn *websocket.Conn
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var frame models.WSMessage
+		if err := conn.ReadJSON(&frame); err != nil {
+			t.Fatalf("no %s frame: %v", frameType, err)
+		}
+		if frame.Type == frameType {
+			return frame
+		}
+	}
+}
 
-	// Buffered channel of outbound messages
-	send chan ChatMessage
+// openChatTest makes the chat server use a test database and sign access tokens with a new key
+func openChatTest(t *testing.T) *gorm.DB {
+	t.Helper()
 
-	// User information
-	userID   string
-	username string
-}
+	db := testdb.Open(t, &models.User{}, &models.Client{}, &models.ChatThread{}, &models.Message{}, &models.RoomSequence{},
+		&models.MessageMention{}, &models.MessageRead{}, &models.Reaction{}, &models.TimelineEvent{}, &models.Role{},
+		&models.Team{}, &models.TeamMember{}, &models.WebhookSubscription{}, &models.WebhookDelivery{})
+	previous := database.DB
+	database.DB = db
+	t.Cleanup(func() { database.DB = previous })
 
-// Initialize a new chat hub
-func newChatHub() *ChatHub {
-	return &ChatHub{
-		clients:    make(map[*ChatClient]bool),
-		register:   make(chan *ChatClient),
-		unregister: make(chan *ChatClient),
-		broadcast:  make(chan ChatMessage),
-		history:    make([]ChatMessage, 0),
+	key, err := auth.GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring, err := auth.NewKeyRing([]*auth.SigningKey{key}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
 	}
+	auth.UseKeyRing(ring)
+	t.Cleanup(func() { auth.UseKeyRing(nil) })
+	return db
 }
 
-// Run the chat hub
-func (h *ChatHub) run() {
-	for {
-		select {
-		case client := <-h.register:
-			h.clients[client] = true
-			// Send chat history to new client
-			h.historyLock.RLock()
-			for _, msg := range h.history {
-				client.send <- msg
-			}
-			h.historyLock.RUnlock()
-
-		case client := <-h.unregister:
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
-			}
+func TestChatServersShareRooms(t *testing.T) {
+	db := openChatTest(t)
 
-		case message := <-h.broadcast:
-			// Store in history
-			h.historyLock.Lock()
-			h.history = append(h.history, message)
-			h.historyLock.Unlock()
-
-			// Send to all clients
-			for client := range h.clients {
-				select {
-				case client.send <- message:
-				default:
-					close(client.send)
-					delete(h.clients, client)
-				}
-			}
+	ada := models.User{Name: "Ada", Email: "ada@example.com", Role: "agent"}
+	bob := models.User{Name: "Bob", Email: "bob@example.com", Role: "admin"}
+	for _, user := range []*models.User{&ada, &bob} {
+		if err := db.Create(user).Error; err != nil {
+			t.Fatal(err)
 		}
 	}
-}
-
-// Parse mentions from message content (simple implementation)
-func parseMentions(content string) []string {
-	// This is a simple placeholder implementation
-	// In a real application, you would parse @username mentions from content
-	return []string{"user1", "user2"}
-}
+	client := models.Client{Name: "Acme", Email: "acme@example.com", OwnerID: &ada.ID}
+	if err := db.Create(&client).Error; err != nil {
+		t.Fatal(err)
+	}
 
-// Process incoming messages
-func (c *ChatClient) readPump() {
-	defer func() {
-		c.hub.unregister <- c
-		c.conn.Close()
-	}()
+	// Ada and Bob are connected to different nodes sharing a broker
+	b := broker.NewInProcess()
+	adaConn := dialChat(t, startChatServer(t, newChatHub(b, nil, nil)), ada, client.ID.String())
+	bobConn := dialChat(t, startChatServer(t, newChatHub(b, nil, nil)), bob, client.ID.String())
+	readFrame(t, adaConn, models.WSTypeSession)
+	readFrame(t, bobConn, models.WSTypeSession)
 
-	// Set message size limit and read deadline
-	c.conn.SetReadLimit(4096)
-	c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-		return nil
-	})
+	send := newFrame(models.WSTypeSend, "1", models.WSSendPayload{Content: "Hello from node A"})
+	if err := adaConn.WriteJSON(send); err != nil {
+		t.Fatal(err)
+	}
+	var ack models.WSAckPayload
+	if err := json.Unmarshal(readFrame(t, adaConn, models.WSTypeAck).Payload, &ack); err != nil {
+		t.Fatal(err)
+	}
 
 	for {
-		_, msgBytes, err := c.conn.ReadMessage()
-		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("error: %v", err)
-			}
-			break
-		}
-
-		// Parse the message
-		var messageData struct {
-			Content string `json:"content"`
+		var message ChatMessage
+		if err := json.Unmarshal(readFrame(t, bobConn, models.WSTypeMessage).Payload, &message); err != nil {
+			t.Fatal(err)
 		}
-		if err := json.Unmarshal(msgBytes, &messageData); err != nil {
-			log.Printf("error parsing message: %v", err)
+		if message.Sender == "System" {
 			continue
 		}
-
-		// Create a new message with parsed mentions
-		mentions := parseMentions(messageData.Content)
-		message := ChatMessage{
-			ID:        uuid.New().String(),
-			Sender:    c.username,
-			Content:   messageData.Content,
-			Mentions:  mentions,
-			Timestamp: time.Now(),
-		}
-
-		// Send the message to hub for broadcasting
-		c.hub.broadcast <- message
-
-		// Log timeline event (in a real app this would go to the database)
-		log.Printf("Timeline Event: User %s sent a message", c.username)
-		if len(mentions) > 0 {
-			log.Printf("Timeline Event: User %s mentioned users: %v", c.username, mentions)
+		if message.ID != ack.MessageID || message.Content != "Hello from node A" || message.Room != client.ID.String() {
+			t.Errorf("Bob got %+v, want Ada's message %s", message, ack.MessageID)
 		}
+		break
 	}
 }
 
-// Send messages to the client
-func (c *ChatClient) writePump() {
-	ticker := time.NewTicker(54 * time.Second)
-	defer func() {
-		ticker.Stop()
-		c.conn.Close()
-	}()
-
-	for {
-		select {
-		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if !ok {
-				// The hub closed the channel
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			
-			// Marshal the message to JSON
-			messageJSON, _ := json.Marshal(message)
-			w.Write(messageJSON)
+func TestUnknownRoomsAreRefusedLikeForbiddenOnes(t *testing.T) {
+	db := openChatTest(t)
 
-			if err := w.Close(); err != nil {
-				return
-			}
+	ada := models.User{Name: "Ada", Email: "ada@example.com", Role: "agent"}
+	bob := models.User{Name: "Bob", Email: "bob@example.com", Role: "agent"}
+	for _, user := range []*models.User{&ada, &bob} {
+		if err := db.Create(user).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	foreign := models.Client{Name: "Acme", Email: "acme@example.com", OwnerID: &bob.ID}
+	if err := db.Create(&foreign).Error; err != nil {
+		t.Fatal(err)
+	}
 
-		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				return
-			}
+	url := startChatServer(t, newChatHub(broker.NewInProcess(), nil, nil))
+	for _, room := range []string{foreign.ID.String(), uuid.New().String(), "not-a-room"} {
+		conn := dialChat(t, url, ada, room)
+		_, _, err := conn.ReadMessage()
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != closeForbidden || closeErr.Text != "not allowed to join room "+room {
+			t.Errorf("joining room %s: got %v, want a close with code %d", room, err, closeForbidden)
 		}
 	}
 }
 
-// Configure WebSocket upgrader
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all connections for testing
-	},
-}
+func TestResumingNeedsAccessToEveryRoomOfTheSession(t *testing.T) {
+	db := openChatTest(t)
 
-// ServeWs handles WebSocket requests from clients
-func serveWs(hub *ChatHub, w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println(err)
-		return
+	ada := models.User{Name: "Ada", Email: "ada@example.com", Role: "agent"}
+	bob := models.User{Name: "Bob", Email: "bob@example.com", Role: "agent"}
+	for _, user := range []*models.User{&ada, &bob} {
+		if err := db.Create(user).Error; err != nil {
+			t.Fatal(err)
+		}
 	}
-
-	// Get user ID and name from query parameters (in a real app, this would come from auth)
-	userID := r.URL.Query().Get("user_id")
-	username := r.URL.Query().Get("username")
-	
-	if userID == "" || username == "" {
-		// Generate random IDs for testing
-		userID = uuid.New().String()
-		username = fmt.Sprintf("User-%s", userID[:5])
+	owned := models.Client{Name: "Owned", Email: "owned@example.com", OwnerID: &ada.ID}
+	foreign := models.Client{Name: "Foreign", Email: "foreign@example.com", OwnerID: &bob.ID}
+	for _, client := range []*models.Client{&owned, &foreign} {
+		if err := db.Create(client).Error; err != nil {
+			t.Fatal(err)
+		}
 	}
 
-	// Create a new client
-	client := &ChatClient{
-		hub:      hub,
-		conn:     conn,
-		send:     make(chan ChatMessage, 256),
-		userID:   userID,
-		username: username,
+	// Ada's session was parked in a room of a client she has since lost. The hub is not running
+	// yet, so the session can be parked directly.
+	hub := newChatHub(broker.NewInProcess(), nil, nil)
+	hub.parked["token"] = &parkedSession{
+		userID:    ada.ID.String(),
+		rooms:     map[string]bool{owned.ID.String(): true, foreign.ID.String(): true},
+		expiresAt: time.Now().Add(time.Minute),
 	}
-	
-	// Register client
-	client.hub.register <- client
+	conn := dialChat(t, startChatServer(t, hub)+"?resume_token=token", ada, owned.ID.String())
 
-	// Send welcome message
-	welcomeMsg := ChatMessage{
-		ID:        uuid.New().String(),
-		Sender:    "System",
-		Content:   fmt.Sprintf("Welcome to the chat, %s!", username),
-		Timestamp: time.Now(),
+	_, _, err := conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != closeForbidden {
+		t.Errorf("resuming got %v, want a close with code %d", err, closeForbidden)
 	}
-	client.send <- welcomeMsg
-
-	// Start goroutines for reading and writing
-	go client.writePump()
-	go client.readPump()
-}
-
-// Initialize and start the chat test server
-func initChatTestServer(mux *http.ServeMux) {
-	// Create a new hub
-	hub := newChatHub()
-	go hub.run()
-
-	// Add chat test route
-	mux.HandleFunc("/ws/chat", func(w http.ResponseWriter, r *http.Request) {
-		serveWs(hub, w, r)
-	})
-
-	// Add test page for chat
-	mux.HandleFunc("/chat-test", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/html")
-		html := `
-		<!DOCTYPE html>
-		<html>
-		<head>
-			<title>CRM Chat Test</title>
-			<style>
-				body { font-family: Arial, sans-serif; max-width: 800px; margin: 0 auto; padding: 20px; }
-				#messages { height: 300px; overflow-y: auto; border: 1px solid #ccc; margin-bottom: 10px; padding: 10px; }
-				#messageForm { display: flex; }
-				#messageInput { flex-grow: 1; padding: 5px; }
-				button { padding: 5px 15px; background: #4CAF50; color: white; border: none; cursor: pointer; }
-				.message { margin-bottom: 10px; }
-				.message .sender { font-weight: bold; }
-				.message .time { color: #999; font-size: 12px; }
-				.message .content { margin-top: 5px; }
-				.mention { background-color: #e6f7ff; padding: 2px 4px; border-radius: 2px; }
-				#status { margin-bottom: 10px; color: #999; }
-			</style>
-		</head>
-		<body>
-			<h1>CRM Chat API Test</h1>
-			<p>This is a simple test interface for the CRM Chat API using WebSockets.</p>
-			
-			<div>
-				<label for="username">Username:</label>
-				<input type="text" id="username" value="TestUser" />
-				<button onclick="connect()">Connect</button>
-			</div>
-			
-			<div id="status">Disconnected</div>
-			
-			<div id="messages"></div>
-			
-			<form id="messageForm" onsubmit="sendMessage(event)">
-				<input type="text" id="messageInput" placeholder="Type a message..." />
-				<button type="submit">Send</button>
-			</form>
-			
-			<script>
-				let socket;
-				let username = '';
-				
-				function connect() {
-					username = document.getElementById('username').value;
-					if (!username) {
-						alert('Please enter a username');
-						return;
-					}
-					
-					const statusEl = document.getElementById('status');
-					statusEl.textContent = 'Connecting...';
-					
-					// Create WebSocket connection
-					const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
-					const wsUrl = '${protocol}//${window.location.host}/ws/chat?username=' + encodeURIComponent(username);
-					socket = new WebSocket(wsUrl);
-					
-					// Connection opened
-					socket.addEventListener('open', function (event) {
-						statusEl.textContent = 'Connected as ' + username;
-						statusEl.style.color = '#4CAF50';
-					});
-					
-					// Listen for messages
-					socket.addEventListener('message', function (event) {
-						const message = JSON.parse(event.data);
-						displayMessage(message);
-					});
-					
-					// Connection closed
-					socket.addEventListener('close', function (event) {
-						statusEl.textContent = 'Disconnected';
-						statusEl.style.color = '#999';
-					});
-					
-					// Connection error
-					socket.addEventListener('error', function (event) {
-						statusEl.textContent = 'Error connecting';
-						statusEl.style.color = 'red';
-						console.error('WebSocket error:', event);
-					});
-				}
-				
-				function sendMessage(event) {
-					event.preventDefault();
-					
-					if (!socket || socket.readyState !== WebSocket.OPEN) {
-						alert('Not connected');
-						return;
-					}
-					
-					const input = document.getElementById('messageInput');
-					const message = {
-						content: input.value
-					};
-					
-					socket.send(JSON.stringify(message));
-					input.value = '';
-				}
-				
-				function displayMessage(message) {
-					const messagesContainer = document.getElementById('messages');
-					
-					const messageEl = document.createElement('div');
-					messageEl.className = 'message';
-					
-					const headerEl = document.createElement('div');
-					
-					const senderEl = document.createElement('span');
-					senderEl.className = 'sender';
-					senderEl.textContent = message.sender;
-					headerEl.appendChild(senderEl);
-					
-					headerEl.appendChild(document.createTextNode(' '));
-					
-					const timeEl = document.createElement('span');
-					timeEl.className = 'time';
-					const date = new Date(message.timestamp);
-					timeEl.textContent = date.toLocaleTimeString();
-					headerEl.appendChild(timeEl);
-					
-					messageEl.appendChild(headerEl);
-					
-					// Process content for mentions
-					let content = message.content;
-					if (message.mentions && message.mentions.length > 0) {
-						// Simple highlighting of mentions
-						message.mentions.forEach(mention => {
-							content = content.replace(
-								new RegExp('@' + mention, 'g'),
-								'<span class="mention">@' + mention + '</span>'
-							);
-						});
-					}
-					
-					const contentEl = document.createElement('div');
-					contentEl.className = 'content';
-					contentEl.innerHTML = content;
-					messageEl.appendChild(contentEl);
-					
-					messagesContainer.appendChild(messageEl);
-					messagesContainer.scrollTop = messagesContainer.scrollHeight;
-				}
-			</script>
-		</body>
-		</html>
-		`;
-		w.Write([]byte(html))
-	})
-
-	log.Println("Chat test server initialized at /chat-test")
-	log.Println("WebSocket endpoint available at /ws/chat")
 }
-
-// RegisterChatTestRoutes adds the chat test routes to the main server
-func RegisterChatTestRoutes(mux *http.ServeMux) {
-	initChatTestServer(mux)
-}
\ No newline at end of file